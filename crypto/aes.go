@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"io"
 
 	"go.sophtrust.dev/pkg/zerolog/v2"
@@ -15,7 +16,13 @@ import (
 
 // DecryptString decrypts the given block of ciphertext that was encrypted using the EncryptString() function.
 //
-// If the string was encrypted using a random key generated by EncryptString(), leave the key empty.
+// Ciphertext envelopes are detected automatically and the key is derived according to the key derivation function
+// recorded in the envelope. If the string was encrypted using a random key generated by EncryptString(), leave the
+// key empty. Ciphertext with an embedded random key is rejected when a key is given, and any other ciphertext is
+// rejected when the key is empty.
+//
+// Ciphertext produced by earlier versions of EncryptString(), which is not wrapped in an envelope, can still be
+// decrypted by this function.
 //
 // The following errors are returned by this function:
 // ErrDecodeFailure, ErrGenerateCipherFailure, ErrGenerateGCMFailure, ErrDecryptFailure
@@ -25,6 +32,114 @@ func DecryptString(ctx context.Context, ciphertext, key string) (string, error)
 		logger = *l
 	}
 
+	if !IsCiphertextEnvelope(ciphertext) {
+		return decryptLegacyString(logger, ciphertext, key)
+	}
+
+	// decode the envelope
+	env, err := parseCiphertextEnvelope(ciphertext)
+	if err != nil {
+		e := &ErrDecodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	logger = logger.With().Str("key_id", env.KeyID).Str("kdf", env.KDF.String()).
+		Str("cipher", env.Cipher.String()).Logger()
+
+	// never fall back to an embedded key when the caller supplied one, since anyone can create such ciphertext
+	if env.KDF == KDFEmbeddedKey && key != "" {
+		e := &ErrDecryptFailure{Err: errors.New("ciphertext uses an embedded key but a key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	if env.KDF != KDFEmbeddedKey && key == "" {
+		e := &ErrDecryptFailure{Err: errors.New("no key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+
+	// derive the key and decrypt the data
+	cipherKey, err := deriveEnvelopeKey(env, []byte(key))
+	if err != nil {
+		e := &ErrDecryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	plaintext, err := openEnvelope(env, cipherKey)
+	if err != nil {
+		logger.Error().Err(err).Msg(err.Error())
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// EncryptString encrypts the given string using the given key.
+//
+// If the key is empty, a random key is generated and stored with the ciphertext.
+//
+// The ciphertext is returned as an encoded CiphertextEnvelope.
+//
+// The following errors are returned by this function:
+// any error returned by EncryptStringWithKeyID
+func EncryptString(ctx context.Context, plaintext, key string) (string, error) {
+	return EncryptStringWithKeyID(ctx, plaintext, key, "")
+}
+
+// EncryptStringWithKeyID encrypts the given string using the given key and records the key ID in the ciphertext
+// envelope so that the key can be identified when the data is decrypted.
+//
+// The key is hashed with SHA-256 to produce the encryption key. If the key is empty, a random key is generated and
+// stored with the ciphertext.
+//
+// The following errors are returned by this function:
+// ErrGenerateRandomKeyFailure, ErrEncryptFailure, ErrGenerateCipherFailure, ErrGenerateGCMFailure,
+// ErrGenerateNonceFailure
+func EncryptStringWithKeyID(ctx context.Context, plaintext, key, keyID string) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("key_id", keyID).Logger()
+
+	env := &CiphertextEnvelope{
+		Version: CiphertextEnvelopeVersion1,
+		KDF:     KDFSHA256,
+		Cipher:  CipherAES256GCM,
+		KeyID:   keyID,
+	}
+
+	// generate a random key if needed
+	if key == "" {
+		randomKey := make([]byte, 32)
+		if _, err := rand.Read(randomKey); err != nil {
+			e := &ErrGenerateRandomKeyFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return "", e
+		}
+		env.KDF = KDFEmbeddedKey
+		env.KDFParams = randomKey
+	}
+
+	// derive the key and encrypt the data
+	cipherKey, err := deriveEnvelopeKey(env, []byte(key))
+	if err != nil {
+		e := &ErrEncryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	if err := sealEnvelope(env, []byte(plaintext), cipherKey); err != nil {
+		logger.Error().Err(err).Msg(err.Error())
+		return "", err
+	}
+	return env.String(), nil
+}
+
+// decryptLegacyString decrypts ciphertext that was produced by EncryptString() before ciphertext envelopes were
+// introduced.
+//
+// The following errors are returned by this function:
+// ErrDecodeFailure, ErrGenerateCipherFailure, ErrGenerateGCMFailure, ErrDecryptFailure
+func decryptLegacyString(logger zerolog.Logger, ciphertext, key string) (string, error) {
 	// decode the Base64-encoded string
 	data, err := base64.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
@@ -37,6 +152,11 @@ func DecryptString(ctx context.Context, ciphertext, key string) (string, error)
 	cipherKey := []byte(key)
 	var nonce []byte
 	if key == "" {
+		if len(data) < 44 {
+			e := &ErrDecodeFailure{Err: errors.New("ciphertext is truncated")}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return "", e
+		}
 		cipherKey = make([]byte, 32)
 		nonce = make([]byte, 12)
 		for i := 0; i < 44; i++ {
@@ -58,27 +178,20 @@ func DecryptString(ctx context.Context, ciphertext, key string) (string, error)
 		}
 		data = data[44:]
 	} else {
+		if len(data) < 12 {
+			e := &ErrDecodeFailure{Err: errors.New("ciphertext is truncated")}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return "", e
+		}
 		nonce = data[0:12]
 		data = data[12:]
 	}
 
-	// hash the key
-	sha := sha256.Sum256(cipherKey)
-
-	// create a new cipher block from the key
-	block, err := aes.NewCipher(sha[0:32])
+	// hash the key and create a new GCM from it
+	aesGCM, err := newGCM(cipherKey)
 	if err != nil {
-		e := &ErrGenerateCipherFailure{Err: err}
-		logger.Error().Err(e.Err).Msg(e.Error())
-		return "", e
-	}
-
-	// create a new GCM
-	aesGCM, err := cipher.NewGCM(block)
-	if err != nil {
-		e := &ErrGenerateGCMFailure{Err: err}
-		logger.Error().Err(e.Err).Msg(e.Error())
-		return "", e
+		logger.Error().Err(err).Msg(err.Error())
+		return "", err
 	}
 
 	// decrypt the data
@@ -91,72 +204,44 @@ func DecryptString(ctx context.Context, ciphertext, key string) (string, error)
 	return string(plaintext), nil
 }
 
-// EncryptString encrypts the given string using the given key.
-//
-// If the key is empty, a random key is generated and stored with the ciphertext.
+// generateNonce generates a random nonce of the given size.
 //
 // The following errors are returned by this function:
-// ErrGenerateRandomKeyFailure, ErrGenerateCipherFailure, ErrGenerateGCMFailure, ErrGenerateNonceFailure
-func EncryptString(ctx context.Context, plaintext, key string) (string, error) {
-	logger := log.Logger
-	if l := zerolog.Ctx(ctx); l != nil {
-		logger = *l
-	}
-
-	// generate a random key if needed
-	cipherKey := []byte(key)
-	if key == "" {
-		cipherKey = make([]byte, 32)
-		if _, err := rand.Read(cipherKey); err != nil {
-			e := &ErrGenerateRandomKeyFailure{Err: err}
-			logger.Error().Err(e.Err).Msg(e.Error())
-			return "", e
-		}
+// ErrGenerateNonceFailure
+func generateNonce(size int) ([]byte, error) {
+	nonce := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, &ErrGenerateNonceFailure{Err: err}
 	}
+	return nonce, nil
+}
 
-	// hash the key
-	sha := sha256.Sum256(cipherKey)
+// newGCM hashes the given key with SHA-256 and wraps an AES-256 cipher block created from the hash in GCM.
+//
+// The following errors are returned by this function:
+// ErrGenerateCipherFailure, ErrGenerateGCMFailure
+func newGCM(key []byte) (cipher.AEAD, error) {
+	sha := sha256.Sum256(key)
+	return newAESGCM(sha[0:32])
+}
 
+// newAESGCM wraps an AES cipher block created directly from the given key in GCM.
+//
+// The following errors are returned by this function:
+// ErrGenerateCipherFailure, ErrGenerateGCMFailure
+func newAESGCM(key []byte) (cipher.AEAD, error) {
 	// create a new cipher block from the key
-	block, err := aes.NewCipher(sha[0:32])
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		e := &ErrGenerateCipherFailure{Err: err}
-		logger.Error().Err(e.Err).Msg(e.Error())
-		return "", e
+		return nil, &ErrGenerateCipherFailure{Err: err}
 	}
 
 	// create a new GCM
 	aesGCM, err := cipher.NewGCM(block)
 	if err != nil {
-		e := &ErrGenerateGCMFailure{Err: err}
-		logger.Error().Err(e.Err).Msg(e.Error())
-		return "", e
-	}
-
-	// create a nonce from GCM
-	nonce := make([]byte, aesGCM.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		e := &ErrGenerateNonceFailure{Err: err}
-		logger.Error().Err(e.Err).Msg(e.Error())
-		return "", e
-	}
-
-	// encrypt the data and hide the key inside the ciphertext
-	var data []byte
-	if key == "" {
-		ciphertext := aesGCM.Seal(nil, nonce, []byte(plaintext), cipherKey)
-		data = cipherKey[24:32]
-		data = append(data, nonce[0:4]...)
-		data = append(data, reverseSlice(cipherKey[16:24])...)
-		data = append(data, nonce[8:12]...)
-		data = append(data, cipherKey[0:8]...)
-		data = append(data, reverseSlice(nonce[4:8])...)
-		data = append(data, reverseSlice(cipherKey[8:16])...)
-		data = append(data, ciphertext...)
-	} else {
-		data = aesGCM.Seal(nonce, nonce, []byte(plaintext), cipherKey)
+		return nil, &ErrGenerateGCMFailure{Err: err}
 	}
-	return base64.StdEncoding.EncodeToString(data), nil
+	return aesGCM, nil
 }
 
 // reverseSlice simply reverses the byte slice passed in and returns the reversed slice.
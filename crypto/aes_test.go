@@ -40,3 +40,80 @@ func TestEncrypt(t *testing.T) {
 		t.Errorf("want: test_string, got: %s", plaintext)
 	}
 }
+
+func TestEncryptEnvelope(t *testing.T) {
+	ctx := context.TODO()
+
+	ciphertext, err := crypto.EncryptStringWithKeyID(ctx, "test_string", "some_key", "key-1")
+	if err != nil {
+		t.Fatalf("error while encrypting string: %s", err.Error())
+	}
+	if !crypto.IsCiphertextEnvelope(ciphertext) {
+		t.Fatalf("error: ciphertext is not an envelope: %s", ciphertext)
+	}
+
+	env, err := crypto.ParseCiphertextEnvelope(ctx, ciphertext)
+	if err != nil {
+		t.Fatalf("error while parsing envelope: %s", err.Error())
+	}
+	if env.Version != crypto.CiphertextEnvelopeVersion1 || env.KDF != crypto.KDFSHA256 ||
+		env.Cipher != crypto.CipherAES256GCM || env.KeyID != "key-1" {
+		t.Errorf("error: unexpected envelope header: %+v", env)
+	}
+
+	plaintext, err := crypto.DecryptString(ctx, ciphertext, "some_key")
+	if err != nil {
+		t.Fatalf("error while decrypting string: %s", err.Error())
+	}
+	if plaintext != "test_string" {
+		t.Errorf("want: test_string, got: %s", plaintext)
+	}
+
+	// altering the key ID in the header must cause decryption to fail
+	env.KeyID = "key-2"
+	if _, err := crypto.DecryptString(ctx, env.String(), "some_key"); err == nil {
+		t.Errorf("error: got nil, expected error for altered header")
+	}
+}
+
+func TestDecryptEmbeddedKeyDowngrade(t *testing.T) {
+	ctx := context.TODO()
+
+	// anyone can create ciphertext with an embedded key, so it must not be accepted when a key is given
+	forged, err := crypto.EncryptString(ctx, "attacker", "")
+	if err != nil {
+		t.Fatalf("error while encrypting string: %s", err.Error())
+	}
+	_, err = crypto.DecryptString(ctx, forged, "real-secret")
+	if _, ok := err.(*crypto.ErrDecryptFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrDecryptFailure", err)
+	}
+
+	// ciphertext encrypted with a key cannot be decrypted without one
+	ciphertext, _ := crypto.EncryptString(ctx, "test_string", "real-secret")
+	_, err = crypto.DecryptString(ctx, ciphertext, "")
+	if _, ok := err.(*crypto.ErrDecryptFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrDecryptFailure", err)
+	}
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	ctx := context.TODO()
+
+	// ciphertext produced by EncryptString() before envelopes were introduced
+	legacy := map[string]string{
+		"some_key": "t6xr9YA+BqEcXdb7SVbqWXAFUnSedU5rS7khfqWVHjitBEM2FKn8sVo=",
+		"":         "oBoWu1B3vpTbD8I7zOxPsjULTvFn/V4A8gu/TCD2K2Bnoo+Y2E26tFaKdp+aRu1A7dwjmEzTOK+WCjgtJtGwyTrYFF+R5lxoQQ==",
+	}
+	for key, ciphertext := range legacy {
+		if crypto.IsCiphertextEnvelope(ciphertext) {
+			t.Errorf("error: legacy ciphertext detected as an envelope: %s", ciphertext)
+		}
+		plaintext, err := crypto.DecryptString(ctx, ciphertext, key)
+		if err != nil {
+			t.Errorf("error while decrypting legacy string: %s", err.Error())
+		} else if plaintext != "legacy_string" {
+			t.Errorf("want: legacy_string, got: %s", plaintext)
+		}
+	}
+}
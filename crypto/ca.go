@@ -0,0 +1,561 @@
+package crypto
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+const (
+	// DefaultRootCAValidity is the default lifetime of a root CA certificate.
+	DefaultRootCAValidity = 10 * 365 * 24 * time.Hour
+
+	// DefaultIntermediateCAValidity is the default lifetime of an intermediate CA certificate.
+	DefaultIntermediateCAValidity = 5 * 365 * 24 * time.Hour
+
+	// DefaultCertificateValidity is the default lifetime of a certificate issued by a CA.
+	DefaultCertificateValidity = 365 * 24 * time.Hour
+
+	// DefaultCAKeyType is the default type of key generated for CAs and issued certificates.
+	DefaultCAKeyType = KeyTypeECDSAP256
+
+	// certificateBackdate is subtracted from the current time when setting the start of a certificate's validity
+	// period to allow for clock skew between systems.
+	certificateBackdate = 5 * time.Minute
+)
+
+// CertificateAuthorityOptions holds the options used to create a root or intermediate CA.
+type CertificateAuthorityOptions struct {
+	// Subject is the distinguished name of the CA.
+	Subject pkix.Name
+
+	// Key is the CA's private key. If nil, a new key of type KeyType is generated.
+	Key crypto.Signer
+
+	// KeyType is the type of key to generate if Key is nil. If not set, DefaultCAKeyType is used.
+	KeyType KeyType
+
+	// Validity is the lifetime of the CA certificate. If not set, DefaultRootCAValidity or
+	// DefaultIntermediateCAValidity is used. An intermediate CA cannot outlive the CA that issues it.
+	Validity time.Duration
+
+	// MaxPathLen is the maximum number of intermediate CAs which may follow this CA in a chain. As with
+	// x509.Certificate, a zero value means no limit unless MaxPathLenZero is true. If the issuing CA has a limit,
+	// an intermediate CA's limit must be lower and defaults to one less than the issuing CA's.
+	MaxPathLen int
+
+	// MaxPathLenZero indicates that a MaxPathLen of zero is explicit so that the CA can only issue leaf
+	// certificates.
+	MaxPathLenZero bool
+}
+
+// CertificateOptions holds the options used when a CA issues a certificate.
+type CertificateOptions struct {
+	// Subject is the distinguished name of the certificate.
+	Subject pkix.Name
+
+	// DNSNames holds the DNS subject alternative names.
+	DNSNames []string
+
+	// IPAddresses holds the IP address subject alternative names.
+	IPAddresses []net.IP
+
+	// EmailAddresses holds the email subject alternative names.
+	EmailAddresses []string
+
+	// URIs holds the URI subject alternative names.
+	URIs []*url.URL
+
+	// KeyUsage holds the key usages. If not set, digital signatures are allowed along with key encipherment for
+	// RSA keys.
+	KeyUsage x509.KeyUsage
+
+	// ExtKeyUsages holds the extended key usages. If empty, both server and client authentication are allowed.
+	ExtKeyUsages []x509.ExtKeyUsage
+
+	// PolicyIdentifiers holds the OIDs of the certificate policies asserted by the certificate.
+	PolicyIdentifiers []asn1.ObjectIdentifier
+
+	// Validity is the lifetime of the certificate. If not set, DefaultCertificateValidity is used. The certificate
+	// cannot outlive the CA.
+	Validity time.Duration
+
+	// NotBefore is the start of the validity period. If not set, the current time less a few minutes is used to
+	// allow for clock skew.
+	NotBefore time.Time
+}
+
+// CertificateAuthority issues and signs certificates.
+type CertificateAuthority struct {
+	// Certificate is the CA certificate.
+	Certificate *x509.Certificate
+
+	// Chain holds the certificates of the CAs above this one, starting with the issuer of Certificate. It is empty
+	// for a root CA.
+	Chain []*x509.Certificate
+
+	// SerialFile is the path to a file holding the next serial number as a hexadecimal string, the same format used
+	// by OpenSSL. If set, serial numbers are issued sequentially and the file is updated after each certificate is
+	// issued. Otherwise random 128-bit serial numbers are used.
+	SerialFile string
+
+	// RequestPolicy restricts the certificate signing requests accepted by IssueCertificateFromRequest(). If nil,
+	// only the signature of each request is checked.
+	RequestPolicy *CertificateRequestPolicy
+
+	// OCSPServers holds the URLs of the OCSP responders which are included in each certificate issued by the CA.
+	OCSPServers []string
+
+	// CRLDistributionPoints holds the URLs of the CRLs which are included in each certificate issued by the CA.
+	CRLDistributionPoints []string
+
+	// key is the CA private key.
+	key crypto.Signer
+
+	// mutex serializes the allocation of serial numbers.
+	mutex sync.Mutex
+}
+
+// NewRootCertificateAuthority creates a new root CA with a self-signed certificate.
+//
+// If opts is nil, a CA with an ECDSA P-256 key, an empty subject and the default validity is created.
+//
+// The following errors are returned by this function:
+// ErrGeneratePrivateKeyFailure, ErrGenerateCertificateFailure
+func NewRootCertificateAuthority(ctx context.Context, opts *CertificateAuthorityOptions) (*CertificateAuthority,
+	error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	o, key, err := caOptions(ctx, opts, DefaultRootCAValidity)
+	if err != nil {
+		return nil, err
+	}
+	ca := &CertificateAuthority{key: key}
+	template, err := ca.caTemplate(o)
+	if err != nil {
+		e := &ErrGenerateCertificateFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if ca.Certificate, err = createCertificate(template, template, key.Public(), key); err != nil {
+		e := &ErrGenerateCertificateFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return ca, nil
+}
+
+// NewIntermediateCertificateAuthority creates a new intermediate CA whose certificate is issued by this CA.
+//
+// If opts is nil, a CA with an ECDSA P-256 key, an empty subject and the default validity is created.
+//
+// The following errors are returned by this function:
+// ErrGeneratePrivateKeyFailure, ErrGenerateCertificateFailure, ErrWriteFileFailure
+func (ca *CertificateAuthority) NewIntermediateCertificateAuthority(ctx context.Context,
+	opts *CertificateAuthorityOptions) (*CertificateAuthority, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	o, key, err := caOptions(ctx, opts, DefaultIntermediateCAValidity)
+	if err != nil {
+		return nil, err
+	}
+	template, err := ca.caTemplate(o)
+	if err != nil {
+		e := &ErrGenerateCertificateFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	cert, err := ca.sign(ctx, template, key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &CertificateAuthority{
+		Certificate: cert,
+		Chain:       ca.CertificateChain(),
+		key:         key,
+	}, nil
+}
+
+// LoadCertificateAuthority loads a CA from a PEM-formatted certificate file and private key file.
+//
+// The certificate file must contain the CA certificate first, optionally followed by the certificates of the CAs
+// above it. The private key may be in any format supported by ParsePrivateKeyBytes(). If the private key is not
+// encrypted, you can safely pass nil for the password.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrLoadCertificateFailure, ErrInvalidCertificate, any error returned by ParsePrivateKeyFile
+func LoadCertificateAuthority(ctx context.Context, certFile, keyFile string, password []byte) (
+	*CertificateAuthority, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("certificate_file", certFile).Str("key_file", keyFile).Logger()
+
+	contents, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: certFile}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	certs, err := parsePEMCertificates(contents)
+	if err != nil {
+		e := &ErrLoadCertificateFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if !certs[0].IsCA || certs[0].KeyUsage&x509.KeyUsageCertSign == 0 {
+		e := &ErrInvalidCertificate{Err: errors.New("certificate is not a CA certificate")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	key, err := ParsePrivateKeyFile(logger.WithContext(ctx), keyFile, password)
+	if err != nil {
+		return nil, err
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(certs[0].PublicKey) {
+		e := &ErrLoadCertificateFailure{Err: errors.New("private key does not match the CA certificate")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return &CertificateAuthority{
+		Certificate: certs[0],
+		Chain:       certs[1:],
+		key:         key,
+	}, nil
+}
+
+// WriteFiles writes the CA certificate chain and private key to PEM-formatted files which can be read by
+// LoadCertificateAuthority().
+//
+// If opts is nil, the private key is written as an unencrypted PKCS#8 key.
+//
+// The following errors are returned by this function:
+// any error returned by WriteCertificatesFile or WritePrivateKeyFile
+func (ca *CertificateAuthority) WriteFiles(ctx context.Context, certFile, keyFile string,
+	opts *PrivateKeyMarshalOptions) error {
+
+	if err := WriteCertificatesFile(ctx, certFile, ca.CertificateChain()); err != nil {
+		return err
+	}
+	return WritePrivateKeyFile(ctx, keyFile, ca.key, opts)
+}
+
+// CertificateChain returns the CA certificate followed by the certificates of the CAs above it.
+func (ca *CertificateAuthority) CertificateChain() []*x509.Certificate {
+	return append([]*x509.Certificate{ca.Certificate}, ca.Chain...)
+}
+
+// Signer returns the CA private key.
+func (ca *CertificateAuthority) Signer() crypto.Signer {
+	return ca.key
+}
+
+// IssueCertificate issues a certificate for the given public key.
+//
+// If opts is nil, a certificate with an empty subject, no subject alternative names and the default key usages and
+// validity is issued.
+//
+// The following errors are returned by this function:
+// ErrGenerateCertificateFailure, ErrWriteFileFailure
+func (ca *CertificateAuthority) IssueCertificate(ctx context.Context, pub crypto.PublicKey, opts *CertificateOptions) (
+	*x509.Certificate, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if pub == nil {
+		e := &ErrGenerateCertificateFailure{Err: errors.New("no public key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	o := CertificateOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Validity == 0 {
+		o.Validity = DefaultCertificateValidity
+	}
+	if o.NotBefore.IsZero() {
+		o.NotBefore = time.Now().Add(-certificateBackdate)
+	}
+	if o.KeyUsage == 0 {
+		o.KeyUsage = x509.KeyUsageDigitalSignature
+		if _, ok := pub.(*rsa.PublicKey); ok {
+			o.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
+	if len(o.ExtKeyUsages) == 0 {
+		o.ExtKeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+
+	template := &x509.Certificate{
+		Subject:               o.Subject,
+		DNSNames:              o.DNSNames,
+		IPAddresses:           o.IPAddresses,
+		EmailAddresses:        o.EmailAddresses,
+		URIs:                  o.URIs,
+		NotBefore:             o.NotBefore,
+		NotAfter:              o.NotBefore.Add(o.Validity),
+		KeyUsage:              o.KeyUsage,
+		ExtKeyUsage:           o.ExtKeyUsages,
+		PolicyIdentifiers:     o.PolicyIdentifiers,
+		BasicConstraintsValid: true,
+	}
+	return ca.sign(ctx, template, pub)
+}
+
+// IssueCertificateKeyPair generates a new private key of the given type and issues a certificate for it.
+//
+// The following errors are returned by this function:
+// ErrGeneratePrivateKeyFailure, ErrGenerateCertificateFailure, ErrWriteFileFailure
+func (ca *CertificateAuthority) IssueCertificateKeyPair(ctx context.Context, keyType KeyType,
+	opts *CertificateOptions) (*x509.Certificate, crypto.Signer, error) {
+
+	if keyType == 0 {
+		keyType = DefaultCAKeyType
+	}
+	key, err := GeneratePrivateKey(ctx, keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := ca.IssueCertificate(ctx, key.Public(), opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// IssueCertificateFromRequest issues a certificate for the public key in the certificate signing request.
+//
+// The request is checked by ValidateCertificateRequest() using the CA's RequestPolicy before the certificate is
+// issued. The subject and subject alternative names are taken from the request unless they are set in opts. The
+// remaining options work as they do for IssueCertificate().
+//
+// The following errors are returned by this function:
+// ErrInvalidCertificateRequest, ErrGenerateCertificateFailure, ErrWriteFileFailure
+func (ca *CertificateAuthority) IssueCertificateFromRequest(ctx context.Context, csr *x509.CertificateRequest,
+	opts *CertificateOptions) (*x509.Certificate, error) {
+
+	if err := ValidateCertificateRequest(ctx, csr, ca.RequestPolicy); err != nil {
+		return nil, err
+	}
+
+	o := CertificateOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if len(o.Subject.ToRDNSequence()) == 0 {
+		o.Subject = csr.Subject
+	}
+	if len(o.DNSNames) == 0 && len(o.IPAddresses) == 0 && len(o.EmailAddresses) == 0 && len(o.URIs) == 0 {
+		o.DNSNames = csr.DNSNames
+		o.IPAddresses = csr.IPAddresses
+		o.EmailAddresses = csr.EmailAddresses
+		o.URIs = csr.URIs
+	}
+	return ca.IssueCertificate(ctx, csr.PublicKey, &o)
+}
+
+// caTemplate returns the certificate template for a new CA using the given options. The start of the validity
+// period is backdated to allow for clock skew.
+//
+// If the CA has a certificate, the template is for an intermediate CA and must fit within the CA's path length
+// constraint. An intermediate CA without a path length of its own is given one less than the CA's.
+func (ca *CertificateAuthority) caTemplate(o *CertificateAuthorityOptions) (*x509.Certificate, error) {
+	maxPathLen, maxPathLenZero := o.MaxPathLen, o.MaxPathLenZero
+	if ca.Certificate != nil && ca.Certificate.MaxPathLen >= 0 {
+		if ca.Certificate.MaxPathLen == 0 {
+			return nil, errors.New("CA path length constraint does not allow it to issue intermediate CAs")
+		}
+		limit := ca.Certificate.MaxPathLen - 1
+		if maxPathLen <= 0 && !maxPathLenZero {
+			maxPathLen, maxPathLenZero = limit, limit == 0
+		} else if maxPathLen > limit {
+			return nil, fmt.Errorf("path length of %d exceeds the limit of %d imposed by the CA", maxPathLen, limit)
+		}
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now().Add(-certificateBackdate)
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               o.Subject,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(o.Validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLenZero,
+	}, nil
+}
+
+// sign assigns a serial number to the template and issues the certificate.
+func (ca *CertificateAuthority) sign(ctx context.Context, template *x509.Certificate, pub crypto.PublicKey) (
+	*x509.Certificate, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if ca.Certificate == nil || ca.key == nil {
+		e := &ErrGenerateCertificateFailure{Err: errors.New("CA has not been initialized")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if template.NotAfter.After(ca.Certificate.NotAfter) {
+		e := &ErrGenerateCertificateFailure{Err: fmt.Errorf("certificate would expire after the CA expires at %s",
+			ca.Certificate.NotAfter.UTC().Format(time.RFC3339))}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	// serial numbers must be allocated and recorded one at a time
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	var err error
+	if ca.SerialFile != "" {
+		template.SerialNumber, err = readSerialFile(ca.SerialFile)
+	} else {
+		template.SerialNumber, err = randomSerialNumber()
+	}
+	if err != nil {
+		e := &ErrGenerateCertificateFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	logger = logger.With().Str("serial_number", template.SerialNumber.Text(16)).Logger()
+	template.OCSPServer = ca.OCSPServers
+	template.CRLDistributionPoints = ca.CRLDistributionPoints
+
+	cert, err := createCertificate(template, ca.Certificate, pub, ca.key)
+	if err != nil {
+		e := &ErrGenerateCertificateFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if ca.SerialFile != "" {
+		next := new(big.Int).Add(template.SerialNumber, big.NewInt(1))
+		if err := writeSerialFile(ca.SerialFile, next); err != nil {
+			e := &ErrWriteFileFailure{Err: err, File: ca.SerialFile}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+	}
+	logger.Debug().Str("subject", cert.Subject.String()).Msg("issued certificate")
+	return cert, nil
+}
+
+// caOptions applies the default CA options and returns the CA private key, generating it if necessary.
+func caOptions(ctx context.Context, opts *CertificateAuthorityOptions, validity time.Duration) (
+	*CertificateAuthorityOptions, crypto.Signer, error) {
+
+	o := CertificateAuthorityOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Validity == 0 {
+		o.Validity = validity
+	}
+	if o.KeyType == 0 {
+		o.KeyType = DefaultCAKeyType
+	}
+	if o.Key != nil {
+		return &o, o.Key, nil
+	}
+	key, err := GeneratePrivateKey(ctx, o.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &o, key, nil
+}
+
+// createCertificate creates and parses a certificate.
+func createCertificate(template, parent *x509.Certificate, pub crypto.PublicKey, key crypto.Signer) (
+	*x509.Certificate, error) {
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// randomSerialNumber returns a random, positive 128-bit serial number.
+func randomSerialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+// readSerialFile reads the next serial number from the file. If the file does not exist, the first serial number
+// is 1.
+func readSerialFile(file string) (*big.Int, error) {
+	contents, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return big.NewInt(1), nil
+	} else if err != nil {
+		return nil, err
+	}
+	serial, ok := new(big.Int).SetString(strings.TrimSpace(string(contents)), 16)
+	if !ok || serial.Sign() <= 0 {
+		return nil, fmt.Errorf("serial file '%s' does not hold a positive hexadecimal number", file)
+	}
+	return serial, nil
+}
+
+// writeSerialFile replaces the contents of the file with the next serial number. The number is written to a temporary
+// file which is then renamed so that the file is never left partially written.
+func writeSerialFile(file string, serial *big.Int) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%X\n", serial)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
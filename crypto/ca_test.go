@@ -0,0 +1,192 @@
+package crypto_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestCertificateAuthority(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	root, err := crypto.NewRootCertificateAuthority(ctx, &crypto.CertificateAuthorityOptions{
+		Subject: pkix.Name{CommonName: "Test Root CA"},
+	})
+	if err != nil {
+		t.Fatalf("error while creating root CA: %s", err.Error())
+	}
+	intermediate, err := root.NewIntermediateCertificateAuthority(ctx, &crypto.CertificateAuthorityOptions{
+		Subject:        pkix.Name{CommonName: "Test Intermediate CA"},
+		KeyType:        crypto.KeyTypeRSA2048,
+		MaxPathLenZero: true,
+	})
+	if err != nil {
+		t.Fatalf("error while creating intermediate CA: %s", err.Error())
+	}
+	if len(intermediate.Chain) != 1 || !intermediate.Chain[0].Equal(root.Certificate) {
+		t.Errorf("error: intermediate chain does not contain the root CA")
+	}
+
+	cert, key, err := intermediate.IssueCertificateKeyPair(ctx, crypto.KeyTypeEd25519, &crypto.CertificateOptions{
+		Subject:     pkix.Name{CommonName: "service"},
+		DNSNames:    []string{"service.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+		Validity:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("error while issuing certificate: %s", err.Error())
+	}
+	if cert.IsCA || cert.Subject.CommonName != "service" || key == nil {
+		t.Errorf("error: issued certificate is incorrect")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.Certificate)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate.Certificate)
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		_, err := cert.Verify(x509.VerifyOptions{DNSName: "service.example.com", Roots: roots,
+			Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{usage}})
+		if err != nil {
+			t.Errorf("error while verifying certificate: %s", err.Error())
+		}
+	}
+
+	// the intermediate CA is not allowed to issue further CAs
+	_, err = intermediate.NewIntermediateCertificateAuthority(ctx,
+		&crypto.CertificateAuthorityOptions{Validity: time.Hour})
+	if _, ok := err.(*crypto.ErrGenerateCertificateFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrGenerateCertificateFailure", err)
+	}
+
+	// intermediate CAs inherit a shorter path length from the CA that issues them
+	limited, err := crypto.NewRootCertificateAuthority(ctx, &crypto.CertificateAuthorityOptions{MaxPathLen: 2})
+	if err != nil {
+		t.Fatalf("error while creating root CA: %s", err.Error())
+	}
+	sub, err := limited.NewIntermediateCertificateAuthority(ctx,
+		&crypto.CertificateAuthorityOptions{Validity: time.Hour})
+	if err != nil {
+		t.Fatalf("error while creating sub-CA: %s", err.Error())
+	}
+	if sub.Certificate.MaxPathLen != 1 {
+		t.Errorf("want: 1, got: %d", sub.Certificate.MaxPathLen)
+	}
+	_, err = limited.NewIntermediateCertificateAuthority(ctx, &crypto.CertificateAuthorityOptions{MaxPathLen: 2})
+	if _, ok := err.(*crypto.ErrGenerateCertificateFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrGenerateCertificateFailure", err)
+	}
+
+	// certificates cannot outlive the CA
+	_, err = root.IssueCertificate(ctx, key.Public(), &crypto.CertificateOptions{Validity: 20 * 365 * 24 * time.Hour})
+	if _, ok := err.(*crypto.ErrGenerateCertificateFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrGenerateCertificateFailure", err)
+	}
+}
+
+func TestCertificateAuthorityFromRequest(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ca, err := crypto.NewRootCertificateAuthority(ctx, nil)
+	if err != nil {
+		t.Fatalf("error while creating CA: %s", err.Error())
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "client"},
+		DNSNames: []string{"client.example.com"},
+	}, key)
+	csr, _ := x509.ParseCertificateRequest(der)
+
+	cert, err := ca.IssueCertificateFromRequest(ctx, csr, &crypto.CertificateOptions{
+		ExtKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Fatalf("error while issuing certificate: %s", err.Error())
+	}
+	if cert.Subject.CommonName != "client" || len(cert.DNSNames) != 1 || !key.PublicKey.Equal(cert.PublicKey) {
+		t.Errorf("error: certificate does not match the request")
+	}
+	if err := cert.CheckSignatureFrom(ca.Certificate); err != nil {
+		t.Errorf("error while checking signature: %s", err.Error())
+	}
+
+	// tampered requests are rejected
+	csr.Signature[len(csr.Signature)-1] ^= 0xff
+	if _, err := ca.IssueCertificateFromRequest(ctx, csr, nil); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func TestLoadCertificateAuthority(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	root, _ := crypto.NewRootCertificateAuthority(ctx, nil)
+	intermediate, err := root.NewIntermediateCertificateAuthority(ctx, nil)
+	if err != nil {
+		t.Fatalf("error while creating intermediate CA: %s", err.Error())
+	}
+	certFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "ca.key")
+	opts := &crypto.PrivateKeyMarshalOptions{Password: []byte("secret"),
+		Encryption: &crypto.PKCS8EncryptionOptions{KDF: &crypto.KDFOptions{PBKDF2Iterations: 1000}}}
+	if err := intermediate.WriteFiles(ctx, certFile, keyFile, opts); err != nil {
+		t.Fatalf("error while writing CA: %s", err.Error())
+	}
+
+	ca, err := crypto.LoadCertificateAuthority(ctx, certFile, keyFile, []byte("secret"))
+	if err != nil {
+		t.Fatalf("error while loading CA: %s", err.Error())
+	}
+	if !ca.Certificate.Equal(intermediate.Certificate) || len(ca.Chain) != 1 {
+		t.Errorf("error: loaded CA does not match")
+	}
+
+	// serial numbers are allocated sequentially from the serial file
+	ca.SerialFile = filepath.Join(dir, "serial")
+	for i := int64(1); i <= 2; i++ {
+		cert, _, err := ca.IssueCertificateKeyPair(ctx, 0, nil)
+		if err != nil {
+			t.Fatalf("error while issuing certificate: %s", err.Error())
+		}
+		if cert.SerialNumber.Cmp(big.NewInt(i)) != 0 {
+			t.Errorf("want: %d, got: %s", i, cert.SerialNumber)
+		}
+	}
+	if contents, _ := ioutil.ReadFile(ca.SerialFile); strings.TrimSpace(string(contents)) != "3" {
+		t.Errorf("want: 3, got: %s", contents)
+	}
+
+	// the key must match the certificate
+	otherKey := filepath.Join(dir, "other.key")
+	other, _ := crypto.GeneratePrivateKey(ctx, crypto.KeyTypeECDSAP256)
+	if err := crypto.WritePrivateKeyFile(ctx, otherKey, other, nil); err != nil {
+		t.Fatalf("error while writing key: %s", err.Error())
+	}
+	if _, err := crypto.LoadCertificateAuthority(ctx, certFile, otherKey, nil); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
@@ -0,0 +1,413 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+const (
+	// DefaultExpiryThreshold is the default amount of time before a certificate expires that it is reported as
+	// expiring.
+	DefaultExpiryThreshold = 30 * 24 * time.Hour
+)
+
+// DefaultCertificateExtensions holds the default extensions of the files read by ScanCertificateDirectory().
+var DefaultCertificateExtensions = []string{".pem", ".crt", ".cer", ".cert"}
+
+// CertificateIssue identifies a problem found while inspecting a certificate.
+type CertificateIssue int
+
+// Possible certificate issues.
+const (
+	_ CertificateIssue = iota
+	CertificateIssueExpired
+	CertificateIssueExpiring
+	CertificateIssueNotYetValid
+	CertificateIssueWeakKey
+	CertificateIssueWeakSignature
+	CertificateIssueSelfSigned
+)
+
+// String returns the name of the certificate issue.
+func (i CertificateIssue) String() string {
+	switch i {
+	case CertificateIssueExpired:
+		return "expired"
+	case CertificateIssueExpiring:
+		return "expiring"
+	case CertificateIssueNotYetValid:
+		return "not-yet-valid"
+	case CertificateIssueWeakKey:
+		return "weak-key"
+	case CertificateIssueWeakSignature:
+		return "weak-signature"
+	case CertificateIssueSelfSigned:
+		return "self-signed"
+	}
+	return fmt.Sprintf("unknown(%d)", int(i))
+}
+
+// MarshalText returns the name of the certificate issue so that it is readable when a report is encoded as JSON.
+func (i CertificateIssue) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+// CertificateInfo holds a summary of a certificate and any issues found with it.
+type CertificateInfo struct {
+	// File is the file the certificate was read from, if any.
+	File string `json:"file,omitempty"`
+
+	// Subject is the distinguished name of the subject.
+	Subject string `json:"subject"`
+
+	// Issuer is the distinguished name of the issuer.
+	Issuer string `json:"issuer"`
+
+	// SerialNumber is the serial number as colon-separated hex bytes.
+	SerialNumber string `json:"serial_number"`
+
+	// DNSNames holds the DNS subject alternative names.
+	DNSNames []string `json:"dns_names,omitempty"`
+
+	// IPAddresses holds the IP address subject alternative names.
+	IPAddresses []string `json:"ip_addresses,omitempty"`
+
+	// EmailAddresses holds the email subject alternative names.
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+
+	// URIs holds the URI subject alternative names.
+	URIs []string `json:"uris,omitempty"`
+
+	// NotBefore is the time from which the certificate is valid.
+	NotBefore time.Time `json:"not_before"`
+
+	// NotAfter is the time at which the certificate expires.
+	NotAfter time.Time `json:"not_after"`
+
+	// DaysUntilExpiry is the number of whole days until the certificate expires. It is negative once the
+	// certificate has expired.
+	DaysUntilExpiry int `json:"days_until_expiry"`
+
+	// SHA1Fingerprint is the SHA-1 hash of the certificate as colon-separated hex bytes.
+	SHA1Fingerprint string `json:"sha1_fingerprint"`
+
+	// SHA256Fingerprint is the SHA-256 hash of the certificate as colon-separated hex bytes.
+	SHA256Fingerprint string `json:"sha256_fingerprint"`
+
+	// KeyType is the type of the public key: "RSA", "ECDSA", "Ed25519", "DSA" or "unknown".
+	KeyType string `json:"key_type"`
+
+	// KeyBits is the size of the public key in bits.
+	KeyBits int `json:"key_bits"`
+
+	// SignatureAlgorithm is the algorithm used by the issuer to sign the certificate.
+	SignatureAlgorithm string `json:"signature_algorithm"`
+
+	// IsCA is whether the certificate belongs to a certificate authority.
+	IsCA bool `json:"is_ca"`
+
+	// SelfSigned is whether the certificate is signed by its own key.
+	SelfSigned bool `json:"self_signed"`
+
+	// Issues holds the problems found with the certificate.
+	Issues []CertificateIssue `json:"issues,omitempty"`
+}
+
+// HasIssue returns whether the given issue was found with the certificate.
+func (i *CertificateInfo) HasIssue(issue CertificateIssue) bool {
+	for _, found := range i.Issues {
+		if found == issue {
+			return true
+		}
+	}
+	return false
+}
+
+// CertificateInspectionOptions holds the options used to inspect certificates.
+type CertificateInspectionOptions struct {
+	// ExpiryThreshold is how long before expiry a certificate is reported as expiring. If not set,
+	// DefaultExpiryThreshold is used.
+	ExpiryThreshold time.Duration
+
+	// MinRSAKeyBits is the minimum size of an RSA or DSA key before it is reported as weak. If not set,
+	// DefaultMinRSAKeyBits is used.
+	MinRSAKeyBits int
+
+	// CurrentTime is the time at which the certificates are inspected. If not set, the current time is used.
+	CurrentTime time.Time
+
+	// Extensions holds the extensions of the files read by ScanCertificateDirectory(), including the leading dot.
+	// If empty, DefaultCertificateExtensions is used.
+	Extensions []string
+
+	// Recursive causes ScanCertificateDirectory() to also scan subdirectories.
+	Recursive bool
+}
+
+// CertificateReport holds the results of scanning a directory for certificates.
+type CertificateReport struct {
+	// Time is the time at which the certificates were inspected.
+	Time time.Time `json:"time"`
+
+	// Certificates holds every certificate found, ordered by expiry time.
+	Certificates []*CertificateInfo `json:"certificates"`
+
+	// Errors maps the files which could not be read or parsed to the reason.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// WithIssue returns the certificates with the given issue, ordered by expiry time.
+func (r *CertificateReport) WithIssue(issue CertificateIssue) []*CertificateInfo {
+	found := []*CertificateInfo{}
+	for _, info := range r.Certificates {
+		if info.HasIssue(issue) {
+			found = append(found, info)
+		}
+	}
+	return found
+}
+
+// ExpiringWithin returns the certificates which expire within the given duration of the time of the scan, including
+// any which have already expired, ordered by expiry time.
+func (r *CertificateReport) ExpiringWithin(d time.Duration) []*CertificateInfo {
+	found := []*CertificateInfo{}
+	for _, info := range r.Certificates {
+		if info.NotAfter.Before(r.Time.Add(d)) {
+			found = append(found, info)
+		}
+	}
+	return found
+}
+
+// InspectCertificate summarizes the certificate and checks it for the following issues:
+//
+//  ◽ expired, expiring within the threshold or not yet valid
+//  ◽ RSA or DSA key smaller than the minimum size
+//  ◽ signature using SHA-1 or MD5
+//  ◽ self-signed
+//
+// If opts is nil, the defaults are used.
+func InspectCertificate(cert *x509.Certificate, opts *CertificateInspectionOptions) *CertificateInfo {
+	o := inspectionOptions(opts)
+	info := &CertificateInfo{
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		SerialNumber:       hexBytes(cert.SerialNumber.Bytes()),
+		DNSNames:           cert.DNSNames,
+		EmailAddresses:     cert.EmailAddresses,
+		NotBefore:          cert.NotBefore,
+		NotAfter:           cert.NotAfter,
+		DaysUntilExpiry:    int(math.Floor(cert.NotAfter.Sub(o.CurrentTime).Hours() / 24)),
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		IsCA:               cert.IsCA,
+		Issues:             []CertificateIssue{},
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		info.URIs = append(info.URIs, uri.String())
+	}
+	sha1Sum := sha1.Sum(cert.Raw)
+	info.SHA1Fingerprint = hexBytes(sha1Sum[:])
+	sha256Sum := sha256.Sum256(cert.Raw)
+	info.SHA256Fingerprint = hexBytes(sha256Sum[:])
+
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		info.KeyType, info.KeyBits = "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		info.KeyType, info.KeyBits = "ECDSA", k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		info.KeyType, info.KeyBits = "Ed25519", 256
+	case *dsa.PublicKey:
+		info.KeyType, info.KeyBits = "DSA", k.P.BitLen()
+	default:
+		info.KeyType = "unknown"
+	}
+
+	// a certificate is self-signed if it is its own issuer and its signature verifies with its own key; unlike
+	// CheckSignatureFrom(), CheckSignature() still accepts SHA-1 signatures
+	if bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil {
+		info.SelfSigned = true
+	}
+
+	// check for issues
+	switch {
+	case o.CurrentTime.After(cert.NotAfter):
+		info.Issues = append(info.Issues, CertificateIssueExpired)
+	case o.CurrentTime.Add(o.ExpiryThreshold).After(cert.NotAfter):
+		info.Issues = append(info.Issues, CertificateIssueExpiring)
+	case o.CurrentTime.Before(cert.NotBefore):
+		info.Issues = append(info.Issues, CertificateIssueNotYetValid)
+	}
+	if (info.KeyType == "RSA" || info.KeyType == "DSA") && info.KeyBits < o.MinRSAKeyBits {
+		info.Issues = append(info.Issues, CertificateIssueWeakKey)
+	}
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		info.Issues = append(info.Issues, CertificateIssueWeakSignature)
+	}
+	if info.SelfSigned {
+		info.Issues = append(info.Issues, CertificateIssueSelfSigned)
+	}
+	return info
+}
+
+// InspectCertificateFile reads every certificate in a PEM-formatted file and inspects it using
+// InspectCertificate().
+//
+// The following errors are returned by this function:
+// any error returned by ParsePEMCertificateFile
+func InspectCertificateFile(ctx context.Context, file string, opts *CertificateInspectionOptions) (
+	[]*CertificateInfo, error) {
+
+	certs, err := ParsePEMCertificateFile(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	o := inspectionOptions(opts)
+	infos := []*CertificateInfo{}
+	for _, cert := range certs {
+		info := InspectCertificate(cert, &o)
+		info.File = file
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ScanCertificateDirectory inspects every certificate in the PEM-formatted files in a directory.
+//
+// Only files with one of the configured extensions are read. Files which do not hold any certificates, such as
+// private keys, are skipped. Files which cannot be read or parsed are listed in the report's Errors field rather than
+// stopping the scan.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure
+func ScanCertificateDirectory(ctx context.Context, dir string, opts *CertificateInspectionOptions) (
+	*CertificateReport, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("directory", dir).Logger()
+
+	o := inspectionOptions(opts)
+	report := &CertificateReport{
+		Time:         o.CurrentTime,
+		Certificates: []*CertificateInfo{},
+		Errors:       map[string]string{},
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			report.Errors[path] = err.Error()
+			return nil
+		}
+		if info.IsDir() {
+			if path != dir && !o.Recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !hasExtension(path, o.Extensions) {
+			return nil
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			report.Errors[path] = err.Error()
+			return nil
+		}
+		if !bytes.Contains(contents, []byte("-----BEGIN "+PEMTypeCertificate+"-----")) {
+			return nil
+		}
+		certs, err := parsePEMCertificates(contents)
+		if err != nil {
+			report.Errors[path] = err.Error()
+			return nil
+		}
+		for _, cert := range certs {
+			certInfo := InspectCertificate(cert, &o)
+			certInfo.File = path
+			report.Certificates = append(report.Certificates, certInfo)
+		}
+		return nil
+	})
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: dir}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	sort.SliceStable(report.Certificates, func(i, j int) bool {
+		return report.Certificates[i].NotAfter.Before(report.Certificates[j].NotAfter)
+	})
+	for file, reason := range report.Errors {
+		logger.Warn().Str("file", file).Str("reason", reason).Msg("failed to read certificates from file")
+	}
+	return report, nil
+}
+
+// inspectionOptions returns a copy of the options with the defaults filled in.
+func inspectionOptions(opts *CertificateInspectionOptions) CertificateInspectionOptions {
+	o := CertificateInspectionOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.ExpiryThreshold == 0 {
+		o.ExpiryThreshold = DefaultExpiryThreshold
+	}
+	if o.MinRSAKeyBits == 0 {
+		o.MinRSAKeyBits = DefaultMinRSAKeyBits
+	}
+	if o.CurrentTime.IsZero() {
+		o.CurrentTime = time.Now()
+	}
+	if len(o.Extensions) == 0 {
+		o.Extensions = DefaultCertificateExtensions
+	}
+	return o
+}
+
+// hasExtension returns whether the file has one of the extensions, ignoring case.
+func hasExtension(file string, extensions []string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, e := range extensions {
+		if ext == strings.ToLower(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// hexBytes formats the bytes as colon-separated uppercase hex.
+func hexBytes(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02X", c)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,189 @@
+package crypto_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestInspectCertificate(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ca, _ := crypto.NewRootCertificateAuthority(ctx, nil)
+	cert, _, err := ca.IssueCertificateKeyPair(ctx, crypto.KeyTypeRSA2048, &crypto.CertificateOptions{
+		Subject:  pkix.Name{CommonName: "service"},
+		DNSNames: []string{"service.example.com"},
+		Validity: 10 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("error while issuing certificate: %s", err.Error())
+	}
+
+	info := crypto.InspectCertificate(cert, nil)
+	if info.Subject != "CN=service" || info.KeyType != "RSA" || info.KeyBits != 2048 {
+		t.Errorf("error: unexpected summary: %+v", info)
+	}
+	if len(info.DNSNames) != 1 || info.DNSNames[0] != "service.example.com" {
+		t.Errorf("want: [service.example.com], got: %v", info.DNSNames)
+	}
+	if len(info.SHA256Fingerprint) != 95 || len(info.SHA1Fingerprint) != 59 {
+		t.Errorf("error: unexpected fingerprints: %s, %s", info.SHA256Fingerprint, info.SHA1Fingerprint)
+	}
+	if info.DaysUntilExpiry != 9 {
+		t.Errorf("want: 9, got: %d", info.DaysUntilExpiry)
+	}
+	if !info.HasIssue(crypto.CertificateIssueExpiring) || len(info.Issues) != 1 || info.SelfSigned {
+		t.Errorf("want: [expiring], got: %v", info.Issues)
+	}
+
+	// the CA certificate is self-signed and the leaf is expired after it is no longer valid
+	info = crypto.InspectCertificate(ca.Certificate, nil)
+	if !info.SelfSigned || !info.IsCA || !info.HasIssue(crypto.CertificateIssueSelfSigned) {
+		t.Errorf("error: CA certificate was not reported as self-signed")
+	}
+	info = crypto.InspectCertificate(cert, &crypto.CertificateInspectionOptions{
+		CurrentTime: time.Now().Add(11 * 24 * time.Hour),
+	})
+	if !info.HasIssue(crypto.CertificateIssueExpired) || info.DaysUntilExpiry >= 0 {
+		t.Errorf("want: [expired], got: %v", info.Issues)
+	}
+
+	// weak keys and signatures are reported
+	info = crypto.InspectCertificate(newWeakCertificate(t), nil)
+	for _, issue := range []crypto.CertificateIssue{crypto.CertificateIssueWeakKey,
+		crypto.CertificateIssueWeakSignature, crypto.CertificateIssueSelfSigned} {
+		if !info.HasIssue(issue) {
+			t.Errorf("error: %s was not reported in %v", issue, info.Issues)
+		}
+	}
+}
+
+func TestScanCertificateDirectory(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	dir, err := ioutil.TempDir("", "certinfo")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ca, _ := crypto.NewRootCertificateAuthority(ctx, nil)
+	expiring, key, _ := ca.IssueCertificateKeyPair(ctx, 0, &crypto.CertificateOptions{
+		Subject:  pkix.Name{CommonName: "expiring"},
+		Validity: 24 * time.Hour,
+	})
+	valid, _, _ := ca.IssueCertificateKeyPair(ctx, 0, &crypto.CertificateOptions{
+		Subject:  pkix.Name{CommonName: "valid"},
+		Validity: 90 * 24 * time.Hour,
+	})
+	if err := crypto.WriteCertificatesFile(ctx, filepath.Join(dir, "bundle.pem"),
+		[]*x509.Certificate{valid, expiring}); err != nil {
+		t.Fatalf("error while writing certificates: %s", err.Error())
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	if err := crypto.WriteCertificatesFile(ctx, filepath.Join(dir, "sub", "ca.crt"),
+		[]*x509.Certificate{ca.Certificate}); err != nil {
+		t.Fatalf("error while writing certificates: %s", err.Error())
+	}
+	if err := crypto.WritePrivateKeyFile(ctx, filepath.Join(dir, "key.pem"), key, nil); err != nil {
+		t.Fatalf("error while writing key: %s", err.Error())
+	}
+	corrupt := "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "corrupt.crt"), []byte(corrupt), 0644); err != nil {
+		t.Fatalf("error while writing file: %s", err.Error())
+	}
+
+	report, err := crypto.ScanCertificateDirectory(ctx, dir, nil)
+	if err != nil {
+		t.Fatalf("error while scanning directory: %s", err.Error())
+	}
+	if len(report.Certificates) != 2 || report.Certificates[0].Subject != "CN=expiring" {
+		t.Fatalf("error: unexpected certificates: %+v", report.Certificates)
+	}
+	if len(report.Errors) != 1 || report.Errors[filepath.Join(dir, "corrupt.crt")] == "" {
+		t.Errorf("error: unexpected errors: %v", report.Errors)
+	}
+	if found := report.WithIssue(crypto.CertificateIssueExpiring); len(found) != 1 ||
+		found[0].Subject != "CN=expiring" {
+		t.Errorf("error: expiring certificate was not reported")
+	}
+	if found := report.ExpiringWithin(100 * 24 * time.Hour); len(found) != 2 {
+		t.Errorf("want: 2, got: %d", len(found))
+	}
+
+	// subdirectories are only scanned when recursive
+	report, err = crypto.ScanCertificateDirectory(ctx, dir, &crypto.CertificateInspectionOptions{Recursive: true})
+	if err != nil {
+		t.Fatalf("error while scanning directory: %s", err.Error())
+	}
+	if found := report.WithIssue(crypto.CertificateIssueSelfSigned); len(found) != 1 ||
+		!strings.HasSuffix(found[0].File, "ca.crt") {
+		t.Errorf("error: self-signed certificate was not reported")
+	}
+
+	if _, err := crypto.ScanCertificateDirectory(ctx, filepath.Join(dir, "missing"), nil); err == nil {
+		t.Errorf("error: got nil, expected error")
+	} else if _, ok := err.(*crypto.ErrReadFileFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrReadFileFailure", err)
+	}
+}
+
+func TestParsePEMCertificateBundle(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ca, _ := crypto.NewRootCertificateAuthority(ctx, nil)
+	cert, key, _ := ca.IssueCertificateKeyPair(ctx, 0, nil)
+	keyPEM, _ := crypto.MarshalPrivateKeyPEM(ctx, key, nil)
+	certPEM, _ := crypto.MarshalCertificatesPEM(ctx, []*x509.Certificate{cert, ca.Certificate})
+
+	certs, err := crypto.ParsePEMCertificateBytes(ctx, append(keyPEM, certPEM...))
+	if err != nil {
+		t.Fatalf("error while parsing certificates: %s", err.Error())
+	}
+	if len(certs) != 2 || !certs[0].Equal(cert) || !certs[1].Equal(ca.Certificate) {
+		t.Errorf("error: bundle was not parsed in order")
+	}
+	if _, err := crypto.ParsePEMCertificateBytes(ctx, keyPEM); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func newWeakCertificate(t *testing.T) *x509.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("error while generating key: %s", err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		Subject:            pkix.Name{CommonName: "weak"},
+		NotBefore:          time.Now().Add(-time.Hour),
+		NotAfter:           time.Now().Add(365 * 24 * time.Hour),
+		SignatureAlgorithm: x509.SHA1WithRSA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error while creating certificate: %s", err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error while parsing certificate: %s", err.Error())
+	}
+	return cert
+}
@@ -0,0 +1,322 @@
+package crypto
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+const (
+	// DefaultMinRSAKeyBits is the default minimum size of an RSA key accepted in a certificate request.
+	DefaultMinRSAKeyBits = 2048
+)
+
+// CertificateRequestOptions holds the subject and subject alternative names of a certificate signing request.
+type CertificateRequestOptions struct {
+	// Subject is the distinguished name of the requested certificate.
+	Subject pkix.Name
+
+	// DNSNames holds the DNS subject alternative names.
+	DNSNames []string
+
+	// IPAddresses holds the IP address subject alternative names.
+	IPAddresses []net.IP
+
+	// EmailAddresses holds the email subject alternative names.
+	EmailAddresses []string
+
+	// URIs holds the URI subject alternative names.
+	URIs []*url.URL
+}
+
+// CertificateRequestPolicy restricts the names and keys that may appear in a certificate signing request.
+//
+// Each list holds the allowed values for one type of subject alternative name. If a list is empty, names of that
+// type are not allowed.
+type CertificateRequestPolicy struct {
+	// AllowedDNSNames holds the allowed DNS names. An entry of the form "*.example.com" allows any name with a single
+	// label in front of ".example.com", such as "host.example.com" but not "a.host.example.com". Other entries must
+	// match exactly. Matching is case-insensitive.
+	AllowedDNSNames []string
+
+	// AllowWildcards allows the common name and DNS names to request wildcard names such as "*.example.com". The
+	// wildcard name must itself be allowed by AllowedDNSNames, so "*.example.com" is allowed by the entry
+	// "*.example.com" but not by "*.com". Otherwise, names containing "*" are rejected.
+	AllowWildcards bool
+
+	// AllowedIPNets holds the networks in which IP addresses are allowed.
+	AllowedIPNets []*net.IPNet
+
+	// AllowedEmailDomains holds the allowed domains of email addresses using the same rules as AllowedDNSNames.
+	// Domains containing "*" are always rejected.
+	AllowedEmailDomains []string
+
+	// AllowedURIPrefixes holds the allowed prefixes of URIs, such as "spiffe://cluster.local/".
+	AllowedURIPrefixes []string
+
+	// AllowAnyCommonName allows the subject common name to hold any value. Otherwise, if the common name is set it
+	// must be an allowed DNS name.
+	AllowAnyCommonName bool
+
+	// RequireSAN requires at least one subject alternative name to be present.
+	RequireSAN bool
+
+	// MinRSAKeyBits is the minimum size of an RSA key. If not set, DefaultMinRSAKeyBits is used.
+	MinRSAKeyBits int
+}
+
+// NewCertificateRequest creates a certificate signing request signed by the given private key.
+//
+// The following errors are returned by this function:
+// ErrGenerateCertificateFailure, ErrUnsupportedKey
+func NewCertificateRequest(ctx context.Context, key crypto.Signer, opts *CertificateRequestOptions) (
+	*x509.CertificateRequest, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if key == nil {
+		e := &ErrUnsupportedKey{Err: errors.New("no private key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	o := CertificateRequestOptions{}
+	if opts != nil {
+		o = *opts
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:        o.Subject,
+		DNSNames:       o.DNSNames,
+		IPAddresses:    o.IPAddresses,
+		EmailAddresses: o.EmailAddresses,
+		URIs:           o.URIs,
+	}, key)
+	if err != nil {
+		e := &ErrGenerateCertificateFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		e := &ErrGenerateCertificateFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return csr, nil
+}
+
+// MarshalCertificateRequestPEM encodes the certificate signing request as a "CERTIFICATE REQUEST" PEM block.
+//
+// The following errors are returned by this function:
+// ErrEncodeFailure
+func MarshalCertificateRequestPEM(ctx context.Context, csr *x509.CertificateRequest) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if csr == nil || len(csr.Raw) == 0 {
+		e := &ErrEncodeFailure{Err: errors.New("certificate request has no DER data")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypeCertificateRequest, Bytes: csr.Raw}), nil
+}
+
+// ParseCertificateRequestBytes parses a PEM-formatted or DER-encoded certificate signing request.
+//
+// The signature is not checked. Use ValidateCertificateRequest() before trusting the contents of the request.
+//
+// The following errors are returned by this function:
+// ErrParseCertificateRequestFailure
+func ParseCertificateRequestBytes(ctx context.Context, contents []byte) (*x509.CertificateRequest, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if len(contents) == 0 {
+		e := &ErrParseCertificateRequestFailure{Err: errors.New("no content was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	der := contents
+	if block, _ := pem.Decode(contents); block != nil {
+		// OpenSSL and some older tools use "NEW CERTIFICATE REQUEST"
+		if block.Type != PEMTypeCertificateRequest && block.Type != "NEW "+PEMTypeCertificateRequest {
+			e := &ErrParseCertificateRequestFailure{Err: fmt.Errorf("unsupported PEM block type '%s'", block.Type)}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		der = block.Bytes
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		e := &ErrParseCertificateRequestFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return csr, nil
+}
+
+// ParseCertificateRequestFile reads a PEM-formatted or DER-encoded certificate signing request from a file.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, any error returned by ParseCertificateRequestBytes
+func ParseCertificateRequestFile(ctx context.Context, file string) (*x509.CertificateRequest, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return ParseCertificateRequestBytes(logger.WithContext(ctx), contents)
+}
+
+// ValidateCertificateRequest checks the signature of the certificate signing request and, if a policy is given,
+// that the request satisfies it.
+//
+// Every policy violation is reported in the returned error.
+//
+// The following errors are returned by this function:
+// ErrInvalidCertificateRequest
+func ValidateCertificateRequest(ctx context.Context, csr *x509.CertificateRequest,
+	policy *CertificateRequestPolicy) error {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if csr == nil {
+		e := &ErrInvalidCertificateRequest{Err: errors.New("no certificate request was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	logger = logger.With().Str("subject", csr.Subject.String()).Logger()
+	if err := csr.CheckSignature(); err != nil {
+		e := &ErrInvalidCertificateRequest{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if policy == nil {
+		return nil
+	}
+
+	problems := policy.check(csr)
+	if len(problems) > 0 {
+		e := &ErrInvalidCertificateRequest{Err: errors.New(strings.Join(problems, "; "))}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return nil
+}
+
+// check returns a description of each way in which the request violates the policy.
+func (p *CertificateRequestPolicy) check(csr *x509.CertificateRequest) []string {
+	problems := []string{}
+
+	// check the key
+	minBits := p.MinRSAKeyBits
+	if minBits == 0 {
+		minBits = DefaultMinRSAKeyBits
+	}
+	if k, ok := csr.PublicKey.(*rsa.PublicKey); ok && k.N.BitLen() < minBits {
+		problems = append(problems, fmt.Sprintf("RSA key has %d bits but at least %d are required", k.N.BitLen(),
+			minBits))
+	}
+
+	// check the names
+	cn := csr.Subject.CommonName
+	if cn != "" && !p.AllowAnyCommonName && !matchDomain(p.AllowedDNSNames, cn, p.AllowWildcards) {
+		problems = append(problems, fmt.Sprintf("common name '%s' is not allowed", cn))
+	}
+	for _, name := range csr.DNSNames {
+		if !matchDomain(p.AllowedDNSNames, name, p.AllowWildcards) {
+			problems = append(problems, fmt.Sprintf("DNS name '%s' is not allowed", name))
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		allowed := false
+		for _, n := range p.AllowedIPNets {
+			if n.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			problems = append(problems, fmt.Sprintf("IP address '%s' is not allowed", ip))
+		}
+	}
+	for _, email := range csr.EmailAddresses {
+		i := strings.LastIndex(email, "@")
+		if i < 0 || !matchDomain(p.AllowedEmailDomains, email[i+1:], false) {
+			problems = append(problems, fmt.Sprintf("email address '%s' is not allowed", email))
+		}
+	}
+	for _, uri := range csr.URIs {
+		allowed := false
+		for _, prefix := range p.AllowedURIPrefixes {
+			if strings.HasPrefix(uri.String(), prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			problems = append(problems, fmt.Sprintf("URI '%s' is not allowed", uri))
+		}
+	}
+	if p.RequireSAN && len(csr.DNSNames)+len(csr.IPAddresses)+len(csr.EmailAddresses)+len(csr.URIs) == 0 {
+		problems = append(problems, "no subject alternative names were requested")
+	}
+	return problems
+}
+
+// matchDomain returns whether the name matches one of the patterns. A pattern of the form "*.example.com" matches
+// any name with exactly one additional label in place of the "*", such as "host.example.com" but not
+// "a.host.example.com"; other patterns must match exactly. Matching is case-insensitive.
+//
+// Names containing "*" never match unless allowWildcards is true, in which case the name may only use "*" as its
+// entire leftmost label. That label is then matched like any other label.
+func matchDomain(patterns []string, name string, allowWildcards bool) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if strings.Contains(name, "*") {
+		if !allowWildcards || !strings.HasPrefix(name, "*.") || strings.Contains(name[1:], "*") {
+			return false
+		}
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if strings.HasPrefix(pattern, "*.") {
+			if label := strings.TrimSuffix(name, pattern[1:]); label != name && label != "" &&
+				!strings.Contains(label, ".") {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package crypto_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestCertificateRequest(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	key, _ := crypto.GeneratePrivateKey(ctx, crypto.KeyTypeECDSAP256)
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/default/sa/api")
+	csr, err := crypto.NewCertificateRequest(ctx, key, &crypto.CertificateRequestOptions{
+		Subject:     pkix.Name{CommonName: "api.svc.cluster.local"},
+		DNSNames:    []string{"api.svc.cluster.local", "api"},
+		IPAddresses: []net.IP{net.ParseIP("10.1.2.3")},
+		URIs:        []*url.URL{spiffe},
+	})
+	if err != nil {
+		t.Fatalf("error while creating request: %s", err.Error())
+	}
+
+	contents, err := crypto.MarshalCertificateRequestPEM(ctx, csr)
+	if err != nil {
+		t.Fatalf("error while encoding request: %s", err.Error())
+	}
+	parsed, err := crypto.ParseCertificateRequestBytes(ctx, contents)
+	if err != nil {
+		t.Fatalf("error while parsing request: %s", err.Error())
+	}
+	if _, err := crypto.ParseCertificateRequestBytes(ctx, parsed.Raw); err != nil {
+		t.Fatalf("error while parsing DER request: %s", err.Error())
+	}
+
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/8")
+	policy := &crypto.CertificateRequestPolicy{
+		AllowedDNSNames:    []string{"*.svc.cluster.local", "api"},
+		AllowedIPNets:      []*net.IPNet{cidr},
+		AllowedURIPrefixes: []string{"spiffe://cluster.local/"},
+		RequireSAN:         true,
+	}
+	if err := crypto.ValidateCertificateRequest(ctx, parsed, policy); err != nil {
+		t.Errorf("error while validating request: %s", err.Error())
+	}
+
+	// every violation is reported
+	strict := &crypto.CertificateRequestPolicy{AllowedDNSNames: []string{"*.example.com"}}
+	err = crypto.ValidateCertificateRequest(ctx, parsed, strict)
+	if _, ok := err.(*crypto.ErrInvalidCertificateRequest); !ok {
+		t.Fatalf("error: got %T, expected *crypto.ErrInvalidCertificateRequest", err)
+	}
+	for _, s := range []string{"common name", "'api'", "10.1.2.3", "spiffe://"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error: '%s' does not mention %s", err.Error(), s)
+		}
+	}
+}
+
+func TestValidateCertificateRequestFailure(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	// weak RSA keys are rejected
+	weak, _ := rsa.GenerateKey(rand.Reader, 1024)
+	csr, err := crypto.NewCertificateRequest(ctx, weak, &crypto.CertificateRequestOptions{
+		DNSNames: []string{"host.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("error while creating request: %s", err.Error())
+	}
+	policy := &crypto.CertificateRequestPolicy{AllowedDNSNames: []string{"*.example.com"}}
+	if err := crypto.ValidateCertificateRequest(ctx, csr, policy); err == nil {
+		t.Errorf("error: got nil, expected error for weak key")
+	}
+
+	// tampered requests are rejected
+	csr.Signature[0] ^= 0xff
+	if err := crypto.ValidateCertificateRequest(ctx, csr, nil); err == nil {
+		t.Errorf("error: got nil, expected error for bad signature")
+	}
+
+	if _, err := crypto.ParseCertificateRequestBytes(ctx, []byte(SigningCertificate)); err == nil {
+		t.Errorf("error: got nil, expected error for certificate")
+	}
+}
+
+func TestIssueCertificateFromRequestPolicy(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ca, err := crypto.NewRootCertificateAuthority(ctx, nil)
+	if err != nil {
+		t.Fatalf("error while creating CA: %s", err.Error())
+	}
+	ca.RequestPolicy = &crypto.CertificateRequestPolicy{AllowedDNSNames: []string{"*.internal"}, RequireSAN: true}
+
+	key, _ := crypto.GeneratePrivateKey(ctx, crypto.KeyTypeEd25519)
+	good, _ := crypto.NewCertificateRequest(ctx, key, &crypto.CertificateRequestOptions{
+		DNSNames: []string{"db.internal"},
+	})
+	cert, err := ca.IssueCertificateFromRequest(ctx, good, nil)
+	if err != nil {
+		t.Fatalf("error while issuing certificate: %s", err.Error())
+	}
+	if err := cert.VerifyHostname("db.internal"); err != nil {
+		t.Errorf("error while verifying hostname: %s", err.Error())
+	}
+
+	bad, _ := crypto.NewCertificateRequest(ctx, key, &crypto.CertificateRequestOptions{
+		DNSNames: []string{"db.example.com"},
+	})
+	_, err = ca.IssueCertificateFromRequest(ctx, bad, nil)
+	if _, ok := err.(*crypto.ErrInvalidCertificateRequest); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrInvalidCertificateRequest", err)
+	}
+}
+
+func TestValidateCertificateRequestWildcards(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	key, _ := crypto.GeneratePrivateKey(ctx, crypto.KeyTypeEd25519)
+	policy := &crypto.CertificateRequestPolicy{AllowedDNSNames: []string{"*.example.com"}}
+	tests := []struct {
+		name           string
+		allowWildcards bool
+		valid          bool
+	}{
+		{"host.example.com", false, true},
+		{"HOST.example.com.", false, true},
+		{"a.host.example.com", false, false},
+		{"example.com", false, false},
+		{"*.example.com", false, false},
+		{"*.example.com", true, true},
+		{"*.host.example.com", true, false},
+		{"h*.example.com", true, false},
+		{"*.*.example.com", true, false},
+	}
+	for _, test := range tests {
+		csr, err := crypto.NewCertificateRequest(ctx, key, &crypto.CertificateRequestOptions{
+			DNSNames: []string{test.name},
+		})
+		if err != nil {
+			t.Fatalf("error while creating request: %s", err.Error())
+		}
+		policy.AllowWildcards = test.allowWildcards
+		err = crypto.ValidateCertificateRequest(ctx, csr, policy)
+		if test.valid && err != nil {
+			t.Errorf("%s: error while validating request: %s", test.name, err.Error())
+		} else if !test.valid {
+			if _, ok := err.(*crypto.ErrInvalidCertificateRequest); !ok {
+				t.Errorf("%s: error: got %T, expected *crypto.ErrInvalidCertificateRequest", test.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package crypto
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+// KDFAlgorithm identifies the function used to turn the key supplied by the caller into an encryption key.
+type KDFAlgorithm byte
+
+// Possible values for the key derivation function stored in a ciphertext envelope.
+const (
+	_ KDFAlgorithm = iota
+	KDFEmbeddedKey
+	KDFSHA256
+	KDFArgon2id
+	KDFScrypt
+	KDFPBKDF2SHA256
+)
+
+// String returns the name of the key derivation function.
+func (k KDFAlgorithm) String() string {
+	switch k {
+	case KDFEmbeddedKey:
+		return "embedded-key"
+	case KDFSHA256:
+		return "sha256"
+	case KDFArgon2id:
+		return "argon2id"
+	case KDFScrypt:
+		return "scrypt"
+	case KDFPBKDF2SHA256:
+		return "pbkdf2-sha256"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(k))
+}
+
+// CipherAlgorithm identifies the cipher used to encrypt the data in a ciphertext envelope.
+type CipherAlgorithm byte
+
+// Possible values for the cipher stored in a ciphertext envelope.
+const (
+	_ CipherAlgorithm = iota
+	CipherAES256GCM
+)
+
+// String returns the name of the cipher.
+func (c CipherAlgorithm) String() string {
+	switch c {
+	case CipherAES256GCM:
+		return "aes-256-gcm"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(c))
+}
+
+const (
+	// CiphertextEnvelopeVersion1 is the first version of the ciphertext envelope format.
+	CiphertextEnvelopeVersion1 = 0x01
+
+	// ciphertextEnvelopePrefix marks an encoded string as a ciphertext envelope. Since '$' is not part of the Base64
+	// alphabet, the prefix can never appear at the start of a string produced by the legacy format.
+	ciphertextEnvelopePrefix = "$env$"
+
+	// maxKeyIDLength is the maximum length of a key ID stored in an envelope.
+	maxKeyIDLength = 255
+
+	// maxKDFParamsLength is the maximum length of the KDF parameters stored in an envelope.
+	maxKDFParamsLength = 65535
+)
+
+// CiphertextEnvelope is a versioned, self-describing container for data encrypted by EncryptString() and its
+// related functions.
+//
+// The envelope header records the format version, the key derivation function, the cipher and the ID of the key
+// that was used, along with any parameters the key derivation function needs. The header is authenticated along
+// with the ciphertext, so it cannot be altered without decryption failing.
+//
+// When encoded as a string, the envelope is the "$env$" prefix followed by the Base64-encoded binary
+// envelope:
+//
+//  ◽ version (1 byte)
+//  ◽ KDF ID (1 byte)
+//  ◽ cipher ID (1 byte)
+//  ◽ key ID length (1 byte) followed by the key ID
+//  ◽ KDF parameters length (2 bytes, big endian) followed by the KDF parameters
+//  ◽ nonce length (1 byte) followed by the nonce
+//  ◽ ciphertext
+type CiphertextEnvelope struct {
+	// Version is the version of the envelope format.
+	Version byte
+
+	// KDF is the function used to derive the encryption key.
+	KDF KDFAlgorithm
+
+	// Cipher is the cipher used to encrypt the data.
+	Cipher CipherAlgorithm
+
+	// KeyID identifies the key used to encrypt the data. It may be empty.
+	KeyID string
+
+	// KDFParams holds any parameters required by the key derivation function.
+	KDFParams []byte
+
+	// Nonce is the nonce used when encrypting the data.
+	Nonce []byte
+
+	// Ciphertext is the encrypted data.
+	Ciphertext []byte
+}
+
+// IsCiphertextEnvelope returns whether or not the given ciphertext is encoded as a ciphertext envelope rather than
+// in the legacy format produced by earlier versions of EncryptString().
+func IsCiphertextEnvelope(ciphertext string) bool {
+	return strings.HasPrefix(ciphertext, ciphertextEnvelopePrefix)
+}
+
+// ParseCiphertextEnvelope decodes the given ciphertext into a ciphertext envelope without decrypting it.
+//
+// This is useful for inspecting the algorithms or key ID used to encrypt the data.
+//
+// The following errors are returned by this function:
+// ErrDecodeFailure
+func ParseCiphertextEnvelope(ctx context.Context, ciphertext string) (*CiphertextEnvelope, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	env, err := parseCiphertextEnvelope(ciphertext)
+	if err != nil {
+		e := &ErrDecodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return env, nil
+}
+
+// String returns the envelope encoded as a string.
+func (e *CiphertextEnvelope) String() string {
+	data := e.header()
+	data = append(data, byte(len(e.Nonce)))
+	data = append(data, e.Nonce...)
+	data = append(data, e.Ciphertext...)
+	return ciphertextEnvelopePrefix + base64.StdEncoding.EncodeToString(data)
+}
+
+// header returns the binary header which is authenticated along with the ciphertext.
+func (e *CiphertextEnvelope) header() []byte {
+	header := make([]byte, 0, 6+len(e.KeyID)+len(e.KDFParams))
+	header = append(header, e.Version, byte(e.KDF), byte(e.Cipher), byte(len(e.KeyID)))
+	header = append(header, e.KeyID...)
+	header = append(header, byte(len(e.KDFParams)>>8), byte(len(e.KDFParams)))
+	header = append(header, e.KDFParams...)
+	return header
+}
+
+// validate ensures the envelope fields fit within the limits of the envelope format.
+func (e *CiphertextEnvelope) validate() error {
+	if len(e.KeyID) > maxKeyIDLength {
+		return fmt.Errorf("key ID may not be longer than %d bytes", maxKeyIDLength)
+	}
+	if len(e.KDFParams) > maxKDFParamsLength {
+		return fmt.Errorf("KDF parameters may not be longer than %d bytes", maxKDFParamsLength)
+	}
+	if len(e.Nonce) > 255 {
+		return errors.New("nonce may not be longer than 255 bytes")
+	}
+	return nil
+}
+
+// parseCiphertextEnvelope decodes an encoded envelope string.
+func parseCiphertextEnvelope(ciphertext string) (*CiphertextEnvelope, error) {
+	if !IsCiphertextEnvelope(ciphertext) {
+		return nil, errors.New("ciphertext is not an envelope")
+	}
+	data, err := base64.StdEncoding.DecodeString(ciphertext[len(ciphertextEnvelopePrefix):])
+	if err != nil {
+		return nil, err
+	}
+
+	truncated := errors.New("envelope is truncated")
+	if len(data) < 4 {
+		return nil, truncated
+	}
+	env := &CiphertextEnvelope{
+		Version: data[0],
+		KDF:     KDFAlgorithm(data[1]),
+		Cipher:  CipherAlgorithm(data[2]),
+	}
+	if env.Version != CiphertextEnvelopeVersion1 {
+		return nil, fmt.Errorf("unsupported envelope version: %d", env.Version)
+	}
+
+	keyIDLen := int(data[3])
+	data = data[4:]
+	if len(data) < keyIDLen+2 {
+		return nil, truncated
+	}
+	env.KeyID = string(data[:keyIDLen])
+	data = data[keyIDLen:]
+
+	paramsLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < paramsLen+1 {
+		return nil, truncated
+	}
+	if paramsLen > 0 {
+		env.KDFParams = data[:paramsLen]
+	}
+	data = data[paramsLen:]
+
+	nonceLen := int(data[0])
+	data = data[1:]
+	if len(data) < nonceLen {
+		return nil, truncated
+	}
+	env.Nonce = data[:nonceLen]
+	env.Ciphertext = data[nonceLen:]
+	return env, nil
+}
+
+// deriveEnvelopeKey derives the cipher key for the envelope from the key supplied by the caller according to the
+// envelope's KDF.
+func deriveEnvelopeKey(env *CiphertextEnvelope, key []byte) ([]byte, error) {
+	switch env.KDF {
+	case KDFEmbeddedKey:
+		if len(env.KDFParams) != 32 {
+			return nil, errors.New("embedded key is invalid")
+		}
+		return env.KDFParams, nil
+	case KDFSHA256:
+		if len(key) == 0 {
+			return nil, errors.New("no key was provided")
+		}
+		sha := sha256.Sum256(key)
+		return sha[:], nil
+	case KDFArgon2id, KDFScrypt, KDFPBKDF2SHA256:
+		if len(key) == 0 {
+			return nil, errors.New("no passphrase was provided")
+		}
+		opts, salt, err := unmarshalKDFParams(env.KDF, env.KDFParams)
+		if err != nil {
+			return nil, err
+		}
+		return deriveKey(key, salt, opts)
+	}
+	return nil, fmt.Errorf("unsupported key derivation function: %s", env.KDF)
+}
+
+// sealEnvelope encrypts the plaintext using the given cipher key and stores the result in the envelope.
+//
+// The cipher key must already have been derived according to the envelope's KDF.
+//
+// The following errors are returned by this function:
+// ErrEncryptFailure, ErrGenerateCipherFailure, ErrGenerateGCMFailure, ErrGenerateNonceFailure
+func sealEnvelope(env *CiphertextEnvelope, plaintext, cipherKey []byte) error {
+	if err := env.validate(); err != nil {
+		return &ErrEncryptFailure{Err: err}
+	}
+	if env.Cipher != CipherAES256GCM {
+		return &ErrEncryptFailure{Err: fmt.Errorf("unsupported cipher: %s", env.Cipher)}
+	}
+
+	aesGCM, err := newAESGCM(cipherKey)
+	if err != nil {
+		return err
+	}
+	nonce, err := generateNonce(aesGCM.NonceSize())
+	if err != nil {
+		return err
+	}
+	env.Nonce = nonce
+	env.Ciphertext = aesGCM.Seal(nil, nonce, plaintext, env.header())
+	return nil
+}
+
+// openEnvelope decrypts the data stored in the envelope using the given cipher key.
+//
+// The cipher key must already have been derived according to the envelope's KDF.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure, ErrGenerateCipherFailure, ErrGenerateGCMFailure
+func openEnvelope(env *CiphertextEnvelope, cipherKey []byte) ([]byte, error) {
+	if env.Cipher != CipherAES256GCM {
+		return nil, &ErrDecryptFailure{Err: fmt.Errorf("unsupported cipher: %s", env.Cipher)}
+	}
+
+	aesGCM, err := newAESGCM(cipherKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != aesGCM.NonceSize() {
+		return nil, &ErrDecryptFailure{Err: errors.New("invalid nonce size")}
+	}
+	plaintext, err := aesGCM.Open(nil, env.Nonce, env.Ciphertext, env.header())
+	if err != nil {
+		return nil, &ErrDecryptFailure{Err: err}
+	}
+	return plaintext, nil
+}
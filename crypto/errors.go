@@ -1,6 +1,10 @@
 package crypto
 
-import "fmt"
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
 
 // Object error codes (1251-1500)
 const (
@@ -32,6 +36,24 @@ const (
 	ErrInvalidJWTTokenSignatureAlgorithmCode = 1276
 	ErrInvalidJWTTokenClaimsCode             = 1277
 	ErrParseJWTTokenFailureCode              = 1278
+	ErrDeriveKeyFailureCode                  = 1279
+	ErrKeyRingFailureCode                    = 1280
+	ErrWrapKeyFailureCode                    = 1281
+	ErrUnwrapKeyFailureCode                  = 1282
+	ErrGeneratePasswordFailureCode           = 1283
+	ErrHashPasswordFailureCode               = 1284
+	ErrVerifyPasswordFailureCode             = 1285
+	ErrCheckBreachedPasswordFailureCode      = 1286
+	ErrUnsupportedKeyCode                    = 1287
+	ErrWriteFileFailureCode                  = 1288
+	ErrParsePrivateKeyFailureCode            = 1289
+	ErrParseCertificateRequestFailureCode    = 1290
+	ErrInvalidCertificateRequestCode         = 1291
+	ErrCertificateRevokedCode                = 1292
+	ErrCheckRevocationFailureCode            = 1293
+	ErrRevokePGPKeyFailureCode               = 1294
+	ErrJWTKeyNotFoundCode                    = 1295
+	ErrLoadJWKSetFailureCode                 = 1296
 )
 
 // ErrDecodeFailure occurs when encoded data cannot be decoded.
@@ -451,6 +473,7 @@ func (e *ErrLoadCertificateFailure) Code() int {
 type ErrInvalidCertificate struct {
 	CommonName         string
 	ExpectedCommonName string
+	Reasons            []string
 	Err                error
 }
 
@@ -571,8 +594,7 @@ func (e *ErrInvalidTokenSignatureAlgorithm) Code() int {
 	return ErrInvalidJWTTokenSignatureAlgorithmCode
 }
 
-// ErrInvalidTokenClaims occurs when a token is signed with one algorithm but a different algorithm
-// was expected.
+// ErrInvalidTokenClaims occurs when one or more of the claims in a token are missing or invalid.
 type ErrInvalidTokenClaims struct {
 	Err error
 }
@@ -611,3 +633,385 @@ func (e *ErrParseJWTTokenFailure) Error() string {
 func (e *ErrParseJWTTokenFailure) Code() int {
 	return ErrParseJWTTokenFailureCode
 }
+
+// ErrDeriveKeyFailure occurs when an encryption key cannot be derived from a passphrase.
+type ErrDeriveKeyFailure struct {
+	Algorithm KDFAlgorithm
+	Err       error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrDeriveKeyFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrDeriveKeyFailure) Error() string {
+	return fmt.Sprintf("failed to derive key using %s: %s", e.Algorithm, e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrDeriveKeyFailure) Code() int {
+	return ErrDeriveKeyFailureCode
+}
+
+// ErrKeyRingFailure occurs when a key ring cannot be modified.
+type ErrKeyRingFailure struct {
+	KeyID string
+	Err   error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrKeyRingFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrKeyRingFailure) Error() string {
+	return fmt.Sprintf("failed to update key ring for key '%s': %s", e.KeyID, e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrKeyRingFailure) Code() int {
+	return ErrKeyRingFailureCode
+}
+
+// ErrWrapKeyFailure occurs when a data key cannot be wrapped by a key encryption key.
+type ErrWrapKeyFailure struct {
+	KeyID string
+	Err   error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrWrapKeyFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrWrapKeyFailure) Error() string {
+	return fmt.Sprintf("failed to wrap data key with key encryption key '%s': %s", e.KeyID, e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrWrapKeyFailure) Code() int {
+	return ErrWrapKeyFailureCode
+}
+
+// ErrUnwrapKeyFailure occurs when a wrapped data key cannot be unwrapped by a key encryption key.
+type ErrUnwrapKeyFailure struct {
+	KeyID string
+	Err   error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrUnwrapKeyFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrUnwrapKeyFailure) Error() string {
+	return fmt.Sprintf("failed to unwrap data key with key encryption key '%s': %s", e.KeyID, e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrUnwrapKeyFailure) Code() int {
+	return ErrUnwrapKeyFailureCode
+}
+
+// ErrGeneratePasswordFailure occurs when a password cannot be generated.
+type ErrGeneratePasswordFailure struct {
+	Err error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrGeneratePasswordFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrGeneratePasswordFailure) Error() string {
+	return fmt.Sprintf("failed to generate password: %s", e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrGeneratePasswordFailure) Code() int {
+	return ErrGeneratePasswordFailureCode
+}
+
+// ErrHashPasswordFailure occurs when a password cannot be hashed.
+type ErrHashPasswordFailure struct {
+	Algorithm PasswordHashAlgorithm
+	Err       error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrHashPasswordFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrHashPasswordFailure) Error() string {
+	return fmt.Sprintf("failed to hash password using %s: %s", e.Algorithm, e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrHashPasswordFailure) Code() int {
+	return ErrHashPasswordFailureCode
+}
+
+// ErrVerifyPasswordFailure occurs when a password hash cannot be parsed or checked.
+type ErrVerifyPasswordFailure struct {
+	Err error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrVerifyPasswordFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrVerifyPasswordFailure) Error() string {
+	return fmt.Sprintf("failed to verify password: %s", e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrVerifyPasswordFailure) Code() int {
+	return ErrVerifyPasswordFailureCode
+}
+
+// ErrCheckBreachedPasswordFailure occurs when a password cannot be checked against a breached password list.
+type ErrCheckBreachedPasswordFailure struct {
+	Err error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrCheckBreachedPasswordFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrCheckBreachedPasswordFailure) Error() string {
+	return fmt.Sprintf("failed to check breached password list: %s", e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrCheckBreachedPasswordFailure) Code() int {
+	return ErrCheckBreachedPasswordFailureCode
+}
+
+// ErrUnsupportedKey occurs when a key is of an unsupported type or cannot be used with the requested algorithm.
+type ErrUnsupportedKey struct {
+	Err error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrUnsupportedKey) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrUnsupportedKey) Error() string {
+	return fmt.Sprintf("unsupported key: %s", e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrUnsupportedKey) Code() int {
+	return ErrUnsupportedKeyCode
+}
+
+// ErrWriteFileFailure occurs when a file cannot be written.
+type ErrWriteFileFailure struct {
+	Err  error
+	File string
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrWriteFileFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrWriteFileFailure) Error() string {
+	return fmt.Sprintf("failed to write file '%s': %s", e.File, e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrWriteFileFailure) Code() int {
+	return ErrWriteFileFailureCode
+}
+
+// ErrParsePrivateKeyFailure occurs when a private key cannot be parsed.
+type ErrParsePrivateKeyFailure struct {
+	Format PrivateKeyFormat
+	Err    error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrParsePrivateKeyFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrParsePrivateKeyFailure) Error() string {
+	if e.Format == 0 {
+		return fmt.Sprintf("failed to parse private key: %s", e.Err.Error())
+	}
+	return fmt.Sprintf("failed to parse %s private key: %s", e.Format, e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrParsePrivateKeyFailure) Code() int {
+	return ErrParsePrivateKeyFailureCode
+}
+
+// ErrParseCertificateRequestFailure occurs when a certificate signing request cannot be parsed.
+type ErrParseCertificateRequestFailure struct {
+	Err error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrParseCertificateRequestFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrParseCertificateRequestFailure) Error() string {
+	return fmt.Sprintf("failed to parse certificate request: %s", e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrParseCertificateRequestFailure) Code() int {
+	return ErrParseCertificateRequestFailureCode
+}
+
+// ErrInvalidCertificateRequest occurs when a certificate signing request has an invalid signature or does not
+// satisfy a policy.
+type ErrInvalidCertificateRequest struct {
+	Err error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrInvalidCertificateRequest) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrInvalidCertificateRequest) Error() string {
+	return fmt.Sprintf("invalid certificate request: %s", e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrInvalidCertificateRequest) Code() int {
+	return ErrInvalidCertificateRequestCode
+}
+
+// ErrCertificateRevoked occurs when a certificate has been revoked by its issuer.
+type ErrCertificateRevoked struct {
+	SerialNumber   *big.Int
+	RevocationTime time.Time
+	Err            error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrCertificateRevoked) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrCertificateRevoked) Error() string {
+	return fmt.Sprintf("certificate has been revoked: %s", e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrCertificateRevoked) Code() int {
+	return ErrCertificateRevokedCode
+}
+
+// ErrCheckRevocationFailure occurs when the revocation status of a certificate cannot be determined.
+type ErrCheckRevocationFailure struct {
+	Err error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrCheckRevocationFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrCheckRevocationFailure) Error() string {
+	return fmt.Sprintf("failed to check certificate revocation: %s", e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrCheckRevocationFailure) Code() int {
+	return ErrCheckRevocationFailureCode
+}
+
+// ErrRevokePGPKeyFailure occurs when a PGP key or subkey cannot be revoked.
+type ErrRevokePGPKeyFailure struct {
+	Fingerprint string
+	Err         error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrRevokePGPKeyFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrRevokePGPKeyFailure) Error() string {
+	return fmt.Sprintf("failed to revoke PGP key '%s': %s", e.Fingerprint, e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrRevokePGPKeyFailure) Code() int {
+	return ErrRevokePGPKeyFailureCode
+}
+
+// ErrJWTKeyNotFound occurs when no key matching the key ID and algorithm of a JWT token is found.
+type ErrJWTKeyNotFound struct {
+	KeyID string
+	Alg   string
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrJWTKeyNotFound) InternalError() error {
+	return nil
+}
+
+// Error returns the string version of the error.
+func (e *ErrJWTKeyNotFound) Error() string {
+	if e.KeyID == "" {
+		return fmt.Sprintf("JWT token has no key ID and no single '%s' key was found to verify it", e.Alg)
+	}
+	return fmt.Sprintf("no '%s' key with ID '%s' was found to verify the JWT token", e.Alg, e.KeyID)
+}
+
+// Code returns the corresponding error code.
+func (e *ErrJWTKeyNotFound) Code() int {
+	return ErrJWTKeyNotFoundCode
+}
+
+// ErrLoadJWKSetFailure occurs when a JWK set cannot be loaded or parsed.
+type ErrLoadJWKSetFailure struct {
+	Source string
+	Err    error
+}
+
+// InternalError returns the internal standard error object if there is one or nil if none is set.
+func (e *ErrLoadJWKSetFailure) InternalError() error {
+	return e.Err
+}
+
+// Error returns the string version of the error.
+func (e *ErrLoadJWKSetFailure) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("failed to load JWK set: %s", e.Err.Error())
+	}
+	return fmt.Sprintf("failed to load JWK set from '%s': %s", e.Source, e.Err.Error())
+}
+
+// Code returns the corresponding error code.
+func (e *ErrLoadJWKSetFailure) Code() int {
+	return ErrLoadJWKSetFailureCode
+}
@@ -0,0 +1,520 @@
+package crypto
+
+import (
+	"context"
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+const (
+	// DetachedSignatureExtension is appended to a file's path to form the path of its detached signature.
+	DetachedSignatureExtension = ".sig"
+
+	// SignatureManifestVersion1 is the current version of the signature manifest format.
+	SignatureManifestVersion1 = 1
+
+	// DefaultSignatureManifestName is the default name of a signature manifest file. A manifest with this name at
+	// the top of a directory, and its detached signature, are skipped when a manifest is created or verified.
+	DefaultSignatureManifestName = "MANIFEST.json"
+)
+
+// SignReader hashes the data read from r and signs the digest.
+//
+// The data is processed incrementally so streams of any size can be signed. Ed25519 signers are not supported
+// because Ed25519 cannot sign a pre-computed digest.
+//
+// Use the VerifyReader() function to verify the signature.
+//
+// The following errors are returned by this function:
+// ErrSignDataFailure
+func SignReader(ctx context.Context, r io.Reader, signer Signer) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// validate parameters
+	if r == nil {
+		e := &ErrSignDataFailure{Err: errors.New("no reader was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if signer == nil {
+		e := &ErrSignDataFailure{Err: errors.New("no signer was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if signer.Hash() == 0 {
+		e := &ErrSignDataFailure{Err: fmt.Errorf("%s cannot sign streamed data", signer.Algorithm())}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	// hash the data and sign the digest
+	h := signer.Hash().New()
+	if _, err := io.Copy(h, r); err != nil {
+		e := &ErrSignDataFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return signer.SignDigest(ctx, h.Sum(nil))
+}
+
+// VerifyReader hashes the data read from r and checks it against the signature.
+//
+// The following errors are returned by this function:
+// ErrInvalidSignature
+func VerifyReader(ctx context.Context, r io.Reader, signature []byte, verifier Verifier) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// validate parameters
+	if r == nil {
+		e := &ErrInvalidSignature{Err: errors.New("no reader was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if verifier == nil {
+		e := &ErrInvalidSignature{Err: errors.New("no verifier was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if verifier.Hash() == 0 {
+		e := &ErrInvalidSignature{Err: fmt.Errorf("%s cannot verify streamed data", verifier.Algorithm())}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+
+	// hash the data and verify the digest
+	h := verifier.Hash().New()
+	if _, err := io.Copy(h, r); err != nil {
+		e := &ErrInvalidSignature{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return verifier.VerifyDigest(ctx, h.Sum(nil), signature)
+}
+
+// SignFile signs the contents of the given file without reading the whole file into memory.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrSignDataFailure
+func SignFile(ctx context.Context, file string, signer Signer) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	f, err := os.Open(file)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	defer f.Close()
+	return SignReader(logger.WithContext(ctx), f, signer)
+}
+
+// VerifyFile checks the contents of the given file against the signature.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrInvalidSignature
+func VerifyFile(ctx context.Context, file string, signature []byte, verifier Verifier) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	f, err := os.Open(file)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	defer f.Close()
+	return VerifyReader(logger.WithContext(ctx), f, signature, verifier)
+}
+
+// SignFileDetached signs the given file and writes the signature to a file with the same path plus
+// DetachedSignatureExtension. The path of the signature file is returned.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrSignDataFailure, ErrWriteFileFailure
+func SignFileDetached(ctx context.Context, file string, signer Signer) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	signature, err := SignFile(ctx, file, signer)
+	if err != nil {
+		return "", err
+	}
+	sigFile := file + DetachedSignatureExtension
+	if err := ioutil.WriteFile(sigFile, signature, 0644); err != nil {
+		e := &ErrWriteFileFailure{Err: err, File: sigFile}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	return sigFile, nil
+}
+
+// VerifyFileDetached checks the given file against the detached signature written by SignFileDetached().
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrInvalidSignature
+func VerifyFileDetached(ctx context.Context, file string, verifier Verifier) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	sigFile := file + DetachedSignatureExtension
+	signature, err := ioutil.ReadFile(sigFile)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: sigFile}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return VerifyFile(ctx, file, signature, verifier)
+}
+
+// SignatureManifestEntry describes a single file listed in a signature manifest.
+type SignatureManifestEntry struct {
+	// Path is the path of the file relative to the manifest's directory, using forward slashes.
+	Path string `json:"path"`
+
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+
+	// Digest is the hex-encoded digest of the file's contents.
+	Digest string `json:"digest"`
+}
+
+// SignatureManifest is a signed list of files along with their sizes and digests.
+//
+// A manifest allows a whole directory of files, such as release artifacts, to be verified with a single signature.
+// The manifest is stored as JSON and its signature covers every field except the signature itself.
+type SignatureManifest struct {
+	// Version is the version of the manifest format.
+	Version int `json:"version"`
+
+	// Algorithm is the signature scheme used to sign the manifest.
+	Algorithm string `json:"algorithm"`
+
+	// Hash is the hash function used to compute the file digests, e.g. "SHA-256".
+	Hash string `json:"hash"`
+
+	// Files lists the files covered by the manifest sorted by path.
+	Files []SignatureManifestEntry `json:"files"`
+
+	// Signature is the signature over the rest of the manifest.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// CreateSignatureManifest creates a signed manifest for all of the regular files in the given directory and its
+// subdirectories.
+//
+// Only the DefaultSignatureManifestName file at the top of the directory and its detached signature are skipped, and
+// an error is returned if the directory contains anything other than regular files and subdirectories, such as a
+// symbolic link. File digests are computed with the signer's hash function, or SHA-256 for Ed25519 signers.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrSignDataFailure
+func CreateSignatureManifest(ctx context.Context, dir string, signer Signer) (*SignatureManifest, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("path", dir).Logger()
+
+	if signer == nil {
+		e := &ErrSignDataFailure{Err: errors.New("no signer was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	hash := signer.Hash()
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+
+	files, others, err := listManifestFiles(dir)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: dir}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if len(others) > 0 {
+		file := filepath.Join(dir, filepath.FromSlash(others[0]))
+		e := &ErrReadFileFailure{Err: errors.New("not a regular file"), File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	m := &SignatureManifest{
+		Version:   SignatureManifestVersion1,
+		Algorithm: signer.Algorithm().String(),
+		Hash:      hash.String(),
+		Files:     []SignatureManifestEntry{},
+	}
+	for _, name := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		size, digest, err := digestFile(file, hash)
+		if err != nil {
+			e := &ErrReadFileFailure{Err: err, File: file}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		m.Files = append(m.Files, SignatureManifestEntry{Path: name, Size: size, Digest: digest})
+	}
+
+	// sign the manifest
+	payload, err := m.signedPayload()
+	if err != nil {
+		e := &ErrSignDataFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if m.Signature, err = signer.Sign(ctx, payload); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadSignatureManifest reads a signature manifest from the given JSON file.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrDecodeFailure
+func LoadSignatureManifest(ctx context.Context, file string) (*SignatureManifest, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	m := &SignatureManifest{}
+	if err := json.Unmarshal(contents, m); err != nil {
+		e := &ErrDecodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return m, nil
+}
+
+// WriteFile writes the manifest to the given file as indented JSON.
+//
+// The following errors are returned by this function:
+// ErrEncodeFailure, ErrWriteFileFailure
+func (m *SignatureManifest) WriteFile(ctx context.Context, file string) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	contents, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		e := &ErrEncodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if err := ioutil.WriteFile(file, append(contents, '\n'), 0644); err != nil {
+		e := &ErrWriteFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return nil
+}
+
+// Verify checks the manifest's signature and then checks that the files in the given directory exactly match the
+// files listed in the manifest.
+//
+// Every problem found is reported, including files that are missing, changed or not listed in the manifest. Only the
+// DefaultSignatureManifestName file at the top of the directory and its detached signature are ignored, and entries
+// that are not regular files, such as symbolic links, never match the manifest.
+//
+// The following errors are returned by this function:
+// ErrInvalidSignature
+func (m *SignatureManifest) Verify(ctx context.Context, dir string, verifier Verifier) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("path", dir).Logger()
+
+	// validate the manifest itself
+	if verifier == nil {
+		e := &ErrInvalidSignature{Err: errors.New("no verifier was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if m.Version != SignatureManifestVersion1 {
+		e := &ErrInvalidSignature{Err: fmt.Errorf("unsupported manifest version: %d", m.Version)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if m.Algorithm != verifier.Algorithm().String() {
+		e := &ErrInvalidSignature{Err: fmt.Errorf("manifest was signed using %s but verifier uses %s", m.Algorithm,
+			verifier.Algorithm())}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	payload, err := m.signedPayload()
+	if err != nil {
+		e := &ErrInvalidSignature{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if err := verifier.Verify(ctx, payload, m.Signature); err != nil {
+		return err
+	}
+	var hash crypto.Hash
+	for _, h := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		if m.Hash == h.String() {
+			hash = h
+		}
+	}
+	if hash == 0 {
+		e := &ErrInvalidSignature{Err: fmt.Errorf("unsupported manifest hash: %s", m.Hash)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+
+	// check the files
+	files, others, err := listManifestFiles(dir)
+	if err != nil {
+		e := &ErrInvalidSignature{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	present := map[string]bool{}
+	for _, name := range files {
+		present[name] = true
+	}
+	for _, name := range others {
+		present[name] = false
+	}
+	problems := []string{}
+	for _, entry := range m.Files {
+		clean := path.Clean(entry.Path)
+		if clean != entry.Path || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			problems = append(problems, fmt.Sprintf("%s: invalid path", entry.Path))
+			continue
+		}
+		regular, ok := present[entry.Path]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing", entry.Path))
+			continue
+		}
+		delete(present, entry.Path)
+		if !regular {
+			problems = append(problems, fmt.Sprintf("%s: not a regular file", entry.Path))
+			continue
+		}
+		size, digest, err := digestFile(filepath.Join(dir, filepath.FromSlash(entry.Path)), hash)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", entry.Path, err.Error()))
+		} else if size != entry.Size {
+			problems = append(problems, fmt.Sprintf("%s: size is %d bytes, expected %d", entry.Path, size,
+				entry.Size))
+		} else if digest != strings.ToLower(entry.Digest) {
+			problems = append(problems, fmt.Sprintf("%s: digest does not match", entry.Path))
+		}
+	}
+	extra := []string{}
+	for name := range present {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		problems = append(problems, fmt.Sprintf("%s: not listed in manifest", name))
+	}
+	if len(problems) > 0 {
+		e := &ErrInvalidSignature{Err: fmt.Errorf("manifest does not match files: %s", strings.Join(problems, "; "))}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return nil
+}
+
+// signedPayload returns the bytes covered by the manifest's signature, which is the JSON encoding of the manifest
+// without its signature.
+func (m *SignatureManifest) signedPayload() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// listManifestFiles returns the sorted, slash-separated relative paths of the regular files in the directory and,
+// separately, of any other entries that are not directories, such as symbolic links. Only the manifest at the top of
+// the directory and its detached signature are skipped.
+func listManifestFiles(dir string) ([]string, []string, error) {
+	files := []string{}
+	others := []string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == DefaultSignatureManifestName || rel == DefaultSignatureManifestName+DetachedSignatureExtension {
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, rel)
+		} else {
+			others = append(others, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(files)
+	sort.Strings(others)
+	return files, others, nil
+}
+
+// digestFile returns the size and hex-encoded digest of the file's contents.
+func digestFile(file string, hash crypto.Hash) (int64, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := hash.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,224 @@
+package crypto_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func newTestRSASigner(t *testing.T) (crypto.Signer, crypto.Verifier) {
+	ctx := context.TODO()
+	block, _ := pem.Decode([]byte(SigningKey))
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("error: failed to parse private key: %s", err.Error())
+	}
+	signer, err := crypto.NewSigner(ctx, key, nil)
+	if err != nil {
+		t.Fatalf("error while creating signer: %s", err.Error())
+	}
+	verifier, err := crypto.NewVerifier(ctx, signer.Public(), nil)
+	if err != nil {
+		t.Fatalf("error while creating verifier: %s", err.Error())
+	}
+	return signer, verifier
+}
+
+func TestSignVerifyReader(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+	signer, verifier := newTestRSASigner(t)
+
+	data := bytes.Repeat([]byte(TestContents), 10000)
+	signature, err := crypto.SignReader(ctx, bytes.NewReader(data), signer)
+	if err != nil {
+		t.Fatalf("error while signing stream: %s", err.Error())
+	}
+	if err := verifier.Verify(ctx, data, signature); err != nil {
+		t.Errorf("error: stream signature does not match content signature: %s", err.Error())
+	}
+	if err := crypto.VerifyReader(ctx, bytes.NewReader(data), signature, verifier); err != nil {
+		t.Errorf("error while verifying stream: %s", err.Error())
+	}
+	data[0] ^= 0xFF
+	if err := crypto.VerifyReader(ctx, bytes.NewReader(data), signature, verifier); err == nil {
+		t.Errorf("error: got nil, expected error")
+	} else if _, ok := err.(*crypto.ErrInvalidSignature); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrInvalidSignature", err)
+	}
+}
+
+func TestSignFileDetached(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+	signer, verifier := newTestRSASigner(t)
+
+	dir, err := ioutil.TempDir("", "filesig")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "release.tar.gz")
+	if err := ioutil.WriteFile(file, []byte(TestContents), 0600); err != nil {
+		t.Fatalf("error while writing file: %s", err.Error())
+	}
+
+	sigFile, err := crypto.SignFileDetached(ctx, file, signer)
+	if err != nil {
+		t.Fatalf("error while signing file: %s", err.Error())
+	}
+	if sigFile != file+crypto.DetachedSignatureExtension {
+		t.Errorf("want: %s, got: %s", file+crypto.DetachedSignatureExtension, sigFile)
+	}
+	if err := crypto.VerifyFileDetached(ctx, file, verifier); err != nil {
+		t.Errorf("error while verifying file: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(file, []byte(TestContents+"!"), 0600); err != nil {
+		t.Fatalf("error while writing file: %s", err.Error())
+	}
+	if err := crypto.VerifyFileDetached(ctx, file, verifier); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func TestSignatureManifest(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := crypto.NewSigner(ctx, key, nil)
+	verifier, _ := crypto.NewVerifier(ctx, signer.Public(), nil)
+
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0700); err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	files := map[string]string{"README.md": "readme", "bin/app": "binary", "bin/app.sha256": "checksum"}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatalf("error while writing file: %s", err.Error())
+		}
+	}
+
+	// create, write and reload the manifest
+	m, err := crypto.CreateSignatureManifest(ctx, dir, signer)
+	if err != nil {
+		t.Fatalf("error while creating manifest: %s", err.Error())
+	}
+	if len(m.Files) != 3 || m.Files[0].Path != "README.md" || m.Files[1].Path != "bin/app" {
+		t.Fatalf("unexpected manifest entries: %+v", m.Files)
+	}
+	manifestFile := filepath.Join(dir, crypto.DefaultSignatureManifestName)
+	if err := m.WriteFile(ctx, manifestFile); err != nil {
+		t.Fatalf("error while writing manifest: %s", err.Error())
+	}
+	loaded, err := crypto.LoadSignatureManifest(ctx, manifestFile)
+	if err != nil {
+		t.Fatalf("error while loading manifest: %s", err.Error())
+	}
+	if err := loaded.Verify(ctx, dir, verifier); err != nil {
+		t.Fatalf("error while verifying manifest: %s", err.Error())
+	}
+
+	// every problem is reported
+	if err := ioutil.WriteFile(filepath.Join(dir, "bin/app"), []byte("tampered"), 0600); err != nil {
+		t.Fatalf("error while writing file: %s", err.Error())
+	}
+	if err := os.Remove(filepath.Join(dir, "README.md")); err != nil {
+		t.Fatalf("error while removing file: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "extra"), []byte("extra"), 0600); err != nil {
+		t.Fatalf("error while writing file: %s", err.Error())
+	}
+	err = loaded.Verify(ctx, dir, verifier)
+	if err == nil {
+		t.Fatalf("error: got nil, expected error")
+	}
+	for _, want := range []string{"README.md: missing", "bin/app: size", "extra: not listed"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err.Error(), want)
+		}
+	}
+
+	// tampering with the manifest invalidates its signature
+	loaded.Files[0].Digest = strings.Repeat("0", 64)
+	if err := loaded.Verify(ctx, dir, verifier); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func TestSignatureManifestSkippedFiles(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := crypto.NewSigner(ctx, key, nil)
+	verifier, _ := crypto.NewVerifier(ctx, signer.Public(), nil)
+
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	files := map[string]string{
+		"app": "binary", "app.sig": "signature", "sub/" + crypto.DefaultSignatureManifestName: "{}",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatalf("error while writing file: %s", err.Error())
+		}
+	}
+
+	// only the top-level manifest and its signature are skipped
+	m, err := crypto.CreateSignatureManifest(ctx, dir, signer)
+	if err != nil {
+		t.Fatalf("error while creating manifest: %s", err.Error())
+	}
+	if len(m.Files) != 3 || m.Files[1].Path != "app.sig" || m.Files[2].Path != "sub/MANIFEST.json" {
+		t.Fatalf("unexpected manifest entries: %+v", m.Files)
+	}
+	manifestFile := filepath.Join(dir, crypto.DefaultSignatureManifestName)
+	if err := m.WriteFile(ctx, manifestFile); err != nil {
+		t.Fatalf("error while writing manifest: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(manifestFile+crypto.DetachedSignatureExtension, []byte("sig"), 0600); err != nil {
+		t.Fatalf("error while writing file: %s", err.Error())
+	}
+	if err := m.Verify(ctx, dir, verifier); err != nil {
+		t.Fatalf("error while verifying manifest: %s", err.Error())
+	}
+
+	// symbolic links are reported rather than ignored
+	if err := os.Symlink(filepath.Join(dir, "app"), filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("error while creating link: %s", err.Error())
+	}
+	err = m.Verify(ctx, dir, verifier)
+	if err == nil {
+		t.Fatalf("error: got nil, expected error")
+	}
+	if !strings.Contains(err.Error(), "link: not listed") {
+		t.Errorf("error %q does not mention %q", err.Error(), "link: not listed")
+	}
+	_, err = crypto.CreateSignatureManifest(ctx, dir, signer)
+	if _, ok := err.(*crypto.ErrReadFileFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrReadFileFailure", err)
+	}
+}
@@ -0,0 +1,475 @@
+package crypto
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+const (
+	// JWKSPath is the well-known path at which a JWK set is usually published.
+	JWKSPath = "/.well-known/jwks.json"
+
+	// DefaultJWKSRefreshInterval is the default interval at which a JWK set is reloaded from its source.
+	DefaultJWKSRefreshInterval = time.Hour
+
+	// DefaultJWKSMinRefreshInterval is the default minimum time between reloads of a JWK set triggered by tokens
+	// signed with unknown keys.
+	DefaultJWKSMinRefreshInterval = time.Minute
+
+	// DefaultJWKSHTTPTimeout is the default timeout for fetching a JWK set.
+	DefaultJWKSHTTPTimeout = 10 * time.Second
+
+	// maxJWKSResponseSize is the maximum size of a JWK set fetched over HTTP.
+	maxJWKSResponseSize = 1024 * 1024
+)
+
+// JWKSetOptions holds the options used to load a JWK set.
+type JWKSetOptions struct {
+	// URL is the URL from which the JWK set is fetched, such as "https://example.com/.well-known/jwks.json".
+	URL string
+
+	// File is the path to the file from which the JWK set is loaded. It is ignored if URL is set.
+	File string
+
+	// HTTPClient is the client used to fetch the JWK set. If nil, a client with a timeout of DefaultJWKSHTTPTimeout
+	// is used.
+	HTTPClient *http.Client
+
+	// RefreshInterval is how often the JWK set is reloaded after Start() is called. If not set,
+	// DefaultJWKSRefreshInterval is used.
+	RefreshInterval time.Duration
+
+	// MinRefreshInterval is the minimum time between reloads triggered by tokens signed with unknown keys. If not
+	// set, DefaultJWKSMinRefreshInterval is used.
+	MinRefreshInterval time.Duration
+}
+
+// JWKSet holds a set of public keys used to verify JWT tokens, as described by RFC 7517.
+//
+// A JWKSet can publish its keys by serving them as JSON, or hold the keys loaded from a remote service or file.
+// Loaded keys are cached and reloaded periodically once Start() is called, as well as when a token is signed with a
+// key which is not in the set. Use it as the KeySet of a JWTAuthKeyService to verify tokens.
+//
+// Only RSA, ECDSA and Ed25519 signature keys are supported. Other keys are ignored when the set is loaded.
+//
+// A JWKSet is safe for concurrent use.
+type JWKSet struct {
+	// options holds the options used to load the set.
+	options JWKSetOptions
+
+	// keys holds the public keys in the set.
+	keys []JWTKey
+
+	// mutex protects keys.
+	mutex sync.RWMutex
+
+	// refreshed is when the set was last loaded from its source.
+	refreshed time.Time
+
+	// refreshMutex serializes reloads and protects refreshed.
+	refreshMutex sync.Mutex
+
+	// stop is closed to stop reloading the set.
+	stop chan struct{}
+
+	// stopOnce ensures stop is only closed once.
+	stopOnce sync.Once
+}
+
+// jwk is the JSON representation of a single key in a JWK set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwkSet is the JSON representation of a JWK set.
+type jwkSet struct {
+	Keys []json.RawMessage `json:"keys"`
+}
+
+// NewJWKSet creates a new JWK set holding the public part of the given keys, such as the signing keys of a
+// JWTAuthKeyService, so that they can be published.
+//
+// The following errors are returned by this function:
+// ErrUnsupportedKey
+func NewJWKSet(ctx context.Context, keys []JWTKey) (*JWKSet, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	s := &JWKSet{stop: make(chan struct{})}
+	for _, key := range keys {
+		pub, err := jwtVerificationKey(&key)
+		if err == nil {
+			if _, ok := pub.([]byte); ok {
+				err = fmt.Errorf("%s secrets cannot be published in a JWK set", key.Algorithm)
+			}
+		}
+		if err != nil {
+			e := &ErrUnsupportedKey{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		s.keys = append(s.keys, JWTKey{ID: key.ID, Algorithm: key.Algorithm, Key: pub})
+	}
+	return s, nil
+}
+
+// ParseJWKSet parses a JSON-encoded JWK set.
+//
+// Keys which are not used for signatures or are of an unsupported type are ignored. If a key does not specify its
+// algorithm, RS256 is assumed for RSA keys and the algorithm matching the curve is used for other keys.
+//
+// The following errors are returned by this function:
+// ErrLoadJWKSetFailure
+func ParseJWKSet(ctx context.Context, contents []byte) (*JWKSet, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	keys, err := parseJWKs(logger, contents)
+	if err != nil {
+		e := &ErrLoadJWKSetFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return &JWKSet{keys: keys, stop: make(chan struct{})}, nil
+}
+
+// LoadJWKSet loads a JWK set from a URL or file.
+//
+// See ParseJWKSet() for details on how the keys are parsed. Call Start() to reload the set periodically.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrLoadJWKSetFailure
+func LoadJWKSet(ctx context.Context, opts *JWKSetOptions) (*JWKSet, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if opts == nil || (opts.URL == "" && opts.File == "") {
+		e := &ErrLoadJWKSetFailure{Err: errors.New("a URL or file is required")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	s := &JWKSet{
+		options: *opts,
+		stop:    make(chan struct{}),
+	}
+	if s.options.HTTPClient == nil {
+		s.options.HTTPClient = &http.Client{Timeout: DefaultJWKSHTTPTimeout}
+	}
+	if s.options.RefreshInterval <= 0 {
+		s.options.RefreshInterval = DefaultJWKSRefreshInterval
+	}
+	if s.options.MinRefreshInterval <= 0 {
+		s.options.MinRefreshInterval = DefaultJWKSMinRefreshInterval
+	}
+	if err := s.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Keys returns the keys in the set.
+func (s *JWKSet) Keys() []JWTKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return append([]JWTKey{}, s.keys...)
+}
+
+// Refresh reloads the set from its source. If the set could not be loaded, the current keys are kept. Sets which
+// were not loaded using LoadJWKSet() are not changed.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrLoadJWKSetFailure
+func (s *JWKSet) Refresh(ctx context.Context) error {
+	s.refreshMutex.Lock()
+	defer s.refreshMutex.Unlock()
+
+	return s.refresh(ctx)
+}
+
+// Start reloads the set from its source in a background goroutine until the context is cancelled or Stop() is
+// called.
+//
+// Errors are logged using the logger attached to the context.
+func (s *JWKSet) Start(ctx context.Context) {
+	if s.options.URL == "" && s.options.File == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.options.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				_ = s.Refresh(ctx)
+			}
+		}
+	}()
+}
+
+// Stop stops reloading the set.
+func (s *JWKSet) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// MarshalJSON returns the JSON encoding of the set.
+func (s *JWKSet) MarshalJSON() ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := []jwk{}
+	for _, key := range s.keys {
+		k := jwk{Use: "sig", Kid: key.ID, Alg: key.Algorithm}
+		switch pub := key.Key.(type) {
+		case *rsa.PublicKey:
+			k.Kty = "RSA"
+			k.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			k.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			k.Kty = "EC"
+			k.Crv = pub.Curve.Params().Name
+			k.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+			k.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			k.Kty = "OKP"
+			k.Crv = "Ed25519"
+			k.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			return nil, fmt.Errorf("%T cannot be published in a JWK set", key.Key)
+		}
+		keys = append(keys, k)
+	}
+	return json.Marshal(map[string]interface{}{"keys": keys})
+}
+
+// ServeHTTP serves the set as JSON so that it can be published, usually at JWKSPath.
+func (s *JWKSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	contents, err := s.MarshalJSON()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(contents)
+	}
+}
+
+// refreshForUnknownKey reloads the set from its source unless it was loaded less than MinRefreshInterval ago and
+// returns whether the keys were reloaded.
+func (s *JWKSet) refreshForUnknownKey(ctx context.Context) bool {
+	if s.options.URL == "" && s.options.File == "" {
+		return false
+	}
+	s.refreshMutex.Lock()
+	defer s.refreshMutex.Unlock()
+
+	if time.Since(s.refreshed) < s.options.MinRefreshInterval {
+		return false
+	}
+	return s.refresh(ctx) == nil
+}
+
+// refresh reloads the set from its source. The caller must hold refreshMutex.
+func (s *JWKSet) refresh(ctx context.Context) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	source := s.options.URL
+	if source == "" {
+		source = s.options.File
+	}
+	if source == "" {
+		return nil
+	}
+	logger = logger.With().Str("source", source).Logger()
+	s.refreshed = time.Now()
+
+	var contents []byte
+	var err error
+	if s.options.URL != "" {
+		contents, err = s.fetch(ctx)
+	} else {
+		if contents, err = ioutil.ReadFile(s.options.File); err != nil {
+			e := &ErrReadFileFailure{Err: err, File: s.options.File}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return e
+		}
+	}
+	var keys []JWTKey
+	if err == nil {
+		keys, err = parseJWKs(logger, contents)
+	}
+	if err != nil {
+		e := &ErrLoadJWKSetFailure{Source: source, Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+
+	s.mutex.Lock()
+	s.keys = keys
+	s.mutex.Unlock()
+	logger.Debug().Int("keys", len(keys)).Msg("loaded JWK set")
+	return nil
+}
+
+// fetch downloads the set from its URL.
+func (s *JWKSet) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.options.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.options.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxJWKSResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) > maxJWKSResponseSize {
+		return nil, errors.New("response is too large")
+	}
+	return contents, nil
+}
+
+// parseJWKs parses the supported keys in a JSON-encoded JWK set.
+func parseJWKs(logger zerolog.Logger, contents []byte) ([]JWTKey, error) {
+	var set jwkSet
+	if err := json.Unmarshal(contents, &set); err != nil {
+		return nil, err
+	}
+	if set.Keys == nil {
+		return nil, errors.New("data does not hold a 'keys' array")
+	}
+
+	keys := []JWTKey{}
+	for _, raw := range set.Keys {
+		var k jwk
+		if err := json.Unmarshal(raw, &k); err != nil {
+			return nil, err
+		}
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(&k)
+		if err == nil {
+			_, err = jwtVerificationKey(key)
+		}
+		if err != nil {
+			logger.Warn().Err(err).Str("kid", k.Kid).Msg("ignoring unsupported key in JWK set")
+			continue
+		}
+		keys = append(keys, *key)
+	}
+	return keys, nil
+}
+
+// parseJWK returns the public key described by a JWK.
+func parseJWK(k *jwk) (*JWTKey, error) {
+	key := &JWTKey{ID: k.Kid, Algorithm: k.Alg}
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %s", err.Error())
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		key.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.Algorithm == "" {
+			key.Algorithm = "RS256"
+		}
+	case "EC":
+		curves := map[string]struct {
+			curve elliptic.Curve
+			alg   string
+		}{
+			"P-256": {elliptic.P256(), "ES256"},
+			"P-384": {elliptic.P384(), "ES384"},
+			"P-521": {elliptic.P521(), "ES512"},
+		}
+		c, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid EC point")
+		}
+		pub := &ecdsa.PublicKey{Curve: c.curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		key.Key = pub
+		if key.Algorithm == "" {
+			key.Algorithm = c.alg
+		}
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		key.Key = ed25519.PublicKey(x)
+		if key.Algorithm == "" {
+			key.Algorithm = "EdDSA"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+	}
+	return key, nil
+}
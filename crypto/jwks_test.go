@@ -0,0 +1,258 @@
+package crypto_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+// jwksServer serves a JWK set which can be replaced and counts the requests for it.
+type jwksServer struct {
+	set      *crypto.JWKSet
+	mutex    sync.Mutex
+	requests int32
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&s.requests, 1)
+	s.mutex.Lock()
+	set := s.set
+	s.mutex.Unlock()
+	if set == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	set.ServeHTTP(w, r)
+}
+
+func (s *jwksServer) setKeys(t *testing.T, keys ...crypto.JWTKey) {
+	set, err := crypto.NewJWKSet(context.TODO(), keys)
+	if err != nil {
+		t.Fatalf("error while creating JWK set: %s", err.Error())
+	}
+	s.mutex.Lock()
+	s.set = set
+	s.mutex.Unlock()
+}
+
+func TestJWKSetPublishAndLoad(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keys := []crypto.JWTKey{
+		{ID: "rsa", Algorithm: "PS256", Key: rsaKey},
+		{ID: "ec", Algorithm: "ES384", Key: ecKey},
+		{ID: "ed", Algorithm: "EdDSA", Key: edKey},
+	}
+
+	// publish the keys
+	issuer := &jwksServer{}
+	issuer.setKeys(t, keys...)
+	mux := http.NewServeMux()
+	mux.Handle(crypto.JWKSPath, issuer)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + crypto.JWKSPath)
+	if err != nil {
+		t.Fatalf("error while fetching JWK set: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("want: application/json, got: %s", ct)
+	}
+	var published struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &published); err != nil {
+		t.Fatalf("error while parsing JWK set: %s", err.Error())
+	}
+	if len(published.Keys) != 3 {
+		t.Fatalf("want: 3 keys, got: %d", len(published.Keys))
+	}
+	for _, k := range published.Keys {
+		if _, ok := k["d"]; ok {
+			t.Errorf("error: private key was published for '%s'", k["kid"])
+		}
+	}
+
+	// verify tokens signed with each key using the loaded set
+	set, err := crypto.LoadJWKSet(ctx, &crypto.JWKSetOptions{URL: server.URL + crypto.JWKSPath})
+	if err != nil {
+		t.Fatalf("error while loading JWK set: %s", err.Error())
+	}
+	if len(set.Keys()) != 3 {
+		t.Fatalf("want: 3 keys, got: %d", len(set.Keys()))
+	}
+	verifier, err := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{KeySet: set})
+	if err != nil {
+		t.Fatalf("error while creating verifier: %s", err.Error())
+	}
+	for _, key := range keys {
+		k := key
+		signer, _ := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{SigningKey: &k})
+		token, _ := signer.GenerateToken(ctx, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})
+		if _, err := verifier.VerifyToken(ctx, token); err != nil {
+			t.Errorf("error while verifying %s token: %s", key.Algorithm, err.Error())
+		}
+	}
+
+	// secrets cannot be published
+	_, err = crypto.NewJWKSet(ctx, []crypto.JWTKey{{Algorithm: "HS256", Key: make([]byte, 32)}})
+	if _, ok := err.(*crypto.ErrUnsupportedKey); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrUnsupportedKey", err)
+	}
+}
+
+func TestJWKSetRefresh(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+	exp := time.Now().Add(time.Hour).Unix()
+
+	key1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer1, _ := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{
+		SigningKey: &crypto.JWTKey{ID: "key-1", Algorithm: "ES256", Key: key1},
+	})
+	signer2, _ := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{
+		SigningKey: &crypto.JWTKey{ID: "key-2", Algorithm: "ES256", Key: key2},
+	})
+	token1, _ := signer1.GenerateToken(ctx, jwt.MapClaims{"exp": exp})
+	token2, _ := signer2.GenerateToken(ctx, jwt.MapClaims{"exp": exp})
+
+	issuer := &jwksServer{}
+	issuer.setKeys(t, crypto.JWTKey{ID: "key-1", Algorithm: "ES256", Key: key1})
+	server := httptest.NewServer(issuer)
+	defer server.Close()
+
+	// the set is only reloaded for unknown keys once the minimum interval has passed
+	set, err := crypto.LoadJWKSet(ctx, &crypto.JWKSetOptions{URL: server.URL, MinRefreshInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("error while loading JWK set: %s", err.Error())
+	}
+	verifier, _ := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{KeySet: set})
+	if _, err := verifier.VerifyToken(ctx, token1); err != nil {
+		t.Errorf("error while verifying token: %s", err.Error())
+	}
+	issuer.setKeys(t, crypto.JWTKey{ID: "key-1", Algorithm: "ES256", Key: key1},
+		crypto.JWTKey{ID: "key-2", Algorithm: "ES256", Key: key2})
+	_, err = verifier.VerifyToken(ctx, token2)
+	if _, ok := err.(*crypto.ErrJWTKeyNotFound); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrJWTKeyNotFound", err)
+	}
+	if n := atomic.LoadInt32(&issuer.requests); n != 1 {
+		t.Errorf("want: 1 request, got: %d", n)
+	}
+
+	// a token signed with a new key triggers a reload
+	set, _ = crypto.LoadJWKSet(ctx, &crypto.JWKSetOptions{URL: server.URL, MinRefreshInterval: time.Nanosecond})
+	issuer.setKeys(t, crypto.JWTKey{ID: "key-1", Algorithm: "ES256", Key: key1})
+	verifier, _ = crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{KeySet: set})
+	issuer.setKeys(t, crypto.JWTKey{ID: "key-2", Algorithm: "ES256", Key: key2})
+	if _, err := verifier.VerifyToken(ctx, token2); err != nil {
+		t.Errorf("error while verifying token: %s", err.Error())
+	}
+
+	// failed reloads keep the current keys
+	issuer.mutex.Lock()
+	issuer.set = nil
+	issuer.mutex.Unlock()
+	err = set.Refresh(ctx)
+	if _, ok := err.(*crypto.ErrLoadJWKSetFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrLoadJWKSetFailure", err)
+	}
+	if _, err := verifier.VerifyToken(ctx, token2); err != nil {
+		t.Errorf("error while verifying token: %s", err.Error())
+	}
+
+	// the set is reloaded in the background
+	issuer.setKeys(t, crypto.JWTKey{ID: "key-1", Algorithm: "ES256", Key: key1})
+	set, _ = crypto.LoadJWKSet(ctx, &crypto.JWKSetOptions{URL: server.URL, RefreshInterval: 10 * time.Millisecond})
+	issuer.setKeys(t, crypto.JWTKey{ID: "key-2", Algorithm: "ES256", Key: key2})
+	set.Start(ctx)
+	defer set.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for set.Keys()[0].ID != "key-2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("error: JWK set was not reloaded in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJWKSetFile(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatalf("error while creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// unsupported keys and keys which are not used for signatures are ignored
+	contents := `{"keys": [
+		{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "EC", "kid": "bad", "crv": "P-256", "x": "AQAB", "y": "AQAB"},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	]}`
+	file := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatalf("error while writing file: %s", err.Error())
+	}
+	set, err := crypto.LoadJWKSet(ctx, &crypto.JWKSetOptions{File: file})
+	if err != nil {
+		t.Fatalf("error while loading JWK set: %s", err.Error())
+	}
+	keys := set.Keys()
+	if len(keys) != 1 || keys[0].ID != "ed" || keys[0].Algorithm != "EdDSA" {
+		t.Errorf("want: 1 EdDSA key, got: %+v", keys)
+	}
+
+	// the set survives a round trip
+	published, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("error while marshalling JWK set: %s", err.Error())
+	}
+	if !strings.Contains(string(published), "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo") {
+		t.Errorf("error: published set does not contain the key: %s", published)
+	}
+	if parsed, err := crypto.ParseJWKSet(ctx, published); err != nil || len(parsed.Keys()) != 1 {
+		t.Errorf("error while parsing published JWK set: %v", err)
+	}
+
+	// failures
+	_, err = crypto.LoadJWKSet(ctx, &crypto.JWKSetOptions{File: filepath.Join(dir, "missing.json")})
+	if _, ok := err.(*crypto.ErrReadFileFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrReadFileFailure", err)
+	}
+	if _, err := crypto.ParseJWKSet(ctx, []byte(`{"foo": []}`)); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+	if _, err := crypto.LoadJWKSet(ctx, nil); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
@@ -3,113 +3,180 @@ package crypto
 import (
 	"context"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"go.sophtrust.dev/pkg/zerolog/v2"
 	"go.sophtrust.dev/pkg/zerolog/v2/log"
 )
 
+// maxJWTNumericDate is the largest NumericDate accepted in a token, which is 9999-12-31T23:59:59Z.
+const maxJWTNumericDate = 253402300799
+
+// JWTAlgorithms holds the names of the JWT signing algorithms supported by JWTAuthKeyService.
+var JWTAlgorithms = []string{
+	"HS256", "HS384", "HS512",
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
 // JWTAuthService represents any object that is able to generate new JWT tokens and also validate them.
 type JWTAuthService interface {
 	// GenerateToken should generate a new JWT token with the given claims and return the encoded JWT token.
-	GenerateToken(jwt.Claims, context.Context) (string, error)
+	GenerateToken(context.Context, jwt.Claims) (string, error)
 
 	// VerifyToken should parse and verify the token string and return the resulting JWT token for further validation.
-	VerifyToken(string, context.Context) (*jwt.Token, error)
+	VerifyToken(context.Context, string) (*jwt.Token, error)
 }
 
-// JWTAuthHMACService creates and validates JWT tokens that are signed with an HMAC256-hashed secret.
-//
-// You must use the same validate the JWT token as was used to generate it. Otherwise, validation will fail.
-type JWTAuthHMACService struct {
-	secret []byte
+// JWTKey is a key used to sign or verify JWT tokens.
+type JWTKey struct {
+	// ID is the key ID. It is stored in the "kid" header of tokens signed with the key and used to find the key when
+	// verifying tokens.
+	ID string
+
+	// Algorithm is the name of the signing algorithm used with the key, such as "ES256". See JWTAlgorithms.
+	Algorithm string
+
+	// Key is the key itself. The following types are supported:
+	//
+	//  ◽ HS256, HS384, HS512: []byte holding a secret at least as long as the hash
+	//  ◽ RS256, RS384, RS512, PS256, PS384, PS512: *rsa.PrivateKey or *rsa.PublicKey
+	//  ◽ ES256, ES384, ES512: *ecdsa.PrivateKey or *ecdsa.PublicKey on the P-256, P-384 or P-521 curve respectively
+	//  ◽ EdDSA: ed25519.PrivateKey or ed25519.PublicKey
+	//
+	// Verification keys may be either private or public keys.
+	Key interface{}
 }
 
-// NewJWTAuthHMACService creates an initializes a new service object.
-func NewJWTAuthHMACService(secret []byte) *JWTAuthHMACService {
-	return &JWTAuthHMACService{secret: secret}
+// JWTAuthServiceOptions holds the options used to create a JWTAuthKeyService.
+type JWTAuthServiceOptions struct {
+	// SigningKey is the private key or secret used to generate tokens. It is also used to verify tokens. If it is
+	// nil, the service can only verify tokens.
+	SigningKey *JWTKey
+
+	// VerificationKeys holds additional keys used to verify tokens, such as the previous signing key while keys are
+	// being rotated or the public keys of other token issuers.
+	VerificationKeys []JWTKey
+
+	// KeySet holds additional keys used to verify tokens, such as the keys published by a token issuer. If a token
+	// is signed with a key which is not found, the set is reloaded from its source before the token is rejected.
+	KeySet *JWKSet
+
+	// Issuer is the issuer which tokens must hold in their "iss" claim. If not set, the claim is not checked.
+	Issuer string
+
+	// Audience holds the audiences of which tokens must hold at least one in their "aud" claim. If not set, the claim
+	// is not checked.
+	Audience []string
+
+	// RequireNotBefore indicates whether tokens must hold an "nbf" claim. The claim is always checked if it is
+	// present.
+	RequireNotBefore bool
+
+	// Leeway is the amount of clock skew allowed when checking the "exp", "nbf" and "iat" claims.
+	Leeway time.Duration
+
+	// Now returns the current time. If not set, time.Now() is used.
+	Now func() time.Time
 }
 
-// GenerateToken generates a new JWT token with the given claims.
+// JWTAuthKeyService creates and validates JWT tokens signed with any of the algorithms in JWTAlgorithms.
 //
-// The following errors are returned by this function:
-// ErrSignJWTTokenFailure
-func (j *JWTAuthHMACService) GenerateToken(ctx context.Context, claims jwt.Claims) (string, error) {
-	logger := log.Logger
-	if l := zerolog.Ctx(ctx); l != nil {
-		logger = *l
-	}
+// Tokens are verified using the key, from the verification keys or the key set, whose ID matches the "kid" header
+// of the token. If the token has no "kid" header, it is verified using the only key for its algorithm. Tokens must
+// hold an "exp" claim, and the "exp", "nbf" and "iat" claims are checked allowing for the configured leeway.
+//
+// A JWTAuthKeyService is safe for concurrent use.
+type JWTAuthKeyService struct {
+	// options holds the service options.
+	options JWTAuthServiceOptions
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString(j.secret)
-	if err != nil {
-		e := &ErrSignJWTTokenFailure{Err: err}
-		logger.Error().Err(e.Err).Msg(e.Error())
-		return "", e
-	}
-	return signedToken, nil
+	// signingKey holds the key used to sign tokens or nil if the service can only verify tokens.
+	signingKey *JWTKey
+
+	// keys holds the keys used to verify tokens, with any private keys replaced by their public keys.
+	keys []JWTKey
 }
 
-// VerifyToken parses and verifies the token string, returning the resulting JWT token for further validation.
+// NewJWTAuthKeyService creates and initializes a new service object.
 //
 // The following errors are returned by this function:
-// ErrInvalidTokenSignatureAlgorithm, ErrParseJWTTokenFailure
-func (j *JWTAuthHMACService) VerifyToken(ctx context.Context, encodedToken string) (*jwt.Token, error) {
+// ErrUnsupportedKey
+func NewJWTAuthKeyService(ctx context.Context, opts *JWTAuthServiceOptions) (*JWTAuthKeyService, error) {
 	logger := log.Logger
 	if l := zerolog.Ctx(ctx); l != nil {
 		logger = *l
 	}
 
-	// parse the JWT token
-	token, err := jwt.Parse(encodedToken, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			e := &ErrInvalidTokenSignatureAlgorithm{Alg: token.Header["alg"], Expected: "HS256"}
-			logger.Error().Err(e).Msg(e.Error())
+	j := &JWTAuthKeyService{}
+	if opts != nil {
+		j.options = *opts
+	}
+	if j.options.Now == nil {
+		j.options.Now = time.Now
+	}
+
+	keys := j.options.VerificationKeys
+	if j.options.SigningKey != nil {
+		signingKey := *j.options.SigningKey
+		if err := checkJWTSigningKey(&signingKey); err != nil {
+			e := &ErrUnsupportedKey{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
 			return nil, e
 		}
-		return j.secret, nil
-	})
-	if err != nil {
-		e := &ErrParseJWTTokenFailure{
-			Err: err,
+		j.signingKey = &signingKey
+		keys = append([]JWTKey{signingKey}, keys...)
+	}
+	for _, key := range keys {
+		pub, err := jwtVerificationKey(&key)
+		if err != nil {
+			e := &ErrUnsupportedKey{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
 		}
-		logger.Error().Err(e).Msg(e.Error())
+		j.keys = append(j.keys, JWTKey{ID: key.ID, Algorithm: key.Algorithm, Key: pub})
+	}
+	if len(j.keys) == 0 && j.options.KeySet == nil {
+		e := &ErrUnsupportedKey{Err: errors.New("at least one signing or verification key or a key set is required")}
+		logger.Error().Err(e.Err).Msg(e.Error())
 		return nil, e
 	}
-	return token, nil
+	return j, nil
 }
 
-// JWTAuthRSAService creates and validates JWT tokens that are signed with a private RSA key and validated with a
-// public RSA key.
+// GenerateToken generates a new JWT token with the given claims, signed with the signing key.
 //
-// You must use the same key pair to validate the JWT token as was used to generate it. Otherwise, validation
-// will fail.
-type JWTAuthRSAService struct {
-	publicKey  *rsa.PublicKey
-	privateKey *rsa.PrivateKey
-}
-
-// NewJWTAuthRSAService creates an initializes a new service object.
-func NewJWTAuthRSAService(publicKey *rsa.PublicKey, privateKey *rsa.PrivateKey) *JWTAuthRSAService {
-	return &JWTAuthRSAService{
-		publicKey:  publicKey,
-		privateKey: privateKey,
-	}
-}
-
-// GenerateToken generates a new JWT token with the given claims.
+// The "kid" header of the token is set to the ID of the signing key, if it has one. The claims are not changed, so
+// be sure they include the "exp" claim and any other claims required to verify the token.
 //
 // The following errors are returned by this function:
 // ErrSignJWTTokenFailure
-func (j *JWTAuthRSAService) GenerateToken(ctx context.Context, claims jwt.Claims) (string, error) {
+func (j *JWTAuthKeyService) GenerateToken(ctx context.Context, claims jwt.Claims) (string, error) {
 	logger := log.Logger
 	if l := zerolog.Ctx(ctx); l != nil {
 		logger = *l
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	signedToken, err := token.SignedString(j.privateKey)
+	if j.signingKey == nil {
+		e := &ErrSignJWTTokenFailure{Err: errors.New("no signing key was configured")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(j.signingKey.Algorithm), claims)
+	if j.signingKey.ID != "" {
+		token.Header["kid"] = j.signingKey.ID
+	}
+	signedToken, err := token.SignedString(j.signingKey.Key)
 	if err != nil {
 		e := &ErrSignJWTTokenFailure{Err: err}
 		logger.Error().Err(e.Err).Msg(e.Error())
@@ -118,25 +185,29 @@ func (j *JWTAuthRSAService) GenerateToken(ctx context.Context, claims jwt.Claims
 	return signedToken, nil
 }
 
-// VerifyToken parses and verifies the token string, returning the resulting JWT token for further validation.
+// VerifyToken parses and verifies the token string and its claims, returning the resulting JWT token for further
+// validation. The claims of the returned token are of type jwt.MapClaims.
 //
 // The following errors are returned by this function:
-// ErrInvalidTokenSignatureAlgorithm, ErrParseJWTTokenFailure
-func (j *JWTAuthRSAService) VerifyToken(ctx context.Context, encodedToken string) (*jwt.Token, error) {
+// ErrInvalidTokenSignatureAlgorithm, ErrJWTKeyNotFound, ErrParseJWTTokenFailure, ErrInvalidTokenClaims
+func (j *JWTAuthKeyService) VerifyToken(ctx context.Context, encodedToken string) (*jwt.Token, error) {
 	logger := log.Logger
 	if l := zerolog.Ctx(ctx); l != nil {
 		logger = *l
 	}
 
-	// parse the JWT token
-	token, err := jwt.Parse(encodedToken, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			e := &ErrInvalidTokenSignatureAlgorithm{Alg: token.Header["alg"], Expected: "RS256"}
-			logger.Error().Err(e).Msg(e.Error())
-			return nil, e
-		}
-		return j.publicKey, nil
+	// parse the JWT token; the claims are checked afterwards to allow for leeway
+	var keyErr error
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(encodedToken, func(token *jwt.Token) (interface{}, error) {
+		key, err := j.findKey(ctx, token)
+		keyErr = err
+		return key, err
 	})
+	if keyErr != nil {
+		logger.Error().Err(keyErr).Msg(keyErr.Error())
+		return nil, keyErr
+	}
 	if err != nil {
 		e := &ErrParseJWTTokenFailure{
 			Err: err,
@@ -144,72 +215,217 @@ func (j *JWTAuthRSAService) VerifyToken(ctx context.Context, encodedToken string
 		logger.Error().Err(e).Msg(e.Error())
 		return nil, e
 	}
+
+	// validate the claims
+	if err := j.validateClaims(token.Claims.(jwt.MapClaims)); err != nil {
+		e := &ErrInvalidTokenClaims{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
 	return token, nil
 }
 
-// JWTAuthECDSAService creates and validates JWT tokens that are signed with a private ECDSA key and validated with a
-// public ECDSA key.
-//
-// You must use the same key pair to validate the JWT token as was used to generate it. Otherwise, validation
-// will fail.
-type JWTAuthECDSAService struct {
-	publicKey  *ecdsa.PublicKey
-	privateKey *ecdsa.PrivateKey
+// findKey returns the key used to verify the token, reloading the key set if the key is not found.
+func (j *JWTAuthKeyService) findKey(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	key, err := j.matchKey(token)
+	if err != nil && j.options.KeySet != nil && j.options.KeySet.refreshForUnknownKey(ctx) {
+		return j.matchKey(token)
+	}
+	return key, err
+}
+
+// matchKey returns the only key matching the key ID and algorithm of the token.
+func (j *JWTAuthKeyService) matchKey(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	kid, _ := token.Header["kid"].(string)
+	keys := j.keys
+	if j.options.KeySet != nil {
+		keys = append(append([]JWTKey{}, keys...), j.options.KeySet.Keys()...)
+	}
+	algs := []string{}
+	candidates := []JWTKey{}
+	for _, key := range keys {
+		if !containsString(algs, key.Algorithm) {
+			algs = append(algs, key.Algorithm)
+		}
+		if key.Algorithm == alg && (kid == "" || key.ID == kid) {
+			candidates = append(candidates, key)
+		}
+	}
+	if !containsString(algs, alg) {
+		return nil, &ErrInvalidTokenSignatureAlgorithm{Alg: token.Header["alg"], Expected: strings.Join(algs, ", ")}
+	}
+	if len(candidates) != 1 {
+		return nil, &ErrJWTKeyNotFound{KeyID: kid, Alg: alg}
+	}
+	return candidates[0].Key, nil
 }
 
-// NewJWTAuthECDSAService creates an initializes a new service object.
-func NewJWTAuthECDSAService(publicKey *ecdsa.PublicKey, privateKey *ecdsa.PrivateKey) *JWTAuthECDSAService {
-	return &JWTAuthECDSAService{
-		publicKey:  publicKey,
-		privateKey: privateKey,
+// validateClaims checks the registered claims of a token.
+func (j *JWTAuthKeyService) validateClaims(claims jwt.MapClaims) error {
+	now := j.options.Now()
+
+	// check the times
+	exp, ok, err := jwtTimeClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("token has no 'exp' claim")
+	}
+	if now.After(exp.Add(j.options.Leeway)) {
+		return fmt.Errorf("token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	nbf, ok, err := jwtTimeClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if !ok && j.options.RequireNotBefore {
+		return errors.New("token has no 'nbf' claim")
+	}
+	if ok && now.Add(j.options.Leeway).Before(nbf) {
+		return fmt.Errorf("token is not valid before %s", nbf.UTC().Format(time.RFC3339))
+	}
+	iat, ok, err := jwtTimeClaim(claims, "iat")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(j.options.Leeway).Before(iat) {
+		return fmt.Errorf("token was issued in the future at %s", iat.UTC().Format(time.RFC3339))
 	}
+
+	// check the issuer and audience
+	if j.options.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.options.Issuer {
+			return fmt.Errorf("token was issued by '%s' but '%s' was expected", iss, j.options.Issuer)
+		}
+	}
+	if len(j.options.Audience) > 0 {
+		audiences := []string{}
+		switch aud := claims["aud"].(type) {
+		case string:
+			audiences = append(audiences, aud)
+		case []interface{}:
+			for _, a := range aud {
+				if s, ok := a.(string); ok {
+					audiences = append(audiences, s)
+				}
+			}
+		}
+		found := false
+		for _, a := range audiences {
+			if containsString(j.options.Audience, a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("token audience %v does not include any of %v", audiences, j.options.Audience)
+		}
+	}
+	return nil
 }
 
-// GenerateToken generates a new JWT token with the given claims.
-//
-// The following errors are returned by this function:
-// ErrSignJWTTokenFailure
-func (j *JWTAuthECDSAService) GenerateToken(ctx context.Context, claims jwt.Claims) (string, error) {
-	logger := log.Logger
-	if l := zerolog.Ctx(ctx); l != nil {
-		logger = *l
+// jwtTimeClaim returns the value of a NumericDate claim and whether it is present.
+func jwtTimeClaim(claims jwt.MapClaims, name string) (time.Time, bool, error) {
+	var seconds float64
+	switch v := claims[name].(type) {
+	case nil:
+		return time.Time{}, false, nil
+	case float64:
+		seconds = v
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("token '%s' claim is not a number", name)
+		}
+		seconds = f
+	default:
+		return time.Time{}, false, fmt.Errorf("token '%s' claim is not a number", name)
+	}
+	if math.IsNaN(seconds) || math.IsInf(seconds, 0) || math.Abs(seconds) > maxJWTNumericDate {
+		return time.Time{}, false, fmt.Errorf("token '%s' claim is out of range", name)
 	}
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*1e9)), true, nil
+}
+
+// checkJWTSigningKey checks that the key can be used to sign tokens with its algorithm.
+func checkJWTSigningKey(key *JWTKey) error {
+	switch key.Key.(type) {
+	case []byte, *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+	default:
+		return fmt.Errorf("%T cannot be used to sign JWT tokens", key.Key)
+	}
+	_, err := jwtVerificationKey(key)
+	return err
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	signedToken, err := token.SignedString(j.privateKey)
+// jwtVerificationKey checks that the key can be used with its algorithm and returns the key used to verify tokens.
+func jwtVerificationKey(key *JWTKey) (interface{}, error) {
+	method, err := jwtSigningMethod(key.Algorithm)
 	if err != nil {
-		e := &ErrSignJWTTokenFailure{Err: err}
-		logger.Error().Err(e.Err).Msg(e.Error())
-		return "", e
+		return nil, err
 	}
-	return signedToken, nil
+	var pub interface{}
+	switch m := method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if secret, ok := key.Key.([]byte); ok {
+			if len(secret) < m.Hash.Size() {
+				return nil, fmt.Errorf("%s secret must be at least %d bytes long", key.Algorithm, m.Hash.Size())
+			}
+			pub = secret
+		}
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		switch k := key.Key.(type) {
+		case *rsa.PrivateKey:
+			pub = &k.PublicKey
+		case *rsa.PublicKey:
+			pub = k
+		}
+	case *jwt.SigningMethodECDSA:
+		var p *ecdsa.PublicKey
+		switch k := key.Key.(type) {
+		case *ecdsa.PrivateKey:
+			p = &k.PublicKey
+		case *ecdsa.PublicKey:
+			p = k
+		}
+		if p != nil {
+			if p.Curve.Params().BitSize != m.CurveBits {
+				return nil, fmt.Errorf("%s requires a %d-bit curve but the key uses %s", key.Algorithm, m.CurveBits,
+					p.Curve.Params().Name)
+			}
+			pub = p
+		}
+	case *jwt.SigningMethodEd25519:
+		switch k := key.Key.(type) {
+		case ed25519.PrivateKey:
+			pub = k.Public()
+		case ed25519.PublicKey:
+			pub = k
+		}
+	}
+	if pub == nil {
+		return nil, fmt.Errorf("%T cannot be used with the %s algorithm", key.Key, key.Algorithm)
+	}
+	return pub, nil
 }
 
-// VerifyToken parses and verifies the token string, returning the resulting JWT token for further validation.
-//
-// The following errors are returned by this function:
-// ErrInvalidTokenSignatureAlgorithm, ErrParseJWTTokenFailure
-func (j *JWTAuthECDSAService) VerifyToken(ctx context.Context, encodedToken string) (*jwt.Token, error) {
-	logger := log.Logger
-	if l := zerolog.Ctx(ctx); l != nil {
-		logger = *l
+// jwtSigningMethod returns the signing method for a supported algorithm.
+func jwtSigningMethod(alg string) (jwt.SigningMethod, error) {
+	if !containsString(JWTAlgorithms, alg) {
+		return nil, fmt.Errorf("unsupported JWT algorithm '%s'", alg)
 	}
+	return jwt.GetSigningMethod(alg), nil
+}
 
-	// parse the JWT token
-	token, err := jwt.Parse(encodedToken, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			e := &ErrInvalidTokenSignatureAlgorithm{Alg: token.Header["alg"], Expected: "RS256"}
-			logger.Error().Err(e).Msg(e.Error())
-			return nil, e
+// containsString returns whether the slice contains the string.
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
 		}
-		return j.publicKey, nil
-	})
-	if err != nil {
-		e := &ErrParseJWTTokenFailure{
-			Err: err,
-		}
-		logger.Error().Err(e).Msg(e.Error())
-		return nil, e
 	}
-	return token, nil
+	return false
 }
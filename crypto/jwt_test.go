@@ -0,0 +1,231 @@
+package crypto_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestJWTAuthKeyServiceAlgorithms(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p521, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	secret := make([]byte, 64)
+	_, _ = rand.Read(secret)
+
+	keys := map[string]interface{}{
+		"HS256": secret, "HS384": secret, "HS512": secret,
+		"RS256": rsaKey, "RS384": rsaKey, "RS512": rsaKey,
+		"PS256": rsaKey, "PS384": rsaKey, "PS512": rsaKey,
+		"ES256": p256, "ES384": p384, "ES512": p521,
+		"EdDSA": edKey,
+	}
+	for _, alg := range crypto.JWTAlgorithms {
+		signer, err := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{
+			SigningKey: &crypto.JWTKey{ID: "key-1", Algorithm: alg, Key: keys[alg]},
+		})
+		if err != nil {
+			t.Fatalf("error while creating %s service: %s", alg, err.Error())
+		}
+		token, err := signer.GenerateToken(ctx, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+		if err != nil {
+			t.Fatalf("error while generating %s token: %s", alg, err.Error())
+		}
+
+		// verify using only the public key, or the secret for HMAC
+		verificationKey := keys[alg]
+		switch k := verificationKey.(type) {
+		case *rsa.PrivateKey:
+			verificationKey = &k.PublicKey
+		case *ecdsa.PrivateKey:
+			verificationKey = &k.PublicKey
+		case ed25519.PrivateKey:
+			verificationKey = k.Public()
+		}
+		verifier, err := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{
+			VerificationKeys: []crypto.JWTKey{{ID: "key-1", Algorithm: alg, Key: verificationKey}},
+		})
+		if err != nil {
+			t.Fatalf("error while creating %s verifier: %s", alg, err.Error())
+		}
+		parsed, err := verifier.VerifyToken(ctx, token)
+		if err != nil {
+			t.Fatalf("error while verifying %s token: %s", alg, err.Error())
+		}
+		if parsed.Header["kid"] != "key-1" || parsed.Claims.(jwt.MapClaims)["sub"] != "alice" {
+			t.Errorf("error: unexpected %s token: %v %v", alg, parsed.Header, parsed.Claims)
+		}
+		if _, err := verifier.GenerateToken(ctx, jwt.MapClaims{}); err == nil {
+			t.Errorf("error: got nil, expected error")
+		}
+	}
+
+	// keys which do not match the algorithm are rejected
+	invalid := []crypto.JWTKey{
+		{Algorithm: "none", Key: secret},
+		{Algorithm: "HS512", Key: secret[:32]},
+		{Algorithm: "ES384", Key: p256},
+		{Algorithm: "RS256", Key: p256},
+		{Algorithm: "EdDSA", Key: rsaKey},
+	}
+	for _, key := range invalid {
+		k := key
+		_, err := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{SigningKey: &k})
+		if _, ok := err.(*crypto.ErrUnsupportedKey); !ok {
+			t.Errorf("error: got %T, expected *crypto.ErrUnsupportedKey for %s", err, key.Algorithm)
+		}
+	}
+	_, err := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{
+		SigningKey: &crypto.JWTKey{Algorithm: "RS256", Key: &rsaKey.PublicKey},
+	})
+	if _, ok := err.(*crypto.ErrUnsupportedKey); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrUnsupportedKey", err)
+	}
+	if _, err := crypto.NewJWTAuthKeyService(ctx, nil); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func TestJWTAuthKeyServiceKeyIDs(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+	exp := time.Now().Add(time.Hour).Unix()
+
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	old, _ := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{
+		SigningKey: &crypto.JWTKey{ID: "old", Algorithm: "ES256", Key: oldKey},
+	})
+	oldToken, _ := old.GenerateToken(ctx, jwt.MapClaims{"exp": exp})
+
+	// the rotated service still accepts tokens signed with the old key
+	j, err := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{
+		SigningKey:       &crypto.JWTKey{ID: "new", Algorithm: "ES256", Key: newKey},
+		VerificationKeys: []crypto.JWTKey{{ID: "old", Algorithm: "ES256", Key: &oldKey.PublicKey}},
+	})
+	if err != nil {
+		t.Fatalf("error while creating service: %s", err.Error())
+	}
+	newToken, _ := j.GenerateToken(ctx, jwt.MapClaims{"exp": exp})
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := j.VerifyToken(ctx, token); err != nil {
+			t.Errorf("error while verifying token: %s", err.Error())
+		}
+	}
+
+	// tokens with an unknown key ID or without a key ID when several keys match are rejected
+	other, _ := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{
+		SigningKey: &crypto.JWTKey{ID: "other", Algorithm: "ES256", Key: oldKey},
+	})
+	otherToken, _ := other.GenerateToken(ctx, jwt.MapClaims{"exp": exp})
+	noKID, _ := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{
+		SigningKey: &crypto.JWTKey{Algorithm: "ES256", Key: oldKey},
+	})
+	noKIDToken, _ := noKID.GenerateToken(ctx, jwt.MapClaims{"exp": exp})
+	for _, token := range []string{otherToken, noKIDToken} {
+		_, err := j.VerifyToken(ctx, token)
+		if _, ok := err.(*crypto.ErrJWTKeyNotFound); !ok {
+			t.Errorf("error: got %T, expected *crypto.ErrJWTKeyNotFound", err)
+		}
+	}
+	if _, err := noKID.VerifyToken(ctx, noKIDToken); err != nil {
+		t.Errorf("error while verifying token: %s", err.Error())
+	}
+
+	// tokens signed with an unexpected algorithm are rejected
+	hmac, _ := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{
+		SigningKey: &crypto.JWTKey{ID: "new", Algorithm: "HS256", Key: []byte("0123456789abcdef0123456789abcdef")},
+	})
+	hmacToken, _ := hmac.GenerateToken(ctx, jwt.MapClaims{"exp": exp})
+	_, err = j.VerifyToken(ctx, hmacToken)
+	if _, ok := err.(*crypto.ErrInvalidTokenSignatureAlgorithm); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrInvalidTokenSignatureAlgorithm", err)
+	}
+
+	// tampered tokens are rejected
+	_, err = j.VerifyToken(ctx, newToken[:len(newToken)-4]+"AAAA")
+	if _, ok := err.(*crypto.ErrParseJWTTokenFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrParseJWTTokenFailure", err)
+	}
+}
+
+func TestJWTAuthKeyServiceClaims(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	key := &crypto.JWTKey{Algorithm: "HS256", Key: []byte("0123456789abcdef0123456789abcdef")}
+	j, err := crypto.NewJWTAuthKeyService(ctx, &crypto.JWTAuthServiceOptions{
+		SigningKey:       key,
+		Issuer:           "https://issuer.example.com",
+		Audience:         []string{"api", "admin"},
+		RequireNotBefore: true,
+		Leeway:           30 * time.Second,
+		Now:              func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("error while creating service: %s", err.Error())
+	}
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "https://issuer.example.com",
+			"aud": []string{"web", "api"},
+			"iat": now.Unix(),
+			"nbf": now.Unix(),
+			"exp": now.Add(time.Minute).Unix(),
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(jwt.MapClaims)
+		valid  bool
+	}{
+		{"valid", func(jwt.MapClaims) {}, true},
+		{"single audience", func(c jwt.MapClaims) { c["aud"] = "admin" }, true},
+		{"expired within leeway", func(c jwt.MapClaims) { c["exp"] = now.Add(-20 * time.Second).Unix() }, true},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Minute).Unix() }, false},
+		{"missing exp", func(c jwt.MapClaims) { delete(c, "exp") }, false},
+		{"invalid exp", func(c jwt.MapClaims) { c["exp"] = "tomorrow" }, false},
+		{"not yet valid within leeway", func(c jwt.MapClaims) { c["nbf"] = now.Add(20 * time.Second).Unix() }, true},
+		{"not yet valid", func(c jwt.MapClaims) { c["nbf"] = now.Add(time.Minute).Unix() }, false},
+		{"far-future nbf", func(c jwt.MapClaims) { c["nbf"] = 10000000000 }, false},
+		{"far-future exp", func(c jwt.MapClaims) { c["exp"] = 10000000000 }, true},
+		{"out of range exp", func(c jwt.MapClaims) { c["exp"] = 1e300 }, false},
+		{"missing nbf", func(c jwt.MapClaims) { delete(c, "nbf") }, false},
+		{"issued in the future", func(c jwt.MapClaims) { c["iat"] = now.Add(time.Minute).Unix() }, false},
+		{"wrong issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, false},
+		{"missing issuer", func(c jwt.MapClaims) { delete(c, "iss") }, false},
+		{"wrong audience", func(c jwt.MapClaims) { c["aud"] = []string{"web"} }, false},
+		{"missing audience", func(c jwt.MapClaims) { delete(c, "aud") }, false},
+	}
+	for _, test := range tests {
+		claims := valid()
+		test.change(claims)
+		token, err := j.GenerateToken(ctx, claims)
+		if err != nil {
+			t.Fatalf("error while generating token: %s", err.Error())
+		}
+		_, err = j.VerifyToken(ctx, token)
+		if test.valid && err != nil {
+			t.Errorf("%s: error while verifying token: %s", test.name, err.Error())
+		} else if !test.valid {
+			if _, ok := err.(*crypto.ErrInvalidTokenClaims); !ok {
+				t.Errorf("%s: error: got %T, expected *crypto.ErrInvalidTokenClaims", test.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Default cost parameters used when the corresponding KDFOptions field is not set.
+const (
+	// DefaultKDFSaltLength is the default length of the random salt in bytes.
+	DefaultKDFSaltLength = 16
+
+	// DefaultArgon2idTime is the default number of passes over memory made by Argon2id.
+	DefaultArgon2idTime = 3
+
+	// DefaultArgon2idMemory is the default amount of memory used by Argon2id in KiB (64 MiB).
+	DefaultArgon2idMemory = 64 * 1024
+
+	// DefaultArgon2idThreads is the default degree of parallelism used by Argon2id.
+	DefaultArgon2idThreads = 4
+
+	// DefaultScryptN is the default CPU/memory cost parameter used by scrypt.
+	DefaultScryptN = 32768
+
+	// DefaultScryptR is the default block size parameter used by scrypt.
+	DefaultScryptR = 8
+
+	// DefaultScryptP is the default parallelization parameter used by scrypt.
+	DefaultScryptP = 1
+
+	// DefaultPBKDF2Iterations is the default number of PBKDF2-SHA256 iterations.
+	DefaultPBKDF2Iterations = 600000
+)
+
+// Upper bounds for cost parameters. These limits are also applied to the parameters stored in ciphertext, password
+// hashes and encrypted keys, so decrypting or verifying crafted data uses at most 1 GiB of memory and a bounded
+// amount of work.
+const (
+	maxKDFSaltLength    = 64
+	maxArgon2idTime     = 16
+	maxArgon2idMemory   = 1024 * 1024
+	maxScryptMemory     = 1024 * 1024 * 1024
+	maxPBKDF2Iterations = 10000000
+
+	// derivedKeyLength is the length of the keys produced by the KDFs, which is suitable for AES-256.
+	derivedKeyLength = 32
+)
+
+// KDFOptions holds the algorithm and cost parameters used to derive an encryption key from a passphrase.
+//
+// Any cost parameter that is 0 is replaced by its default value. Only the fields relevant to the selected
+// algorithm are used.
+type KDFOptions struct {
+	// Algorithm is the key derivation function to use. It must be KDFArgon2id, KDFScrypt or KDFPBKDF2SHA256.
+	Algorithm KDFAlgorithm
+
+	// SaltLength is the length of the random salt in bytes.
+	SaltLength int
+
+	// Argon2Time is the number of passes over memory made by Argon2id.
+	Argon2Time uint32
+
+	// Argon2Memory is the amount of memory used by Argon2id in KiB.
+	Argon2Memory uint32
+
+	// Argon2Threads is the degree of parallelism used by Argon2id.
+	Argon2Threads uint8
+
+	// ScryptN is the CPU/memory cost parameter used by scrypt. It must be a power of 2.
+	ScryptN int
+
+	// ScryptR is the block size parameter used by scrypt.
+	ScryptR int
+
+	// ScryptP is the parallelization parameter used by scrypt.
+	ScryptP int
+
+	// PBKDF2Iterations is the number of PBKDF2-SHA256 iterations.
+	PBKDF2Iterations int
+}
+
+// DefaultKDFOptions returns the default options for the given key derivation function.
+func DefaultKDFOptions(alg KDFAlgorithm) *KDFOptions {
+	opts := &KDFOptions{Algorithm: alg}
+	opts.setDefaults()
+	return opts
+}
+
+// setDefaults replaces any unset parameters with their default values.
+func (o *KDFOptions) setDefaults() {
+	if o.SaltLength == 0 {
+		o.SaltLength = DefaultKDFSaltLength
+	}
+	switch o.Algorithm {
+	case KDFArgon2id:
+		if o.Argon2Time == 0 {
+			o.Argon2Time = DefaultArgon2idTime
+		}
+		if o.Argon2Memory == 0 {
+			o.Argon2Memory = DefaultArgon2idMemory
+		}
+		if o.Argon2Threads == 0 {
+			o.Argon2Threads = DefaultArgon2idThreads
+		}
+	case KDFScrypt:
+		if o.ScryptN == 0 {
+			o.ScryptN = DefaultScryptN
+		}
+		if o.ScryptR == 0 {
+			o.ScryptR = DefaultScryptR
+		}
+		if o.ScryptP == 0 {
+			o.ScryptP = DefaultScryptP
+		}
+	case KDFPBKDF2SHA256:
+		if o.PBKDF2Iterations == 0 {
+			o.PBKDF2Iterations = DefaultPBKDF2Iterations
+		}
+	}
+}
+
+// validate ensures the options use a supported algorithm and that the cost parameters are within bounds.
+func (o *KDFOptions) validate() error {
+	if o.SaltLength < 8 || o.SaltLength > maxKDFSaltLength {
+		return fmt.Errorf("salt length must be between 8 and %d bytes", maxKDFSaltLength)
+	}
+	switch o.Algorithm {
+	case KDFArgon2id:
+		if o.Argon2Time < 1 || o.Argon2Time > maxArgon2idTime {
+			return fmt.Errorf("Argon2id time must be between 1 and %d", maxArgon2idTime)
+		}
+		if o.Argon2Threads < 1 {
+			return errors.New("Argon2id threads must be at least 1")
+		}
+		if o.Argon2Memory < 8*uint32(o.Argon2Threads) || o.Argon2Memory > maxArgon2idMemory {
+			return fmt.Errorf("Argon2id memory must be between %d and %d KiB", 8*uint32(o.Argon2Threads),
+				maxArgon2idMemory)
+		}
+	case KDFScrypt:
+		if o.ScryptN <= 1 || o.ScryptN&(o.ScryptN-1) != 0 {
+			return errors.New("scrypt N must be a power of 2 greater than 1")
+		}
+		if o.ScryptR < 1 || o.ScryptP < 1 {
+			return errors.New("scrypt r and p must be at least 1")
+		}
+
+		// scrypt uses 128*N*r bytes for each of the p lanes; dividing avoids overflow
+		if o.ScryptN > maxScryptMemory/128/o.ScryptR/o.ScryptP {
+			return fmt.Errorf("scrypt parameters must not require more than %d MiB (128*N*r*p bytes)",
+				maxScryptMemory/1024/1024)
+		}
+	case KDFPBKDF2SHA256:
+		if o.PBKDF2Iterations < 1 || o.PBKDF2Iterations > maxPBKDF2Iterations {
+			return fmt.Errorf("PBKDF2 iterations must be between 1 and %d", maxPBKDF2Iterations)
+		}
+	default:
+		return fmt.Errorf("%s is not a passphrase-based key derivation function", o.Algorithm)
+	}
+	return nil
+}
+
+// DeriveKey derives a 32-byte key from the passphrase and salt using the given options.
+//
+// If opts is nil, Argon2id is used with its default parameters.
+//
+// The following errors are returned by this function:
+// ErrDeriveKeyFailure
+func DeriveKey(ctx context.Context, passphrase, salt []byte, opts *KDFOptions) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	o := resolveKDFOptions(opts)
+	if len(salt) == 0 {
+		e := &ErrDeriveKeyFailure{Algorithm: o.Algorithm, Err: errors.New("no salt was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	o.SaltLength = len(salt)
+	if err := o.validate(); err != nil {
+		e := &ErrDeriveKeyFailure{Algorithm: o.Algorithm, Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	key, err := deriveKey(passphrase, salt, o)
+	if err != nil {
+		e := &ErrDeriveKeyFailure{Algorithm: o.Algorithm, Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return key, nil
+}
+
+// EncryptStringWithPassphrase encrypts the given string with a key derived from the passphrase.
+//
+// A random salt is generated for each call and stored, along with the KDF cost parameters, in the ciphertext
+// envelope. If opts is nil, Argon2id is used with its default parameters.
+//
+// The ciphertext can be decrypted with either DecryptStringWithPassphrase() or DecryptString().
+//
+// The following errors are returned by this function:
+// ErrDeriveKeyFailure, ErrGenerateRandomKeyFailure, ErrEncryptFailure, ErrGenerateCipherFailure,
+// ErrGenerateGCMFailure, ErrGenerateNonceFailure
+func EncryptStringWithPassphrase(ctx context.Context, plaintext, passphrase string, opts *KDFOptions) (
+	string, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	o := resolveKDFOptions(opts)
+	logger = logger.With().Str("kdf", o.Algorithm.String()).Logger()
+	if passphrase == "" {
+		e := &ErrDeriveKeyFailure{Algorithm: o.Algorithm, Err: errors.New("no passphrase was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	if err := o.validate(); err != nil {
+		e := &ErrDeriveKeyFailure{Algorithm: o.Algorithm, Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+
+	// generate a random salt
+	salt := make([]byte, o.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		e := &ErrGenerateRandomKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+
+	// derive the key and encrypt the data
+	cipherKey, err := deriveKey([]byte(passphrase), salt, o)
+	if err != nil {
+		e := &ErrDeriveKeyFailure{Algorithm: o.Algorithm, Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	env := &CiphertextEnvelope{
+		Version:   CiphertextEnvelopeVersion1,
+		KDF:       o.Algorithm,
+		Cipher:    CipherAES256GCM,
+		KDFParams: marshalKDFParams(o, salt),
+	}
+	if err := sealEnvelope(env, []byte(plaintext), cipherKey); err != nil {
+		logger.Error().Err(err).Msg(err.Error())
+		return "", err
+	}
+	return env.String(), nil
+}
+
+// DecryptStringWithPassphrase decrypts ciphertext produced by EncryptStringWithPassphrase().
+//
+// Unlike DecryptString(), this function refuses to decrypt ciphertext whose envelope does not use a
+// passphrase-based key derivation function, so a passphrase is never used directly as a key.
+//
+// The following errors are returned by this function:
+// ErrDecodeFailure, ErrDecryptFailure, ErrGenerateCipherFailure, ErrGenerateGCMFailure
+func DecryptStringWithPassphrase(ctx context.Context, ciphertext, passphrase string) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	env, err := parseCiphertextEnvelope(ciphertext)
+	if err != nil {
+		e := &ErrDecodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	logger = logger.With().Str("kdf", env.KDF.String()).Logger()
+
+	switch env.KDF {
+	case KDFArgon2id, KDFScrypt, KDFPBKDF2SHA256:
+	default:
+		e := &ErrDecryptFailure{Err: fmt.Errorf("%s is not a passphrase-based key derivation function", env.KDF)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+
+	// derive the key and decrypt the data
+	cipherKey, err := deriveEnvelopeKey(env, []byte(passphrase))
+	if err != nil {
+		e := &ErrDecryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	plaintext, err := openEnvelope(env, cipherKey)
+	if err != nil {
+		logger.Error().Err(err).Msg(err.Error())
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// resolveKDFOptions returns a copy of the options with any unset parameters replaced by their default values.
+func resolveKDFOptions(opts *KDFOptions) *KDFOptions {
+	o := &KDFOptions{Algorithm: KDFArgon2id}
+	if opts != nil {
+		*o = *opts
+	}
+	o.setDefaults()
+	return o
+}
+
+// deriveKey runs the key derivation function. The options must already have been validated.
+func deriveKey(passphrase, salt []byte, o *KDFOptions) ([]byte, error) {
+	switch o.Algorithm {
+	case KDFArgon2id:
+		return argon2.IDKey(passphrase, salt, o.Argon2Time, o.Argon2Memory, o.Argon2Threads, derivedKeyLength), nil
+	case KDFScrypt:
+		return scrypt.Key(passphrase, salt, o.ScryptN, o.ScryptR, o.ScryptP, derivedKeyLength)
+	case KDFPBKDF2SHA256:
+		return pbkdf2.Key(passphrase, salt, o.PBKDF2Iterations, derivedKeyLength, sha256.New), nil
+	}
+	return nil, fmt.Errorf("%s is not a passphrase-based key derivation function", o.Algorithm)
+}
+
+// marshalKDFParams encodes the salt and cost parameters so they can be stored in a ciphertext envelope.
+//
+// The salt is stored first, prefixed by its length, followed by the algorithm's cost parameters as big endian
+// integers.
+func marshalKDFParams(o *KDFOptions, salt []byte) []byte {
+	params := append([]byte{byte(len(salt))}, salt...)
+	switch o.Algorithm {
+	case KDFArgon2id:
+		params = appendUint32(params, o.Argon2Time)
+		params = appendUint32(params, o.Argon2Memory)
+		params = append(params, o.Argon2Threads)
+	case KDFScrypt:
+		params = appendUint32(params, uint32(o.ScryptN))
+		params = appendUint32(params, uint32(o.ScryptR))
+		params = appendUint32(params, uint32(o.ScryptP))
+	case KDFPBKDF2SHA256:
+		params = appendUint32(params, uint32(o.PBKDF2Iterations))
+	}
+	return params
+}
+
+// unmarshalKDFParams decodes the salt and cost parameters stored in a ciphertext envelope and validates them.
+func unmarshalKDFParams(alg KDFAlgorithm, params []byte) (*KDFOptions, []byte, error) {
+	invalid := errors.New("KDF parameters are invalid")
+	if len(params) < 1 || len(params) < 1+int(params[0]) {
+		return nil, nil, invalid
+	}
+	salt := params[1 : 1+int(params[0])]
+	params = params[1+len(salt):]
+
+	o := &KDFOptions{Algorithm: alg, SaltLength: len(salt)}
+	switch alg {
+	case KDFArgon2id:
+		if len(params) != 9 {
+			return nil, nil, invalid
+		}
+		o.Argon2Time = binary.BigEndian.Uint32(params[0:4])
+		o.Argon2Memory = binary.BigEndian.Uint32(params[4:8])
+		o.Argon2Threads = params[8]
+	case KDFScrypt:
+		if len(params) != 12 {
+			return nil, nil, invalid
+		}
+		o.ScryptN = int(binary.BigEndian.Uint32(params[0:4]))
+		o.ScryptR = int(binary.BigEndian.Uint32(params[4:8]))
+		o.ScryptP = int(binary.BigEndian.Uint32(params[8:12]))
+	case KDFPBKDF2SHA256:
+		if len(params) != 4 {
+			return nil, nil, invalid
+		}
+		o.PBKDF2Iterations = int(binary.BigEndian.Uint32(params[0:4]))
+	default:
+		return nil, nil, fmt.Errorf("%s is not a passphrase-based key derivation function", alg)
+	}
+	if err := o.validate(); err != nil {
+		return nil, nil, err
+	}
+	return o, salt, nil
+}
+
+// appendUint32 appends the big endian encoding of v to b.
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
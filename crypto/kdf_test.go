@@ -0,0 +1,108 @@
+package crypto_test
+
+import (
+	"context"
+	"testing"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+// testKDFOptions uses low cost parameters to keep the tests fast.
+var testKDFOptions = []*crypto.KDFOptions{
+	{Algorithm: crypto.KDFArgon2id, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 1},
+	{Algorithm: crypto.KDFScrypt, ScryptN: 1024, ScryptR: 8, ScryptP: 1},
+	{Algorithm: crypto.KDFPBKDF2SHA256, PBKDF2Iterations: 1000},
+}
+
+func TestEncryptWithPassphrase(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	for _, opts := range testKDFOptions {
+		t.Logf("*** testing %s ***", opts.Algorithm)
+		ciphertext, err := crypto.EncryptStringWithPassphrase(ctx, "test_string", "correct horse", opts)
+		if err != nil {
+			t.Errorf("error while encrypting string: %s", err.Error())
+			continue
+		}
+
+		env, err := crypto.ParseCiphertextEnvelope(ctx, ciphertext)
+		if err != nil {
+			t.Errorf("error while parsing envelope: %s", err.Error())
+		} else if env.KDF != opts.Algorithm {
+			t.Errorf("error: envelope KDF is %s, expected %s", env.KDF, opts.Algorithm)
+		}
+
+		plaintext, err := crypto.DecryptStringWithPassphrase(ctx, ciphertext, "correct horse")
+		if err != nil {
+			t.Errorf("error while decrypting string: %s", err.Error())
+		} else if plaintext != "test_string" {
+			t.Errorf("want: test_string, got: %s", plaintext)
+		}
+
+		plaintext, err = crypto.DecryptString(ctx, ciphertext, "correct horse")
+		if err != nil {
+			t.Errorf("error while decrypting string with DecryptString: %s", err.Error())
+		} else if plaintext != "test_string" {
+			t.Errorf("want: test_string, got: %s", plaintext)
+		}
+
+		if _, err := crypto.DecryptStringWithPassphrase(ctx, ciphertext, "wrong horse"); err == nil {
+			t.Errorf("error: got nil, expected error for wrong passphrase")
+		}
+	}
+}
+
+func TestEncryptWithPassphraseFailure(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	t.Log("*** testing invalid cost parameters ***")
+	opts := &crypto.KDFOptions{Algorithm: crypto.KDFScrypt, ScryptN: 1000}
+	if _, err := crypto.EncryptStringWithPassphrase(ctx, "test_string", "passphrase", opts); err == nil {
+		t.Errorf("error: got nil, expected error")
+	} else if _, ok := err.(*crypto.ErrDeriveKeyFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrDeriveKeyFailure", err)
+	}
+
+	t.Log("*** testing excessive memory ***")
+	excessive := []*crypto.KDFOptions{
+		{Algorithm: crypto.KDFScrypt, ScryptN: 1 << 20, ScryptR: 8, ScryptP: 2},
+		{Algorithm: crypto.KDFScrypt, ScryptN: 1 << 16, ScryptR: 1 << 20, ScryptP: 1 << 20},
+		{Algorithm: crypto.KDFArgon2id, Argon2Memory: 2 * 1024 * 1024, Argon2Time: 1, Argon2Threads: 1},
+		{Algorithm: crypto.KDFArgon2id, Argon2Memory: 64 * 1024, Argon2Time: 64, Argon2Threads: 1},
+	}
+	for _, opts := range excessive {
+		if _, err := crypto.DeriveKey(ctx, []byte("passphrase"), []byte("saltsalt"), opts); err == nil {
+			t.Errorf("error: got nil, expected error for %+v", opts)
+		}
+	}
+
+	t.Log("*** testing non-passphrase envelope ***")
+	ciphertext, err := crypto.EncryptString(ctx, "test_string", "passphrase")
+	if err != nil {
+		t.Fatalf("error while encrypting string: %s", err.Error())
+	}
+	if _, err := crypto.DecryptStringWithPassphrase(ctx, ciphertext, "passphrase"); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	salt := []byte("0123456789abcdef")
+	for _, opts := range testKDFOptions {
+		first, err := crypto.DeriveKey(ctx, []byte("passphrase"), salt, opts)
+		if err != nil {
+			t.Errorf("error while deriving key with %s: %s", opts.Algorithm, err.Error())
+			continue
+		}
+		second, _ := crypto.DeriveKey(ctx, []byte("passphrase"), salt, opts)
+		if len(first) != 32 || string(first) != string(second) {
+			t.Errorf("error: %s did not derive a stable 32-byte key", opts.Algorithm)
+		}
+	}
+}
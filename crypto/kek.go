@@ -0,0 +1,405 @@
+package crypto
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+const (
+	// KEKAlgorithmRSAOAEP256 identifies data keys wrapped with RSA-OAEP using SHA-256.
+	KEKAlgorithmRSAOAEP256 = "RSA-OAEP-256"
+
+	// KEKAlgorithmA128KW identifies data keys wrapped with AES-128 key wrap (RFC 3394).
+	KEKAlgorithmA128KW = "A128KW"
+
+	// KEKAlgorithmA192KW identifies data keys wrapped with AES-192 key wrap (RFC 3394).
+	KEKAlgorithmA192KW = "A192KW"
+
+	// KEKAlgorithmA256KW identifies data keys wrapped with AES-256 key wrap (RFC 3394).
+	KEKAlgorithmA256KW = "A256KW"
+
+	// DataKeyCipherA256GCM identifies data encrypted with AES-256-GCM using a random data key.
+	DataKeyCipherA256GCM = "A256GCM"
+)
+
+// keyWrapIV is the default initial value defined in RFC 3394 section 2.2.3.1.
+var keyWrapIV = []byte{0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6}
+
+// KeyEncryptionKey represents a key that wraps (encrypts) and unwraps (decrypts) the random data keys used for
+// envelope encryption.
+//
+// The interface only deals with data keys, so an implementation backed by a key management service can simply
+// call the service's wrap and unwrap operations without the key encryption key ever leaving the service.
+type KeyEncryptionKey interface {
+	// ID returns the identifier of the key which is stored alongside the wrapped data key.
+	ID() string
+
+	// Algorithm returns the name of the algorithm used to wrap data keys.
+	Algorithm() string
+
+	// WrapKey encrypts the given data key.
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+
+	// UnwrapKey decrypts a data key that was previously wrapped by WrapKey.
+	UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error)
+}
+
+// DataKeyEnvelope holds data encrypted with a random data key along with the data key wrapped by a key encryption
+// key.
+//
+// The envelope can be stored as JSON. The key ID, algorithm, cipher and wrapped key are authenticated along with
+// the ciphertext.
+type DataKeyEnvelope struct {
+	// KeyID is the ID of the key encryption key that wrapped the data key.
+	KeyID string `json:"kid"`
+
+	// Algorithm is the algorithm used to wrap the data key.
+	Algorithm string `json:"alg"`
+
+	// WrappedKey is the wrapped data key.
+	WrappedKey []byte `json:"wrapped_key"`
+
+	// Cipher is the cipher used to encrypt the data with the data key.
+	Cipher string `json:"enc"`
+
+	// Nonce is the nonce used when encrypting the data.
+	Nonce []byte `json:"nonce"`
+
+	// Ciphertext is the encrypted data.
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// additionalData returns the envelope fields which are authenticated along with the ciphertext.
+func (e *DataKeyEnvelope) additionalData() []byte {
+	var data []byte
+	for _, field := range [][]byte{[]byte(e.KeyID), []byte(e.Algorithm), []byte(e.Cipher), e.WrappedKey} {
+		data = appendUint32(data, uint32(len(field)))
+		data = append(data, field...)
+	}
+	return data
+}
+
+// EncryptWithKEK encrypts the plaintext with a new random AES-256 data key and wraps the data key with the given
+// key encryption key.
+//
+// The following errors are returned by this function:
+// ErrEncryptFailure, ErrGenerateRandomKeyFailure, ErrWrapKeyFailure, ErrGenerateCipherFailure,
+// ErrGenerateGCMFailure, ErrGenerateNonceFailure
+func EncryptWithKEK(ctx context.Context, plaintext []byte, kek KeyEncryptionKey) (*DataKeyEnvelope, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// validate parameters
+	if kek == nil {
+		e := &ErrEncryptFailure{Err: errors.New("no key encryption key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	logger = logger.With().Str("key_id", kek.ID()).Str("algorithm", kek.Algorithm()).Logger()
+
+	// generate and wrap a random data key
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		e := &ErrGenerateRandomKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	defer zeroBytes(dataKey)
+	wrappedKey, err := kek.WrapKey(ctx, dataKey)
+	if err != nil {
+		e := &ErrWrapKeyFailure{KeyID: kek.ID(), Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	// encrypt the data
+	aesGCM, err := newAESGCM(dataKey)
+	if err != nil {
+		logger.Error().Err(err).Msg(err.Error())
+		return nil, err
+	}
+	nonce, err := generateNonce(aesGCM.NonceSize())
+	if err != nil {
+		logger.Error().Err(err).Msg(err.Error())
+		return nil, err
+	}
+	env := &DataKeyEnvelope{
+		KeyID:      kek.ID(),
+		Algorithm:  kek.Algorithm(),
+		WrappedKey: wrappedKey,
+		Cipher:     DataKeyCipherA256GCM,
+		Nonce:      nonce,
+	}
+	env.Ciphertext = aesGCM.Seal(nil, nonce, plaintext, env.additionalData())
+	return env, nil
+}
+
+// DecryptWithKEK unwraps the data key in the envelope with the given key encryption key and uses it to decrypt
+// the data.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure, ErrUnwrapKeyFailure, ErrGenerateCipherFailure, ErrGenerateGCMFailure
+func DecryptWithKEK(ctx context.Context, env *DataKeyEnvelope, kek KeyEncryptionKey) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// validate parameters
+	if env == nil {
+		e := &ErrDecryptFailure{Err: errors.New("no envelope was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if kek == nil {
+		e := &ErrDecryptFailure{Err: errors.New("no key encryption key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	logger = logger.With().Str("key_id", env.KeyID).Str("algorithm", env.Algorithm).Logger()
+	if env.KeyID != kek.ID() {
+		e := &ErrDecryptFailure{Err: fmt.Errorf("data key was wrapped by key '%s' but key '%s' was provided",
+			env.KeyID, kek.ID())}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if env.Algorithm != kek.Algorithm() {
+		e := &ErrDecryptFailure{Err: fmt.Errorf("data key was wrapped using '%s' but key uses '%s'",
+			env.Algorithm, kek.Algorithm())}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if env.Cipher != DataKeyCipherA256GCM {
+		e := &ErrDecryptFailure{Err: fmt.Errorf("unsupported cipher: %s", env.Cipher)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	// unwrap the data key
+	dataKey, err := kek.UnwrapKey(ctx, env.WrappedKey)
+	if err != nil {
+		e := &ErrUnwrapKeyFailure{KeyID: env.KeyID, Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	defer zeroBytes(dataKey)
+
+	// decrypt the data
+	aesGCM, err := newAESGCM(dataKey)
+	if err != nil {
+		logger.Error().Err(err).Msg(err.Error())
+		return nil, err
+	}
+	if len(env.Nonce) != aesGCM.NonceSize() {
+		e := &ErrDecryptFailure{Err: errors.New("invalid nonce size")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	plaintext, err := aesGCM.Open(nil, env.Nonce, env.Ciphertext, env.additionalData())
+	if err != nil {
+		e := &ErrDecryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return plaintext, nil
+}
+
+// RSAKeyEncryptionKey is a local key encryption key which wraps data keys using RSA-OAEP with SHA-256.
+type RSAKeyEncryptionKey struct {
+	id         string
+	publicKey  *rsa.PublicKey
+	privateKey *rsa.PrivateKey
+}
+
+// NewRSAKeyEncryptionKey creates a new RSAKeyEncryptionKey object.
+//
+// The private key may be nil if the key will only be used to wrap data keys. If the public key is nil, the public
+// portion of the private key is used.
+//
+// The following errors are returned by this function:
+// ErrUnsupportedKey
+func NewRSAKeyEncryptionKey(ctx context.Context, id string, publicKey *rsa.PublicKey, privateKey *rsa.PrivateKey) (
+	*RSAKeyEncryptionKey, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if publicKey == nil && privateKey != nil {
+		publicKey = &privateKey.PublicKey
+	}
+	if publicKey == nil {
+		e := &ErrUnsupportedKey{Err: errors.New("no public or private key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return &RSAKeyEncryptionKey{
+		id:         id,
+		publicKey:  publicKey,
+		privateKey: privateKey,
+	}, nil
+}
+
+// ID returns the identifier of the key.
+func (k *RSAKeyEncryptionKey) ID() string {
+	return k.id
+}
+
+// Algorithm returns the name of the algorithm used to wrap data keys.
+func (k *RSAKeyEncryptionKey) Algorithm() string {
+	return KEKAlgorithmRSAOAEP256
+}
+
+// WrapKey encrypts the given data key with the RSA public key.
+func (k *RSAKeyEncryptionKey) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, k.publicKey, dataKey, nil)
+}
+
+// UnwrapKey decrypts the given data key with the RSA private key.
+func (k *RSAKeyEncryptionKey) UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error) {
+	if k.privateKey == nil {
+		return nil, errors.New("key encryption key does not have a private key")
+	}
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, k.privateKey, wrappedKey, nil)
+}
+
+// AESKeyEncryptionKey is a local key encryption key which wraps data keys using the AES key wrap algorithm defined
+// in RFC 3394.
+type AESKeyEncryptionKey struct {
+	id  string
+	key []byte
+}
+
+// NewAESKeyEncryptionKey creates a new AESKeyEncryptionKey object.
+//
+// The key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256 key wrap, respectively.
+//
+// The following errors are returned by this function:
+// ErrGenerateCipherFailure
+func NewAESKeyEncryptionKey(ctx context.Context, id string, key []byte) (*AESKeyEncryptionKey, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if _, err := aes.NewCipher(key); err != nil {
+		e := &ErrGenerateCipherFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return &AESKeyEncryptionKey{
+		id:  id,
+		key: append([]byte{}, key...),
+	}, nil
+}
+
+// ID returns the identifier of the key.
+func (k *AESKeyEncryptionKey) ID() string {
+	return k.id
+}
+
+// Algorithm returns the name of the algorithm used to wrap data keys.
+func (k *AESKeyEncryptionKey) Algorithm() string {
+	switch len(k.key) {
+	case 16:
+		return KEKAlgorithmA128KW
+	case 24:
+		return KEKAlgorithmA192KW
+	}
+	return KEKAlgorithmA256KW
+}
+
+// WrapKey encrypts the given data key using AES key wrap.
+func (k *AESKeyEncryptionKey) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	return aesKeyWrap(k.key, dataKey)
+}
+
+// UnwrapKey decrypts the given data key using AES key wrap.
+func (k *AESKeyEncryptionKey) UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error) {
+	return aesKeyUnwrap(k.key, wrappedKey)
+}
+
+// aesKeyWrap wraps the plaintext key according to RFC 3394 section 2.2.1.
+func aesKeyWrap(kek, plaintext []byte) ([]byte, error) {
+	if len(plaintext) < 16 || len(plaintext)%8 != 0 {
+		return nil, errors.New("key to wrap must be a multiple of 8 bytes and at least 16 bytes long")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(plaintext) / 8
+	out := make([]byte, 8+len(plaintext))
+	copy(out, keyWrapIV)
+	copy(out[8:], plaintext)
+
+	buf := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, out[:8])
+			copy(buf[8:], out[i*8:i*8+8])
+			block.Encrypt(buf, buf)
+
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(buf[:8])^t)
+			copy(out[i*8:], buf[8:])
+		}
+	}
+	return out, nil
+}
+
+// aesKeyUnwrap unwraps the wrapped key according to RFC 3394 section 2.2.2 and checks its integrity.
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, errors.New("wrapped key must be a multiple of 8 bytes and at least 24 bytes long")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, len(wrapped)-8)
+	copy(r, wrapped[8:])
+
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a)^t)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+
+			copy(a, buf[:8])
+			copy(r[(i-1)*8:], buf[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(a, keyWrapIV) != 1 {
+		zeroBytes(r)
+		return nil, errors.New("integrity check of wrapped key failed")
+	}
+	return r, nil
+}
+
+// zeroBytes overwrites the given slice with zeros.
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,117 @@
+package crypto_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"testing"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestAESKeyWrapVectors(t *testing.T) {
+	ctx := context.TODO()
+
+	// test vectors from RFC 3394 sections 4.1 and 4.6
+	vectors := []struct {
+		kek, key, wrapped string
+	}{
+		{
+			kek:     "000102030405060708090A0B0C0D0E0F",
+			key:     "00112233445566778899AABBCCDDEEFF",
+			wrapped: "1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5",
+		},
+		{
+			kek:     "000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			key:     "00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F",
+			wrapped: "28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21",
+		},
+	}
+	for _, v := range vectors {
+		kekBytes, _ := hex.DecodeString(v.kek)
+		key, _ := hex.DecodeString(v.key)
+		expected, _ := hex.DecodeString(v.wrapped)
+
+		kek, err := crypto.NewAESKeyEncryptionKey(ctx, "test", kekBytes)
+		if err != nil {
+			t.Fatalf("error while creating key encryption key: %s", err.Error())
+		}
+		wrapped, err := kek.WrapKey(ctx, key)
+		if err != nil {
+			t.Fatalf("error while wrapping key: %s", err.Error())
+		}
+		if !bytes.Equal(wrapped, expected) {
+			t.Errorf("want: %X, got: %X", expected, wrapped)
+		}
+		unwrapped, err := kek.UnwrapKey(ctx, wrapped)
+		if err != nil {
+			t.Fatalf("error while unwrapping key: %s", err.Error())
+		}
+		if !bytes.Equal(unwrapped, key) {
+			t.Errorf("want: %X, got: %X", key, unwrapped)
+		}
+
+		wrapped[len(wrapped)-1] ^= 0x01
+		if _, err := kek.UnwrapKey(ctx, wrapped); err == nil {
+			t.Errorf("error: got nil, expected error for altered wrapped key")
+		}
+	}
+}
+
+func TestEnvelopeEncryptionWithKEK(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error: failed to generate random private key")
+	}
+	rsaKEK, err := crypto.NewRSAKeyEncryptionKey(ctx, "rsa-1", nil, privateKey)
+	if err != nil {
+		t.Fatalf("error while creating RSA key encryption key: %s", err.Error())
+	}
+	aesKey := make([]byte, 32)
+	_, _ = rand.Read(aesKey)
+	aesKEK, err := crypto.NewAESKeyEncryptionKey(ctx, "aes-1", aesKey)
+	if err != nil {
+		t.Fatalf("error while creating AES key encryption key: %s", err.Error())
+	}
+
+	for _, kek := range []crypto.KeyEncryptionKey{rsaKEK, aesKEK} {
+		t.Logf("*** testing %s ***", kek.Algorithm())
+		env, err := crypto.EncryptWithKEK(ctx, []byte(TestContents), kek)
+		if err != nil {
+			t.Fatalf("error while encrypting: %s", err.Error())
+		}
+		if env.KeyID != kek.ID() || env.Algorithm != kek.Algorithm() {
+			t.Errorf("error: unexpected envelope key ID or algorithm: %s, %s", env.KeyID, env.Algorithm)
+		}
+		plaintext, err := crypto.DecryptWithKEK(ctx, env, kek)
+		if err != nil {
+			t.Fatalf("error while decrypting: %s", err.Error())
+		}
+		if string(plaintext) != TestContents {
+			t.Errorf("want: %s, got: %s", TestContents, plaintext)
+		}
+
+		env.Ciphertext[0] ^= 0x01
+		if _, err := crypto.DecryptWithKEK(ctx, env, kek); err == nil {
+			t.Errorf("error: got nil, expected error for altered ciphertext")
+		}
+	}
+
+	t.Log("*** testing missing RSA key ***")
+	_, err = crypto.NewRSAKeyEncryptionKey(ctx, "rsa-2", nil, nil)
+	if _, ok := err.(*crypto.ErrUnsupportedKey); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrUnsupportedKey", err)
+	}
+
+	t.Log("*** testing mismatched key encryption key ***")
+	env, _ := crypto.EncryptWithKEK(ctx, []byte(TestContents), rsaKEK)
+	if _, err := crypto.DecryptWithKEK(ctx, env, aesKEK); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
@@ -0,0 +1,261 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+// KeyRing holds a set of named encryption keys, one of which is marked as the primary key.
+//
+// Data is always encrypted with the primary key and the key's ID is recorded in the ciphertext envelope so the
+// correct key can be selected when the data is decrypted. This allows keys to be rotated by adding a new primary
+// key, re-encrypting existing ciphertext with Rewrap() and finally removing the old key.
+//
+// A KeyRing is safe for concurrent use.
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[string]string
+	primary string
+}
+
+// NewKeyRing creates a new, empty KeyRing object.
+func NewKeyRing() *KeyRing {
+	return &KeyRing{
+		keys: map[string]string{},
+	}
+}
+
+// AddKey adds a key to the key ring.
+//
+// The key is treated in the same way as the key passed to EncryptString(). If primary is true or the key ring does
+// not yet have a primary key, the key becomes the primary key.
+//
+// The following errors are returned by this function:
+// ErrKeyRingFailure
+func (kr *KeyRing) AddKey(ctx context.Context, id, key string, primary bool) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("key_id", id).Logger()
+
+	// validate parameters
+	if id == "" {
+		e := &ErrKeyRingFailure{KeyID: id, Err: errors.New("no key ID was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if len(id) > maxKeyIDLength {
+		e := &ErrKeyRingFailure{KeyID: id, Err: fmt.Errorf("key ID may not be longer than %d bytes", maxKeyIDLength)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if key == "" {
+		e := &ErrKeyRingFailure{KeyID: id, Err: errors.New("no key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.keys[id]; ok {
+		e := &ErrKeyRingFailure{KeyID: id, Err: errors.New("a key with the same ID already exists")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	kr.keys[id] = key
+	if primary || kr.primary == "" {
+		kr.primary = id
+	}
+	return nil
+}
+
+// RemoveKey removes a key from the key ring.
+//
+// The primary key cannot be removed. Make another key the primary key first.
+//
+// The following errors are returned by this function:
+// ErrKeyRingFailure
+func (kr *KeyRing) RemoveKey(ctx context.Context, id string) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("key_id", id).Logger()
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.keys[id]; !ok {
+		e := &ErrKeyRingFailure{KeyID: id, Err: errors.New("key was not found in the key ring")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if kr.primary == id {
+		e := &ErrKeyRingFailure{KeyID: id, Err: errors.New("the primary key cannot be removed")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	delete(kr.keys, id)
+	return nil
+}
+
+// SetPrimary marks the key with the given ID as the primary key.
+//
+// The following errors are returned by this function:
+// ErrKeyRingFailure
+func (kr *KeyRing) SetPrimary(ctx context.Context, id string) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("key_id", id).Logger()
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.keys[id]; !ok {
+		e := &ErrKeyRingFailure{KeyID: id, Err: errors.New("key was not found in the key ring")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	kr.primary = id
+	return nil
+}
+
+// Primary returns the ID of the primary key or an empty string if the key ring is empty.
+func (kr *KeyRing) Primary() string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.primary
+}
+
+// KeyIDs returns the sorted IDs of all of the keys in the key ring.
+func (kr *KeyRing) KeyIDs() []string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	ids := make([]string, 0, len(kr.keys))
+	for id := range kr.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// EncryptString encrypts the given string using the primary key and records the primary key's ID in the
+// ciphertext envelope.
+//
+// The following errors are returned by this function:
+// ErrEncryptFailure, any error returned by EncryptStringWithKeyID
+func (kr *KeyRing) EncryptString(ctx context.Context, plaintext string) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	kr.mu.RLock()
+	id, key := kr.primary, kr.keys[kr.primary]
+	kr.mu.RUnlock()
+	if id == "" {
+		e := &ErrEncryptFailure{Err: errors.New("key ring does not have a primary key")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	return EncryptStringWithKeyID(ctx, plaintext, key, id)
+}
+
+// DecryptString decrypts the given ciphertext using the key whose ID is recorded in the ciphertext envelope.
+//
+// Ciphertext that does not carry a key ID, such as ciphertext in the legacy format or produced by EncryptString()
+// without a key ID, is decrypted by trying each key in the key ring in turn. Ciphertext with an embedded random
+// key is rejected since it was not encrypted with a key in the key ring.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure, any error returned by DecryptString
+func (kr *KeyRing) DecryptString(ctx context.Context, ciphertext string) (string, error) {
+	plaintext, _, err := kr.decryptString(ctx, ciphertext)
+	return plaintext, err
+}
+
+// Rewrap re-encrypts the given ciphertext using the primary key.
+//
+// Ciphertext that is already encrypted with the primary key is returned unchanged. Use this function after
+// rotating to a new primary key to migrate existing ciphertext before removing the old key.
+//
+// The following errors are returned by this function:
+// any error returned by DecryptString or EncryptString
+func (kr *KeyRing) Rewrap(ctx context.Context, ciphertext string) (string, error) {
+	plaintext, id, err := kr.decryptString(ctx, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if id != "" && id == kr.Primary() {
+		return ciphertext, nil
+	}
+	return kr.EncryptString(ctx, plaintext)
+}
+
+// decryptString decrypts the given ciphertext and returns the plaintext along with the ID of the key whose ID was
+// recorded in the envelope with the SHA-256 KDF.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure, any error returned by DecryptString
+func (kr *KeyRing) decryptString(ctx context.Context, ciphertext string) (string, string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// decrypt using the key named in the envelope
+	var env *CiphertextEnvelope
+	if IsCiphertextEnvelope(ciphertext) {
+		var err error
+		if env, err = ParseCiphertextEnvelope(ctx, ciphertext); err != nil {
+			return "", "", err
+		}
+		if env.KDF == KDFEmbeddedKey {
+			// anyone can create ciphertext with an embedded key, so it was not encrypted with a key in the ring
+			e := &ErrDecryptFailure{Err: errors.New("ciphertext with an embedded key is not accepted by a key ring")}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return "", "", e
+		}
+	}
+	if env != nil && env.KeyID != "" {
+		logger = logger.With().Str("key_id", env.KeyID).Logger()
+		kr.mu.RLock()
+		key, ok := kr.keys[env.KeyID]
+		kr.mu.RUnlock()
+		if !ok {
+			e := &ErrDecryptFailure{Err: fmt.Errorf("key '%s' was not found in the key ring", env.KeyID)}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return "", "", e
+		}
+		plaintext, err := DecryptString(ctx, ciphertext, key)
+		if err != nil || env.KDF != KDFSHA256 {
+			return plaintext, "", err
+		}
+		return plaintext, env.KeyID, nil
+	}
+
+	// no key ID is available so try each key - failures are expected so they are not logged
+	nop := zerolog.Nop()
+	quietCtx := nop.WithContext(ctx)
+	for _, id := range kr.KeyIDs() {
+		kr.mu.RLock()
+		key, ok := kr.keys[id]
+		kr.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		if plaintext, err := DecryptString(quietCtx, ciphertext, key); err == nil {
+			return plaintext, "", nil
+		}
+	}
+	e := &ErrDecryptFailure{Err: errors.New("none of the keys in the key ring could decrypt the data")}
+	logger.Error().Err(e.Err).Msg(e.Error())
+	return "", "", e
+}
@@ -0,0 +1,128 @@
+package crypto_test
+
+import (
+	"context"
+	"testing"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestKeyRingRotation(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	kr := crypto.NewKeyRing()
+	if err := kr.AddKey(ctx, "2021-q4", "old_key", false); err != nil {
+		t.Fatalf("error while adding key: %s", err.Error())
+	}
+	old, err := kr.EncryptString(ctx, "test_string")
+	if err != nil {
+		t.Fatalf("error while encrypting string: %s", err.Error())
+	}
+
+	// rotate to a new primary key
+	if err := kr.AddKey(ctx, "2022-q1", "new_key", true); err != nil {
+		t.Fatalf("error while adding key: %s", err.Error())
+	}
+	if kr.Primary() != "2022-q1" {
+		t.Fatalf("error: primary key is %s, expected 2022-q1", kr.Primary())
+	}
+	plaintext, err := kr.DecryptString(ctx, old)
+	if err != nil {
+		t.Fatalf("error while decrypting string with old key: %s", err.Error())
+	}
+	if plaintext != "test_string" {
+		t.Errorf("want: test_string, got: %s", plaintext)
+	}
+
+	// re-encrypt under the new key and remove the old key
+	rewrapped, err := kr.Rewrap(ctx, old)
+	if err != nil {
+		t.Fatalf("error while rewrapping string: %s", err.Error())
+	}
+	env, err := crypto.ParseCiphertextEnvelope(ctx, rewrapped)
+	if err != nil {
+		t.Fatalf("error while parsing envelope: %s", err.Error())
+	}
+	if env.KeyID != "2022-q1" {
+		t.Errorf("error: rewrapped key ID is %s, expected 2022-q1", env.KeyID)
+	}
+	if again, _ := kr.Rewrap(ctx, rewrapped); again != rewrapped {
+		t.Errorf("error: ciphertext already using the primary key was rewrapped")
+	}
+	if err := kr.RemoveKey(ctx, "2021-q4"); err != nil {
+		t.Fatalf("error while removing key: %s", err.Error())
+	}
+	if _, err := kr.DecryptString(ctx, old); err == nil {
+		t.Errorf("error: got nil, expected error after removing old key")
+	} else if _, ok := err.(*crypto.ErrDecryptFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrDecryptFailure", err)
+	}
+	if plaintext, err := kr.DecryptString(ctx, rewrapped); err != nil || plaintext != "test_string" {
+		t.Errorf("error: failed to decrypt rewrapped string")
+	}
+}
+
+func TestKeyRingUntaggedCiphertext(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	kr := crypto.NewKeyRing()
+	_ = kr.AddKey(ctx, "a", "some_key", false)
+	_ = kr.AddKey(ctx, "b", "other_key", true)
+
+	// ciphertext without a key ID, including the legacy format, is decrypted by trying every key
+	for _, ciphertext := range []string{"t6xr9YA+BqEcXdb7SVbqWXAFUnSedU5rS7khfqWVHjitBEM2FKn8sVo="} {
+		rewrapped, err := kr.Rewrap(ctx, ciphertext)
+		if err != nil {
+			t.Fatalf("error while rewrapping string: %s", err.Error())
+		}
+		plaintext, err := kr.DecryptString(ctx, rewrapped)
+		if err != nil || plaintext != "legacy_string" {
+			t.Errorf("error: failed to decrypt rewrapped legacy string")
+		}
+	}
+}
+
+func TestKeyRingFailure(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	kr := crypto.NewKeyRing()
+	if _, err := kr.EncryptString(ctx, "test_string"); err == nil {
+		t.Errorf("error: got nil, expected error for empty key ring")
+	}
+	_ = kr.AddKey(ctx, "a", "some_key", false)
+	if err := kr.AddKey(ctx, "a", "other_key", false); err == nil {
+		t.Errorf("error: got nil, expected error for duplicate key ID")
+	}
+	if err := kr.RemoveKey(ctx, "a"); err == nil {
+		t.Errorf("error: got nil, expected error for removing primary key")
+	}
+	if err := kr.SetPrimary(ctx, "missing"); err == nil {
+		t.Errorf("error: got nil, expected error for missing key")
+	}
+}
+
+func TestKeyRingEmbeddedKey(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	kr := crypto.NewKeyRing()
+	_ = kr.AddKey(ctx, "a", "some_key", true)
+
+	// ciphertext with an embedded key can be created without any key in the ring
+	forged, err := crypto.EncryptString(ctx, "attacker", "")
+	if err != nil {
+		t.Fatalf("error while encrypting string: %s", err.Error())
+	}
+	_, err = kr.DecryptString(ctx, forged)
+	if _, ok := err.(*crypto.ErrDecryptFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrDecryptFailure", err)
+	}
+	_, err = kr.Rewrap(ctx, forged)
+	if _, ok := err.(*crypto.ErrDecryptFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrDecryptFailure", err)
+	}
+}
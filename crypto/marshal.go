@@ -0,0 +1,314 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+// PEM block types for public keys, certificates and certificate requests.
+const (
+	PEMTypePublicKey          = "PUBLIC KEY"
+	PEMTypeCertificate        = "CERTIFICATE"
+	PEMTypeCertificateRequest = "CERTIFICATE REQUEST"
+)
+
+// PrivateKeyMarshalOptions holds the options used when encoding a private key.
+type PrivateKeyMarshalOptions struct {
+	// Format is the encoding of the key. If not set, PrivateKeyFormatPKCS8 is used. PKCS#1 only supports RSA keys and
+	// SEC1 only supports ECDSA keys. OpenSSH encoding is not supported.
+	Format PrivateKeyFormat
+
+	// Password is used to encrypt the key if it is not empty. Only PKCS#8 keys can be encrypted.
+	Password []byte
+
+	// Encryption holds the options used to encrypt the key. It is ignored if no password is set. If nil, the
+	// defaults described for EncryptPKCS8PrivateKey() are used.
+	Encryption *PKCS8EncryptionOptions
+}
+
+// MarshalPrivateKeyDER encodes the private key as DER data in the given format.
+//
+// The following errors are returned by this function:
+// ErrEncodeFailure, ErrUnsupportedKey
+func MarshalPrivateKeyDER(ctx context.Context, key crypto.Signer, format PrivateKeyFormat) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if key == nil {
+		e := &ErrEncodeFailure{Err: errors.New("no private key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if format == 0 {
+		format = PrivateKeyFormatPKCS8
+	}
+	logger = logger.With().Str("format", format.String()).Logger()
+
+	switch format {
+	case PrivateKeyFormatPKCS1:
+		if k, ok := key.(*rsa.PrivateKey); ok {
+			return x509.MarshalPKCS1PrivateKey(k), nil
+		}
+	case PrivateKeyFormatPKCS8:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			e := &ErrUnsupportedKey{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		return der, nil
+	case PrivateKeyFormatSEC1:
+		if k, ok := key.(*ecdsa.PrivateKey); ok {
+			der, err := x509.MarshalECPrivateKey(k)
+			if err != nil {
+				e := &ErrEncodeFailure{Err: err}
+				logger.Error().Err(e.Err).Msg(e.Error())
+				return nil, e
+			}
+			return der, nil
+		}
+	default:
+		e := &ErrEncodeFailure{Err: fmt.Errorf("%s keys cannot be encoded as DER data", format)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	e := &ErrUnsupportedKey{Err: fmt.Errorf("%T cannot be encoded as a %s private key", key, format)}
+	logger.Error().Err(e.Err).Msg(e.Error())
+	return nil, e
+}
+
+// MarshalPrivateKeyPEM encodes the private key as a PEM block using the given options.
+//
+// If opts is nil, the key is encoded as an unencrypted PKCS#8 "PRIVATE KEY" block. If a password is set, the key is
+// encrypted and encoded as an "ENCRYPTED PRIVATE KEY" block.
+//
+// The following errors are returned by this function:
+// ErrEncodeFailure, ErrUnsupportedKey, any error returned by EncryptPKCS8PrivateKey
+func MarshalPrivateKeyPEM(ctx context.Context, key crypto.Signer, opts *PrivateKeyMarshalOptions) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	o := PrivateKeyMarshalOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Format == 0 {
+		o.Format = PrivateKeyFormatPKCS8
+	}
+
+	// encrypted keys are always PKCS#8
+	if len(o.Password) > 0 {
+		if o.Format != PrivateKeyFormatPKCS8 {
+			e := &ErrEncodeFailure{Err: fmt.Errorf("%s keys cannot be encrypted; use PKCS#8 instead", o.Format)}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		block, err := EncryptPKCS8PrivateKey(ctx, key, o.Password, o.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(block), nil
+	}
+
+	der, err := MarshalPrivateKeyDER(ctx, key, o.Format)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(der)
+	blockType := PEMTypePrivateKey
+	switch o.Format {
+	case PrivateKeyFormatPKCS1:
+		blockType = PEMTypeRSAPrivateKey
+	case PrivateKeyFormatSEC1:
+		blockType = PEMTypeECPrivateKey
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), nil
+}
+
+// MarshalPublicKeyDER encodes the public key as DER-encoded PKIX data.
+//
+// The key must be an RSA, ECDSA or Ed25519 public key.
+//
+// The following errors are returned by this function:
+// ErrUnsupportedKey
+func MarshalPublicKeyDER(ctx context.Context, key crypto.PublicKey) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if key == nil {
+		e := &ErrUnsupportedKey{Err: errors.New("no public key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		e := &ErrUnsupportedKey{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return der, nil
+}
+
+// MarshalPublicKeyPEM encodes the public key as a PKIX "PUBLIC KEY" PEM block.
+//
+// The following errors are returned by this function:
+// any error returned by MarshalPublicKeyDER
+func MarshalPublicKeyPEM(ctx context.Context, key crypto.PublicKey) ([]byte, error) {
+	der, err := MarshalPublicKeyDER(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypePublicKey, Bytes: der}), nil
+}
+
+// MarshalCertificatesDER concatenates the DER encoding of each certificate. The result can be parsed with
+// x509.ParseCertificates().
+//
+// The following errors are returned by this function:
+// ErrEncodeFailure
+func MarshalCertificatesDER(ctx context.Context, certs []*x509.Certificate) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if err := checkCertificates(certs); err != nil {
+		e := &ErrEncodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		buf.Write(cert.Raw)
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalCertificatesPEM encodes each certificate as a "CERTIFICATE" PEM block, in order.
+//
+// To write a certificate chain, pass the leaf certificate first followed by each intermediate certificate.
+//
+// The following errors are returned by this function:
+// ErrEncodeFailure
+func MarshalCertificatesPEM(ctx context.Context, certs []*x509.Certificate) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if err := checkCertificates(certs); err != nil {
+		e := &ErrEncodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		if err := pem.Encode(&buf, &pem.Block{Type: PEMTypeCertificate, Bytes: cert.Raw}); err != nil {
+			e := &ErrEncodeFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// WritePrivateKeyFile encodes the private key as a PEM block using the given options and writes it to the file.
+// The file is only readable by its owner.
+//
+// The following errors are returned by this function:
+// ErrWriteFileFailure, any error returned by MarshalPrivateKeyPEM
+func WritePrivateKeyFile(ctx context.Context, file string, key crypto.Signer, opts *PrivateKeyMarshalOptions) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	contents, err := MarshalPrivateKeyPEM(logger.WithContext(ctx), key, opts)
+	if err != nil {
+		return err
+	}
+	defer zeroBytes(contents)
+	if err := ioutil.WriteFile(file, contents, 0600); err != nil {
+		e := &ErrWriteFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return nil
+}
+
+// WritePublicKeyFile encodes the public key as a PKIX "PUBLIC KEY" PEM block and writes it to the file.
+//
+// The following errors are returned by this function:
+// ErrWriteFileFailure, any error returned by MarshalPublicKeyPEM
+func WritePublicKeyFile(ctx context.Context, file string, key crypto.PublicKey) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	contents, err := MarshalPublicKeyPEM(logger.WithContext(ctx), key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, contents, 0644); err != nil {
+		e := &ErrWriteFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return nil
+}
+
+// WriteCertificatesFile encodes the certificates as PEM blocks and writes them to the file.
+//
+// The following errors are returned by this function:
+// ErrWriteFileFailure, any error returned by MarshalCertificatesPEM
+func WriteCertificatesFile(ctx context.Context, file string, certs []*x509.Certificate) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	contents, err := MarshalCertificatesPEM(logger.WithContext(ctx), certs)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, contents, 0644); err != nil {
+		e := &ErrWriteFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return nil
+}
+
+// checkCertificates ensures there is at least one certificate and that each certificate has been encoded.
+func checkCertificates(certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("no certificates were provided")
+	}
+	for i, cert := range certs {
+		if cert == nil || len(cert.Raw) == 0 {
+			return fmt.Errorf("certificate %d has no DER data", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package crypto_test
+
+import (
+	"context"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestMarshalPrivateKeyPEM(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	rsaKey, _ := crypto.ParsePEMPrivateKeyBytes(ctx, []byte(SigningKey), nil)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	kdf := &crypto.KDFOptions{Algorithm: crypto.KDFPBKDF2SHA256, PBKDF2Iterations: 1000}
+
+	tests := []struct {
+		name      string
+		key       equalSigner
+		opts      *crypto.PrivateKeyMarshalOptions
+		blockType string
+	}{
+		{"pkcs1", rsaKey, &crypto.PrivateKeyMarshalOptions{Format: crypto.PrivateKeyFormatPKCS1}, "RSA PRIVATE KEY"},
+		{"pkcs8-rsa", rsaKey, nil, "PRIVATE KEY"},
+		{"pkcs8-ecdsa", ecKey, nil, "PRIVATE KEY"},
+		{"pkcs8-ed25519", edKey, nil, "PRIVATE KEY"},
+		{"sec1", ecKey, &crypto.PrivateKeyMarshalOptions{Format: crypto.PrivateKeyFormatSEC1}, "EC PRIVATE KEY"},
+		{"encrypted", edKey, &crypto.PrivateKeyMarshalOptions{Password: []byte("secret"),
+			Encryption: &crypto.PKCS8EncryptionOptions{KDF: kdf}}, "ENCRYPTED PRIVATE KEY"},
+	}
+	for _, test := range tests {
+		contents, err := crypto.MarshalPrivateKeyPEM(ctx, test.key, test.opts)
+		if err != nil {
+			t.Errorf("%s: error while encoding key: %s", test.name, err.Error())
+			continue
+		}
+		if block, _ := pem.Decode(contents); block == nil || block.Type != test.blockType {
+			t.Errorf("%s: error: PEM block type is not %s", test.name, test.blockType)
+			continue
+		}
+		var password []byte
+		if test.opts != nil {
+			password = test.opts.Password
+		}
+		key, err := crypto.ParsePrivateKeyBytes(ctx, contents, password)
+		if err != nil {
+			t.Errorf("%s: error while parsing key: %s", test.name, err.Error())
+			continue
+		}
+		if !test.key.Equal(key) {
+			t.Errorf("%s: error: parsed key does not match", test.name)
+		}
+	}
+}
+
+func TestMarshalPrivateKeyPEMFailure(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, err := crypto.MarshalPrivateKeyPEM(ctx, ecKey, &crypto.PrivateKeyMarshalOptions{
+		Format: crypto.PrivateKeyFormatPKCS1})
+	if _, ok := err.(*crypto.ErrUnsupportedKey); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrUnsupportedKey", err)
+	}
+	_, err = crypto.MarshalPrivateKeyPEM(ctx, ecKey, &crypto.PrivateKeyMarshalOptions{
+		Format: crypto.PrivateKeyFormatSEC1, Password: []byte("secret")})
+	if _, ok := err.(*crypto.ErrEncodeFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrEncodeFailure", err)
+	}
+	_, err = crypto.MarshalPrivateKeyDER(ctx, ecKey, crypto.PrivateKeyFormatOpenSSH)
+	if _, ok := err.(*crypto.ErrEncodeFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrEncodeFailure", err)
+	}
+}
+
+func TestMarshalPublicKeyPEM(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	contents, err := crypto.MarshalPublicKeyPEM(ctx, ecKey.Public())
+	if err != nil {
+		t.Fatalf("error while encoding key: %s", err.Error())
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != crypto.PEMTypePublicKey {
+		t.Fatalf("error: PEM block type is not %s", crypto.PEMTypePublicKey)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("error while parsing key: %s", err.Error())
+	}
+	if !ecKey.PublicKey.Equal(key) {
+		t.Errorf("error: parsed key does not match")
+	}
+
+	if _, err := crypto.MarshalPublicKeyPEM(ctx, nil); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func TestMarshalCertificates(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	certs, err := crypto.ParsePEMCertificateBytes(ctx, []byte(SigningCertificate))
+	if err != nil {
+		t.Fatalf("error while parsing certificate: %s", err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certPEM, _, err := crypto.NewSelfSignedCertificateKeyPair(ctx, template, 2048)
+	if err != nil {
+		t.Fatalf("error while creating certificate: %s", err.Error())
+	}
+	selfSigned, _ := crypto.ParsePEMCertificateBytes(ctx, certPEM)
+	chain := append(certs, selfSigned...)
+
+	der, err := crypto.MarshalCertificatesDER(ctx, chain)
+	if err != nil {
+		t.Fatalf("error while encoding certificates: %s", err.Error())
+	}
+	if parsed, err := x509.ParseCertificates(der); err != nil || len(parsed) != 2 || !parsed[1].Equal(chain[1]) {
+		t.Errorf("error: DER certificates do not match")
+	}
+
+	dir, err := ioutil.TempDir("", "marshal")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "chain.pem")
+	if err := crypto.WriteCertificatesFile(ctx, file, chain); err != nil {
+		t.Fatalf("error while writing certificates: %s", err.Error())
+	}
+	contents, _ := ioutil.ReadFile(file)
+	var count int
+	for block, rest := pem.Decode(contents); block != nil; block, rest = pem.Decode(rest) {
+		if cert, err := x509.ParseCertificate(block.Bytes); err != nil || !cert.Equal(chain[count]) {
+			t.Errorf("error: PEM certificate %d does not match", count)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("want: 2, got: %d", count)
+	}
+
+	if _, err := crypto.MarshalCertificatesPEM(ctx, nil); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func TestWritePrivateKeyFile(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	dir, err := ioutil.TempDir("", "marshal")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	file := filepath.Join(dir, "key.pem")
+	if err := crypto.WritePrivateKeyFile(ctx, file, key, nil); err != nil {
+		t.Fatalf("error while writing key: %s", err.Error())
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("error: key file is not private")
+	}
+	parsed, err := crypto.ParsePrivateKeyFile(ctx, file, nil)
+	if err != nil {
+		t.Fatalf("error while parsing key: %s", err.Error())
+	}
+	if !key.Equal(parsed) {
+		t.Errorf("error: parsed key does not match")
+	}
+
+	pubFile := filepath.Join(dir, "key.pub")
+	if err := crypto.WritePublicKeyFile(ctx, pubFile, key.Public()); err != nil {
+		t.Fatalf("error while writing public key: %s", err.Error())
+	}
+	if err := crypto.WritePublicKeyFile(ctx, filepath.Join(dir, "missing", "key.pub"), key.Public()); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+type equalSigner interface {
+	gocrypto.Signer
+	Equal(x gocrypto.PrivateKey) bool
+}
@@ -1,48 +1,266 @@
 package crypto
 
 import (
-	"math/rand"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
 	"strings"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
 )
 
-// GeneratePassword generates a random password with the given characteristics.
-func GeneratePassword(passwordLength, minSpecialChar, minNum, minUpperCase int) string {
-	var password strings.Builder
+// Character sets used by the default password policy.
+const (
+	// PasswordLowercaseChars holds all lowercase letters.
+	PasswordLowercaseChars = "abcdefghijklmnopqrstuvwxyz"
+
+	// PasswordUppercaseChars holds all uppercase letters.
+	PasswordUppercaseChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	// PasswordDigitChars holds all digits.
+	PasswordDigitChars = "0123456789"
+
+	// PasswordSpecialChars holds the special characters used in generated passwords.
+	PasswordSpecialChars = "!@#$%&*"
+
+	// PasswordSimilarChars holds characters which are easily mistaken for one another.
+	PasswordSimilarChars = "il1Lo0OI|"
+)
+
+// PasswordCharacterClass is a set of characters from which a password may be built.
+type PasswordCharacterClass struct {
+	// Name describes the class in error messages.
+	Name string
+
+	// Characters holds the characters in the class.
+	Characters string
+
+	// Min is the minimum number of characters from the class which must appear in the password.
+	Min int
+}
+
+// PasswordPolicy describes how passwords are generated by GeneratePasswordWithPolicy().
+type PasswordPolicy struct {
+	// Length is the length of the password.
+	Length int
+
+	// Classes holds the character classes from which the password is built. Characters are drawn from the union
+	// of all classes once the minimum for each class has been met.
+	Classes []PasswordCharacterClass
+
+	// ExcludeSimilar removes look-alike characters (see PasswordSimilarChars) from every class.
+	ExcludeSimilar bool
+
+	// ExcludeChars holds any additional characters which must not appear in the password.
+	ExcludeChars string
+
+	// NoRepeats prevents any character from appearing more than once in the password.
+	NoRepeats bool
+}
+
+// DefaultPasswordPolicy returns a policy for 32-character passwords containing at least 5 uppercase letters,
+// 5 digits and 5 special characters.
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		Length: 32,
+		Classes: []PasswordCharacterClass{
+			{Name: "lowercase", Characters: PasswordLowercaseChars},
+			{Name: "uppercase", Characters: PasswordUppercaseChars, Min: 5},
+			{Name: "digit", Characters: PasswordDigitChars, Min: 5},
+			{Name: "special", Characters: PasswordSpecialChars, Min: 5},
+		},
+	}
+}
+
+// Entropy returns the number of bits of entropy in a password generated with the policy.
+//
+// The estimate assumes every character is chosen uniformly from the full alphabet, so it slightly overstates the
+// entropy of policies with large minimums for small classes.
+//
+// The following errors are returned by this function:
+// ErrGeneratePasswordFailure
+func (p *PasswordPolicy) Entropy() (float64, error) {
+	_, alphabet, err := p.resolve()
+	if err != nil {
+		return 0, &ErrGeneratePasswordFailure{Err: err}
+	}
+
+	n := float64(len(alphabet))
+	if !p.NoRepeats {
+		return float64(p.Length) * math.Log2(n), nil
+	}
+	var bits float64
+	for i := 0; i < p.Length; i++ {
+		bits += math.Log2(n - float64(i))
+	}
+	return bits, nil
+}
 
-	var (
-		lowerCharSet   = "abcdedfghijklmnopqrst"
-		upperCharSet   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
-		specialCharSet = "!@#$%&*"
-		numberSet      = "0123456789"
-		allCharSet     = lowerCharSet + upperCharSet + specialCharSet + numberSet
-	)
+// resolve applies the exclusions to each character class and returns the resulting classes along with the union
+// of all of their characters. An error is returned if the policy cannot be met.
+func (p *PasswordPolicy) resolve() ([][]rune, []rune, error) {
+	if p.Length <= 0 {
+		return nil, nil, errors.New("password length must be greater than 0")
+	}
+	if len(p.Classes) == 0 {
+		return nil, nil, errors.New("at least one character class is required")
+	}
+	exclude := p.ExcludeChars
+	if p.ExcludeSimilar {
+		exclude += PasswordSimilarChars
+	}
+
+	classes := make([][]rune, len(p.Classes))
+	seen := map[rune]bool{}
+	alphabet := []rune{}
+	minTotal := 0
+	for i, class := range p.Classes {
+		classSeen := map[rune]bool{}
+		for _, r := range class.Characters {
+			if classSeen[r] || strings.ContainsRune(exclude, r) {
+				continue
+			}
+			classSeen[r] = true
+			classes[i] = append(classes[i], r)
+			if !seen[r] {
+				seen[r] = true
+				alphabet = append(alphabet, r)
+			}
+		}
 
-	//Set special character
-	for i := 0; i < minSpecialChar; i++ {
-		random := rand.Intn(len(specialCharSet))
-		password.WriteString(string(specialCharSet[random]))
+		if class.Min < 0 {
+			return nil, nil, fmt.Errorf("minimum for %s characters may not be negative", class.Name)
+		}
+		if class.Min > 0 && len(classes[i]) == 0 {
+			return nil, nil, fmt.Errorf("no %s characters are available after exclusions", class.Name)
+		}
+		if p.NoRepeats && class.Min > len(classes[i]) {
+			return nil, nil, fmt.Errorf("only %d unique %s characters are available but %d are required",
+				len(classes[i]), class.Name, class.Min)
+		}
+		minTotal += class.Min
+	}
+	if minTotal > p.Length {
+		return nil, nil, fmt.Errorf("character class minimums add up to %d but password length is %d", minTotal,
+			p.Length)
+	}
+	if p.NoRepeats && len(alphabet) < p.Length {
+		return nil, nil, fmt.Errorf("only %d unique characters are available but password length is %d",
+			len(alphabet), p.Length)
+	}
+	return classes, alphabet, nil
+}
+
+// GeneratePasswordWithPolicy generates a random password which satisfies the given policy.
+//
+// Characters are chosen using crypto/rand. If policy is nil, DefaultPasswordPolicy() is used.
+//
+// The following errors are returned by this function:
+// ErrGeneratePasswordFailure
+func GeneratePasswordWithPolicy(ctx context.Context, policy *PasswordPolicy) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
 	}
 
-	//Set numeric
-	for i := 0; i < minNum; i++ {
-		random := rand.Intn(len(numberSet))
-		password.WriteString(string(numberSet[random]))
+	if policy == nil {
+		policy = DefaultPasswordPolicy()
+	}
+	classes, alphabet, err := policy.resolve()
+	if err != nil {
+		e := &ErrGeneratePasswordFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
 	}
 
-	//Set uppercase
-	for i := 0; i < minUpperCase; i++ {
-		random := rand.Intn(len(upperCharSet))
-		password.WriteString(string(upperCharSet[random]))
+	used := map[rune]bool{}
+	password := make([]rune, 0, policy.Length)
+	pick := func(set []rune) error {
+		available := set
+		if policy.NoRepeats {
+			available = make([]rune, 0, len(set))
+			for _, r := range set {
+				if !used[r] {
+					available = append(available, r)
+				}
+			}
+			if len(available) == 0 {
+				return errors.New("policy cannot be met without repeating characters")
+			}
+		}
+		i, err := randomInt(len(available))
+		if err != nil {
+			return err
+		}
+		used[available[i]] = true
+		password = append(password, available[i])
+		return nil
 	}
 
-	remainingLength := passwordLength - minSpecialChar - minNum - minUpperCase
-	for i := 0; i < remainingLength; i++ {
-		random := rand.Intn(len(allCharSet))
-		password.WriteString(string(allCharSet[random]))
+	// satisfy the minimum for each class and then fill the rest from the full alphabet
+	for i, class := range policy.Classes {
+		for j := 0; j < class.Min; j++ {
+			if err := pick(classes[i]); err != nil {
+				e := &ErrGeneratePasswordFailure{Err: err}
+				logger.Error().Err(e.Err).Msg(e.Error())
+				return "", e
+			}
+		}
+	}
+	for len(password) < policy.Length {
+		if err := pick(alphabet); err != nil {
+			e := &ErrGeneratePasswordFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return "", e
+		}
+	}
+
+	// shuffle so the required characters are not always at the start
+	for i := len(password) - 1; i > 0; i-- {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			e := &ErrGeneratePasswordFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return "", e
+		}
+		password[i], password[j] = password[j], password[i]
+	}
+	return string(password), nil
+}
+
+// GeneratePassword generates a random password with the given characteristics.
+//
+// This is a thin wrapper around GeneratePasswordWithPolicy(). If the minimums add up to more than the password
+// length, the password is lengthened to fit them. An empty string is returned if the password cannot be generated.
+func GeneratePassword(passwordLength, minSpecialChar, minNum, minUpperCase int) string {
+	if minTotal := minSpecialChar + minNum + minUpperCase; minTotal > passwordLength {
+		passwordLength = minTotal
+	}
+	policy := &PasswordPolicy{
+		Length: passwordLength,
+		Classes: []PasswordCharacterClass{
+			{Name: "lowercase", Characters: PasswordLowercaseChars},
+			{Name: "uppercase", Characters: PasswordUppercaseChars, Min: minUpperCase},
+			{Name: "digit", Characters: PasswordDigitChars, Min: minNum},
+			{Name: "special", Characters: PasswordSpecialChars, Min: minSpecialChar},
+		},
+	}
+	password, err := GeneratePasswordWithPolicy(context.Background(), policy)
+	if err != nil {
+		return ""
+	}
+	return password
+}
+
+// randomInt returns a uniformly distributed random integer in [0, n) using crypto/rand.
+func randomInt(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
 	}
-	inRune := []rune(password.String())
-	rand.Shuffle(len(inRune), func(i, j int) {
-		inRune[i], inRune[j] = inRune[j], inRune[i]
-	})
-	return string(inRune)
+	return int(i.Int64()), nil
 }
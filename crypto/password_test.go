@@ -0,0 +1,120 @@
+package crypto_test
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestGeneratePasswordWithPolicy(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	policy := &crypto.PasswordPolicy{
+		Length: 20,
+		Classes: []crypto.PasswordCharacterClass{
+			{Name: "lowercase", Characters: crypto.PasswordLowercaseChars, Min: 2},
+			{Name: "uppercase", Characters: crypto.PasswordUppercaseChars, Min: 3},
+			{Name: "digit", Characters: crypto.PasswordDigitChars, Min: 4},
+			{Name: "special", Characters: crypto.PasswordSpecialChars, Min: 5},
+		},
+		ExcludeSimilar: true,
+		NoRepeats:      true,
+	}
+	for i := 0; i < 50; i++ {
+		password, err := crypto.GeneratePasswordWithPolicy(ctx, policy)
+		if err != nil {
+			t.Fatalf("error while generating password: %s", err.Error())
+		}
+		if len(password) != 20 {
+			t.Fatalf("want: 20 characters, got: %d", len(password))
+		}
+		for _, class := range policy.Classes {
+			count := 0
+			for _, r := range password {
+				if strings.ContainsRune(class.Characters, r) {
+					count++
+				}
+			}
+			if count < class.Min {
+				t.Fatalf("password %s has %d %s characters, expected at least %d", password, count, class.Name,
+					class.Min)
+			}
+		}
+		if strings.ContainsAny(password, crypto.PasswordSimilarChars) {
+			t.Fatalf("password %s contains look-alike characters", password)
+		}
+		seen := map[rune]bool{}
+		for _, r := range password {
+			if seen[r] {
+				t.Fatalf("password %s repeats character %c", password, r)
+			}
+			seen[r] = true
+		}
+	}
+}
+
+func TestGeneratePasswordWithPolicyFailure(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	policies := map[string]*crypto.PasswordPolicy{
+		"minimums exceed length": {
+			Length: 4,
+			Classes: []crypto.PasswordCharacterClass{
+				{Name: "digit", Characters: crypto.PasswordDigitChars, Min: 5},
+			},
+		},
+		"class excluded": {
+			Length:       8,
+			ExcludeChars: crypto.PasswordDigitChars,
+			Classes: []crypto.PasswordCharacterClass{
+				{Name: "lowercase", Characters: crypto.PasswordLowercaseChars},
+				{Name: "digit", Characters: crypto.PasswordDigitChars, Min: 1},
+			},
+		},
+		"not enough unique characters": {
+			Length:    11,
+			NoRepeats: true,
+			Classes: []crypto.PasswordCharacterClass{
+				{Name: "digit", Characters: crypto.PasswordDigitChars},
+			},
+		},
+	}
+	for name, policy := range policies {
+		if _, err := crypto.GeneratePasswordWithPolicy(ctx, policy); err == nil {
+			t.Errorf("%s: error: got nil, expected error", name)
+		} else if _, ok := err.(*crypto.ErrGeneratePasswordFailure); !ok {
+			t.Errorf("%s: error: got %T, expected *crypto.ErrGeneratePasswordFailure", name, err)
+		}
+	}
+}
+
+func TestPasswordPolicyEntropy(t *testing.T) {
+	policy := &crypto.PasswordPolicy{
+		Length: 10,
+		Classes: []crypto.PasswordCharacterClass{
+			{Name: "digit", Characters: crypto.PasswordDigitChars},
+		},
+	}
+	bits, err := policy.Entropy()
+	if err != nil {
+		t.Fatalf("error while calculating entropy: %s", err.Error())
+	}
+	if want := 10 * math.Log2(10); math.Abs(bits-want) > 1e-9 {
+		t.Errorf("want: %f, got: %f", want, bits)
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	password := crypto.GeneratePassword(16, 2, 2, 2)
+	if len(password) != 16 {
+		t.Errorf("want: 16 characters, got: %d", len(password))
+	}
+}
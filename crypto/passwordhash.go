@@ -0,0 +1,429 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordHashAlgorithm identifies the function used to hash a password.
+type PasswordHashAlgorithm int
+
+// Possible values for the password hashing algorithm.
+const (
+	_ PasswordHashAlgorithm = iota
+	PasswordHashArgon2id
+	PasswordHashBcrypt
+	PasswordHashScrypt
+)
+
+// String returns the name of the password hashing algorithm.
+func (a PasswordHashAlgorithm) String() string {
+	switch a {
+	case PasswordHashArgon2id:
+		return "argon2id"
+	case PasswordHashBcrypt:
+		return "bcrypt"
+	case PasswordHashScrypt:
+		return "scrypt"
+	}
+	return fmt.Sprintf("unknown(%d)", int(a))
+}
+
+const (
+	// DefaultPasswordHashKeyLength is the default length of the hash produced by Argon2id and scrypt in bytes.
+	DefaultPasswordHashKeyLength = 32
+
+	// DefaultBcryptCost is the default bcrypt cost factor.
+	DefaultBcryptCost = 12
+
+	// maxPasswordHashKeyLength is the maximum length of the hash produced by Argon2id and scrypt in bytes.
+	maxPasswordHashKeyLength = 64
+
+	// maxBcryptPasswordLength is the maximum length of a password which bcrypt can hash without truncating it.
+	maxBcryptPasswordLength = 72
+)
+
+// PasswordHashOptions holds the algorithm and cost parameters used to hash a password.
+//
+// Any cost parameter that is 0 is replaced by its default value. Only the fields relevant to the selected
+// algorithm are used. The Argon2id and scrypt defaults are the same as those used by KDFOptions.
+type PasswordHashOptions struct {
+	// Algorithm is the password hashing algorithm to use.
+	Algorithm PasswordHashAlgorithm
+
+	// SaltLength is the length of the random salt in bytes. It is not used by bcrypt.
+	SaltLength int
+
+	// KeyLength is the length of the hash in bytes. It is not used by bcrypt.
+	KeyLength int
+
+	// Argon2Time is the number of passes over memory made by Argon2id.
+	Argon2Time uint32
+
+	// Argon2Memory is the amount of memory used by Argon2id in KiB.
+	Argon2Memory uint32
+
+	// Argon2Threads is the degree of parallelism used by Argon2id.
+	Argon2Threads uint8
+
+	// ScryptN is the CPU/memory cost parameter used by scrypt. It must be a power of 2.
+	ScryptN int
+
+	// ScryptR is the block size parameter used by scrypt.
+	ScryptR int
+
+	// ScryptP is the parallelization parameter used by scrypt.
+	ScryptP int
+
+	// BcryptCost is the bcrypt cost factor.
+	BcryptCost int
+}
+
+// DefaultPasswordHashOptions returns the default options for the given password hashing algorithm.
+func DefaultPasswordHashOptions(alg PasswordHashAlgorithm) *PasswordHashOptions {
+	return resolvePasswordHashOptions(&PasswordHashOptions{Algorithm: alg})
+}
+
+// resolvePasswordHashOptions returns a copy of the options with any unset parameters replaced by their default
+// values. If opts is nil, Argon2id is used.
+func resolvePasswordHashOptions(opts *PasswordHashOptions) *PasswordHashOptions {
+	o := &PasswordHashOptions{Algorithm: PasswordHashArgon2id}
+	if opts != nil {
+		*o = *opts
+	}
+	switch o.Algorithm {
+	case PasswordHashArgon2id, PasswordHashScrypt:
+		k := o.kdfOptions()
+		k.setDefaults()
+		o.SaltLength, o.Argon2Time, o.Argon2Memory, o.Argon2Threads = k.SaltLength, k.Argon2Time, k.Argon2Memory,
+			k.Argon2Threads
+		o.ScryptN, o.ScryptR, o.ScryptP = k.ScryptN, k.ScryptR, k.ScryptP
+		if o.KeyLength == 0 {
+			o.KeyLength = DefaultPasswordHashKeyLength
+		}
+	case PasswordHashBcrypt:
+		if o.BcryptCost == 0 {
+			o.BcryptCost = DefaultBcryptCost
+		}
+	}
+	return o
+}
+
+// kdfOptions converts the options into the equivalent KDFOptions so the cost parameters can be validated and
+// defaulted in the same way as they are for encryption keys.
+func (o *PasswordHashOptions) kdfOptions() *KDFOptions {
+	k := &KDFOptions{
+		SaltLength:    o.SaltLength,
+		Argon2Time:    o.Argon2Time,
+		Argon2Memory:  o.Argon2Memory,
+		Argon2Threads: o.Argon2Threads,
+		ScryptN:       o.ScryptN,
+		ScryptR:       o.ScryptR,
+		ScryptP:       o.ScryptP,
+	}
+	switch o.Algorithm {
+	case PasswordHashArgon2id:
+		k.Algorithm = KDFArgon2id
+	case PasswordHashScrypt:
+		k.Algorithm = KDFScrypt
+	}
+	return k
+}
+
+// validate ensures the options use a supported algorithm and that the cost parameters are within bounds.
+func (o *PasswordHashOptions) validate() error {
+	switch o.Algorithm {
+	case PasswordHashArgon2id, PasswordHashScrypt:
+		if o.KeyLength < 16 || o.KeyLength > maxPasswordHashKeyLength {
+			return fmt.Errorf("key length must be between 16 and %d bytes", maxPasswordHashKeyLength)
+		}
+		return o.kdfOptions().validate()
+	case PasswordHashBcrypt:
+		if o.BcryptCost < bcrypt.MinCost || o.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not a supported password hashing algorithm", o.Algorithm)
+}
+
+// HashPassword hashes the given password and returns the hash as a PHC string.
+//
+// Argon2id and scrypt hashes are encoded in the PHC string format, e.g.:
+//
+//  ◽ $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+//  ◽ $scrypt$ln=15,r=8,p=1$<salt>$<hash>
+//
+// bcrypt hashes use the standard $2a$ modular crypt format. Salts and hashes are encoded using unpadded standard
+// base64. If opts is nil, Argon2id is used with its default parameters.
+//
+// The following errors are returned by this function:
+// ErrHashPasswordFailure, ErrGenerateRandomKeyFailure
+func HashPassword(ctx context.Context, password string, opts *PasswordHashOptions) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	o := resolvePasswordHashOptions(opts)
+	logger = logger.With().Str("algorithm", o.Algorithm.String()).Logger()
+	if err := o.validate(); err != nil {
+		e := &ErrHashPasswordFailure{Algorithm: o.Algorithm, Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+
+	// bcrypt generates its own salt
+	if o.Algorithm == PasswordHashBcrypt {
+		if len(password) > maxBcryptPasswordLength {
+			e := &ErrHashPasswordFailure{
+				Algorithm: o.Algorithm,
+				Err:       fmt.Errorf("password may not be longer than %d bytes", maxBcryptPasswordLength),
+			}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return "", e
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), o.BcryptCost)
+		if err != nil {
+			e := &ErrHashPasswordFailure{Algorithm: o.Algorithm, Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return "", e
+		}
+		return string(hash), nil
+	}
+
+	// generate a random salt
+	salt := make([]byte, o.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		e := &ErrGenerateRandomKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+
+	key, err := hashPassword([]byte(password), salt, o)
+	if err != nil {
+		e := &ErrHashPasswordFailure{Algorithm: o.Algorithm, Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	return encodePasswordHash(o, salt, key), nil
+}
+
+// VerifyPassword checks whether the password matches the given hash.
+//
+// The hash must have been produced by HashPassword() or be a compatible Argon2id, scrypt or bcrypt hash. False is
+// returned with a nil error when the hash is valid but the password does not match. Passwords longer than 72 bytes
+// never match a bcrypt hash, since HashPassword() refuses to hash them.
+//
+// The following errors are returned by this function:
+// ErrVerifyPasswordFailure
+func VerifyPassword(ctx context.Context, password, hash string) (bool, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	o, salt, key, err := decodePasswordHash(hash)
+	if err != nil {
+		e := &ErrVerifyPasswordFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return false, e
+	}
+	logger = logger.With().Str("algorithm", o.Algorithm.String()).Logger()
+
+	if o.Algorithm == PasswordHashBcrypt {
+		// bcrypt ignores everything after the first 72 bytes, so a longer password would match a hash of its prefix
+		if len(password) > maxBcryptPasswordLength {
+			logger.Warn().Msg("password is too long to be verified with bcrypt")
+			return false, nil
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		} else if err != nil {
+			e := &ErrVerifyPasswordFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return false, e
+		}
+		return true, nil
+	}
+
+	computed, err := hashPassword([]byte(password), salt, o)
+	if err != nil {
+		e := &ErrVerifyPasswordFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return false, e
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+// NeedsRehash checks whether the given hash was produced with a different algorithm or different parameters than
+// those in opts.
+//
+// Call this function after a password has been successfully verified and, if it returns true, hash the password
+// again with HashPassword() and store the new hash. If opts is nil, the default Argon2id options are used.
+//
+// The following errors are returned by this function:
+// ErrVerifyPasswordFailure
+func NeedsRehash(ctx context.Context, hash string, opts *PasswordHashOptions) (bool, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	current, salt, _, err := decodePasswordHash(hash)
+	if err != nil {
+		e := &ErrVerifyPasswordFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return false, e
+	}
+	want := resolvePasswordHashOptions(opts)
+	if current.Algorithm != want.Algorithm {
+		return true, nil
+	}
+
+	switch want.Algorithm {
+	case PasswordHashArgon2id:
+		return current.Argon2Time != want.Argon2Time || current.Argon2Memory != want.Argon2Memory ||
+			current.Argon2Threads != want.Argon2Threads || len(salt) != want.SaltLength ||
+			current.KeyLength != want.KeyLength, nil
+	case PasswordHashScrypt:
+		return current.ScryptN != want.ScryptN || current.ScryptR != want.ScryptR || current.ScryptP != want.ScryptP ||
+			len(salt) != want.SaltLength || current.KeyLength != want.KeyLength, nil
+	case PasswordHashBcrypt:
+		return current.BcryptCost != want.BcryptCost, nil
+	}
+	return true, nil
+}
+
+// hashPassword runs the password hashing function. The options must already have been validated.
+func hashPassword(password, salt []byte, o *PasswordHashOptions) ([]byte, error) {
+	switch o.Algorithm {
+	case PasswordHashArgon2id:
+		return argon2.IDKey(password, salt, o.Argon2Time, o.Argon2Memory, o.Argon2Threads, uint32(o.KeyLength)), nil
+	case PasswordHashScrypt:
+		return scrypt.Key(password, salt, o.ScryptN, o.ScryptR, o.ScryptP, o.KeyLength)
+	}
+	return nil, fmt.Errorf("%s is not a supported password hashing algorithm", o.Algorithm)
+}
+
+// encodePasswordHash encodes the parameters, salt and hash as a PHC string.
+func encodePasswordHash(o *PasswordHashOptions, salt, key []byte) string {
+	b64 := base64.RawStdEncoding
+	switch o.Algorithm {
+	case PasswordHashArgon2id:
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, o.Argon2Memory, o.Argon2Time,
+			o.Argon2Threads, b64.EncodeToString(salt), b64.EncodeToString(key))
+	case PasswordHashScrypt:
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", bits.TrailingZeros(uint(o.ScryptN)), o.ScryptR,
+			o.ScryptP, b64.EncodeToString(salt), b64.EncodeToString(key))
+	}
+	return ""
+}
+
+// decodePasswordHash parses a hash string and returns its parameters, salt and hash. The parameters are validated
+// so that a crafted hash cannot force an excessive amount of work or memory when it is verified.
+//
+// Only the algorithm and cost are returned for bcrypt hashes.
+func decodePasswordHash(hash string) (*PasswordHashOptions, []byte, []byte, error) {
+	invalid := errors.New("password hash is invalid")
+
+	// bcrypt hashes use the modular crypt format
+	if strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") {
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, nil, nil, invalid
+		}
+		return &PasswordHashOptions{Algorithm: PasswordHashBcrypt, BcryptCost: cost}, nil, nil, nil
+	}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) < 5 || parts[0] != "" {
+		return nil, nil, nil, invalid
+	}
+	o := &PasswordHashOptions{}
+	var params map[string]int
+	var err error
+	switch parts[1] {
+	case "argon2id":
+		if len(parts) != 6 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+			return nil, nil, nil, errors.New("password hash uses an unsupported Argon2 version")
+		}
+		if params, err = parsePHCParams(parts[3], "m", "t", "p"); err != nil {
+			return nil, nil, nil, err
+		}
+		if params["t"] > maxArgon2idTime || params["m"] > maxArgon2idMemory || params["p"] > 255 {
+			return nil, nil, nil, invalid
+		}
+		o.Algorithm = PasswordHashArgon2id
+		o.Argon2Memory, o.Argon2Time, o.Argon2Threads = uint32(params["m"]), uint32(params["t"]), uint8(params["p"])
+	case "scrypt":
+		if len(parts) != 5 {
+			return nil, nil, nil, invalid
+		}
+		if params, err = parsePHCParams(parts[2], "ln", "r", "p"); err != nil {
+			return nil, nil, nil, err
+		}
+		if params["ln"] > 30 {
+			return nil, nil, nil, invalid
+		}
+		o.Algorithm = PasswordHashScrypt
+		o.ScryptN, o.ScryptR, o.ScryptP = 1<<uint(params["ln"]), params["r"], params["p"]
+	default:
+		return nil, nil, nil, fmt.Errorf("password hash uses unsupported algorithm '%s'", parts[1])
+	}
+
+	// decode the salt and hash
+	salt, err := base64.RawStdEncoding.DecodeString(parts[len(parts)-2])
+	if err != nil {
+		return nil, nil, nil, invalid
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[len(parts)-1])
+	if err != nil {
+		return nil, nil, nil, invalid
+	}
+	o.SaltLength, o.KeyLength = len(salt), len(key)
+	if err := o.validate(); err != nil {
+		return nil, nil, nil, err
+	}
+	return o, salt, key, nil
+}
+
+// parsePHCParams parses a comma-separated list of name=value parameters from a PHC string. Exactly the given
+// parameters must be present and each value must be a non-negative integer.
+func parsePHCParams(s string, names ...string) (map[string]int, error) {
+	params := map[string]int{}
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("password hash parameter '%s' is invalid", field)
+		}
+		v, err := strconv.ParseUint(kv[1], 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("password hash parameter '%s' is invalid", field)
+		}
+		params[kv[0]] = int(v)
+	}
+	if len(params) != len(names) {
+		return nil, errors.New("password hash parameters are invalid")
+	}
+	for _, name := range names {
+		if _, ok := params[name]; !ok {
+			return nil, fmt.Errorf("password hash parameter '%s' is missing", name)
+		}
+	}
+	return params, nil
+}
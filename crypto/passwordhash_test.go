@@ -0,0 +1,126 @@
+package crypto_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+// fastHashOptions holds cheap cost parameters for each algorithm so the tests run quickly.
+var fastHashOptions = map[string]*crypto.PasswordHashOptions{
+	"argon2id": {Algorithm: crypto.PasswordHashArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1},
+	"scrypt":   {Algorithm: crypto.PasswordHashScrypt, ScryptN: 1024, ScryptR: 8, ScryptP: 1},
+	"bcrypt":   {Algorithm: crypto.PasswordHashBcrypt, BcryptCost: 4},
+}
+
+func TestHashPassword(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	for name, opts := range fastHashOptions {
+		hash, err := crypto.HashPassword(ctx, "correct horse battery staple", opts)
+		if err != nil {
+			t.Fatalf("%s: error while hashing password: %s", name, err.Error())
+		}
+		if name != "bcrypt" && !strings.HasPrefix(hash, "$"+name+"$") {
+			t.Errorf("%s: hash %s does not use the PHC string format", name, hash)
+		}
+
+		ok, err := crypto.VerifyPassword(ctx, "correct horse battery staple", hash)
+		if err != nil {
+			t.Fatalf("%s: error while verifying password: %s", name, err.Error())
+		}
+		if !ok {
+			t.Errorf("%s: correct password was not accepted", name)
+		}
+		ok, err = crypto.VerifyPassword(ctx, "Tr0ub4dor&3", hash)
+		if err != nil {
+			t.Fatalf("%s: error while verifying password: %s", name, err.Error())
+		}
+		if ok {
+			t.Errorf("%s: incorrect password was accepted", name)
+		}
+	}
+}
+
+func TestVerifyPasswordKnownHash(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	// argon2id test vector from the reference implementation's test suite
+	hash := "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	if ok, err := crypto.VerifyPassword(ctx, "password", hash); err != nil {
+		t.Fatalf("error while verifying password: %s", err.Error())
+	} else if !ok {
+		t.Errorf("reference hash was not accepted")
+	}
+}
+
+func TestVerifyPasswordFailure(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	hashes := []string{
+		"",
+		"plaintext",
+		"$md5$abc$def",
+		"$argon2id$v=16$m=1024,t=1,p=1$c29tZXNhbHRzYWx0$c29tZXNhbHRzYWx0c29tZXNhbHRzYWx0",
+		"$argon2id$v=19$m=1024,t=1$c29tZXNhbHRzYWx0$c29tZXNhbHRzYWx0c29tZXNhbHRzYWx0",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c29tZXNhbHRzYWx0$c29tZXNhbHRzYWx0c29tZXNhbHRzYWx0",
+		"$scrypt$ln=40,r=8,p=1$c29tZXNhbHRzYWx0$c29tZXNhbHRzYWx0c29tZXNhbHRzYWx0",
+		"$2a$99$invalid",
+	}
+	for _, hash := range hashes {
+		if _, err := crypto.VerifyPassword(ctx, "password", hash); err == nil {
+			t.Errorf("%s: error: got nil, expected error", hash)
+		} else if _, ok := err.(*crypto.ErrVerifyPasswordFailure); !ok {
+			t.Errorf("%s: error: got %T, expected *crypto.ErrVerifyPasswordFailure", hash, err)
+		}
+	}
+}
+
+func TestVerifyPasswordBcryptLength(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	// bcrypt truncates input after 72 bytes, so appending to a 72-byte password must not verify
+	password := strings.Repeat("a", 72)
+	hash, err := crypto.HashPassword(ctx, password, fastHashOptions["bcrypt"])
+	if err != nil {
+		t.Fatalf("error while hashing password: %s", err.Error())
+	}
+	if ok, err := crypto.VerifyPassword(ctx, password, hash); err != nil || !ok {
+		t.Errorf("want: true, got: %t (%v)", ok, err)
+	}
+	if ok, err := crypto.VerifyPassword(ctx, password+"suffix", hash); err != nil || ok {
+		t.Errorf("want: false, got: %t (%v)", ok, err)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	opts := fastHashOptions["argon2id"]
+	hash, err := crypto.HashPassword(ctx, "password", opts)
+	if err != nil {
+		t.Fatalf("error while hashing password: %s", err.Error())
+	}
+	if rehash, err := crypto.NeedsRehash(ctx, hash, opts); err != nil {
+		t.Fatalf("error while checking hash: %s", err.Error())
+	} else if rehash {
+		t.Errorf("want: false, got: true for unchanged options")
+	}
+
+	stronger := *opts
+	stronger.Argon2Time = 2
+	if rehash, _ := crypto.NeedsRehash(ctx, hash, &stronger); !rehash {
+		t.Errorf("want: true, got: false for increased cost")
+	}
+	if rehash, _ := crypto.NeedsRehash(ctx, hash, fastHashOptions["bcrypt"]); !rehash {
+		t.Errorf("want: true, got: false for different algorithm")
+	}
+}
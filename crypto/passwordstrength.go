@@ -0,0 +1,571 @@
+package crypto
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+// PasswordStrength is a score from 0 (very weak) to 4 (very strong) describing how hard a password is to guess.
+type PasswordStrength int
+
+// Possible values for the password strength score.
+const (
+	PasswordStrengthVeryWeak PasswordStrength = iota
+	PasswordStrengthWeak
+	PasswordStrengthFair
+	PasswordStrengthStrong
+	PasswordStrengthVeryStrong
+)
+
+// String returns the name of the password strength score.
+func (s PasswordStrength) String() string {
+	switch s {
+	case PasswordStrengthVeryWeak:
+		return "very-weak"
+	case PasswordStrengthWeak:
+		return "weak"
+	case PasswordStrengthFair:
+		return "fair"
+	case PasswordStrengthStrong:
+		return "strong"
+	case PasswordStrengthVeryStrong:
+		return "very-strong"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// Translation keys for password strength feedback. Use them with an i18n translator to localize the feedback,
+// passing the feedback's Params as the {0}, {1}, ... parameters.
+const (
+	// PasswordFeedbackTooShort is returned when the password is shorter than the minimum length. {0} is the minimum
+	// length.
+	PasswordFeedbackTooShort = "password-too-short"
+
+	// PasswordFeedbackFewClasses is returned when the password uses fewer than 3 character classes.
+	PasswordFeedbackFewClasses = "password-few-classes"
+
+	// PasswordFeedbackRepeated is returned when the password contains repeated characters. {0} is the repeated text.
+	PasswordFeedbackRepeated = "password-repeated-characters"
+
+	// PasswordFeedbackSequence is returned when the password contains a sequence such as "abc" or "321". {0} is the
+	// sequence.
+	PasswordFeedbackSequence = "password-sequence"
+
+	// PasswordFeedbackKeyboard is returned when the password contains a keyboard pattern such as "qwerty". {0} is
+	// the pattern.
+	PasswordFeedbackKeyboard = "password-keyboard-pattern"
+
+	// PasswordFeedbackDictionary is returned when the password contains a common word or password. {0} is the word.
+	PasswordFeedbackDictionary = "password-dictionary-word"
+
+	// PasswordFeedbackUserInput is returned when the password contains personal information such as the user's name
+	// or email address. {0} is the matching text.
+	PasswordFeedbackUserInput = "password-user-input"
+
+	// PasswordFeedbackDate is returned when the password contains a year. {0} is the year.
+	PasswordFeedbackDate = "password-date"
+
+	// PasswordFeedbackBreached is returned when the password appears in a list of breached passwords. {0} is the
+	// number of times it was seen.
+	PasswordFeedbackBreached = "password-breached"
+)
+
+// passwordFeedbackMessages holds the default English text for each feedback key.
+var passwordFeedbackMessages = map[string]string{
+	PasswordFeedbackTooShort:   "Use at least {0} characters.",
+	PasswordFeedbackFewClasses: "Use a mix of uppercase and lowercase letters, numbers and symbols.",
+	PasswordFeedbackRepeated:   "Avoid repeated characters like \"{0}\".",
+	PasswordFeedbackSequence:   "Avoid sequences like \"{0}\".",
+	PasswordFeedbackKeyboard:   "Avoid keyboard patterns like \"{0}\".",
+	PasswordFeedbackDictionary: "Avoid common words and passwords like \"{0}\".",
+	PasswordFeedbackUserInput:  "Avoid personal information like \"{0}\".",
+	PasswordFeedbackDate:       "Avoid years like \"{0}\" that are associated with you.",
+	PasswordFeedbackBreached:   "This password has appeared in {0} data breaches and must not be used.",
+}
+
+// DefaultPasswordMinLength is the default minimum password length used by EstimatePasswordStrength().
+const DefaultPasswordMinLength = 12
+
+// commonPasswordWords holds common passwords and words which are tried first by password crackers.
+var commonPasswordWords = []string{
+	"password", "passw0rd", "welcome", "admin", "administrator", "letmein", "monkey", "dragon", "iloveyou",
+	"sunshine", "princess", "football", "baseball", "soccer", "hockey", "master", "shadow", "login", "secret",
+	"trustno1", "superman", "batman", "michael", "jennifer", "jordan", "hunter", "ranger", "buster", "thomas",
+	"robert", "charlie", "freedom", "whatever", "starwars", "computer", "internet", "summer", "winter", "spring",
+	"autumn", "love", "hello", "flower", "cheese", "qazwsx", "zaq1", "changeme", "default", "guest", "root",
+	"access", "pass", "user", "test", "abc", "god", "money", "angel", "killer", "pepper", "ginger", "matrix",
+}
+
+// keyboardRows holds the rows of a US QWERTY keyboard used to detect keyboard patterns.
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./", "~!@#$%^&*()_+", "qaz", "wsx", "edc", "rfv",
+	"tgb", "yhn", "ujm",
+}
+
+// leetSubstitutions maps common character substitutions back to the letters they replace.
+var leetSubstitutions = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g', '@': 'a', '$': 's', '!': 'i',
+	'+': 't',
+}
+
+// yearPattern matches years between 1900 and 2099.
+var yearPattern = regexp.MustCompile(`(19|20)\d\d`)
+
+// PasswordFeedback describes a single problem found with a password.
+//
+// Key is a translation key (one of the PasswordFeedback* constants) and Params holds the values for its {0}, {1},
+// ... placeholders. Message holds the default English text with the parameters already substituted.
+type PasswordFeedback struct {
+	Key     string   `json:"key"`
+	Params  []string `json:"params,omitempty"`
+	Message string   `json:"message"`
+}
+
+// newPasswordFeedback creates a PasswordFeedback object for the given key and parameters.
+func newPasswordFeedback(key string, params ...string) PasswordFeedback {
+	msg := passwordFeedbackMessages[key]
+	for i, p := range params {
+		msg = strings.ReplaceAll(msg, "{"+strconv.Itoa(i)+"}", p)
+	}
+	return PasswordFeedback{Key: key, Params: params, Message: msg}
+}
+
+// PasswordStrengthResult holds the result of estimating a password's strength.
+type PasswordStrengthResult struct {
+	// Score rates how hard the password is to guess.
+	Score PasswordStrength `json:"score"`
+
+	// Entropy is the estimated number of bits of entropy in the password after accounting for patterns.
+	Entropy float64 `json:"entropy"`
+
+	// Length is the number of characters in the password.
+	Length int `json:"length"`
+
+	// Classes is the number of character classes (lowercase, uppercase, digits, symbols) in the password.
+	Classes int `json:"classes"`
+
+	// BreachCount is the number of times the password was seen in a data breach. It is only set when a
+	// BreachedPasswordChecker is supplied.
+	BreachCount int `json:"breach_count,omitempty"`
+
+	// Feedback lists the problems found with the password.
+	Feedback []PasswordFeedback `json:"feedback,omitempty"`
+}
+
+// PasswordStrengthOptions holds the options used by EstimatePasswordStrength().
+type PasswordStrengthOptions struct {
+	// MinLength is the minimum acceptable password length. If 0, DefaultPasswordMinLength is used.
+	MinLength int
+
+	// Dictionary holds additional words to treat as common, such as the application or company name.
+	Dictionary []string
+
+	// UserInputs holds personal information about the user, such as their name, username or email address.
+	UserInputs []string
+
+	// BreachChecker is used to check whether the password has appeared in a data breach. If nil, no check is made.
+	BreachChecker *BreachedPasswordChecker
+}
+
+// passwordMatch records a pattern found in a password.
+type passwordMatch struct {
+	start, end int
+	bits       float64
+	feedback   PasswordFeedback
+}
+
+// EstimatePasswordStrength estimates how hard the given password is to guess.
+//
+// The estimate starts from the size of the character set used by the password and then discounts any repeated
+// characters, sequences, keyboard patterns, common words, personal information and years, since these are
+// tried early by password crackers. If the password appears in the breached password list, its score is always
+// PasswordStrengthVeryWeak.
+//
+// The Feedback field of the result describes each problem found in a form suitable for localization. If opts is
+// nil, the default options are used.
+//
+// The following errors are returned by this function:
+// any error returned by BreachedPasswordChecker.Check
+func EstimatePasswordStrength(ctx context.Context, password string, opts *PasswordStrengthOptions) (
+	*PasswordStrengthResult, error) {
+
+	o := PasswordStrengthOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.MinLength <= 0 {
+		o.MinLength = DefaultPasswordMinLength
+	}
+
+	runes := []rune(password)
+	result := &PasswordStrengthResult{Length: len(runes)}
+
+	// determine the size of the character set
+	var lower, upper, digit, symbol bool
+	for _, r := range runes {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	charset := 0
+	for _, c := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}} {
+		if c.present {
+			result.Classes++
+			charset += c.size
+		}
+	}
+	charBits := 0.0
+	if charset > 0 {
+		charBits = math.Log2(float64(charset))
+	}
+
+	// find patterns and replace the entropy of the characters they cover with the entropy of the pattern
+	matches := findPasswordPatterns(runes, &o)
+	covered := make([]bool, len(runes))
+	for _, m := range matches {
+		for i := m.start; i < m.end; i++ {
+			covered[i] = true
+		}
+		result.Entropy += m.bits
+	}
+	for _, c := range covered {
+		if !c {
+			result.Entropy += charBits
+		}
+	}
+
+	// build the feedback
+	if result.Length < o.MinLength {
+		result.Feedback = append(result.Feedback, newPasswordFeedback(PasswordFeedbackTooShort,
+			strconv.Itoa(o.MinLength)))
+	}
+	if result.Length > 0 && result.Classes < 3 {
+		result.Feedback = append(result.Feedback, newPasswordFeedback(PasswordFeedbackFewClasses))
+	}
+	seen := map[string]bool{}
+	for _, m := range matches {
+		id := m.feedback.Key + "\x00" + strings.Join(m.feedback.Params, "\x00")
+		if !seen[id] {
+			seen[id] = true
+			result.Feedback = append(result.Feedback, m.feedback)
+		}
+	}
+
+	// score the password
+	switch {
+	case result.Entropy < 28:
+		result.Score = PasswordStrengthVeryWeak
+	case result.Entropy < 40:
+		result.Score = PasswordStrengthWeak
+	case result.Entropy < 60:
+		result.Score = PasswordStrengthFair
+	case result.Entropy < 80:
+		result.Score = PasswordStrengthStrong
+	default:
+		result.Score = PasswordStrengthVeryStrong
+	}
+	if result.Length < o.MinLength && result.Score > PasswordStrengthWeak {
+		result.Score = PasswordStrengthWeak
+	}
+
+	// check the breached password list
+	if o.BreachChecker != nil && password != "" {
+		count, err := o.BreachChecker.Check(ctx, password)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			result.BreachCount = count
+			result.Score = PasswordStrengthVeryWeak
+			result.Feedback = append([]PasswordFeedback{newPasswordFeedback(PasswordFeedbackBreached,
+				strconv.Itoa(count))}, result.Feedback...)
+		}
+	}
+	return result, nil
+}
+
+// findPasswordPatterns returns the patterns found in the password. Overlapping matches are resolved by keeping the
+// longest match.
+func findPasswordPatterns(runes []rune, o *PasswordStrengthOptions) []passwordMatch {
+	lower := []rune(strings.ToLower(string(runes)))
+	if len(lower) != len(runes) {
+		lower = runes
+	}
+	unleet := make([]rune, len(lower))
+	for i, r := range lower {
+		if s, ok := leetSubstitutions[r]; ok {
+			unleet[i] = s
+		} else {
+			unleet[i] = r
+		}
+	}
+
+	candidates := []passwordMatch{}
+
+	// repeated characters, e.g. "aaa"
+	for i := 0; i < len(lower); {
+		j := i + 1
+		for j < len(lower) && lower[j] == lower[i] {
+			j++
+		}
+		if j-i >= 3 {
+			candidates = append(candidates, passwordMatch{start: i, end: j, bits: 5 + math.Log2(float64(j-i)),
+				feedback: newPasswordFeedback(PasswordFeedbackRepeated, string(runes[i:j]))})
+		}
+		i = j
+	}
+
+	// sequences, e.g. "abcd" or "4321"
+	for i := 0; i+2 < len(lower); {
+		delta := lower[i+1] - lower[i]
+		j := i + 1
+		if (delta == 1 || delta == -1) && sameSequenceClass(lower[i], lower[j]) {
+			for j+1 < len(lower) && lower[j+1]-lower[j] == delta && sameSequenceClass(lower[j], lower[j+1]) {
+				j++
+			}
+		}
+		if j-i+1 >= 3 {
+			candidates = append(candidates, passwordMatch{start: i, end: j + 1, bits: 4 + math.Log2(float64(j-i+1)),
+				feedback: newPasswordFeedback(PasswordFeedbackSequence, string(runes[i:j+1]))})
+			i = j + 1
+		} else {
+			i++
+		}
+	}
+
+	// keyboard patterns, e.g. "qwerty" or "asdf"
+	for i := 0; i < len(lower); i++ {
+		best := 0
+		for _, row := range keyboardRows {
+			for _, r := range []string{row, reverseString(row)} {
+				n := 0
+				for i+n < len(lower) && strings.Contains(r, string(lower[i:i+n+1])) {
+					n++
+				}
+				if n > best {
+					best = n
+				}
+			}
+		}
+		if best >= 4 {
+			candidates = append(candidates, passwordMatch{start: i, end: i + best, bits: 6 + math.Log2(float64(best)),
+				feedback: newPasswordFeedback(PasswordFeedbackKeyboard, string(runes[i:i+best]))})
+			i += best - 1
+		}
+	}
+
+	// common words and personal information
+	addWords := func(words []string, key string, bits float64) {
+		for _, w := range words {
+			w = strings.ToLower(w)
+			if len([]rune(w)) < 3 {
+				continue
+			}
+			for _, haystack := range [][]rune{lower, unleet} {
+				s := string(haystack)
+				for offset := 0; offset < len(s); {
+					idx := strings.Index(s[offset:], w)
+					if idx < 0 {
+						break
+					}
+					start := len([]rune(s[:offset+idx]))
+					end := start + len([]rune(w))
+					candidates = append(candidates, passwordMatch{start: start, end: end, bits: bits,
+						feedback: newPasswordFeedback(key, string(runes[start:end]))})
+					offset += idx + len(w)
+				}
+			}
+		}
+	}
+	inputs := []string{}
+	for _, in := range o.UserInputs {
+		inputs = append(inputs, in)
+		// also match the parts of email addresses and names
+		inputs = append(inputs, strings.FieldsFunc(in, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+	}
+	addWords(inputs, PasswordFeedbackUserInput, 4)
+	addWords(o.Dictionary, PasswordFeedbackDictionary, 8)
+	addWords(commonPasswordWords, PasswordFeedbackDictionary, 8)
+
+	// years
+	for _, loc := range yearPattern.FindAllStringIndex(string(lower), -1) {
+		start := len([]rune(string(lower)[:loc[0]]))
+		end := len([]rune(string(lower)[:loc[1]]))
+		candidates = append(candidates, passwordMatch{start: start, end: end, bits: 7,
+			feedback: newPasswordFeedback(PasswordFeedbackDate, string(runes[start:end]))})
+	}
+
+	// keep the longest non-overlapping matches
+	matches := []passwordMatch{}
+	used := make([]bool, len(runes))
+	for len(candidates) > 0 {
+		best := 0
+		for i, c := range candidates {
+			if c.end-c.start > candidates[best].end-candidates[best].start {
+				best = i
+			}
+		}
+		m := candidates[best]
+		candidates = append(candidates[:best], candidates[best+1:]...)
+		overlaps := false
+		for i := m.start; i < m.end; i++ {
+			if used[i] {
+				overlaps = true
+				break
+			}
+		}
+		if overlaps {
+			continue
+		}
+		for i := m.start; i < m.end; i++ {
+			used[i] = true
+		}
+		matches = append(matches, m)
+	}
+
+	// return the matches in the order they appear in the password
+	for i := 1; i < len(matches); i++ {
+		for j := i; j > 0 && matches[j].start < matches[j-1].start; j-- {
+			matches[j], matches[j-1] = matches[j-1], matches[j]
+		}
+	}
+	return matches
+}
+
+// sameSequenceClass returns whether both characters are letters or both are digits.
+func sameSequenceClass(a, b rune) bool {
+	return (unicode.IsLetter(a) && unicode.IsLetter(b)) || (unicode.IsDigit(a) && unicode.IsDigit(b))
+}
+
+// reverseString returns the string with its characters in reverse order.
+func reverseString(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+// BreachedPasswordChecker checks passwords against a local copy of a breached password list stored in the
+// k-anonymity hash-prefix format used by the Pwned Passwords range API.
+//
+// The list is a directory containing one file per 5-character SHA-1 hash prefix, named either "ABCDE" or
+// "ABCDE.txt". Each line of a file holds the remaining 35 characters of a SHA-1 hash, a colon and the number of
+// times the password was seen, e.g. "0018A45C4D1DEF81644B54AB7F969B88D65:10". Only the file for the password's
+// prefix is read and no network calls are made.
+type BreachedPasswordChecker struct {
+	dir string
+}
+
+// NewBreachedPasswordChecker creates a new BreachedPasswordChecker object for the hash-prefix files in the given
+// directory.
+//
+// The following errors are returned by this function:
+// ErrCheckBreachedPasswordFailure
+func NewBreachedPasswordChecker(ctx context.Context, dir string) (*BreachedPasswordChecker, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("path", dir).Logger()
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		e := &ErrCheckBreachedPasswordFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if !info.IsDir() {
+		e := &ErrCheckBreachedPasswordFailure{Err: errors.New("path is not a directory")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return &BreachedPasswordChecker{dir: dir}, nil
+}
+
+// Check returns the number of times the given password appears in the breached password list, or 0 if it does
+// not appear.
+//
+// A missing hash-prefix file is treated as meaning that no password with that prefix has been breached.
+//
+// The following errors are returned by this function:
+// ErrCheckBreachedPasswordFailure
+func (c *BreachedPasswordChecker) Check(ctx context.Context, password string) (int, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// the hash-prefix format is defined in terms of SHA-1
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+	logger = logger.With().Str("hash_prefix", prefix).Logger()
+
+	// open the file for the prefix
+	var file *os.File
+	var err error
+	for _, name := range []string{prefix, prefix + ".txt"} {
+		file, err = os.Open(filepath.Join(c.dir, name))
+		if err == nil || !os.IsNotExist(err) {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		e := &ErrCheckBreachedPasswordFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return 0, e
+	}
+	defer file.Close()
+
+	// search for the suffix
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], suffix) {
+			continue
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			e := &ErrCheckBreachedPasswordFailure{Err: fmt.Errorf("invalid count for hash suffix %s", parts[0])}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return 0, e
+		}
+		return count, nil
+	}
+	if err := scanner.Err(); err != nil {
+		e := &ErrCheckBreachedPasswordFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return 0, e
+	}
+	return 0, nil
+}
@@ -0,0 +1,118 @@
+package crypto_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestEstimatePasswordStrength(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	weak := crypto.PasswordStrengthVeryWeak
+	tests := []struct {
+		password string
+		minScore crypto.PasswordStrength
+		maxScore crypto.PasswordStrength
+		feedback string
+	}{
+		{"password", weak, weak, crypto.PasswordFeedbackDictionary},
+		{"P@ssw0rd1984", weak, crypto.PasswordStrengthWeak, crypto.PasswordFeedbackDate},
+		{"qwertyuiop", weak, weak, crypto.PasswordFeedbackKeyboard},
+		{"abcdefgh1234", weak, weak, crypto.PasswordFeedbackSequence},
+		{"zzzzzzzzzzzz", weak, weak, crypto.PasswordFeedbackRepeated},
+		{"xK#9vQ!2mR$7pL@4", crypto.PasswordStrengthStrong, crypto.PasswordStrengthVeryStrong, ""},
+	}
+	for _, test := range tests {
+		result, err := crypto.EstimatePasswordStrength(ctx, test.password, nil)
+		if err != nil {
+			t.Fatalf("%s: error while estimating strength: %s", test.password, err.Error())
+		}
+		if result.Score > test.maxScore || result.Score < test.minScore {
+			t.Errorf("%s: got score %s, expected between %s and %s", test.password, result.Score, test.minScore,
+				test.maxScore)
+		}
+		if test.feedback == "" {
+			continue
+		}
+		found := false
+		for _, f := range result.Feedback {
+			if f.Key == test.feedback {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: feedback %s was not returned: %+v", test.password, test.feedback, result.Feedback)
+		}
+	}
+}
+
+func TestEstimatePasswordStrengthUserInputs(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	opts := &crypto.PasswordStrengthOptions{UserInputs: []string{"jane.doe@example.com"}}
+	result, err := crypto.EstimatePasswordStrength(ctx, "Janedoe!Rocks", opts)
+	if err != nil {
+		t.Fatalf("error while estimating strength: %s", err.Error())
+	}
+	for _, f := range result.Feedback {
+		if f.Key == crypto.PasswordFeedbackUserInput {
+			if f.Message == "" || len(f.Params) != 1 {
+				t.Errorf("feedback is missing its message or parameters: %+v", f)
+			}
+			return
+		}
+	}
+	t.Errorf("feedback %s was not returned: %+v", crypto.PasswordFeedbackUserInput, result.Feedback)
+}
+
+func TestBreachedPasswordChecker(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	// SHA-1("password") = 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	dir, err := ioutil.TempDir("", "breached")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	contents := "003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\r\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "5BAA6.txt"), []byte(contents), 0600); err != nil {
+		t.Fatalf("error while writing range file: %s", err.Error())
+	}
+
+	checker, err := crypto.NewBreachedPasswordChecker(ctx, dir)
+	if err != nil {
+		t.Fatalf("error while creating checker: %s", err.Error())
+	}
+	if count, err := checker.Check(ctx, "password"); err != nil {
+		t.Fatalf("error while checking password: %s", err.Error())
+	} else if count != 3861493 {
+		t.Errorf("want: 3861493, got: %d", count)
+	}
+	if count, err := checker.Check(ctx, "xK#9vQ!2mR$7pL@4"); err != nil {
+		t.Fatalf("error while checking password: %s", err.Error())
+	} else if count != 0 {
+		t.Errorf("want: 0, got: %d", count)
+	}
+
+	result, err := crypto.EstimatePasswordStrength(ctx, "password",
+		&crypto.PasswordStrengthOptions{BreachChecker: checker})
+	if err != nil {
+		t.Fatalf("error while estimating strength: %s", err.Error())
+	}
+	if result.BreachCount != 3861493 || result.Feedback[0].Key != crypto.PasswordFeedbackBreached {
+		t.Errorf("breach was not reported: %+v", result)
+	}
+
+	if _, err := crypto.NewBreachedPasswordChecker(ctx, filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
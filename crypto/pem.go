@@ -11,6 +11,7 @@ import (
 	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"strings"
@@ -102,6 +103,9 @@ func DecodePEMBlockFromFile(ctx context.Context, file string) (*pem.Block, error
 // deficiencies in the format, it's not always possible to detect an incorrect password. In these cases no error will
 // be returned but the decrypted DER bytes will be random noise.
 //
+// Deprecated: Legacy PEM encryption as specified in RFC 1423 is insecure by design. Use DecryptPKCS8PrivateKey() to
+// read "ENCRYPTED PRIVATE KEY" blocks instead.
+//
 // The following errors are returned by this function:
 // ErrDecryptFailure
 func DecryptPEMBlock(ctx context.Context, b *pem.Block, password []byte) ([]byte, error) {
@@ -204,6 +208,9 @@ func DecryptPEMBlock(ctx context.Context, b *pem.Block, password []byte) ([]byte
 // EncryptPEMBlock returns a PEM block of the specified type holding the given DER encoded data encrypted with the
 // specified algorithm and password according to RFC 1423.
 //
+// Deprecated: Legacy PEM encryption as specified in RFC 1423 is insecure by design. Use EncryptPKCS8PrivateKey() to
+// encrypt private keys instead.
+//
 // The following errors are returned by this function:
 // ErrEncryptFailure, ErrGenerateIVFailure
 func EncryptPEMBlock(ctx context.Context, rand io.Reader, blockType string, data, password []byte, alg PEMCipher) (
@@ -269,6 +276,9 @@ func IsEncryptedPEMBlock(b *pem.Block) bool {
 
 // ParsePEMCertificateBytes takes a PEM-formatted byte string and converts it into one or more X509 certificates.
 //
+// Every "CERTIFICATE" PEM block is parsed, so a concatenated bundle returns all of its certificates in order. Other
+// blocks, such as private keys, are ignored.
+//
 // The following errors are returned by this function:
 // ErrDecryptFailure, ErrDecodeFailure, ErrParseCertificateFailure
 func ParsePEMCertificateBytes(ctx context.Context, contents []byte) ([]*x509.Certificate, error) {
@@ -283,14 +293,14 @@ func ParsePEMCertificateBytes(ctx context.Context, contents []byte) ([]*x509.Cer
 		return nil, e
 	}
 
-	block, _ := pem.Decode(contents)
-	if block == nil {
+	if block, _ := pem.Decode(contents); block == nil {
 		e := &ErrDecodeFailure{Err: errors.New("no PEM data was decoded")}
 		logger.Error().Err(e.Err).Msg(e.Error())
 		return nil, e
 	}
 
-	certs, err := x509.ParseCertificates(block.Bytes)
+	// bundles hold one certificate per PEM block and may also hold other blocks, such as private keys
+	certs, err := parsePEMCertificates(contents)
 	if err != nil {
 		e := &ErrParseCertificateFailure{Err: err}
 		logger.Error().Err(e.Err).Msg(e.Error())
@@ -324,8 +334,11 @@ func ParsePEMCertificateFile(ctx context.Context, file string) ([]*x509.Certific
 // If the private key is encrypted, be sure to include a password or else this function will return an error.
 // If no password is required, you can safely pass nil for the password.
 //
+// The key may be in any format supported by ParsePrivateKeyBytes(), but it must be an RSA key. Use
+// ParsePrivateKeyBytes() to parse ECDSA and Ed25519 keys.
+//
 // The following errors are returned by this function:
-// ErrDecryptFailure, ErrDecodeFailure
+// ErrDecryptFailure, ErrDecodeFailure, ErrParsePrivateKeyFailure, ErrUnsupportedKey
 func ParsePEMPrivateKeyBytes(ctx context.Context, contents []byte, password []byte) (*rsa.PrivateKey, error) {
 	logger := log.Logger
 	if l := zerolog.Ctx(ctx); l != nil {
@@ -345,29 +358,17 @@ func ParsePEMPrivateKeyBytes(ctx context.Context, contents []byte, password []by
 		return nil, e
 	}
 
-	var err error
-	decryptedBlock := block.Bytes
-	if IsEncryptedPEMBlock(block) {
-		if password == nil {
-			e := &ErrDecryptFailure{Err: errors.New("private key is encrypted but no password was supplied")}
-			logger.Error().Err(e.Err).Msg(e.Error())
-			return nil, e
-		}
-		decryptedBlock, err = DecryptPEMBlock(ctx, block, password)
-		if err != nil {
-			e := &ErrDecryptFailure{Err: err}
-			logger.Error().Err(e.Err).Msg(e.Error())
-			return nil, e
-		}
-	}
-
-	key, err := x509.ParsePKCS1PrivateKey(decryptedBlock)
+	key, format, err := parsePrivateKey(ctx, contents, password)
 	if err != nil {
-		e := &ErrDecryptFailure{Err: err}
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		e := &ErrUnsupportedKey{Err: fmt.Errorf("%s private key is a %T, not an RSA key", format, key)}
 		logger.Error().Err(e.Err).Msg(e.Error())
 		return nil, e
 	}
-	return key, nil
+	return rsaKey, nil
 }
 
 // ParsePEMPrivateKeyFile takes a PEM-formatted file and converts it into an RSA private key.
@@ -443,3 +444,37 @@ func (c rfc1423Algo) deriveKey(password, salt []byte) []byte {
 	}
 	return out
 }
+
+// parsePEMCertificates parses every "CERTIFICATE" block in the PEM data, in order. Other block types are skipped.
+func parsePEMCertificates(contents []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(contents); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != PEMTypeCertificate {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificates were found")
+	}
+	return certs, nil
+}
+
+// parseCertificates parses every certificate in PEM-formatted or DER-encoded data.
+func parseCertificates(contents []byte) ([]*x509.Certificate, error) {
+	if block, _ := pem.Decode(contents); block != nil {
+		return parsePEMCertificates(contents)
+	}
+	certs, err := x509.ParseCertificates(contents)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates were found")
+	}
+	return certs, nil
+}
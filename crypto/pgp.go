@@ -21,7 +21,7 @@ type PGPKeyPair struct {
 // Be sure to call ClearPrivateParams on the returned key to clear memory out when finished with the object.
 //
 // The following errors are returned by this function:
-// ErrGeneratePGPKeyFailure, ErrLockPGPKeyFailure, ErrPGPArmorKeyFailure
+// ErrGeneratePGPKeyFailure, ErrGeneratePasswordFailure, ErrLockPGPKeyFailure, ErrPGPArmorKeyFailure
 func NewPGPKeyPair(ctx context.Context, name, email, keyType string, bits int) (*PGPKeyPair, error) {
 	logger := log.Logger
 	if l := zerolog.Ctx(ctx); l != nil {
@@ -40,15 +40,22 @@ func NewPGPKeyPair(ctx context.Context, name, email, keyType string, bits int) (
 	kp.privateKey = key
 
 	// encrypt the key with a random password
-	kp.passphrase = GeneratePassword(32, 5, 5, 5)
+	passphrase, err := GeneratePasswordWithPolicy(ctx, DefaultPasswordPolicy())
+	if err != nil {
+		key.ClearPrivateParams()
+		return nil, err
+	}
+	kp.passphrase = passphrase
 	locked, err := key.Lock([]byte(kp.passphrase))
 	if err != nil {
+		key.ClearPrivateParams()
 		e := &ErrLockPGPKeyFailure{Err: err, Name: name, Email: email, KeyType: keyType, Bits: bits}
 		logger.Error().Err(e.Err).Msg(e.Error())
 		return nil, e
 	}
 	armoredKey, err := locked.Armor()
 	if err != nil {
+		key.ClearPrivateParams()
 		e := &ErrArmorPGPKeyFailure{Err: err, Name: name, Email: email, KeyType: keyType, Bits: bits}
 		logger.Error().Err(e.Err).Msg(e.Error())
 		return nil, e
@@ -111,6 +118,44 @@ func (kp *PGPKeyPair) ClearPrivateParams() {
 	}
 }
 
+// SetPassphrase locks the armored private key returned by GetArmoredPrivateKey() with the given passphrase instead
+// of the random passphrase chosen by NewPGPKeyPair().
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrLockPGPKeyFailure, ErrArmorPGPKeyFailure
+func (kp *PGPKeyPair) SetPassphrase(ctx context.Context, passphrase string) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if kp.privateKey == nil {
+		e := &ErrGetPGPKeyFailure{Err: errors.New("private key has not been initialized")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if passphrase == "" {
+		e := &ErrLockPGPKeyFailure{Err: errors.New("a passphrase is required")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	locked, err := kp.privateKey.Lock([]byte(passphrase))
+	if err != nil {
+		e := &ErrLockPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	armoredKey, err := locked.Armor()
+	if err != nil {
+		e := &ErrArmorPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	kp.armoredKey = armoredKey
+	kp.passphrase = passphrase
+	return nil
+}
+
 // GetArmoredPrivateKey returns the private key wrapped in PGP armor.
 //
 // The following errors are returned by this function:
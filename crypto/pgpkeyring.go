@@ -0,0 +1,935 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	gocrypto "crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	pmailarmor "github.com/ProtonMail/gopenpgp/v2/armor"
+	"github.com/ProtonMail/gopenpgp/v2/constants"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+// PGPRevocationReason is the reason given when revoking a PGP key or subkey.
+type PGPRevocationReason int
+
+// Possible revocation reasons.
+const (
+	_ PGPRevocationReason = iota
+	PGPRevocationNoReason
+	PGPRevocationKeySuperseded
+	PGPRevocationKeyCompromised
+	PGPRevocationKeyRetired
+)
+
+// String returns the name of the revocation reason.
+func (r PGPRevocationReason) String() string {
+	switch r {
+	case PGPRevocationNoReason:
+		return "no reason"
+	case PGPRevocationKeySuperseded:
+		return "key superseded"
+	case PGPRevocationKeyCompromised:
+		return "key compromised"
+	case PGPRevocationKeyRetired:
+		return "key retired"
+	}
+	return fmt.Sprintf("unknown(%d)", int(r))
+}
+
+// code returns the RFC 4880 reason for revocation code.
+func (r PGPRevocationReason) code() uint8 {
+	switch r {
+	case PGPRevocationKeySuperseded:
+		return uint8(packet.KeySuperseded)
+	case PGPRevocationKeyCompromised:
+		return uint8(packet.KeyCompromised)
+	case PGPRevocationKeyRetired:
+		return uint8(packet.KeyRetired)
+	}
+	return uint8(packet.NoReason)
+}
+
+// PGPSubkeyUsage is what a PGP subkey is used for.
+type PGPSubkeyUsage int
+
+// Possible subkey usages.
+const (
+	_ PGPSubkeyUsage = iota
+	PGPSubkeyEncrypt
+	PGPSubkeySign
+)
+
+// String returns the name of the subkey usage.
+func (u PGPSubkeyUsage) String() string {
+	switch u {
+	case PGPSubkeyEncrypt:
+		return "encrypt"
+	case PGPSubkeySign:
+		return "sign"
+	}
+	return fmt.Sprintf("unknown(%d)", int(u))
+}
+
+// PGPKeyOptions holds the options used to generate a PGP key.
+type PGPKeyOptions struct {
+	// Name is the name of the key's owner.
+	Name string
+
+	// Email is the email address of the key's owner.
+	Email string
+
+	// KeyType is either "rsa" or "x25519". If not set, "x25519" is used.
+	KeyType string
+
+	// Bits is the size of an RSA key. If not set, 4096 is used.
+	Bits int
+
+	// Expiry is how long after its creation the key expires. If not set, the key does not expire.
+	Expiry time.Duration
+
+	// Passphrase is used to lock the private key. It is required.
+	Passphrase []byte
+}
+
+// PGPSubkeyOptions holds the options used to add a subkey to a PGP key.
+type PGPSubkeyOptions struct {
+	// Usage is what the subkey is used for. If not set, PGPSubkeyEncrypt is used.
+	Usage PGPSubkeyUsage
+
+	// KeyType is either "rsa" or "x25519". If not set, "x25519" is used.
+	KeyType string
+
+	// Bits is the size of an RSA key. If not set, 4096 is used.
+	Bits int
+
+	// Expiry is how long after its creation the subkey expires. If not set, the subkey does not expire.
+	Expiry time.Duration
+}
+
+// PGPKeyInfo describes a PGP key in a PGPKeyRing.
+type PGPKeyInfo struct {
+	// Fingerprint is the fingerprint of the primary key as lowercase hex.
+	Fingerprint string
+
+	// KeyID is the ID of the primary key as lowercase hex.
+	KeyID string
+
+	// Identities holds the user IDs of the key, such as "Name <email@example.com>".
+	Identities []string
+
+	// Emails holds the email addresses of the user IDs.
+	Emails []string
+
+	// CreationTime is when the key was created.
+	CreationTime time.Time
+
+	// ExpiryTime is when the key expires. It is zero if the key does not expire.
+	ExpiryTime time.Time
+
+	// Revoked is whether the key has been revoked.
+	Revoked bool
+
+	// HasPrivateKey is whether the key ring holds the private key.
+	HasPrivateKey bool
+
+	// Subkeys describes the subkeys of the key.
+	Subkeys []PGPSubkeyInfo
+}
+
+// PGPSubkeyInfo describes a subkey of a PGP key.
+type PGPSubkeyInfo struct {
+	// Fingerprint is the fingerprint of the subkey as lowercase hex.
+	Fingerprint string
+
+	// KeyID is the ID of the subkey as lowercase hex.
+	KeyID string
+
+	// Usage is what the subkey is used for. It is zero if the subkey has been revoked.
+	Usage PGPSubkeyUsage
+
+	// CreationTime is when the subkey was created.
+	CreationTime time.Time
+
+	// ExpiryTime is when the subkey expires. It is zero if the subkey does not expire.
+	ExpiryTime time.Time
+
+	// Revoked is whether the subkey has been revoked.
+	Revoked bool
+}
+
+// PGPKeyRing stores PGP public keys and locked private keys.
+//
+// Private keys are always locked while they are stored. Operations which need a private key take its passphrase
+// explicitly, and Unlock() returns a PGPKeyPair for encrypting, decrypting and signing data.
+//
+// A PGPKeyRing is safe for concurrent use.
+type PGPKeyRing struct {
+	// entities holds the keys in the order they were added.
+	entities []*openpgp.Entity
+
+	// mutex protects entities.
+	mutex sync.RWMutex
+}
+
+// NewPGPKeyRing returns an empty PGPKeyRing.
+func NewPGPKeyRing() *PGPKeyRing {
+	return &PGPKeyRing{}
+}
+
+// GenerateKey generates a new PGP key with an encryption subkey, adds it to the key ring and returns its
+// fingerprint.
+//
+// The following errors are returned by this function:
+// ErrGeneratePGPKeyFailure, ErrLockPGPKeyFailure
+func (kr *PGPKeyRing) GenerateKey(ctx context.Context, opts *PGPKeyOptions) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	o := PGPKeyOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	logger = logger.With().Str("name", o.Name).Str("email", o.Email).Str("key_type", o.KeyType).Logger()
+	if len(o.Passphrase) == 0 {
+		e := &ErrGeneratePGPKeyFailure{Err: errors.New("a passphrase is required"), Name: o.Name, Email: o.Email,
+			KeyType: o.KeyType, Bits: o.Bits}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+
+	config, err := pgpKeyConfig(o.KeyType, o.Bits, o.Expiry)
+	if err == nil {
+		var entity *openpgp.Entity
+		if entity, err = openpgp.NewEntity(o.Name, "", o.Email, config); err == nil {
+			if err := lockPGPEntity(entity, o.Passphrase); err != nil {
+				e := &ErrLockPGPKeyFailure{Err: err, Name: o.Name, Email: o.Email, KeyType: o.KeyType, Bits: o.Bits}
+				logger.Error().Err(e.Err).Msg(e.Error())
+				return "", e
+			}
+			kr.mutex.Lock()
+			defer kr.mutex.Unlock()
+			kr.entities = append(kr.entities, entity)
+			return pgpFingerprint(entity.PrimaryKey), nil
+		}
+	}
+	e := &ErrGeneratePGPKeyFailure{Err: err, Name: o.Name, Email: o.Email, KeyType: o.KeyType, Bits: o.Bits}
+	logger.Error().Err(e.Err).Msg(e.Error())
+	return "", e
+}
+
+// Import adds the keys in an armored public or private key block to the key ring and returns their fingerprints.
+//
+// Private keys which are not locked are locked with the given passphrase, which is otherwise ignored. If a key is
+// already in the key ring, it is replaced unless only the stored key holds the private key, in which case any
+// revocations are copied to the stored key instead.
+//
+// The following errors are returned by this function:
+// ErrLoadPGPKeyFailure, ErrLockPGPKeyFailure
+func (kr *PGPKeyRing) Import(ctx context.Context, armored string, passphrase []byte) ([]string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		e := &ErrLoadPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	for _, entity := range entities {
+		if entity.PrivateKey == nil || entity.PrivateKey.Encrypted {
+			continue
+		}
+		if len(passphrase) == 0 {
+			e := &ErrLockPGPKeyFailure{Err: fmt.Errorf("private key '%s' is not locked and no passphrase was given",
+				pgpFingerprint(entity.PrimaryKey))}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		if err := lockPGPEntity(entity, passphrase); err != nil {
+			e := &ErrLockPGPKeyFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+	}
+
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	fingerprints := []string{}
+	for _, entity := range entities {
+		fingerprint := pgpFingerprint(entity.PrimaryKey)
+		fingerprints = append(fingerprints, fingerprint)
+		i := kr.index(fingerprint)
+		switch {
+		case i < 0:
+			kr.entities = append(kr.entities, entity)
+		case entity.PrivateKey == nil && kr.entities[i].PrivateKey != nil:
+			kr.entities[i].Revocations = mergePGPRevocations(kr.entities[i].Revocations, entity.Revocations)
+		default:
+			entity.Revocations = mergePGPRevocations(entity.Revocations, kr.entities[i].Revocations)
+			kr.entities[i] = entity
+		}
+	}
+	return fingerprints, nil
+}
+
+// Remove removes a key from the key ring and returns whether it was found.
+func (kr *PGPKeyRing) Remove(fingerprint string) bool {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+
+	i := kr.index(fingerprint)
+	if i < 0 {
+		return false
+	}
+	kr.entities = append(kr.entities[:i], kr.entities[i+1:]...)
+	return true
+}
+
+// Keys describes every key in the key ring.
+func (kr *PGPKeyRing) Keys() []*PGPKeyInfo {
+	kr.mutex.RLock()
+	defer kr.mutex.RUnlock()
+
+	infos := []*PGPKeyInfo{}
+	for _, entity := range kr.entities {
+		infos = append(infos, newPGPKeyInfo(entity))
+	}
+	return infos
+}
+
+// FindByFingerprint returns the key with the given fingerprint, ignoring case and spaces, or nil if it is not in the
+// key ring.
+func (kr *PGPKeyRing) FindByFingerprint(fingerprint string) *PGPKeyInfo {
+	kr.mutex.RLock()
+	defer kr.mutex.RUnlock()
+
+	if i := kr.index(fingerprint); i >= 0 {
+		return newPGPKeyInfo(kr.entities[i])
+	}
+	return nil
+}
+
+// FindByEmail returns the keys with a user ID holding the given email address, ignoring case.
+func (kr *PGPKeyRing) FindByEmail(email string) []*PGPKeyInfo {
+	kr.mutex.RLock()
+	defer kr.mutex.RUnlock()
+
+	infos := []*PGPKeyInfo{}
+	for _, entity := range kr.entities {
+		for _, identity := range entity.Identities {
+			if strings.EqualFold(identity.UserId.Email, email) {
+				infos = append(infos, newPGPKeyInfo(entity))
+				break
+			}
+		}
+	}
+	return infos
+}
+
+// ExportPublicKey returns the armored public key with the given fingerprint, including any revocations.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrArmorPGPKeyFailure
+func (kr *PGPKeyRing) ExportPublicKey(ctx context.Context, fingerprint string) (string, error) {
+	return kr.export(ctx, fingerprint, false)
+}
+
+// ExportPrivateKey returns the armored private key with the given fingerprint. The key remains locked with its
+// passphrase.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrArmorPGPKeyFailure
+func (kr *PGPKeyRing) ExportPrivateKey(ctx context.Context, fingerprint string) (string, error) {
+	return kr.export(ctx, fingerprint, true)
+}
+
+// Unlock unlocks the private key with the given fingerprint and returns it as a PGPKeyPair. The key in the key ring
+// remains locked.
+//
+// Be sure to call ClearPrivateParams on the returned key to clear memory out when finished with the object.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrArmorPGPKeyFailure, any error returned by NewPGPKeyPairFromArmor
+func (kr *PGPKeyRing) Unlock(ctx context.Context, fingerprint string, passphrase []byte) (*PGPKeyPair, error) {
+	armored, err := kr.ExportPrivateKey(ctx, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return NewPGPKeyPairFromArmor(ctx, armored, string(passphrase))
+}
+
+// ChangePassphrase changes the passphrase of the private key with the given fingerprint.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrUnlockPGPKeyFailure, ErrLockPGPKeyFailure
+func (kr *PGPKeyRing) ChangePassphrase(ctx context.Context, fingerprint string, oldPassphrase,
+	newPassphrase []byte) error {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("fingerprint", fingerprint).Logger()
+
+	if len(newPassphrase) == 0 {
+		e := &ErrLockPGPKeyFailure{Err: errors.New("a passphrase is required")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return kr.withUnlockedKey(logger.WithContext(ctx), fingerprint, oldPassphrase, newPassphrase,
+		func(*openpgp.Entity) error { return nil })
+}
+
+// AddSubkey generates a new subkey for the key with the given fingerprint and returns the subkey's fingerprint.
+//
+// The passphrase of the private key is required to sign the new subkey, which is locked with the same passphrase.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrUnlockPGPKeyFailure, ErrLockPGPKeyFailure, ErrGeneratePGPKeyFailure
+func (kr *PGPKeyRing) AddSubkey(ctx context.Context, fingerprint string, passphrase []byte,
+	opts *PGPSubkeyOptions) (string, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("fingerprint", fingerprint).Logger()
+
+	var subkeyFingerprint string
+	err := kr.withUnlockedKey(logger.WithContext(ctx), fingerprint, passphrase, passphrase,
+		func(entity *openpgp.Entity) error {
+			fp, err := addPGPSubkey(logger, entity, opts)
+			subkeyFingerprint = fp
+			return err
+		})
+	if err != nil {
+		return "", err
+	}
+	return subkeyFingerprint, nil
+}
+
+// RotateSubkey generates a new subkey for the key with the given fingerprint and revokes every other subkey with
+// the same usage as superseded. It returns the new subkey's fingerprint.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrUnlockPGPKeyFailure, ErrLockPGPKeyFailure, ErrGeneratePGPKeyFailure,
+// ErrRevokePGPKeyFailure
+func (kr *PGPKeyRing) RotateSubkey(ctx context.Context, fingerprint string, passphrase []byte,
+	opts *PGPSubkeyOptions) (string, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("fingerprint", fingerprint).Logger()
+
+	var subkeyFingerprint string
+	err := kr.withUnlockedKey(logger.WithContext(ctx), fingerprint, passphrase, passphrase,
+		func(entity *openpgp.Entity) error {
+			old := []int{}
+			for i := range entity.Subkeys {
+				if pgpSubkeyUsage(&entity.Subkeys[i]) == subkeyOptions(opts).Usage {
+					old = append(old, i)
+				}
+			}
+			fp, err := addPGPSubkey(logger, entity, opts)
+			if err != nil {
+				return err
+			}
+			subkeyFingerprint = fp
+			for _, i := range old {
+				if err := revokePGPSubkey(logger, entity, i, PGPRevocationKeySuperseded, "subkey rotated"); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return "", err
+	}
+	return subkeyFingerprint, nil
+}
+
+// RevokeSubkey revokes the subkey with the given fingerprint belonging to the key with the given fingerprint.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrUnlockPGPKeyFailure, ErrLockPGPKeyFailure, ErrRevokePGPKeyFailure
+func (kr *PGPKeyRing) RevokeSubkey(ctx context.Context, fingerprint, subkeyFingerprint string, passphrase []byte,
+	reason PGPRevocationReason, text string) error {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("fingerprint", fingerprint).Str("subkey_fingerprint", subkeyFingerprint).Logger()
+
+	return kr.withUnlockedKey(logger.WithContext(ctx), fingerprint, passphrase, passphrase,
+		func(entity *openpgp.Entity) error {
+			for i := range entity.Subkeys {
+				if pgpFingerprint(entity.Subkeys[i].PublicKey) == normalizePGPFingerprint(subkeyFingerprint) {
+					return revokePGPSubkey(logger, entity, i, reason, text)
+				}
+			}
+			e := &ErrRevokePGPKeyFailure{Err: errors.New("subkey was not found"), Fingerprint: subkeyFingerprint}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return e
+		})
+}
+
+// RevocationCertificate generates an armored revocation certificate for the key with the given fingerprint.
+//
+// The certificate does not change the key ring. Store it safely so that the key can be revoked with Revoke(), or by
+// other OpenPGP implementations such as GnuPG, if the private key or its passphrase is lost.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrUnlockPGPKeyFailure, ErrLockPGPKeyFailure, ErrRevokePGPKeyFailure, ErrArmorPGPKeyFailure
+func (kr *PGPKeyRing) RevocationCertificate(ctx context.Context, fingerprint string, passphrase []byte,
+	reason PGPRevocationReason, text string) (string, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("fingerprint", fingerprint).Logger()
+
+	var buf bytes.Buffer
+	err := kr.withUnlockedKey(logger.WithContext(ctx), fingerprint, passphrase, passphrase,
+		func(entity *openpgp.Entity) error {
+			sig := newPGPRevocationSignature(entity, packet.SigTypeKeyRevocation, reason, text)
+			if err := sig.RevokeKey(entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+				e := &ErrRevokePGPKeyFailure{Err: err, Fingerprint: fingerprint}
+				logger.Error().Err(e.Err).Msg(e.Error())
+				return e
+			}
+			return sig.Serialize(&buf)
+		})
+	if err != nil {
+		return "", err
+	}
+	armored, err := pmailarmor.ArmorWithType(buf.Bytes(), constants.PublicKeyHeader)
+	if err != nil {
+		e := &ErrArmorPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	return armored, nil
+}
+
+// Revoke applies an armored revocation certificate, such as one created by RevocationCertificate(), to the matching
+// key in the key ring. Export the public key afterwards to publish the revocation.
+//
+// The following errors are returned by this function:
+// ErrLoadPGPKeyFailure, ErrGetPGPKeyFailure, ErrRevokePGPKeyFailure
+func (kr *PGPKeyRing) Revoke(ctx context.Context, certificate string) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	der, err := pmailarmor.Unarmor(certificate)
+	if err != nil {
+		e := &ErrLoadPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	p, err := packet.Read(bytes.NewReader(der))
+	if err != nil {
+		e := &ErrLoadPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok || sig.SigType != packet.SigTypeKeyRevocation {
+		e := &ErrLoadPGPKeyFailure{Err: errors.New("data is not a key revocation certificate")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	for _, entity := range kr.entities {
+		if !sig.CheckKeyIdOrFingerprint(entity.PrimaryKey) {
+			continue
+		}
+		fingerprint := pgpFingerprint(entity.PrimaryKey)
+		if err := entity.PrimaryKey.VerifyRevocationSignature(sig); err != nil {
+			e := &ErrRevokePGPKeyFailure{Err: err, Fingerprint: fingerprint}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return e
+		}
+		entity.Revocations = mergePGPRevocations(entity.Revocations, []*packet.Signature{sig})
+		logger.Info().Str("fingerprint", fingerprint).Msg("revoked PGP key")
+		return nil
+	}
+	e := &ErrGetPGPKeyFailure{Err: errors.New("the key for the revocation certificate is not in the key ring")}
+	logger.Error().Err(e.Err).Msg(e.Error())
+	return e
+}
+
+// export returns the armored public or private key with the given fingerprint.
+func (kr *PGPKeyRing) export(ctx context.Context, fingerprint string, private bool) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("fingerprint", fingerprint).Logger()
+
+	kr.mutex.RLock()
+	defer kr.mutex.RUnlock()
+
+	i := kr.index(fingerprint)
+	if i < 0 || (private && kr.entities[i].PrivateKey == nil) {
+		e := &ErrGetPGPKeyFailure{Err: errors.New("key was not found in the key ring")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	var buf bytes.Buffer
+	header := constants.PublicKeyHeader
+	if private {
+		header = constants.PrivateKeyHeader
+	}
+	err := serializePGPEntity(&buf, kr.entities[i], private)
+	if err == nil {
+		var armored string
+		if armored, err = pmailarmor.ArmorWithType(buf.Bytes(), header); err == nil {
+			return armored, nil
+		}
+	}
+	e := &ErrArmorPGPKeyFailure{Err: err}
+	logger.Error().Err(e.Err).Msg(e.Error())
+	return "", e
+}
+
+// withUnlockedKey unlocks the private key with the given fingerprint, calls f and locks the key again using
+// newPassphrase.
+func (kr *PGPKeyRing) withUnlockedKey(ctx context.Context, fingerprint string, passphrase, newPassphrase []byte,
+	f func(*openpgp.Entity) error) error {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+
+	i := kr.index(fingerprint)
+	if i < 0 || kr.entities[i].PrivateKey == nil {
+		e := &ErrGetPGPKeyFailure{Err: errors.New("private key was not found in the key ring")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+
+	// work on a copy so that the stored key is unchanged if anything fails
+	var buf bytes.Buffer
+	if err := serializePGPEntity(&buf, kr.entities[i], true); err != nil {
+		e := &ErrGetPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	entity, err := openpgp.ReadEntity(packet.NewReader(&buf))
+	if err != nil {
+		e := &ErrGetPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if err := unlockPGPEntity(entity, passphrase); err != nil {
+		e := &ErrUnlockPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if err := f(entity); err != nil {
+		return err
+	}
+	if err := lockPGPEntity(entity, newPassphrase); err != nil {
+		e := &ErrLockPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	kr.entities[i] = entity
+	return nil
+}
+
+// index returns the position of the key with the given fingerprint or -1 if it is not in the key ring.
+func (kr *PGPKeyRing) index(fingerprint string) int {
+	fingerprint = normalizePGPFingerprint(fingerprint)
+	for i, entity := range kr.entities {
+		if pgpFingerprint(entity.PrimaryKey) == fingerprint {
+			return i
+		}
+	}
+	return -1
+}
+
+// subkeyOptions returns a copy of the subkey options with the defaults filled in.
+func subkeyOptions(opts *PGPSubkeyOptions) PGPSubkeyOptions {
+	o := PGPSubkeyOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Usage == 0 {
+		o.Usage = PGPSubkeyEncrypt
+	}
+	return o
+}
+
+// pgpKeyConfig returns the configuration used to generate a key or subkey.
+func pgpKeyConfig(keyType string, bits int, expiry time.Duration) (*packet.Config, error) {
+	config := &packet.Config{
+		DefaultHash:     gocrypto.SHA256,
+		DefaultCipher:   packet.CipherAES256,
+		KeyLifetimeSecs: uint32(expiry / time.Second),
+	}
+	switch strings.ToLower(keyType) {
+	case "", "x25519":
+		config.Algorithm = packet.PubKeyAlgoEdDSA
+	case "rsa":
+		config.Algorithm = packet.PubKeyAlgoRSA
+		config.RSABits = bits
+		if bits == 0 {
+			config.RSABits = 4096
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", keyType)
+	}
+	return config, nil
+}
+
+// addPGPSubkey adds a new subkey to the unlocked entity and returns its fingerprint.
+func addPGPSubkey(logger zerolog.Logger, entity *openpgp.Entity, opts *PGPSubkeyOptions) (string, error) {
+	o := subkeyOptions(opts)
+	config, err := pgpKeyConfig(o.KeyType, o.Bits, o.Expiry)
+	if err == nil {
+		switch o.Usage {
+		case PGPSubkeyEncrypt:
+			err = entity.AddEncryptionSubkey(config)
+		case PGPSubkeySign:
+			err = entity.AddSigningSubkey(config)
+		default:
+			err = fmt.Errorf("unsupported subkey usage '%s'", o.Usage)
+		}
+	}
+	if err != nil {
+		e := &ErrGeneratePGPKeyFailure{Err: err, KeyType: o.KeyType, Bits: o.Bits}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	return pgpFingerprint(entity.Subkeys[len(entity.Subkeys)-1].PublicKey), nil
+}
+
+// revokePGPSubkey replaces the binding signature of a subkey of the unlocked entity with a revocation signature.
+func revokePGPSubkey(logger zerolog.Logger, entity *openpgp.Entity, i int, reason PGPRevocationReason,
+	text string) error {
+
+	subkey := &entity.Subkeys[i]
+	sig := newPGPRevocationSignature(entity, packet.SigTypeSubkeyRevocation, reason, text)
+	// unlike key revocations, subkey revocations are computed over both the primary key and the subkey
+	if err := sig.SignKey(subkey.PublicKey, entity.PrivateKey, nil); err != nil {
+		e := &ErrRevokePGPKeyFailure{Err: err, Fingerprint: pgpFingerprint(subkey.PublicKey)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	subkey.Sig = sig
+	return nil
+}
+
+// newPGPRevocationSignature returns an unsigned revocation signature issued by the entity's primary key.
+func newPGPRevocationSignature(entity *openpgp.Entity, sigType packet.SignatureType, reason PGPRevocationReason,
+	text string) *packet.Signature {
+
+	code := reason.code()
+	return &packet.Signature{
+		Version:              entity.PrimaryKey.Version,
+		CreationTime:         time.Now(),
+		SigType:              sigType,
+		PubKeyAlgo:           entity.PrimaryKey.PubKeyAlgo,
+		Hash:                 gocrypto.SHA256,
+		RevocationReason:     &code,
+		RevocationReasonText: text,
+		IssuerKeyId:          &entity.PrimaryKey.KeyId,
+	}
+}
+
+// lockPGPEntity encrypts the private key and subkeys of the entity with the passphrase.
+func lockPGPEntity(entity *openpgp.Entity, passphrase []byte) error {
+	if err := entity.PrivateKey.Encrypt(passphrase); err != nil {
+		return err
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && !subkey.PrivateKey.Dummy() {
+			if err := subkey.PrivateKey.Encrypt(passphrase); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unlockPGPEntity decrypts the private key and subkeys of the entity with the passphrase.
+func unlockPGPEntity(entity *openpgp.Entity, passphrase []byte) error {
+	if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+		return errors.New("passphrase is incorrect")
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && !subkey.PrivateKey.Dummy() {
+			if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+				return errors.New("passphrase is incorrect")
+			}
+		}
+	}
+	return nil
+}
+
+// serializePGPEntity writes the public or private key, including any revocations, which openpgp.Entity omits.
+func serializePGPEntity(w io.Writer, entity *openpgp.Entity, private bool) error {
+	var err error
+	if private {
+		err = entity.PrivateKey.Serialize(w)
+	} else {
+		err = entity.PrimaryKey.Serialize(w)
+	}
+	if err != nil {
+		return err
+	}
+	for _, sig := range entity.Revocations {
+		if err := sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+
+	// write the identities in a stable order
+	names := []string{}
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		identity := entity.Identities[name]
+		if err := identity.UserId.Serialize(w); err != nil {
+			return err
+		}
+		for _, sig := range identity.Signatures {
+			if err := sig.Serialize(w); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, subkey := range entity.Subkeys {
+		if private && subkey.PrivateKey != nil {
+			err = subkey.PrivateKey.Serialize(w)
+		} else {
+			err = subkey.PublicKey.Serialize(w)
+		}
+		if err != nil {
+			return err
+		}
+		if err := subkey.Sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergePGPRevocations returns the revocations in a followed by those in b which are not in a.
+func mergePGPRevocations(a, b []*packet.Signature) []*packet.Signature {
+	merged := append([]*packet.Signature{}, a...)
+	for _, sig := range b {
+		found := false
+		for _, existing := range a {
+			if existing.CreationTime.Equal(sig.CreationTime) && existing.SigType == sig.SigType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, sig)
+		}
+	}
+	return merged
+}
+
+// newPGPKeyInfo describes the entity.
+func newPGPKeyInfo(entity *openpgp.Entity) *PGPKeyInfo {
+	info := &PGPKeyInfo{
+		Fingerprint:   pgpFingerprint(entity.PrimaryKey),
+		KeyID:         fmt.Sprintf("%016x", entity.PrimaryKey.KeyId),
+		Identities:    []string{},
+		Emails:        []string{},
+		CreationTime:  entity.PrimaryKey.CreationTime,
+		Revoked:       len(entity.Revocations) > 0,
+		HasPrivateKey: entity.PrivateKey != nil,
+		Subkeys:       []PGPSubkeyInfo{},
+	}
+	if identity := entity.PrimaryIdentity(); identity != nil {
+		info.ExpiryTime = pgpExpiryTime(entity.PrimaryKey, identity.SelfSignature)
+	}
+	for _, identity := range entity.Identities {
+		info.Identities = append(info.Identities, identity.Name)
+		if identity.UserId.Email != "" {
+			info.Emails = append(info.Emails, identity.UserId.Email)
+		}
+	}
+	sort.Strings(info.Identities)
+	sort.Strings(info.Emails)
+
+	for i := range entity.Subkeys {
+		subkey := &entity.Subkeys[i]
+		info.Subkeys = append(info.Subkeys, PGPSubkeyInfo{
+			Fingerprint:  pgpFingerprint(subkey.PublicKey),
+			KeyID:        fmt.Sprintf("%016x", subkey.PublicKey.KeyId),
+			Usage:        pgpSubkeyUsage(subkey),
+			CreationTime: subkey.PublicKey.CreationTime,
+			ExpiryTime:   pgpExpiryTime(subkey.PublicKey, subkey.Sig),
+			Revoked:      subkey.Sig.SigType == packet.SigTypeSubkeyRevocation,
+		})
+	}
+	return info
+}
+
+// pgpSubkeyUsage returns what the subkey is used for according to its binding signature.
+func pgpSubkeyUsage(subkey *openpgp.Subkey) PGPSubkeyUsage {
+	switch {
+	case subkey.Sig.SigType == packet.SigTypeSubkeyRevocation || !subkey.Sig.FlagsValid:
+		return 0
+	case subkey.Sig.FlagEncryptCommunications || subkey.Sig.FlagEncryptStorage:
+		return PGPSubkeyEncrypt
+	case subkey.Sig.FlagSign:
+		return PGPSubkeySign
+	}
+	return 0
+}
+
+// pgpExpiryTime returns when the key expires according to the signature or zero if it does not expire.
+func pgpExpiryTime(key *packet.PublicKey, sig *packet.Signature) time.Time {
+	if sig == nil || sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return time.Time{}
+	}
+	return key.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+}
+
+// pgpFingerprint returns the fingerprint of the key as lowercase hex.
+func pgpFingerprint(key *packet.PublicKey) string {
+	return hex.EncodeToString(key.Fingerprint[:])
+}
+
+// normalizePGPFingerprint returns the fingerprint as lowercase hex without spaces.
+func normalizePGPFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(fingerprint, " ", "", -1))
+}
@@ -0,0 +1,222 @@
+package crypto_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestPGPKeyRing(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+	passphrase := []byte("correct horse battery staple")
+
+	kr := crypto.NewPGPKeyRing()
+	fingerprint, err := kr.GenerateKey(ctx, &crypto.PGPKeyOptions{
+		Name:       "Alice",
+		Email:      "alice@example.com",
+		Expiry:     365 * 24 * time.Hour,
+		Passphrase: passphrase,
+	})
+	if err != nil {
+		t.Fatalf("error while generating key: %s", err.Error())
+	}
+	if _, err := kr.GenerateKey(ctx, &crypto.PGPKeyOptions{Name: "Bob"}); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+
+	// look the key up
+	info := kr.FindByFingerprint(strings.ToUpper(fingerprint))
+	if info == nil {
+		t.Fatalf("error: key was not found by fingerprint")
+	}
+	if !info.HasPrivateKey || info.Revoked {
+		t.Errorf("want: unrevoked private key, got: private=%t revoked=%t", info.HasPrivateKey, info.Revoked)
+	}
+	if d := info.ExpiryTime.Sub(info.CreationTime); d != 365*24*time.Hour {
+		t.Errorf("want: %s, got: %s", 365*24*time.Hour, d)
+	}
+	if len(info.Subkeys) != 1 || info.Subkeys[0].Usage != crypto.PGPSubkeyEncrypt {
+		t.Fatalf("want: 1 encryption subkey, got: %+v", info.Subkeys)
+	}
+	if infos := kr.FindByEmail("ALICE@example.com"); len(infos) != 1 || infos[0].Fingerprint != fingerprint {
+		t.Errorf("want: 1 key, got: %d", len(infos))
+	}
+	if infos := kr.FindByEmail("bob@example.com"); len(infos) != 0 {
+		t.Errorf("want: 0 keys, got: %d", len(infos))
+	}
+
+	// add and rotate subkeys
+	signing, err := kr.AddSubkey(ctx, fingerprint, passphrase, &crypto.PGPSubkeyOptions{
+		Usage:  crypto.PGPSubkeySign,
+		Expiry: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("error while adding subkey: %s", err.Error())
+	}
+	rotated, err := kr.RotateSubkey(ctx, fingerprint, passphrase, &crypto.PGPSubkeyOptions{Expiry: 30 * 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("error while rotating subkey: %s", err.Error())
+	}
+	subkeys := map[string]crypto.PGPSubkeyInfo{}
+	for _, s := range kr.FindByFingerprint(fingerprint).Subkeys {
+		subkeys[s.Fingerprint] = s
+	}
+	if len(subkeys) != 3 {
+		t.Fatalf("want: 3 subkeys, got: %d", len(subkeys))
+	}
+	if !subkeys[info.Subkeys[0].Fingerprint].Revoked {
+		t.Errorf("error: rotated subkey was not revoked")
+	}
+	if s := subkeys[signing]; s.Revoked || s.Usage != crypto.PGPSubkeySign ||
+		s.ExpiryTime.Sub(s.CreationTime) != 24*time.Hour {
+		t.Errorf("error: unexpected signing subkey: %+v", s)
+	}
+	if s := subkeys[rotated]; s.Revoked || s.Usage != crypto.PGPSubkeyEncrypt {
+		t.Errorf("error: unexpected encryption subkey: %+v", s)
+	}
+	if _, err := kr.AddSubkey(ctx, fingerprint, []byte("wrong"), nil); err == nil {
+		t.Errorf("error: got nil, expected error")
+	} else if _, ok := err.(*crypto.ErrUnlockPGPKeyFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrUnlockPGPKeyFailure", err)
+	}
+	if err := kr.RevokeSubkey(ctx, fingerprint, signing, passphrase, crypto.PGPRevocationKeyRetired, ""); err != nil {
+		t.Fatalf("error while revoking subkey: %s", err.Error())
+	}
+	for _, s := range kr.FindByFingerprint(fingerprint).Subkeys {
+		if s.Fingerprint == signing && !s.Revoked {
+			t.Errorf("error: signing subkey was not revoked")
+		}
+	}
+
+	// the unlocked key pair works with the rotated subkey
+	kp, err := kr.Unlock(ctx, fingerprint, passphrase)
+	if err != nil {
+		t.Fatalf("error while unlocking key: %s", err.Error())
+	}
+	defer kp.ClearPrivateParams()
+	pub, err := kr.ExportPublicKey(ctx, fingerprint)
+	if err != nil {
+		t.Fatalf("error while exporting public key: %s", err.Error())
+	}
+	message, err := crypto.EncryptPGPMessage(ctx, []byte("secret data"), []string{pub}, nil)
+	if err != nil {
+		t.Fatalf("error while encrypting message: %s", err.Error())
+	}
+	plaintext, err := kp.Decrypt(ctx, message, nil)
+	if err != nil {
+		t.Fatalf("error while decrypting message: %s", err.Error())
+	}
+	if string(plaintext) != "secret data" {
+		t.Errorf("want: secret data, got: %s", plaintext)
+	}
+
+	// change the passphrase
+	newPassphrase := []byte("new passphrase")
+	if err := kr.ChangePassphrase(ctx, fingerprint, []byte("wrong"), newPassphrase); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+	if err := kr.ChangePassphrase(ctx, fingerprint, passphrase, newPassphrase); err != nil {
+		t.Fatalf("error while changing passphrase: %s", err.Error())
+	}
+	if _, err := kr.Unlock(ctx, fingerprint, passphrase); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+	if _, err := kr.Unlock(ctx, fingerprint, newPassphrase); err != nil {
+		t.Errorf("error while unlocking key: %s", err.Error())
+	}
+}
+
+func TestPGPKeyRingRevocation(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+	passphrase := []byte("passphrase")
+
+	kr := crypto.NewPGPKeyRing()
+	fingerprint, err := kr.GenerateKey(ctx, &crypto.PGPKeyOptions{
+		Name:       "Alice",
+		Email:      "alice@example.com",
+		Passphrase: passphrase,
+	})
+	if err != nil {
+		t.Fatalf("error while generating key: %s", err.Error())
+	}
+	pub, _ := kr.ExportPublicKey(ctx, fingerprint)
+	certificate, err := kr.RevocationCertificate(ctx, fingerprint, passphrase, crypto.PGPRevocationKeyCompromised,
+		"lost laptop")
+	if err != nil {
+		t.Fatalf("error while generating revocation certificate: %s", err.Error())
+	}
+	if kr.FindByFingerprint(fingerprint).Revoked {
+		t.Errorf("error: key was revoked by generating a certificate")
+	}
+
+	// another key ring holding only the public key
+	other := crypto.NewPGPKeyRing()
+	if _, err := other.Import(ctx, pub, nil); err != nil {
+		t.Fatalf("error while importing public key: %s", err.Error())
+	}
+	if err := other.Revoke(ctx, certificate); err != nil {
+		t.Fatalf("error while revoking key: %s", err.Error())
+	}
+	if !other.FindByFingerprint(fingerprint).Revoked {
+		t.Errorf("error: key was not revoked")
+	}
+
+	// the revocation survives export and import
+	revoked, err := other.ExportPublicKey(ctx, fingerprint)
+	if err != nil {
+		t.Fatalf("error while exporting public key: %s", err.Error())
+	}
+	if _, err := kr.Import(ctx, revoked, nil); err != nil {
+		t.Fatalf("error while importing public key: %s", err.Error())
+	}
+	info := kr.FindByFingerprint(fingerprint)
+	if !info.Revoked || !info.HasPrivateKey {
+		t.Errorf("want: revoked private key, got: private=%t revoked=%t", info.HasPrivateKey, info.Revoked)
+	}
+
+	// a certificate for an unknown key is rejected
+	if !other.Remove(fingerprint) {
+		t.Errorf("error: key was not removed")
+	}
+	if err := other.Revoke(ctx, certificate); err == nil {
+		t.Errorf("error: got nil, expected error")
+	} else if _, ok := err.(*crypto.ErrGetPGPKeyFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrGetPGPKeyFailure", err)
+	}
+}
+
+func TestPGPKeyRingImport(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	kp, _ := newPGPFixture(t, "alice")
+	defer kp.ClearPrivateParams()
+	if err := kp.SetPassphrase(ctx, "my passphrase"); err != nil {
+		t.Fatalf("error while setting passphrase: %s", err.Error())
+	}
+	armored, _ := kp.GetArmoredPrivateKey(ctx)
+
+	kr := crypto.NewPGPKeyRing()
+	fingerprints, err := kr.Import(ctx, armored, nil)
+	if err != nil {
+		t.Fatalf("error while importing private key: %s", err.Error())
+	}
+	if len(fingerprints) != 1 || !kr.FindByFingerprint(fingerprints[0]).HasPrivateKey {
+		t.Fatalf("want: 1 private key, got: %v", fingerprints)
+	}
+	if _, err := kr.Unlock(ctx, fingerprints[0], []byte("my passphrase")); err != nil {
+		t.Errorf("error while unlocking key: %s", err.Error())
+	}
+	if _, err := kr.Import(ctx, "not a key", nil); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+	if len(kr.Keys()) != 1 {
+		t.Errorf("want: 1 key, got: %d", len(kr.Keys()))
+	}
+}
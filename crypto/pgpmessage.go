@@ -0,0 +1,484 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	pmailarmor "github.com/ProtonMail/gopenpgp/v2/armor"
+	"github.com/ProtonMail/gopenpgp/v2/constants"
+	pmailcrypto "github.com/ProtonMail/gopenpgp/v2/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+// EncryptPGPMessage encrypts data to each of the given armored public keys and returns an armored PGP message.
+//
+// If signer is not nil, the message is also signed using its private key.
+//
+// The following errors are returned by this function:
+// ErrLoadPGPKeyFailure, ErrGetPGPKeyFailure, ErrEncryptFailure, ErrEncodeFailure
+func EncryptPGPMessage(ctx context.Context, data []byte, recipients []string, signer *PGPKeyPair) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	publicKeys, signKeys, err := pgpEncryptionKeyRings(ctx, recipients, signer)
+	if err != nil {
+		return "", err
+	}
+	message, err := publicKeys.Encrypt(pmailcrypto.NewPlainMessage(data), signKeys)
+	if err != nil {
+		e := &ErrEncryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	armored, err := message.GetArmored()
+	if err != nil {
+		e := &ErrEncodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	return armored, nil
+}
+
+// NewPGPEncryptWriter returns a writer which encrypts everything written to it to each of the given armored public
+// keys and writes the PGP message to w.
+//
+// If signer is not nil, the message is also signed using its private key. If armored is true, the message is
+// wrapped in PGP armor; otherwise it is written in binary form.
+//
+// The returned writer must be closed to finish the message. Closing it does not close w.
+//
+// The following errors are returned by this function:
+// ErrLoadPGPKeyFailure, ErrGetPGPKeyFailure, ErrEncryptFailure, ErrEncodeFailure
+func NewPGPEncryptWriter(ctx context.Context, w io.Writer, recipients []string, signer *PGPKeyPair, armored bool) (
+	io.WriteCloser, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	publicKeys, signKeys, err := pgpEncryptionKeyRings(ctx, recipients, signer)
+	if err != nil {
+		return nil, err
+	}
+	writer := &pgpEncryptWriter{}
+	if armored {
+		armorWriter, err := pmailarmor.ArmorWithTypeBuffered(w, constants.PGPMessageHeader)
+		if err != nil {
+			e := &ErrEncodeFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		writer.armor = armorWriter
+		w = armorWriter
+	}
+	writer.plaintext, err = publicKeys.EncryptStream(w, nil, signKeys)
+	if err != nil {
+		e := &ErrEncryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return writer, nil
+}
+
+// VerifyPGPCleartext verifies a cleartext signed message using the given armored public keys and returns the text.
+//
+// The following errors are returned by this function:
+// ErrLoadPGPKeyFailure, ErrDecodeFailure, ErrInvalidSignature
+func VerifyPGPCleartext(ctx context.Context, message string, publicKeys []string) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	keyRing, err := newPGPPublicKeyRing(ctx, publicKeys)
+	if err != nil {
+		return "", err
+	}
+	block, _ := clearsign.Decode([]byte(message))
+	if block == nil {
+		e := &ErrDecodeFailure{Err: errors.New("no cleartext signed message was found")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	signature, err := ioutil.ReadAll(block.ArmoredSignature.Body)
+	if err != nil {
+		e := &ErrDecodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	text := pmailcrypto.NewPlainMessageFromString(string(block.Bytes))
+	err = keyRing.VerifyDetached(text, pmailcrypto.NewPGPSignature(signature), pmailcrypto.GetUnixTime())
+	if err != nil {
+		e := &ErrInvalidSignature{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	return text.GetString(), nil
+}
+
+// VerifyPGPDetachedSignature verifies an armored detached signature of data using the given armored public keys.
+//
+// The following errors are returned by this function:
+// ErrLoadPGPKeyFailure, ErrDecodeFailure, ErrInvalidSignature
+func VerifyPGPDetachedSignature(ctx context.Context, data []byte, signature string, publicKeys []string) error {
+	return VerifyPGPDetachedSignatureReader(ctx, bytes.NewReader(data), signature, publicKeys)
+}
+
+// VerifyPGPDetachedSignatureReader verifies an armored detached signature of the data read from r using the given
+// armored public keys.
+//
+// The following errors are returned by this function:
+// ErrLoadPGPKeyFailure, ErrDecodeFailure, ErrInvalidSignature
+func VerifyPGPDetachedSignatureReader(ctx context.Context, r io.Reader, signature string, publicKeys []string) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	keyRing, err := newPGPPublicKeyRing(ctx, publicKeys)
+	if err != nil {
+		return err
+	}
+	sig, err := pmailcrypto.NewPGPSignatureFromArmored(signature)
+	if err != nil {
+		e := &ErrDecodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if err := keyRing.VerifyDetachedStream(r, sig, pmailcrypto.GetUnixTime()); err != nil {
+		e := &ErrInvalidSignature{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return nil
+}
+
+// Encrypt encrypts data to each of the given armored public keys, signs it using the key pair and returns an
+// armored PGP message.
+//
+// Include the key pair's own public key in recipients to be able to decrypt the message with it later.
+//
+// The following errors are returned by this function:
+// any error returned by EncryptPGPMessage
+func (kp *PGPKeyPair) Encrypt(ctx context.Context, data []byte, recipients []string) (string, error) {
+	return EncryptPGPMessage(ctx, data, recipients, kp)
+}
+
+// NewEncryptWriter returns a writer which encrypts everything written to it to each of the given armored public
+// keys, signs it using the key pair and writes the PGP message to w.
+//
+// See NewPGPEncryptWriter() for details.
+//
+// The following errors are returned by this function:
+// any error returned by NewPGPEncryptWriter
+func (kp *PGPKeyPair) NewEncryptWriter(ctx context.Context, w io.Writer, recipients []string, armored bool) (
+	io.WriteCloser, error) {
+	return NewPGPEncryptWriter(ctx, w, recipients, kp, armored)
+}
+
+// Decrypt decrypts an armored PGP message using the key pair.
+//
+// If verifyKeys holds any armored public keys, the message must be signed by one of them. Otherwise any signature
+// in the message is ignored.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrLoadPGPKeyFailure, ErrDecodeFailure, ErrDecryptFailure, ErrInvalidSignature
+func (kp *PGPKeyPair) Decrypt(ctx context.Context, message string, verifyKeys []string) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	keyRing, err := kp.keyRing(ctx)
+	if err != nil {
+		return nil, err
+	}
+	verifyKeyRing, verifyTime, err := pgpVerifyKeyRing(ctx, verifyKeys)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := pmailcrypto.NewPGPMessageFromArmored(message)
+	if err != nil {
+		e := &ErrDecodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	plaintext, err := keyRing.Decrypt(msg, verifyKeyRing, verifyTime)
+	if err != nil {
+		var sigErr pmailcrypto.SignatureVerificationError
+		if errors.As(err, &sigErr) {
+			e := &ErrInvalidSignature{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		e := &ErrDecryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return plaintext.GetBinary(), nil
+}
+
+// NewDecryptReader returns a reader which decrypts the armored or binary PGP message read from r using the key
+// pair.
+//
+// If verifyKeys holds any armored public keys, the message must be signed by one of them. Since the signature can
+// only be checked once the whole message has been read, an invalid signature is reported by the final call to
+// Read() returning ErrInvalidSignature instead of io.EOF. Data read before then must not be trusted until the end of
+// the message is reached.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrLoadPGPKeyFailure, ErrDecodeFailure, ErrDecryptFailure
+func (kp *PGPKeyPair) NewDecryptReader(ctx context.Context, r io.Reader, verifyKeys []string) (io.Reader, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	keyRing, err := kp.keyRing(ctx)
+	if err != nil {
+		return nil, err
+	}
+	verifyKeyRing, verifyTime, err := pgpVerifyKeyRing(ctx, verifyKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// remove the armor if there is any
+	buffered := bufio.NewReader(r)
+	r = buffered
+	if peek, _ := buffered.Peek(64); bytes.HasPrefix(bytes.TrimSpace(peek), []byte("-----BEGIN PGP")) {
+		block, err := armor.Decode(buffered)
+		if err != nil {
+			e := &ErrDecodeFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		r = block.Body
+	}
+
+	plaintext, err := keyRing.DecryptStream(r, verifyKeyRing, verifyTime)
+	if err != nil {
+		e := &ErrDecryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return &pgpDecryptReader{plaintext: plaintext, verify: verifyKeyRing != nil, logger: logger}, nil
+}
+
+// SignCleartext signs the text using the key pair and returns a cleartext signed message.
+//
+// Line endings are canonicalized and trailing whitespace is removed from each line before signing, as required by
+// RFC 4880.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrSignDataFailure, ErrEncodeFailure
+func (kp *PGPKeyPair) SignCleartext(ctx context.Context, text string) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	keyRing, err := kp.keyRing(ctx)
+	if err != nil {
+		return "", err
+	}
+	message := pmailcrypto.NewPlainMessageFromString(text)
+	signature, err := keyRing.SignDetached(message)
+	if err != nil {
+		e := &ErrSignDataFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	armored, err := pmailcrypto.NewClearTextMessage(message.GetBinary(), signature.GetBinary()).GetArmored()
+	if err != nil {
+		e := &ErrEncodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	return armored, nil
+}
+
+// SignDetached signs data using the key pair and returns an armored detached signature.
+//
+// The following errors are returned by this function:
+// any error returned by SignDetachedReader
+func (kp *PGPKeyPair) SignDetached(ctx context.Context, data []byte) (string, error) {
+	return kp.SignDetachedReader(ctx, bytes.NewReader(data))
+}
+
+// SignDetachedReader signs the data read from r using the key pair and returns an armored detached signature.
+//
+// The following errors are returned by this function:
+// ErrGetPGPKeyFailure, ErrSignDataFailure, ErrEncodeFailure
+func (kp *PGPKeyPair) SignDetachedReader(ctx context.Context, r io.Reader) (string, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	keyRing, err := kp.keyRing(ctx)
+	if err != nil {
+		return "", err
+	}
+	signature, err := keyRing.SignDetachedStream(r)
+	if err != nil {
+		e := &ErrSignDataFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	armored, err := signature.GetArmored()
+	if err != nil {
+		e := &ErrEncodeFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return "", e
+	}
+	return armored, nil
+}
+
+// keyRing returns a key ring holding the unlocked private key.
+func (kp *PGPKeyPair) keyRing(ctx context.Context) (*pmailcrypto.KeyRing, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if kp == nil || kp.privateKey == nil {
+		e := &ErrGetPGPKeyFailure{Err: errors.New("private key has not been initialized")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	keyRing, err := pmailcrypto.NewKeyRing(kp.privateKey)
+	if err != nil {
+		e := &ErrGetPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return keyRing, nil
+}
+
+// pgpEncryptWriter encrypts data written to it and closes the armor, if any, when it is closed.
+type pgpEncryptWriter struct {
+	plaintext io.WriteCloser
+	armor     io.Closer
+}
+
+// Write encrypts the data.
+func (w *pgpEncryptWriter) Write(p []byte) (int, error) {
+	return w.plaintext.Write(p)
+}
+
+// Close finishes the message.
+func (w *pgpEncryptWriter) Close() error {
+	if err := w.plaintext.Close(); err != nil {
+		return &ErrEncryptFailure{Err: err}
+	}
+	if w.armor != nil {
+		if err := w.armor.Close(); err != nil {
+			return &ErrEncodeFailure{Err: err}
+		}
+	}
+	return nil
+}
+
+// pgpDecryptReader returns the decrypted data and checks the signature once all of it has been read.
+type pgpDecryptReader struct {
+	plaintext *pmailcrypto.PlainMessageReader
+	verify    bool
+	logger    zerolog.Logger
+}
+
+// Read reads decrypted data.
+func (r *pgpDecryptReader) Read(p []byte) (int, error) {
+	n, err := r.plaintext.Read(p)
+	if err == io.EOF {
+		if r.verify {
+			if err := r.plaintext.VerifySignature(); err != nil {
+				e := &ErrInvalidSignature{Err: err}
+				r.logger.Error().Err(e.Err).Msg(e.Error())
+				return n, e
+			}
+		}
+		return n, io.EOF
+	}
+	if err != nil {
+		e := &ErrDecryptFailure{Err: err}
+		r.logger.Error().Err(e.Err).Msg(e.Error())
+		return n, e
+	}
+	return n, nil
+}
+
+// newPGPPublicKeyRing returns a key ring holding the given armored keys.
+func newPGPPublicKeyRing(ctx context.Context, armoredKeys []string) (*pmailcrypto.KeyRing, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if len(armoredKeys) == 0 {
+		e := &ErrLoadPGPKeyFailure{Err: errors.New("no public keys were provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	keyRing, err := pmailcrypto.NewKeyRing(nil)
+	if err != nil {
+		e := &ErrLoadPGPKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	for _, armoredKey := range armoredKeys {
+		key, err := pmailcrypto.NewKeyFromArmored(armoredKey)
+		if err != nil {
+			e := &ErrLoadPGPKeyFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		if err := keyRing.AddKey(key); err != nil {
+			e := &ErrLoadPGPKeyFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+	}
+	return keyRing, nil
+}
+
+// pgpEncryptionKeyRings returns the key rings of the recipients and, if there is one, the signer.
+func pgpEncryptionKeyRings(ctx context.Context, recipients []string, signer *PGPKeyPair) (
+	*pmailcrypto.KeyRing, *pmailcrypto.KeyRing, error) {
+
+	publicKeys, err := newPGPPublicKeyRing(ctx, recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	if signer == nil {
+		return publicKeys, nil, nil
+	}
+	signKeys, err := signer.keyRing(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return publicKeys, signKeys, nil
+}
+
+// pgpVerifyKeyRing returns the key ring and time used to verify signatures in a message, or nil and 0 if there are
+// no keys so that signatures are not checked.
+func pgpVerifyKeyRing(ctx context.Context, armoredKeys []string) (*pmailcrypto.KeyRing, int64, error) {
+	if len(armoredKeys) == 0 {
+		return nil, 0, nil
+	}
+	keyRing, err := newPGPPublicKeyRing(ctx, armoredKeys)
+	if err != nil {
+		return nil, 0, err
+	}
+	return keyRing, pmailcrypto.GetUnixTime(), nil
+}
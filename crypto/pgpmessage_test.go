@@ -0,0 +1,183 @@
+package crypto_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestPGPEncryptDecrypt(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	alice, alicePub := newPGPFixture(t, "alice")
+	defer alice.ClearPrivateParams()
+	bob, bobPub := newPGPFixture(t, "bob")
+	defer bob.ClearPrivateParams()
+	_, evePub := newPGPFixture(t, "eve")
+
+	// encrypt to several recipients
+	message, err := alice.Encrypt(ctx, []byte("secret data"), []string{alicePub, bobPub})
+	if err != nil {
+		t.Fatalf("error while encrypting message: %s", err.Error())
+	}
+	if !strings.HasPrefix(message, "-----BEGIN PGP MESSAGE-----") {
+		t.Errorf("error: message is not armored")
+	}
+	for _, kp := range []*crypto.PGPKeyPair{alice, bob} {
+		plaintext, err := kp.Decrypt(ctx, message, []string{alicePub})
+		if err != nil {
+			t.Fatalf("error while decrypting message: %s", err.Error())
+		}
+		if string(plaintext) != "secret data" {
+			t.Errorf("want: secret data, got: %s", plaintext)
+		}
+	}
+
+	// the signature must come from one of the verification keys
+	_, err = bob.Decrypt(ctx, message, []string{evePub})
+	if _, ok := err.(*crypto.ErrInvalidSignature); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrInvalidSignature", err)
+	}
+	unsigned, _ := crypto.EncryptPGPMessage(ctx, []byte("secret data"), []string{bobPub}, nil)
+	if _, err := bob.Decrypt(ctx, unsigned, nil); err != nil {
+		t.Errorf("error while decrypting unsigned message: %s", err.Error())
+	}
+	_, err = bob.Decrypt(ctx, unsigned, []string{alicePub})
+	if _, ok := err.(*crypto.ErrInvalidSignature); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrInvalidSignature", err)
+	}
+
+	// only the recipients can decrypt the message
+	eve, _ := newPGPFixture(t, "eve")
+	defer eve.ClearPrivateParams()
+	_, err = eve.Decrypt(ctx, message, nil)
+	if _, ok := err.(*crypto.ErrDecryptFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrDecryptFailure", err)
+	}
+	_, err = crypto.EncryptPGPMessage(ctx, []byte("data"), []string{"not a key"}, nil)
+	if _, ok := err.(*crypto.ErrLoadPGPKeyFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrLoadPGPKeyFailure", err)
+	}
+}
+
+func TestPGPEncryptDecryptStream(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	alice, alicePub := newPGPFixture(t, "alice")
+	defer alice.ClearPrivateParams()
+	bob, bobPub := newPGPFixture(t, "bob")
+	defer bob.ClearPrivateParams()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+	for _, armored := range []bool{true, false} {
+		var buf bytes.Buffer
+		w, err := alice.NewEncryptWriter(ctx, &buf, []string{bobPub}, armored)
+		if err != nil {
+			t.Fatalf("error while creating writer: %s", err.Error())
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("error while encrypting data: %s", err.Error())
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("error while closing writer: %s", err.Error())
+		}
+		if armored != strings.HasPrefix(buf.String(), "-----BEGIN PGP MESSAGE-----") {
+			t.Errorf("error: unexpected message format when armored is %t", armored)
+		}
+		encrypted := buf.Bytes()
+
+		r, err := bob.NewDecryptReader(ctx, bytes.NewReader(encrypted), []string{alicePub})
+		if err != nil {
+			t.Fatalf("error while creating reader: %s", err.Error())
+		}
+		plaintext, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("error while decrypting data: %s", err.Error())
+		}
+		if !bytes.Equal(plaintext, data) {
+			t.Errorf("error: decrypted data does not match")
+		}
+
+		// the signature is checked at the end of the stream
+		r, _ = bob.NewDecryptReader(ctx, bytes.NewReader(encrypted), []string{bobPub})
+		_, err = ioutil.ReadAll(r)
+		if _, ok := err.(*crypto.ErrInvalidSignature); !ok {
+			t.Errorf("error: got %T, expected *crypto.ErrInvalidSignature", err)
+		}
+	}
+}
+
+func TestPGPSignVerify(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	alice, alicePub := newPGPFixture(t, "alice")
+	defer alice.ClearPrivateParams()
+	_, bobPub := newPGPFixture(t, "bob")
+
+	// cleartext signatures
+	signed, err := alice.SignCleartext(ctx, "hello\nworld")
+	if err != nil {
+		t.Fatalf("error while signing text: %s", err.Error())
+	}
+	text, err := crypto.VerifyPGPCleartext(ctx, signed, []string{bobPub, alicePub})
+	if err != nil {
+		t.Fatalf("error while verifying text: %s", err.Error())
+	}
+	if text != "hello\nworld" {
+		t.Errorf("want: hello\\nworld, got: %s", text)
+	}
+	tampered := strings.Replace(signed, "world", "there", 1)
+	if _, err := crypto.VerifyPGPCleartext(ctx, tampered, []string{alicePub}); err == nil {
+		t.Errorf("error: got nil, expected error")
+	} else if _, ok := err.(*crypto.ErrInvalidSignature); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrInvalidSignature", err)
+	}
+	_, err = crypto.VerifyPGPCleartext(ctx, "hello", []string{alicePub})
+	if _, ok := err.(*crypto.ErrDecodeFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrDecodeFailure", err)
+	}
+
+	// detached signatures
+	data := []byte("file contents")
+	signature, err := alice.SignDetached(ctx, data)
+	if err != nil {
+		t.Fatalf("error while signing data: %s", err.Error())
+	}
+	if err := crypto.VerifyPGPDetachedSignature(ctx, data, signature, []string{alicePub}); err != nil {
+		t.Errorf("error while verifying signature: %s", err.Error())
+	}
+	streamSignature, _ := alice.SignDetachedReader(ctx, bytes.NewReader(data))
+	err = crypto.VerifyPGPDetachedSignatureReader(ctx, bytes.NewReader(data), streamSignature, []string{alicePub})
+	if err != nil {
+		t.Errorf("error while verifying signature: %s", err.Error())
+	}
+	err = crypto.VerifyPGPDetachedSignature(ctx, []byte("other contents"), signature, []string{alicePub})
+	if _, ok := err.(*crypto.ErrInvalidSignature); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrInvalidSignature", err)
+	}
+	err = crypto.VerifyPGPDetachedSignature(ctx, data, signature, []string{bobPub})
+	if _, ok := err.(*crypto.ErrInvalidSignature); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrInvalidSignature", err)
+	}
+}
+
+func newPGPFixture(t *testing.T, name string) (*crypto.PGPKeyPair, string) {
+	ctx := context.TODO()
+	kp, err := crypto.NewPGPKeyPair(ctx, name, name+"@example.com", "x25519", 0)
+	if err != nil {
+		t.Fatalf("error while generating key: %s", err.Error())
+	}
+	pub, err := kp.GetArmoredPublicKey(ctx)
+	if err != nil {
+		t.Fatalf("error while getting public key: %s", err.Error())
+	}
+	return kp, pub
+}
@@ -0,0 +1,184 @@
+package crypto
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ParsePKCS12Bytes parses a PKCS#12 (PFX) store holding a client or server identity and returns it as a
+// tls.Certificate.
+//
+// The store must hold exactly one private key and the certificate for it. Any other certificates in the store are
+// appended to the chain after it. The Leaf field of the returned certificate is set.
+//
+// Stores protected using the legacy SHA-1 based algorithms, such as those created with the "-legacy" option of
+// OpenSSL 3 or by older versions of OpenSSL and Windows, and stores protected using PBES2 with AES, the default of
+// OpenSSL 3, are supported.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure, ErrLoadCertificateFailure
+func ParsePKCS12Bytes(ctx context.Context, contents, password []byte) (*tls.Certificate, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	key, leaf, chain, err := decodePKCS12Identity(contents, password)
+	if err != nil {
+		return nil, pkcs12Error(logger, err)
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+// ParsePKCS12File reads a PKCS#12 (PFX) store holding a client or server identity from a file.
+//
+// See ParsePKCS12Bytes() for details.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, any error returned by ParsePKCS12Bytes
+func ParsePKCS12File(ctx context.Context, file string, password []byte) (*tls.Certificate, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return ParsePKCS12Bytes(logger.WithContext(ctx), contents, password)
+}
+
+// AddPKCS12Bytes adds the CA certificates in a PKCS#12 (PFX) store to the pool as trust anchors.
+//
+// The store may be a trust store holding only certificates, such as one created by Java's keytool, in which case
+// every certificate must be marked as trusted. It may also be a store holding an identity, in which case the private
+// key and the certificate for it are ignored and only the CA certificates in its chain are added. Certificates which
+// are not CA certificates are never added.
+//
+// See ParsePKCS12Bytes() for the supported algorithms. Use AddCertificatesFromBytes() for certificates which are not
+// stored in a PKCS#12 store.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure, ErrLoadCertificateFailure
+func (p *CertificatePool) AddPKCS12Bytes(ctx context.Context, contents, password []byte) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	certs, err := pkcs12.DecodeTrustStore(contents, string(password))
+	if err != nil && err != pkcs12.ErrIncorrectPassword {
+		// the store may hold an identity instead, in which case only its chain is trusted
+		trustErr := err
+		_, _, certs, err = decodePKCS12Identity(contents, password)
+		if err != nil && err != pkcs12.ErrIncorrectPassword {
+			err = fmt.Errorf("store is neither a trust store (%s) nor an identity (%s)", trustErr.Error(),
+				err.Error())
+		}
+	}
+	if err != nil {
+		return pkcs12Error(logger, err)
+	}
+
+	added := 0
+	for _, cert := range certs {
+		if !cert.IsCA {
+			logger.Warn().Str("subject", cert.Subject.String()).Msg("skipping certificate which is not a CA")
+			continue
+		}
+		p.AddCert(cert)
+		added++
+	}
+	if added == 0 {
+		e := &ErrLoadCertificateFailure{Err: errors.New("PKCS#12 store does not hold any CA certificates")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return nil
+}
+
+// AddPKCS12File adds the CA certificates in a PKCS#12 (PFX) file to the pool as trust anchors.
+//
+// See AddPKCS12Bytes() for details.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, any error returned by AddPKCS12Bytes
+func (p *CertificatePool) AddPKCS12File(ctx context.Context, file string, password []byte) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return p.AddPKCS12Bytes(logger.WithContext(ctx), contents, password)
+}
+
+// decodePKCS12Identity returns the private key in a PKCS#12 store, the certificate for the key and the other
+// certificates in the store.
+func decodePKCS12Identity(contents, password []byte) (crypto.Signer, *x509.Certificate, []*x509.Certificate,
+	error) {
+
+	k, first, others, err := pkcs12.DecodeChain(contents, string(password))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("PKCS#12 store holds an unsupported private key: %T", k)
+	}
+
+	// the certificate for the key is usually, but not necessarily, the first one in the store
+	var leaf *x509.Certificate
+	chain := []*x509.Certificate{}
+	pub := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	for _, cert := range append([]*x509.Certificate{first}, others...) {
+		if leaf == nil && pub.Equal(cert.PublicKey) {
+			leaf = cert
+		} else {
+			chain = append(chain, cert)
+		}
+	}
+	if leaf == nil {
+		return nil, nil, nil, errors.New("PKCS#12 store does not hold the certificate for its key")
+	}
+	return key, leaf, chain, nil
+}
+
+// pkcs12Error logs and returns the error to report for an error which occurred while decoding a PKCS#12 store.
+func pkcs12Error(logger zerolog.Logger, err error) error {
+	if err == pkcs12.ErrIncorrectPassword {
+		e := &ErrDecryptFailure{Err: errors.New("password is incorrect")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	e := &ErrLoadCertificateFailure{Err: err}
+	logger.Error().Err(e.Err).Msg(e.Error())
+	return e
+}
@@ -0,0 +1,115 @@
+package crypto_test
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+const (
+	// generated with "openssl pkcs12 -export -legacy" using the password "password"; it holds an ECDSA key, its
+	// certificate and the CA certificate
+	PKCS12Identity = `
+MIIE6gIBAzCCBLAGCSqGSIb3DQEHAaCCBKEEggSdMIIEmTCCA48GCSqGSIb3DQEHBqCCA4AwggN8AgEAMIIDdQYJKoZIhvcNAQcB
+MBwGCiqGSIb3DQEMAQYwDgQIp8kjxGXbtBkCAggAgIIDSBtCeKN+m5u2o5jYKlBQW/pyEEtVaBWyOOiKCNfvolGk5zKRVwZwZl3y
+KyCYp056Q59lnQsC6gKJuSSlRfxy+fDusYVsFxAJmvelkOlVh6FETq2XdXfX8C30fwaj8mzs4W/Znoo/d95fmVg11ATymDfKSDYC
+SxQtDxjXH1Cw8vNMX2CxgUHRUKBGfb1WEoVIpsP5jJylEqZmkxJJeJRrMCZCKS0MTuIPholYk9bmRLQKhaeZxg5JCsKm5HNm2TFM
+sqAUvX0WnsifKAdhtCqicUD/NibsTemwo1wbWKGZN2IuHFP1U4m/haLUgcxXrvhTfq7YGj9Jn4TT7tSpKD9OrQkHDrpsGUalEYLo
+CXZWkNYhoxDDS6+dZAqc0bMLz27Aes6CGVS7SnrnfCeYH7s7QkuINpXCY8Pit6xBLOYxMsSxOBDaQllA1OQES2dEAur7MG0Anhem
+Luy+Iyyt5WYLR1HwNDxJB6QRhVG8JHs0uL34693iZdgWmezsOsCoUGRiQm4Sn7Asmi089UVwfotPuRIs4kYFbrb9aJe98Pkw9wTt
++l7hTreUZLuQxbjf4jiiRyMmJkbK/KIEpdwBtJIvlL6PB3IvJXXIk7S4Dn1wuXNGdNUOEYWoVHtskKRK1Pu2OBZWyJfWH3vYRzgp
+nqjG6SXMSXkcXX63VQe9fjsMXna6xMeAbJp3/T3OK+CRmNeztcDOZcpSU/xDiz9XbZdRlVg9Tvtk05kRco8mdK9RekgxcRDUgnLx
+PTeL2+O5rIiOujvRSr8IYkZRiz2a/G1mGktsEqvaNQyztg3u332OUd4/ZXpP42mdbfkrpvDGd0O2WRkYz6N5kfNpFjxhpOjxFEQP
+58ipQGxYj7cQyhWXbi5o3+qPKLDrxpx17+I4yHOX76ugNlmKp91G4sEsrr01h5UtBuHBcdOzoRC6U7GKNoU9C8sZpKWBa8CDHVQj
+qt6h0usVnAV0uzKsmX9RKwnyNXbsidQ83DI08Tb2KRPUjJmKQ/ZtvfmdaN7CaEqaW8yimYTY26xsn7mrI3G8w5pkcdxLCIYr5ZCh
+4nf0GoC4Xly9lh12ppNaEassBeNOPJ6DJ94PTmCUotkDv30bAxGIbe+2pNCDckHqAjCCAQIGCSqGSIb3DQEHAaCB9ASB8TCB7jCB
+6wYLKoZIhvcNAQwKAQKggbQwgbEwHAYKKoZIhvcNAQwBAzAOBAiKJIgvgOFHYwICCAAEgZDrS+k/QPjRgrcKnD701cx1yhvjOCeU
+P1+1sCwv85W/TTQ85gJP+VP/kbLjsmDvQzRSJvh7cavWsOKvBtEDzwR6ip6YSgz2wHRtoSSXgqK0PE9z96uGbsZ+h7WqhIjLY3CN
+SlBpiRKllLRuyKLmaP0AfyH+SM1yVPYZ62DM1ppQuC/GEJlqO3ypOcoVAqp4wDQxJTAjBgkqhkiG9w0BCRUxFgQU+5VQt9VNW+Em
+5CGThdl63f/PkMEwMTAhMAkGBSsOAwIaBQAEFDARwMSG/eMKgGru8LtnPFapE/RiBAgTXF7/g+oBQwICCAA=
+`
+
+	// generated with "EncodeTrustStore" of software.sslmate.com/src/go-pkcs12 using AES-256 and the password
+	// "password"; it holds only the CA certificate of PKCS12Identity, marked as trusted
+	PKCS12TrustStore = `
+MIIDAwIBAzCCArMGCSqGSIb3DQEHAaCCAqQEggKgMIICnDCCApgGCSqGSIb3DQEHBqCCAokwggKFAgEAMIICfgYJKoZIhvcNAQcB
+MF0GCSqGSIb3DQEFDTBQMC8GCSqGSIb3DQEFDDAiBBATDWUmUhQarxVLPvJdyH/WAgIIADAKBggqhkiG9w0CCTAdBglghkgBZQME
+ASoEEDLrdzzN6xD472IAL8uMJ6OAggIQzdwKoFBw7j1Kud76N91tQFgeJe+smN0G8fiGQpUxJxAlttk0YuTcV+ZOEbSu5jvXg9Uw
+7faeXY12GFUZI4HOb8fIWBParSf2M5KMARWszA2QfjuS+6Zs50OxF21d4S4PI6paTGNC8mYtjq689U94kAFDOeujutK3eHD/+LKS
+F4wrgRJwtLO1ri2rl0SrJFrnje4uLesqQO+tvUStF5wH0abwzUW6FdSCaO6XmbtiVwLJwbZHQMJmcj+FuqJOaq4EISTI/lVDCMa3
+ImcH4z6QmAVjy6tOqgQMZ8tq9j8XU1iiJivEYISGUZle7m1fyXLErR7bMlo8VOP63TzgAQAE6MlVnuAJx7KFE/DYi6YA7fhBKRbp
+WmeeX6DZ+/FPmjzA/s5gF1j8muCuSHPWUiXiGHlmKYCIjnx94HLf+Vd7wt36O6yKy1p3qUAHYanFRqpDtQNBkY7lrCgW20KXeC/+
+6sGEQSUvJP5sFclSGkNFcBGQbsZD93da6+ZRS0uY7K79376bEFKxBuc2ltkZSXqlmX+uvBTtp77X0sigOlRH4GNUmOgXAS3QvV7s
+KIwXb4os/rRLeLb69PXxt2IxWCHzn/HmJ7qfh4WDU8o3BWiIWG5ijL3FODUacaOURRGYFduxLnScRj9NubCYpsJm0GzaE3cIL9nE
+07yQhUzIrfKgavMizcl47NemCjDB1puYUoCLMEcwLzALBglghkgBZQMEAgEEIN265+jz0KtN4PG2BkIvKJYMgCPR92f6l0MHCA0y
+fpUuBBAS6lCSaOLW9MnXkm83RQJ0AgIIAA==
+`
+)
+
+func TestParsePKCS12(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	identity := decodePKCS12Fixture(t, PKCS12Identity)
+	cert, err := crypto.ParsePKCS12Bytes(ctx, identity, []byte("password"))
+	if err != nil {
+		t.Fatalf("error while parsing PKCS#12 store: %s", err.Error())
+	}
+	if cert.Leaf.Subject.CommonName != "pkcs12-client" || len(cert.Certificate) != 2 || cert.PrivateKey == nil {
+		t.Errorf("error: unexpected identity: %s with %d certificates", cert.Leaf.Subject, len(cert.Certificate))
+	}
+
+	_, err = crypto.ParsePKCS12Bytes(ctx, identity, []byte("wrong"))
+	if _, ok := err.(*crypto.ErrDecryptFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrDecryptFailure", err)
+	}
+	_, err = crypto.ParsePKCS12Bytes(ctx, identity[:100], []byte("password"))
+	if _, ok := err.(*crypto.ErrLoadCertificateFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrLoadCertificateFailure", err)
+	}
+}
+
+func TestCertificatePoolAddPKCS12(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	// only the CA certificate of an identity is trusted
+	for _, fixture := range []string{PKCS12Identity, PKCS12TrustStore} {
+		pool, _ := crypto.NewCertificatePool(ctx, true)
+		if err := pool.AddPKCS12Bytes(ctx, decodePKCS12Fixture(t, fixture), []byte("password")); err != nil {
+			t.Fatalf("error while adding PKCS#12 store: %s", err.Error())
+		}
+		infos := pool.Inspect(nil)
+		if len(infos) != 1 || infos[0].Subject != "CN=PKCS12 Test CA" {
+			t.Errorf("error: unexpected pool contents: %+v", infos)
+		}
+	}
+
+	pool, _ := crypto.NewCertificatePool(ctx, true)
+	err := pool.AddPKCS12Bytes(ctx, decodePKCS12Fixture(t, PKCS12TrustStore), []byte("wrong"))
+	if _, ok := err.(*crypto.ErrDecryptFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrDecryptFailure", err)
+	}
+	err = pool.AddPKCS12Bytes(ctx, decodePKCS12Fixture(t, PKCS12Identity)[:100], []byte("password"))
+	if _, ok := err.(*crypto.ErrLoadCertificateFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrLoadCertificateFailure", err)
+	}
+
+	// a store without a private key is not an identity
+	_, err = crypto.ParsePKCS12Bytes(ctx, decodePKCS12Fixture(t, PKCS12TrustStore), []byte("password"))
+	if _, ok := err.(*crypto.ErrLoadCertificateFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrLoadCertificateFailure", err)
+	}
+}
+
+func decodePKCS12Fixture(t *testing.T, fixture string) []byte {
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(fixture), ""))
+	if err != nil {
+		t.Fatalf("error while decoding fixture: %s", err.Error())
+	}
+	return der
+}
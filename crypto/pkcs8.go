@@ -0,0 +1,477 @@
+package crypto
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PKCS8Cipher identifies the cipher used to encrypt a PKCS#8 private key.
+type PKCS8Cipher int
+
+// Possible values for the PKCS#8 encryption cipher.
+const (
+	_ PKCS8Cipher = iota
+	PKCS8CipherAES128CBC
+	PKCS8CipherAES192CBC
+	PKCS8CipherAES256CBC
+	PKCS8CipherAES128GCM
+	PKCS8CipherAES192GCM
+	PKCS8CipherAES256GCM
+)
+
+// Object identifiers used by PBES2 (RFC 8018), scrypt (RFC 7914) and AES (RFC 3565 and RFC 5084).
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+)
+
+// pkcs8CipherInfo describes one of the supported PKCS#8 ciphers.
+type pkcs8CipherInfo struct {
+	cipher  PKCS8Cipher
+	name    string
+	oid     asn1.ObjectIdentifier
+	keySize int
+	gcm     bool
+}
+
+// pkcs8Ciphers holds the supported PKCS#8 ciphers.
+var pkcs8Ciphers = []pkcs8CipherInfo{
+	{PKCS8CipherAES128CBC, "AES-128-CBC", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}, 16, false},
+	{PKCS8CipherAES192CBC, "AES-192-CBC", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}, 24, false},
+	{PKCS8CipherAES256CBC, "AES-256-CBC", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}, 32, false},
+	{PKCS8CipherAES128GCM, "AES-128-GCM", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 6}, 16, true},
+	{PKCS8CipherAES192GCM, "AES-192-GCM", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 26}, 24, true},
+	{PKCS8CipherAES256GCM, "AES-256-GCM", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}, 32, true},
+}
+
+// String returns the name of the cipher.
+func (c PKCS8Cipher) String() string {
+	for _, info := range pkcs8Ciphers {
+		if info.cipher == c {
+			return info.name
+		}
+	}
+	return fmt.Sprintf("unknown(%d)", int(c))
+}
+
+// encryptedPrivateKeyInfo is the ASN.1 structure of an encrypted PKCS#8 private key.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params holds the PBES2 key derivation function and encryption scheme.
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params holds the PBKDF2 parameters.
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// scryptParams holds the scrypt parameters.
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// gcmParams holds the AES-GCM parameters.
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"default:12"`
+}
+
+// PKCS8EncryptionOptions holds the options used to encrypt a PKCS#8 private key.
+type PKCS8EncryptionOptions struct {
+	// Cipher is the cipher used to encrypt the key. If not set, PKCS8CipherAES256CBC is used since it is supported
+	// by the widest range of software. OpenSSL cannot read keys encrypted with AES-GCM.
+	Cipher PKCS8Cipher
+
+	// KDF holds the key derivation function and its cost parameters. The algorithm must be KDFPBKDF2SHA256 or
+	// KDFScrypt. If nil, PBKDF2 with SHA-256 and the default number of iterations is used. OpenSSL limits scrypt to
+	// 32 MiB of memory by default, so ScryptN should be no more than 16384 when ScryptR is 8.
+	KDF *KDFOptions
+}
+
+// EncryptPKCS8PrivateKey encrypts the private key using PBES2 and returns it as an "ENCRYPTED PRIVATE KEY" PEM
+// block which can be read by OpenSSL and other modern tools.
+//
+// The key must be an RSA, ECDSA or Ed25519 private key. If opts is nil, AES-256-CBC and PBKDF2 with SHA-256 are
+// used.
+//
+// Use DecryptPKCS8PrivateKey() or ParsePrivateKeyBytes() to read the key.
+//
+// The following errors are returned by this function:
+// ErrEncryptFailure, ErrDeriveKeyFailure, ErrGenerateRandomKeyFailure, ErrGenerateIVFailure
+func EncryptPKCS8PrivateKey(ctx context.Context, key crypto.Signer, password []byte, opts *PKCS8EncryptionOptions) (
+	*pem.Block, error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// validate parameters
+	if key == nil {
+		e := &ErrEncryptFailure{Err: errors.New("no private key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if len(password) == 0 {
+		e := &ErrEncryptFailure{Err: errors.New("no password was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	o := PKCS8EncryptionOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Cipher == 0 {
+		o.Cipher = PKCS8CipherAES256CBC
+	}
+	info := pkcs8CipherByType(o.Cipher)
+	if info == nil {
+		e := &ErrEncryptFailure{Err: fmt.Errorf("unsupported cipher: %s", o.Cipher)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	kdf := &KDFOptions{Algorithm: KDFPBKDF2SHA256}
+	if o.KDF != nil {
+		*kdf = *o.KDF
+		if kdf.Algorithm == 0 {
+			kdf.Algorithm = KDFPBKDF2SHA256
+		}
+	}
+	kdf.setDefaults()
+	if kdf.Algorithm != KDFPBKDF2SHA256 && kdf.Algorithm != KDFScrypt {
+		e := &ErrDeriveKeyFailure{Algorithm: kdf.Algorithm, Err: errors.New("PKCS#8 keys require PBKDF2 or scrypt")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if err := kdf.validate(); err != nil {
+		e := &ErrDeriveKeyFailure{Algorithm: kdf.Algorithm, Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	logger = logger.With().Str("cipher", info.name).Str("kdf", kdf.Algorithm.String()).Logger()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		e := &ErrEncryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	// derive the encryption key
+	salt := make([]byte, kdf.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		e := &ErrGenerateRandomKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	var kdfAlg pkix.AlgorithmIdentifier
+	var cipherKey []byte
+	if kdf.Algorithm == KDFScrypt {
+		params, _ := asn1.Marshal(scryptParams{Salt: salt, CostParameter: kdf.ScryptN, BlockSize: kdf.ScryptR,
+			ParallelizationParameter: kdf.ScryptP})
+		kdfAlg = pkix.AlgorithmIdentifier{Algorithm: oidScrypt, Parameters: asn1.RawValue{FullBytes: params}}
+		cipherKey, err = scrypt.Key(password, salt, kdf.ScryptN, kdf.ScryptR, kdf.ScryptP, info.keySize)
+	} else {
+		params, _ := asn1.Marshal(pbkdf2Params{Salt: salt, IterationCount: kdf.PBKDF2Iterations,
+			PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue}})
+		kdfAlg = pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: params}}
+		cipherKey = pbkdf2.Key(password, salt, kdf.PBKDF2Iterations, info.keySize, sha256.New)
+	}
+	if err != nil {
+		e := &ErrDeriveKeyFailure{Algorithm: kdf.Algorithm, Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	defer zeroBytes(cipherKey)
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		e := &ErrEncryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	// encrypt the key
+	var encrypted, schemeParams []byte
+	if info.gcm {
+		aesGCM, err := cipher.NewGCM(block)
+		if err != nil {
+			e := &ErrEncryptFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		nonce := make([]byte, aesGCM.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			e := &ErrGenerateIVFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		schemeParams, _ = asn1.Marshal(gcmParams{Nonce: nonce, ICVLen: aesGCM.Overhead()})
+		encrypted = aesGCM.Seal(nil, nonce, der, nil)
+	} else {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := rand.Read(iv); err != nil {
+			e := &ErrGenerateIVFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		schemeParams, _ = asn1.Marshal(iv)
+		pad := aes.BlockSize - len(der)%aes.BlockSize
+		encrypted = make([]byte, len(der), len(der)+pad)
+		copy(encrypted, der)
+		for i := 0; i < pad; i++ {
+			encrypted = append(encrypted, byte(pad))
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	}
+	zeroBytes(der)
+
+	// encode the result
+	scheme := pkix.AlgorithmIdentifier{Algorithm: info.oid, Parameters: asn1.RawValue{FullBytes: schemeParams}}
+	params, err := asn1.Marshal(pbes2Params{KeyDerivationFunc: kdfAlg, EncryptionScheme: scheme})
+	if err != nil {
+		e := &ErrEncryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	data, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		e := &ErrEncryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return &pem.Block{Type: PEMTypeEncryptedPrivateKey, Bytes: data}, nil
+}
+
+// DecryptPKCS8PrivateKey decrypts an "ENCRYPTED PRIVATE KEY" PEM block produced by EncryptPKCS8PrivateKey() or
+// by OpenSSL.
+//
+// PBES2 with PBKDF2 (using HMAC-SHA1, -SHA256, -SHA384 or -SHA512) or scrypt and AES-CBC or AES-GCM is supported.
+// The returned key is an *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure, ErrUnsupportedKey
+func DecryptPKCS8PrivateKey(ctx context.Context, b *pem.Block, password []byte) (crypto.Signer, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if b == nil {
+		e := &ErrDecryptFailure{Err: errors.New("PEM block is nil")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if b.Type != PEMTypeEncryptedPrivateKey {
+		e := &ErrDecryptFailure{Err: fmt.Errorf("PEM block type is '%s', not '%s'", b.Type,
+			PEMTypeEncryptedPrivateKey)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	der, err := decryptPKCS8(b.Bytes, password)
+	if err != nil {
+		e := &ErrDecryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	defer zeroBytes(der)
+
+	// CBC padding only catches most incorrect passwords so garbage data is treated the same way
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		e := &ErrDecryptFailure{Err: errors.New("password is incorrect")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	signer, _, err := toSigner(logger, key, PrivateKeyFormatPKCS8)
+	return signer, err
+}
+
+// decryptPKCS8 decrypts the DER-encoded EncryptedPrivateKeyInfo structure and returns the DER-encoded private key.
+func decryptPKCS8(data, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if rest, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after encrypted private key")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported encryption algorithm: %s", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	// determine the cipher
+	var cipherInfo *pkcs8CipherInfo
+	for i := range pkcs8Ciphers {
+		if pkcs8Ciphers[i].oid.Equal(params.EncryptionScheme.Algorithm) {
+			cipherInfo = &pkcs8Ciphers[i]
+		}
+	}
+	if cipherInfo == nil {
+		return nil, fmt.Errorf("unsupported cipher: %s", params.EncryptionScheme.Algorithm)
+	}
+
+	// derive the key
+	cipherKey, err := derivePKCS8Key(params.KeyDerivationFunc, password, cipherInfo.keySize)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(cipherKey)
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// decrypt the data
+	incorrect := errors.New("password is incorrect")
+	if cipherInfo.gcm {
+		var gp gcmParams
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &gp); err != nil {
+			return nil, err
+		}
+		if gp.ICVLen < 12 || gp.ICVLen > 16 || len(gp.Nonce) == 0 {
+			return nil, errors.New("invalid AES-GCM parameters")
+		}
+		aesGCM, err := cipher.NewGCMWithNonceSize(block, len(gp.Nonce))
+		if err != nil {
+			return nil, err
+		}
+		if gp.ICVLen != aesGCM.Overhead() {
+			if aesGCM, err = cipher.NewGCMWithTagSize(block, gp.ICVLen); err != nil {
+				return nil, err
+			}
+			if len(gp.Nonce) != aesGCM.NonceSize() {
+				return nil, errors.New("AES-GCM with a non-standard nonce and tag size is not supported")
+			}
+		}
+		plaintext, err := aesGCM.Open(nil, gp.Nonce, info.EncryptedData, nil)
+		if err != nil {
+			return nil, incorrect
+		}
+		return plaintext, nil
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("incorrect IV size")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted data is not a multiple of the block size")
+	}
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, info.EncryptedData)
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, incorrect
+	}
+	for _, v := range plaintext[len(plaintext)-pad:] {
+		if int(v) != pad {
+			return nil, incorrect
+		}
+	}
+	return plaintext[:len(plaintext)-pad], nil
+}
+
+// derivePKCS8Key derives the encryption key from the password using the PBES2 key derivation function. The cost
+// parameters are checked against the same limits used for ciphertext envelopes.
+func derivePKCS8Key(alg pkix.AlgorithmIdentifier, password []byte, keySize int) ([]byte, error) {
+	switch {
+	case alg.Algorithm.Equal(oidPBKDF2):
+		var p pbkdf2Params
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &p); err != nil {
+			return nil, err
+		}
+		if p.KeyLength != 0 && p.KeyLength != keySize {
+			return nil, errors.New("PBKDF2 key length does not match the cipher")
+		}
+		if p.IterationCount < 1 || p.IterationCount > maxPBKDF2Iterations {
+			return nil, fmt.Errorf("PBKDF2 iterations must be between 1 and %d", maxPBKDF2Iterations)
+		}
+		if len(p.Salt) == 0 || len(p.Salt) > maxKDFSaltLength {
+			return nil, errors.New("invalid PBKDF2 salt")
+		}
+		var h func() hash.Hash
+		switch {
+		case len(p.PRF.Algorithm) == 0 || p.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			h = sha1.New
+		case p.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			h = sha256.New
+		case p.PRF.Algorithm.Equal(oidHMACWithSHA384):
+			h = sha512.New384
+		case p.PRF.Algorithm.Equal(oidHMACWithSHA512):
+			h = sha512.New
+		default:
+			return nil, fmt.Errorf("unsupported PBKDF2 PRF: %s", p.PRF.Algorithm)
+		}
+		return pbkdf2.Key(password, p.Salt, p.IterationCount, keySize, h), nil
+	case alg.Algorithm.Equal(oidScrypt):
+		var p scryptParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &p); err != nil {
+			return nil, err
+		}
+		if p.KeyLength != 0 && p.KeyLength != keySize {
+			return nil, errors.New("scrypt key length does not match the cipher")
+		}
+		o := &KDFOptions{Algorithm: KDFScrypt, SaltLength: len(p.Salt), ScryptN: p.CostParameter,
+			ScryptR: p.BlockSize, ScryptP: p.ParallelizationParameter}
+		if err := o.validate(); err != nil {
+			return nil, err
+		}
+		return scrypt.Key(password, p.Salt, o.ScryptN, o.ScryptR, o.ScryptP, keySize)
+	}
+	return nil, fmt.Errorf("unsupported key derivation function: %s", alg.Algorithm)
+}
+
+// pkcs8CipherByType returns the PKCS#8 cipher information for the given cipher.
+func pkcs8CipherByType(c PKCS8Cipher) *pkcs8CipherInfo {
+	for i := range pkcs8Ciphers {
+		if pkcs8Ciphers[i].cipher == c {
+			return &pkcs8Ciphers[i]
+		}
+	}
+	return nil
+}
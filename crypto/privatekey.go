@@ -0,0 +1,311 @@
+package crypto
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// PrivateKeyFormat identifies the encoding of a private key.
+type PrivateKeyFormat int
+
+// Possible values for the private key format.
+const (
+	_ PrivateKeyFormat = iota
+	PrivateKeyFormatPKCS1
+	PrivateKeyFormatPKCS8
+	PrivateKeyFormatSEC1
+	PrivateKeyFormatOpenSSH
+)
+
+// String returns the name of the private key format.
+func (f PrivateKeyFormat) String() string {
+	switch f {
+	case PrivateKeyFormatPKCS1:
+		return "PKCS#1"
+	case PrivateKeyFormatPKCS8:
+		return "PKCS#8"
+	case PrivateKeyFormatSEC1:
+		return "SEC1"
+	case PrivateKeyFormatOpenSSH:
+		return "OpenSSH"
+	}
+	return "unknown"
+}
+
+// KeyType identifies the algorithm and size of a generated private key.
+type KeyType int
+
+// Possible values for the key type.
+const (
+	_ KeyType = iota
+	KeyTypeRSA2048
+	KeyTypeRSA3072
+	KeyTypeRSA4096
+	KeyTypeECDSAP256
+	KeyTypeECDSAP384
+	KeyTypeECDSAP521
+	KeyTypeEd25519
+)
+
+// String returns the name of the key type.
+func (t KeyType) String() string {
+	switch t {
+	case KeyTypeRSA2048:
+		return "RSA-2048"
+	case KeyTypeRSA3072:
+		return "RSA-3072"
+	case KeyTypeRSA4096:
+		return "RSA-4096"
+	case KeyTypeECDSAP256:
+		return "ECDSA-P256"
+	case KeyTypeECDSAP384:
+		return "ECDSA-P384"
+	case KeyTypeECDSAP521:
+		return "ECDSA-P521"
+	case KeyTypeEd25519:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
+
+// PEM block types for private keys.
+const (
+	PEMTypeRSAPrivateKey       = "RSA PRIVATE KEY"
+	PEMTypePrivateKey          = "PRIVATE KEY"
+	PEMTypeECPrivateKey        = "EC PRIVATE KEY"
+	PEMTypeOpenSSHPrivateKey   = "OPENSSH PRIVATE KEY"
+	PEMTypeEncryptedPrivateKey = "ENCRYPTED PRIVATE KEY"
+)
+
+// GeneratePrivateKey generates a new private key of the given type.
+//
+// The returned key is an *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey.
+//
+// The following errors are returned by this function:
+// ErrGeneratePrivateKeyFailure
+func GeneratePrivateKey(ctx context.Context, keyType KeyType) (crypto.Signer, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("key_type", keyType.String()).Logger()
+
+	var key crypto.Signer
+	var err error
+	switch keyType {
+	case KeyTypeRSA2048:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA3072:
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeRSA4096:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeECDSAP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeECDSAP521:
+		key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported key type: %s", keyType)
+	}
+	if err != nil {
+		e := &ErrGeneratePrivateKeyFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return key, nil
+}
+
+// ParsePrivateKeyBytes parses a private key in any of the supported formats and returns it as a crypto.Signer.
+//
+// The format is detected automatically. The following formats are supported:
+//
+//  ◽ PKCS#1 RSA keys ("RSA PRIVATE KEY")
+//  ◽ PKCS#8 RSA, ECDSA and Ed25519 keys ("PRIVATE KEY")
+//  ◽ PBES2-encrypted PKCS#8 keys ("ENCRYPTED PRIVATE KEY")
+//  ◽ SEC1 ECDSA keys ("EC PRIVATE KEY")
+//  ◽ OpenSSH RSA, ECDSA and Ed25519 keys ("OPENSSH PRIVATE KEY")
+//
+// The contents may be PEM-encoded or raw DER. Encrypted PKCS#8 keys, encrypted OpenSSH keys and legacy PEM blocks
+// encrypted according to RFC 1423 are decrypted using the password. If no password is required, you can safely pass
+// nil for the password.
+//
+// The returned key is an *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey.
+//
+// The following errors are returned by this function:
+// ErrDecodeFailure, ErrDecryptFailure, ErrParsePrivateKeyFailure, ErrUnsupportedKey
+func ParsePrivateKeyBytes(ctx context.Context, contents []byte, password []byte) (crypto.Signer, error) {
+	key, _, err := parsePrivateKey(ctx, contents, password)
+	return key, err
+}
+
+// ParsePrivateKeyFile reads a private key in any of the supported formats from a file and returns it as a
+// crypto.Signer.
+//
+// See ParsePrivateKeyBytes() for the supported formats.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, any error returned by ParsePrivateKeyBytes
+func ParsePrivateKeyFile(ctx context.Context, file string, password []byte) (crypto.Signer, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return ParsePrivateKeyBytes(logger.WithContext(ctx), contents, password)
+}
+
+// parsePrivateKey parses a private key and returns it along with the format that was detected.
+func parsePrivateKey(ctx context.Context, contents []byte, password []byte) (crypto.Signer, PrivateKeyFormat,
+	error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if len(contents) == 0 {
+		e := &ErrDecodeFailure{Err: errors.New("no content was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, 0, e
+	}
+
+	// raw DER data is detected by trying each format in turn
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		for _, format := range []PrivateKeyFormat{PrivateKeyFormatPKCS8, PrivateKeyFormatPKCS1,
+			PrivateKeyFormatSEC1} {
+			if key, err := parsePrivateKeyDER(format, contents); err == nil {
+				return toSigner(logger, key, format)
+			}
+		}
+		e := &ErrParsePrivateKeyFailure{Err: errors.New("data is not a PEM block or a DER-encoded private key")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, 0, e
+	}
+
+	// determine the format from the block type
+	var format PrivateKeyFormat
+	switch block.Type {
+	case PEMTypeRSAPrivateKey:
+		format = PrivateKeyFormatPKCS1
+	case PEMTypePrivateKey, PEMTypeEncryptedPrivateKey:
+		format = PrivateKeyFormatPKCS8
+	case PEMTypeECPrivateKey:
+		format = PrivateKeyFormatSEC1
+	case PEMTypeOpenSSHPrivateKey:
+		format = PrivateKeyFormatOpenSSH
+	default:
+		e := &ErrParsePrivateKeyFailure{Err: fmt.Errorf("unsupported PEM block type '%s'", block.Type)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, 0, e
+	}
+	logger = logger.With().Str("format", format.String()).Logger()
+
+	// OpenSSH keys carry their own encryption
+	if format == PrivateKeyFormatOpenSSH {
+		var key interface{}
+		var err error
+		if len(password) > 0 {
+			key, err = ssh.ParseRawPrivateKeyWithPassphrase(contents, password)
+		} else {
+			key, err = ssh.ParseRawPrivateKey(contents)
+		}
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			e := &ErrDecryptFailure{Err: errors.New("private key is encrypted but no password was supplied")}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, format, e
+		} else if err != nil {
+			e := &ErrParsePrivateKeyFailure{Format: format, Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, format, e
+		}
+		return toSigner(logger, key, format)
+	}
+
+	// decrypt the block if necessary
+	der := block.Bytes
+	if block.Type == PEMTypeEncryptedPrivateKey {
+		if len(password) == 0 {
+			e := &ErrDecryptFailure{Err: errors.New("private key is encrypted but no password was supplied")}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, format, e
+		}
+		key, err := DecryptPKCS8PrivateKey(logger.WithContext(ctx), block, password)
+		return key, format, err
+	}
+	if IsEncryptedPEMBlock(block) {
+		if len(password) == 0 {
+			e := &ErrDecryptFailure{Err: errors.New("private key is encrypted but no password was supplied")}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, format, e
+		}
+		var err error
+		if der, err = DecryptPEMBlock(ctx, block, password); err != nil {
+			return nil, format, err
+		}
+	}
+
+	key, err := parsePrivateKeyDER(format, der)
+	if err != nil {
+		e := &ErrParsePrivateKeyFailure{Format: format, Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, format, e
+	}
+	return toSigner(logger, key, format)
+}
+
+// parsePrivateKeyDER parses DER-encoded key data in the given format.
+func parsePrivateKeyDER(format PrivateKeyFormat, der []byte) (interface{}, error) {
+	switch format {
+	case PrivateKeyFormatPKCS1:
+		return x509.ParsePKCS1PrivateKey(der)
+	case PrivateKeyFormatPKCS8:
+		return x509.ParsePKCS8PrivateKey(der)
+	case PrivateKeyFormatSEC1:
+		return x509.ParseECPrivateKey(der)
+	}
+	return nil, fmt.Errorf("%s keys cannot be parsed from DER data", format)
+}
+
+// toSigner converts a parsed private key into a crypto.Signer, rejecting unsupported key types.
+func toSigner(logger zerolog.Logger, key interface{}, format PrivateKeyFormat) (crypto.Signer, PrivateKeyFormat,
+	error) {
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, format, nil
+	case *ecdsa.PrivateKey:
+		return k, format, nil
+	case ed25519.PrivateKey:
+		return k, format, nil
+	case *ed25519.PrivateKey:
+		return *k, format, nil
+	}
+	e := &ErrUnsupportedKey{Err: fmt.Errorf("%s private key has unsupported type %T", format, key)}
+	logger.Error().Err(e.Err).Msg(e.Error())
+	return nil, format, e
+}
@@ -0,0 +1,316 @@
+package crypto
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+const (
+	// DefaultReloadInterval is the default interval at which a CertificateReloader checks its files for changes.
+	DefaultReloadInterval = time.Minute
+)
+
+// CertificateReloaderOptions holds the options used to create a CertificateReloader.
+type CertificateReloaderOptions struct {
+	// CertFile is the path to the PEM-formatted certificate file. It must contain the certificate first, optionally
+	// followed by the intermediate certificates needed to build its chain.
+	CertFile string
+
+	// KeyFile is the path to the private key file. The key may be in any format supported by ParsePrivateKeyBytes().
+	KeyFile string
+
+	// Password is used to decrypt the private key if it is encrypted.
+	Password []byte
+
+	// CAFiles holds the paths to PEM-formatted CA certificate files which are loaded into the CertificatePool
+	// returned by CertificatePool(), such as the CAs trusted to issue client certificates.
+	CAFiles []string
+
+	// Interval is how often the files are checked for changes. If not set, DefaultReloadInterval is used.
+	Interval time.Duration
+
+	// Validation holds the options used to validate the certificate before it is used. If Roots is nil, the pool
+	// loaded from CAFiles is used, and if Intermediates is nil, the intermediate certificates from CertFile are
+	// used. If Validation is nil, only the validity period of the certificate and that the key matches it are
+	// checked.
+	Validation *ValidationOptions
+}
+
+// CertificateReloader holds a certificate and private key pair, along with an optional CA certificate pool, which
+// are reloaded from disk when the files change so that they can be rotated without restarting a TLS server or
+// client.
+//
+// New files are fully validated before they replace the current ones. If they are invalid, the error is logged and
+// the current certificate continues to be used.
+type CertificateReloader struct {
+	// options holds the reloader options.
+	options CertificateReloaderOptions
+
+	// current holds the active *reloaderState.
+	current atomic.Value
+
+	// stamps holds the size and modification time of each file when it was last loaded.
+	stamps map[string]fileStamp
+
+	// mutex serializes reloads.
+	mutex sync.Mutex
+
+	// stop is closed to stop watching the files.
+	stop chan struct{}
+
+	// stopOnce ensures stop is only closed once.
+	stopOnce sync.Once
+}
+
+// reloaderState holds a loaded certificate and CA pool.
+type reloaderState struct {
+	certificate *tls.Certificate
+	pool        *CertificatePool
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// NewCertificateReloader creates a new CertificateReloader and loads the files for the first time.
+//
+// Call Start() to begin watching the files for changes.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrLoadCertificateFailure, ErrInvalidCertificate, any error returned by ParsePrivateKeyBytes
+func NewCertificateReloader(ctx context.Context, opts *CertificateReloaderOptions) (*CertificateReloader, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if opts == nil || opts.CertFile == "" || opts.KeyFile == "" {
+		e := &ErrLoadCertificateFailure{Err: errors.New("certificate and key files are required")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	r := &CertificateReloader{
+		options: *opts,
+		stamps:  map[string]fileStamp{},
+		stop:    make(chan struct{}),
+	}
+	if r.options.Interval <= 0 {
+		r.options.Interval = DefaultReloadInterval
+	}
+	if _, err := r.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Start watches the files for changes in a background goroutine until the context is cancelled or Stop() is called.
+//
+// Errors are logged using the logger attached to the context.
+func (r *CertificateReloader) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				_, _ = r.Reload(ctx)
+			}
+		}
+	}()
+}
+
+// Stop stops watching the files for changes.
+func (r *CertificateReloader) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// Reload loads the files if any of them have changed since they were last loaded and returns whether the
+// certificate was replaced.
+//
+// If the new files are invalid, the current certificate is kept and the files are not loaded again until they
+// change.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrLoadCertificateFailure, ErrInvalidCertificate, any error returned by ParsePrivateKeyBytes
+func (r *CertificateReloader) Reload(ctx context.Context) (bool, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("certificate_file", r.options.CertFile).Logger()
+	ctx = logger.WithContext(ctx)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// check whether any file has changed
+	files := append([]string{r.options.CertFile, r.options.KeyFile}, r.options.CAFiles...)
+	stamps := map[string]fileStamp{}
+	changed := false
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			e := &ErrReadFileFailure{Err: err, File: file}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return false, e
+		}
+		stamps[file] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		if stamps[file] != r.stamps[file] {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	r.stamps = stamps
+
+	state, err := r.load(ctx)
+	if err != nil {
+		if r.current.Load() != nil {
+			logger.Warn().Msg("keeping the current certificate because the new one could not be loaded")
+		}
+		return false, err
+	}
+	r.current.Store(state)
+	logger.Info().Str("subject", state.certificate.Leaf.Subject.String()).
+		Time("not_after", state.certificate.Leaf.NotAfter).Msg("loaded certificate")
+	return true, nil
+}
+
+// Certificate returns the current certificate.
+func (r *CertificateReloader) Certificate() *tls.Certificate {
+	return r.current.Load().(*reloaderState).certificate
+}
+
+// CertificatePool returns the current pool of certificates loaded from the CA files. It is nil if no CA files
+// were given.
+func (r *CertificateReloader) CertificatePool() *CertificatePool {
+	return r.current.Load().(*reloaderState).pool
+}
+
+// GetCertificate returns the current certificate. It can be used as tls.Config.GetCertificate in TLS servers.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate returns the current certificate. It can be used as tls.Config.GetClientCertificate in TLS
+// clients.
+func (r *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetConfigForClient returns a function which can be used as tls.Config.GetConfigForClient in TLS servers. It
+// returns a copy of the base configuration using the current certificate and, if CA files were given, the current
+// CA pool to verify client certificates.
+func (r *CertificateReloader) GetConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		state := r.current.Load().(*reloaderState)
+		config := &tls.Config{}
+		if base != nil {
+			config = base.Clone()
+		}
+		config.Certificates = []tls.Certificate{*state.certificate}
+		config.GetCertificate = nil
+		config.GetConfigForClient = nil
+		if state.pool != nil {
+			config.ClientCAs = state.pool.CertPool
+		}
+		return config, nil
+	}
+}
+
+// load reads and validates the files.
+func (r *CertificateReloader) load(ctx context.Context) (*reloaderState, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// load the CA pool
+	state := &reloaderState{}
+	if len(r.options.CAFiles) > 0 {
+		pool, err := NewCertificatePool(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range r.options.CAFiles {
+			if err := pool.AddPEMCertificatesFromFile(ctx, file); err != nil {
+				return nil, err
+			}
+		}
+		state.pool = pool
+	}
+
+	// load the certificate and key
+	contents, err := ioutil.ReadFile(r.options.CertFile)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: r.options.CertFile}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	certs, err := parsePEMCertificates(contents)
+	if err != nil {
+		e := &ErrLoadCertificateFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	key, err := ParsePrivateKeyFile(ctx, r.options.KeyFile, r.options.Password)
+	if err != nil {
+		return nil, err
+	}
+	leaf := certs[0]
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(leaf.PublicKey) {
+		e := &ErrLoadCertificateFailure{Err: errors.New("private key does not match the certificate")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	state.certificate = &tls.Certificate{PrivateKey: key, Leaf: leaf}
+	for _, cert := range certs {
+		state.certificate.Certificate = append(state.certificate.Certificate, cert.Raw)
+	}
+
+	// validate the certificate
+	if r.options.Validation == nil {
+		now := time.Now()
+		if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+			e := &ErrInvalidCertificate{Err: fmt.Errorf("certificate is only valid from %s to %s",
+				leaf.NotBefore.UTC().Format(time.RFC3339), leaf.NotAfter.UTC().Format(time.RFC3339))}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		return state, nil
+	}
+	opts := *r.options.Validation
+	if opts.Roots == nil && state.pool != nil {
+		opts.Roots = state.pool
+	}
+	if opts.Intermediates == nil && len(certs) > 1 {
+		if opts.Intermediates, err = NewCertificatePool(ctx, true); err != nil {
+			return nil, err
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+	}
+	if err := ValidateCertificate(ctx, leaf, &opts); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
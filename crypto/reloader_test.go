@@ -0,0 +1,155 @@
+package crypto_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestCertificateReloader(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "reloader")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ca, _ := crypto.NewRootCertificateAuthority(ctx, nil)
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := crypto.WriteCertificatesFile(ctx, caFile, []*x509.Certificate{ca.Certificate}); err != nil {
+		t.Fatalf("error while writing CA: %s", err.Error())
+	}
+	first := writeReloaderPair(t, ca, certFile, keyFile, "first", time.Now())
+
+	reloader, err := crypto.NewCertificateReloader(ctx, &crypto.CertificateReloaderOptions{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		CAFiles:    []string{caFile},
+		Interval:   10 * time.Millisecond,
+		Validation: &crypto.ValidationOptions{DNSName: "localhost"},
+	})
+	if err != nil {
+		t.Fatalf("error while creating reloader: %s", err.Error())
+	}
+	if !reloader.Certificate().Leaf.Equal(first) || reloader.CertificatePool() == nil {
+		t.Fatalf("error: initial certificate was not loaded")
+	}
+	reloader.Start(ctx)
+	defer reloader.Stop()
+
+	// the new certificate is swapped in
+	second := writeReloaderPair(t, ca, certFile, keyFile, "second", time.Now().Add(time.Second))
+	if !waitForCertificate(reloader, second) {
+		t.Fatalf("error: certificate was not reloaded")
+	}
+
+	// an invalid certificate is rejected and the current one is kept
+	other, _ := crypto.NewRootCertificateAuthority(ctx, nil)
+	writeReloaderPair(t, other, certFile, keyFile, "third", time.Now().Add(2*time.Second))
+	time.Sleep(100 * time.Millisecond)
+	if !reloader.Certificate().Leaf.Equal(second) {
+		t.Errorf("error: invalid certificate was loaded")
+	}
+
+	// the callbacks serve the current certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{GetCertificate: reloader.GetCertificate}
+	server.StartTLS()
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:              reloader.CertificatePool().CertPool,
+		ServerName:           "localhost",
+		GetClientCertificate: reloader.GetClientCertificate,
+	}}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("error while connecting to server: %s", err.Error())
+	}
+	resp.Body.Close()
+	if !resp.TLS.PeerCertificates[0].Equal(second) {
+		t.Errorf("error: server did not use the current certificate")
+	}
+}
+
+func TestCertificateReloaderFailure(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	dir, err := ioutil.TempDir("", "reloader")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// the key does not match the certificate
+	ca, _ := crypto.NewRootCertificateAuthority(ctx, nil)
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeReloaderPair(t, ca, certFile, keyFile, "first", time.Now())
+	other, _ := crypto.GeneratePrivateKey(ctx, crypto.KeyTypeECDSAP256)
+	if err := crypto.WritePrivateKeyFile(ctx, keyFile, other, nil); err != nil {
+		t.Fatalf("error while writing key: %s", err.Error())
+	}
+	_, err = crypto.NewCertificateReloader(ctx, &crypto.CertificateReloaderOptions{CertFile: certFile,
+		KeyFile: keyFile})
+	if _, ok := err.(*crypto.ErrLoadCertificateFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrLoadCertificateFailure", err)
+	}
+
+	if _, err := crypto.NewCertificateReloader(ctx, nil); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func writeReloaderPair(t *testing.T, ca *crypto.CertificateAuthority, certFile, keyFile, cn string,
+	modTime time.Time) *x509.Certificate {
+
+	ctx := context.TODO()
+	cert, key, err := ca.IssueCertificateKeyPair(ctx, 0, &crypto.CertificateOptions{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: []string{"localhost"},
+	})
+	if err != nil {
+		t.Fatalf("error while issuing certificate: %s", err.Error())
+	}
+	if err := crypto.WriteCertificatesFile(ctx, certFile, []*x509.Certificate{cert}); err != nil {
+		t.Fatalf("error while writing certificate: %s", err.Error())
+	}
+	if err := crypto.WritePrivateKeyFile(ctx, keyFile, key, nil); err != nil {
+		t.Fatalf("error while writing key: %s", err.Error())
+	}
+
+	// make sure the change is noticed on file systems with coarse timestamps
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatalf("error while setting file time: %s", err.Error())
+		}
+	}
+	return cert
+}
+
+func waitForCertificate(r *crypto.CertificateReloader, cert *x509.Certificate) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if r.Certificate().Leaf.Equal(cert) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
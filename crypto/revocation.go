@@ -0,0 +1,516 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// DefaultRevocationCacheTTL is the default maximum time that revocation results and CRLs are cached.
+	DefaultRevocationCacheTTL = time.Hour
+
+	// DefaultRevocationHTTPTimeout is the default timeout for fetching CRLs and querying OCSP responders.
+	DefaultRevocationHTTPTimeout = 10 * time.Second
+
+	// maxRevocationResponseSize is the maximum size of a CRL or OCSP response fetched over HTTP.
+	maxRevocationResponseSize = 20 * 1024 * 1024
+)
+
+// RevocationMode determines what happens when the revocation status of a certificate cannot be determined.
+type RevocationMode int
+
+// Possible values for the revocation mode.
+const (
+	_ RevocationMode = iota
+	RevocationSoftFail
+	RevocationHardFail
+)
+
+// String returns the name of the revocation mode.
+func (m RevocationMode) String() string {
+	switch m {
+	case RevocationSoftFail:
+		return "soft-fail"
+	case RevocationHardFail:
+		return "hard-fail"
+	}
+	return fmt.Sprintf("unknown(%d)", int(m))
+}
+
+// RevocationCheckerOptions holds the options used to create a RevocationChecker.
+type RevocationCheckerOptions struct {
+	// Mode determines whether a certificate is accepted when its revocation status cannot be determined. If not set,
+	// RevocationSoftFail is used.
+	Mode RevocationMode
+
+	// CRLFiles holds the paths to PEM-formatted or DER-encoded CRLs which are loaded when the checker is created.
+	CRLFiles []string
+
+	// FetchCRLs enables downloading CRLs from the HTTP distribution points listed in certificates.
+	FetchCRLs bool
+
+	// UseOCSP enables querying the OCSP responders listed in certificates. OCSP is tried before CRLs.
+	UseOCSP bool
+
+	// HTTPClient is the client used to fetch CRLs and query OCSP responders. If nil, a client with a timeout of
+	// DefaultRevocationHTTPTimeout is used.
+	HTTPClient *http.Client
+
+	// CacheTTL is the maximum time that revocation results and fetched CRLs are cached. Entries are never cached
+	// beyond the next update time given by the CRL or OCSP response. If not set, DefaultRevocationCacheTTL is used.
+	CacheTTL time.Duration
+}
+
+// RevocationChecker checks whether certificates have been revoked using CRLs and OCSP.
+//
+// Set ValidationOptions.Revocation to have ValidateCertificate() check the verified chain, or call CheckChain() or
+// VerifyConnection() directly. Results are cached so a RevocationChecker should be created once and shared. It is
+// safe for concurrent use.
+type RevocationChecker struct {
+	// options holds the checker options.
+	options RevocationCheckerOptions
+
+	// mutex protects the CRLs and the cache.
+	mutex sync.Mutex
+
+	// crls holds the CRLs loaded from files or added with AddCRL().
+	crls []*pkix.CertificateList
+
+	// fetched holds the CRLs downloaded from distribution points, keyed by URL.
+	fetched map[string]*cachedCRL
+
+	// results holds the cached revocation results, keyed by issuer and serial number.
+	results map[string]*revocationResult
+}
+
+// cachedCRL holds a downloaded CRL.
+type cachedCRL struct {
+	crl     *pkix.CertificateList
+	expires time.Time
+}
+
+// revocationResult holds the cached revocation status of a certificate.
+type revocationResult struct {
+	revoked    bool
+	revokedAt  time.Time
+	source     string
+	nextUpdate time.Time
+	expires    time.Time
+}
+
+// NewRevocationChecker creates a new RevocationChecker.
+//
+// If opts is nil, the checker uses soft-fail mode and only consults CRLs added with AddCRL(), which is rarely
+// useful, so most callers should enable OCSP or CRL fetching.
+//
+// The following errors are returned by this function:
+// ErrReadFileFailure, ErrCheckRevocationFailure
+func NewRevocationChecker(ctx context.Context, opts *RevocationCheckerOptions) (*RevocationChecker, error) {
+	c := &RevocationChecker{
+		fetched: map[string]*cachedCRL{},
+		results: map[string]*revocationResult{},
+	}
+	if opts != nil {
+		c.options = *opts
+	}
+	if c.options.Mode == 0 {
+		c.options.Mode = RevocationSoftFail
+	}
+	if c.options.CacheTTL == 0 {
+		c.options.CacheTTL = DefaultRevocationCacheTTL
+	}
+	if c.options.HTTPClient == nil {
+		c.options.HTTPClient = &http.Client{Timeout: DefaultRevocationHTTPTimeout}
+	}
+
+	for _, file := range c.options.CRLFiles {
+		logger := log.Logger
+		if l := zerolog.Ctx(ctx); l != nil {
+			logger = *l
+		}
+		logger = logger.With().Str("file", file).Logger()
+
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			e := &ErrReadFileFailure{Err: err, File: file}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		if err := c.AddCRL(logger.WithContext(ctx), contents); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// AddCRL adds a PEM-formatted or DER-encoded CRL to the checker. The CRL's signature is checked when it is used to
+// check a certificate.
+//
+// The following errors are returned by this function:
+// ErrCheckRevocationFailure
+func (c *RevocationChecker) AddCRL(ctx context.Context, contents []byte) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	crl, err := x509.ParseCRL(contents)
+	if err != nil {
+		e := &ErrCheckRevocationFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.crls = append(c.crls, crl)
+	return nil
+}
+
+// Check checks whether the certificate issued by the given issuer has been revoked.
+//
+// The cache is consulted first. Otherwise the certificate's OCSP responders are queried if UseOCSP is set, followed
+// by any loaded CRLs and, if FetchCRLs is set, the certificate's CRL distribution points. If the status cannot be
+// determined, nil is returned in soft-fail mode and ErrCheckRevocationFailure is returned in hard-fail mode.
+//
+// The following errors are returned by this function:
+// ErrCertificateRevoked, ErrCheckRevocationFailure
+func (c *RevocationChecker) Check(ctx context.Context, cert, issuer *x509.Certificate) error {
+	return c.check(ctx, cert, issuer, nil, time.Time{})
+}
+
+// CheckStapledOCSP checks whether the certificate has been revoked using an OCSP response stapled to a TLS
+// handshake.
+//
+// If the stapled response is missing, invalid or does not give a definitive status, the certificate is checked in
+// the same way as Check().
+//
+// The following errors are returned by this function:
+// ErrCertificateRevoked, ErrCheckRevocationFailure
+func (c *RevocationChecker) CheckStapledOCSP(ctx context.Context, cert, issuer *x509.Certificate,
+	response []byte) error {
+
+	return c.check(ctx, cert, issuer, response, time.Time{})
+}
+
+// CheckChain checks every certificate in a verified chain except the root, which cannot be revoked. The chain
+// must start with the leaf certificate and each certificate must be followed by its issuer.
+//
+// CRLs and OCSP responses must be valid at the given time, which defaults to the current time if zero. Use the time
+// at which the chain was verified when it was not verified at the current time.
+//
+// The following errors are returned by this function:
+// ErrCertificateRevoked, ErrCheckRevocationFailure
+func (c *RevocationChecker) CheckChain(ctx context.Context, chain []*x509.Certificate, stapled []byte,
+	at time.Time) error {
+
+	for i := 0; i+1 < len(chain); i++ {
+		var response []byte
+		if i == 0 {
+			response = stapled
+		}
+		if err := c.check(ctx, chain[i], chain[i+1], response, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyConnection returns a function suitable for tls.Config.VerifyConnection which checks the revocation status
+// of the peer's verified certificate chain, using a stapled OCSP response if one was sent.
+//
+// The certificate chain must have already been verified, so it must not be used with InsecureSkipVerify or with
+// a ClientAuth setting that does not verify client certificates.
+func (c *RevocationChecker) VerifyConnection(ctx context.Context) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 {
+			if len(cs.PeerCertificates) == 0 {
+				return nil
+			}
+			return c.undetermined(ctx, cs.PeerCertificates[0], errors.New("peer certificate chain was not verified"))
+		}
+		return c.CheckChain(ctx, cs.VerifiedChains[0], cs.OCSPResponse, time.Time{})
+	}
+}
+
+// check checks the revocation status of the certificate at the given time, or at the current time if it is zero.
+func (c *RevocationChecker) check(ctx context.Context, cert, issuer *x509.Certificate, stapled []byte,
+	at time.Time) error {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if cert == nil || issuer == nil {
+		e := &ErrCheckRevocationFailure{Err: errors.New("certificate and issuer are required")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	logger = logger.With().Str("subject", cert.Subject.String()).Str("serial_number", cert.SerialNumber.Text(16)).
+		Logger()
+	ctx = logger.WithContext(ctx)
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	// cached results are only used while they are fresh and if they are still valid at the given time
+	key := revocationCacheKey(cert, issuer)
+	c.mutex.Lock()
+	result, ok := c.results[key]
+	if ok && time.Now().After(result.expires) {
+		delete(c.results, key)
+		ok = false
+	}
+	if ok && !result.nextUpdate.IsZero() && at.After(result.nextUpdate) {
+		ok = false
+	}
+	c.mutex.Unlock()
+
+	// determine the status from each source in turn
+	var problems []string
+	if !ok && len(stapled) > 0 {
+		result, ok = c.checkOCSPResponse(stapled, cert, issuer, "stapled OCSP", at, &problems)
+	}
+	if !ok && c.options.UseOCSP {
+		for _, server := range cert.OCSPServer {
+			if result, ok = c.queryOCSP(ctx, server, cert, issuer, at, &problems); ok {
+				break
+			}
+		}
+	}
+	if !ok {
+		result, ok = c.checkCRLs(ctx, cert, issuer, at, &problems)
+	}
+	if !ok {
+		if len(problems) == 0 {
+			problems = append(problems, "no revocation information is available")
+		}
+		return c.undetermined(ctx, cert, errors.New(strings.Join(problems, "; ")))
+	}
+
+	c.mutex.Lock()
+	c.results[key] = result
+	c.mutex.Unlock()
+
+	if result.revoked {
+		e := &ErrCertificateRevoked{SerialNumber: cert.SerialNumber, RevocationTime: result.revokedAt,
+			Err: fmt.Errorf("certificate '%s' was revoked at %s according to %s", cert.Subject,
+				result.revokedAt.UTC().Format(time.RFC3339), result.source)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return nil
+}
+
+// undetermined handles a certificate whose revocation status cannot be determined according to the mode.
+func (c *RevocationChecker) undetermined(ctx context.Context, cert *x509.Certificate, err error) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	e := &ErrCheckRevocationFailure{Err: err}
+	if c.options.Mode == RevocationSoftFail {
+		logger.Warn().Err(e.Err).Str("subject", cert.Subject.String()).
+			Msg("revocation status could not be determined; accepting certificate")
+		return nil
+	}
+	logger.Error().Err(e.Err).Msg(e.Error())
+	return e
+}
+
+// queryOCSP sends an OCSP request to the responder and checks the response.
+func (c *RevocationChecker) queryOCSP(ctx context.Context, server string, cert, issuer *x509.Certificate,
+	at time.Time, problems *[]string) (*revocationResult, bool) {
+
+	request, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{})
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("OCSP %s: %s", server, err.Error()))
+		return nil, false
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(request))
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("OCSP %s: %s", server, err.Error()))
+		return nil, false
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	response, err := c.fetch(req)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("OCSP %s: %s", server, err.Error()))
+		return nil, false
+	}
+	return c.checkOCSPResponse(response, cert, issuer, "OCSP "+server, at, problems)
+}
+
+// checkOCSPResponse parses and verifies an OCSP response and returns the result if the status is definitive and
+// the response is valid at the given time.
+func (c *RevocationChecker) checkOCSPResponse(response []byte, cert, issuer *x509.Certificate, source string,
+	at time.Time, problems *[]string) (*revocationResult, bool) {
+
+	resp, err := ocsp.ParseResponseForCert(response, cert, issuer)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s: %s", source, err.Error()))
+		return nil, false
+	}
+	if !resp.NextUpdate.IsZero() && at.After(resp.NextUpdate) {
+		*problems = append(*problems, fmt.Sprintf("%s: response expired at %s", source,
+			resp.NextUpdate.UTC().Format(time.RFC3339)))
+		return nil, false
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return &revocationResult{source: source, nextUpdate: resp.NextUpdate,
+			expires: c.expiry(time.Now(), resp.NextUpdate)}, true
+	case ocsp.Revoked:
+		return &revocationResult{revoked: true, revokedAt: resp.RevokedAt, source: source,
+			nextUpdate: resp.NextUpdate, expires: c.expiry(time.Now(), resp.NextUpdate)}, true
+	}
+	*problems = append(*problems, fmt.Sprintf("%s: status is unknown", source))
+	return nil, false
+}
+
+// checkCRLs checks the certificate against the loaded CRLs and, if enabled, the CRLs at its distribution points.
+// Only CRLs which are valid at the given time are used.
+func (c *RevocationChecker) checkCRLs(ctx context.Context, cert, issuer *x509.Certificate, at time.Time,
+	problems *[]string) (*revocationResult, bool) {
+
+	type source struct {
+		name string
+		crl  *pkix.CertificateList
+	}
+	var sources []source
+	c.mutex.Lock()
+	for _, crl := range c.crls {
+		sources = append(sources, source{"CRL", crl})
+	}
+	c.mutex.Unlock()
+	if c.options.FetchCRLs {
+		for _, dp := range cert.CRLDistributionPoints {
+			if !strings.HasPrefix(dp, "http://") && !strings.HasPrefix(dp, "https://") {
+				continue
+			}
+			crl, err := c.fetchCRL(ctx, dp)
+			if err != nil {
+				*problems = append(*problems, fmt.Sprintf("CRL %s: %s", dp, err.Error()))
+				continue
+			}
+			sources = append(sources, source{"CRL " + dp, crl})
+		}
+	}
+
+	for _, s := range sources {
+		if !crlIssuedBy(s.crl, issuer) {
+			continue
+		}
+		if err := issuer.CheckCRLSignature(s.crl); err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s: %s", s.name, err.Error()))
+			continue
+		}
+		if s.crl.HasExpired(at) {
+			*problems = append(*problems, fmt.Sprintf("%s: CRL expired at %s", s.name,
+				s.crl.TBSCertList.NextUpdate.UTC().Format(time.RFC3339)))
+			continue
+		}
+		nextUpdate := s.crl.TBSCertList.NextUpdate
+		expires := c.expiry(time.Now(), nextUpdate)
+		for _, revoked := range s.crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return &revocationResult{revoked: true, revokedAt: revoked.RevocationTime, source: s.name,
+					nextUpdate: nextUpdate, expires: expires}, true
+			}
+		}
+		return &revocationResult{source: s.name, nextUpdate: nextUpdate, expires: expires}, true
+	}
+	return nil, false
+}
+
+// fetchCRL downloads the CRL from the URL or returns the cached copy.
+func (c *RevocationChecker) fetchCRL(ctx context.Context, url string) (*pkix.CertificateList, error) {
+	c.mutex.Lock()
+	cached, ok := c.fetched[url]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.crl, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := c.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseCRL(contents)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.fetched[url] = &cachedCRL{crl: crl, expires: c.expiry(time.Now(), crl.TBSCertList.NextUpdate)}
+	c.mutex.Unlock()
+	return crl, nil
+}
+
+// fetch sends the request and returns the body of a successful response.
+func (c *RevocationChecker) fetch(req *http.Request) ([]byte, error) {
+	resp, err := c.options.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRevocationResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) > maxRevocationResponseSize {
+		return nil, errors.New("response is too large")
+	}
+	return contents, nil
+}
+
+// expiry returns when a cached entry expires given the next update time of its source.
+func (c *RevocationChecker) expiry(now, nextUpdate time.Time) time.Time {
+	expires := now.Add(c.options.CacheTTL)
+	if !nextUpdate.IsZero() && nextUpdate.Before(expires) {
+		return nextUpdate
+	}
+	return expires
+}
+
+// crlIssuedBy returns whether the CRL names the certificate as its issuer.
+func crlIssuedBy(crl *pkix.CertificateList, issuer *x509.Certificate) bool {
+	raw, err := asn1.Marshal(crl.TBSCertList.Issuer)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(raw, issuer.RawSubject)
+}
+
+// revocationCacheKey returns the cache key for a certificate, which identifies it by its issuer's public key and
+// its serial number.
+func revocationCacheKey(cert, issuer *x509.Certificate) string {
+	sum := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:]) + ":" + cert.SerialNumber.Text(16)
+}
@@ -0,0 +1,262 @@
+package crypto_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestRevocationCheckerCRL(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ca, good, revoked := newRevocationFixtures(t, "", "")
+	crl := newCRL(t, ca, revoked)
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ca.crl")
+	if err := ioutil.WriteFile(file, crl, 0600); err != nil {
+		t.Fatalf("error while writing CRL: %s", err.Error())
+	}
+
+	checker, err := crypto.NewRevocationChecker(ctx, &crypto.RevocationCheckerOptions{
+		Mode:     crypto.RevocationHardFail,
+		CRLFiles: []string{file},
+	})
+	if err != nil {
+		t.Fatalf("error while creating checker: %s", err.Error())
+	}
+	if err := checker.Check(ctx, good, ca.Certificate); err != nil {
+		t.Errorf("error while checking certificate: %s", err.Error())
+	}
+	err = checker.CheckChain(ctx, []*x509.Certificate{revoked, ca.Certificate}, nil, time.Time{})
+	if e, ok := err.(*crypto.ErrCertificateRevoked); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrCertificateRevoked", err)
+	} else if e.SerialNumber.Cmp(revoked.SerialNumber) != 0 {
+		t.Errorf("want: %s, got: %s", revoked.SerialNumber, e.SerialNumber)
+	}
+
+	// revocation is checked as part of validation
+	roots, _ := crypto.NewCertificatePool(ctx, true)
+	roots.AddCert(ca.Certificate)
+	opts := &crypto.ValidationOptions{Roots: roots, Revocation: checker}
+	if err := crypto.ValidateCertificate(ctx, good, opts); err != nil {
+		t.Errorf("error while validating certificate: %s", err.Error())
+	}
+	if err := crypto.ValidateCertificate(ctx, revoked, opts); err == nil {
+		t.Errorf("error: got nil, expected revoked certificate")
+	}
+
+	// the CRL must be valid at the validation time even if a result is cached
+	opts.CurrentTime = time.Now().Add(2 * time.Hour)
+	if _, ok := crypto.ValidateCertificate(ctx, good, opts).(*crypto.ErrInvalidCertificate); !ok {
+		t.Errorf("error: expected invalid certificate for expired CRL")
+	}
+	err = checker.CheckChain(ctx, []*x509.Certificate{good, ca.Certificate}, nil, opts.CurrentTime)
+	if _, ok := err.(*crypto.ErrCheckRevocationFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrCheckRevocationFailure", err)
+	}
+}
+
+func TestRevocationCheckerFetchCRL(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	var crl []byte
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		_, _ = w.Write(crl)
+	}))
+	defer server.Close()
+
+	ca, good, revoked := newRevocationFixtures(t, "", server.URL+"/ca.crl")
+	crl = newCRL(t, ca, revoked)
+	checker, _ := crypto.NewRevocationChecker(ctx, &crypto.RevocationCheckerOptions{
+		Mode:      crypto.RevocationHardFail,
+		FetchCRLs: true,
+	})
+	for i := 0; i < 2; i++ {
+		if err := checker.Check(ctx, good, ca.Certificate); err != nil {
+			t.Errorf("error while checking certificate: %s", err.Error())
+		}
+		if err := checker.Check(ctx, revoked, ca.Certificate); err == nil {
+			t.Errorf("error: got nil, expected revoked certificate")
+		}
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 1 {
+		t.Errorf("want: 1, got: %d", hits)
+	}
+}
+
+func TestRevocationCheckerOCSP(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	var ca *crypto.CertificateAuthority
+	var revokedSerial *big.Int
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(newOCSPResponse(t, ca, req.SerialNumber, req.SerialNumber.Cmp(revokedSerial) == 0))
+	}))
+	defer server.Close()
+
+	var good, revoked *x509.Certificate
+	ca, good, revoked = newRevocationFixtures(t, server.URL, "")
+	revokedSerial = revoked.SerialNumber
+	checker, _ := crypto.NewRevocationChecker(ctx, &crypto.RevocationCheckerOptions{
+		Mode:    crypto.RevocationHardFail,
+		UseOCSP: true,
+	})
+	for i := 0; i < 2; i++ {
+		if err := checker.Check(ctx, good, ca.Certificate); err != nil {
+			t.Errorf("error while checking certificate: %s", err.Error())
+		}
+		if _, ok := checker.Check(ctx, revoked, ca.Certificate).(*crypto.ErrCertificateRevoked); !ok {
+			t.Errorf("error: expected revoked certificate")
+		}
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 2 {
+		t.Errorf("want: 2, got: %d", hits)
+	}
+
+	// revocation is checked as part of validation
+	roots, _ := crypto.NewCertificatePool(ctx, true)
+	roots.AddCert(ca.Certificate)
+	opts := &crypto.ValidationOptions{Roots: roots, Revocation: checker}
+	if err := crypto.ValidateCertificate(ctx, good, opts); err != nil {
+		t.Errorf("error while validating certificate: %s", err.Error())
+	}
+	if _, ok := crypto.ValidateCertificate(ctx, revoked, opts).(*crypto.ErrInvalidCertificate); !ok {
+		t.Errorf("error: expected invalid certificate")
+	}
+}
+
+func TestRevocationCheckerStapledOCSP(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ca, good, revoked := newRevocationFixtures(t, "", "")
+	checker, _ := crypto.NewRevocationChecker(ctx, &crypto.RevocationCheckerOptions{Mode: crypto.RevocationHardFail})
+	if err := checker.CheckStapledOCSP(ctx, good, ca.Certificate,
+		newOCSPResponse(t, ca, good.SerialNumber, false)); err != nil {
+		t.Errorf("error while checking certificate: %s", err.Error())
+	}
+	err := checker.CheckStapledOCSP(ctx, revoked, ca.Certificate, newOCSPResponse(t, ca, revoked.SerialNumber, true))
+	if _, ok := err.(*crypto.ErrCertificateRevoked); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrCertificateRevoked", err)
+	}
+
+	// a response for a different certificate is ignored
+	other, _, _ := ca.IssueCertificateKeyPair(ctx, 0, nil)
+	err = checker.CheckStapledOCSP(ctx, other, ca.Certificate, newOCSPResponse(t, ca, good.SerialNumber, false))
+	if _, ok := err.(*crypto.ErrCheckRevocationFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrCheckRevocationFailure", err)
+	}
+}
+
+func TestRevocationCheckerMode(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	// the responder is unreachable so the status cannot be determined
+	server := httptest.NewServer(http.NotFoundHandler())
+	ca, good, _ := newRevocationFixtures(t, server.URL, server.URL+"/ca.crl")
+	server.Close()
+
+	opts := &crypto.RevocationCheckerOptions{UseOCSP: true, FetchCRLs: true}
+	soft, _ := crypto.NewRevocationChecker(ctx, opts)
+	if err := soft.Check(ctx, good, ca.Certificate); err != nil {
+		t.Errorf("error: got %s, expected nil in soft-fail mode", err.Error())
+	}
+	opts.Mode = crypto.RevocationHardFail
+	hard, _ := crypto.NewRevocationChecker(ctx, opts)
+	err := hard.Check(ctx, good, ca.Certificate)
+	if _, ok := err.(*crypto.ErrCheckRevocationFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrCheckRevocationFailure", err)
+	}
+}
+
+func newRevocationFixtures(t *testing.T, ocspServer, crlURL string) (*crypto.CertificateAuthority,
+	*x509.Certificate, *x509.Certificate) {
+
+	ctx := context.TODO()
+	ca, err := crypto.NewRootCertificateAuthority(ctx, nil)
+	if err != nil {
+		t.Fatalf("error while creating CA: %s", err.Error())
+	}
+	if ocspServer != "" {
+		ca.OCSPServers = []string{ocspServer}
+	}
+	if crlURL != "" {
+		ca.CRLDistributionPoints = []string{crlURL}
+	}
+	good, _, err := ca.IssueCertificateKeyPair(ctx, 0, nil)
+	if err != nil {
+		t.Fatalf("error while issuing certificate: %s", err.Error())
+	}
+	revoked, _, err := ca.IssueCertificateKeyPair(ctx, 0, nil)
+	if err != nil {
+		t.Fatalf("error while issuing certificate: %s", err.Error())
+	}
+	return ca, good, revoked
+}
+
+func newCRL(t *testing.T, ca *crypto.CertificateAuthority, revoked *x509.Certificate) []byte {
+	now := time.Now()
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now.Add(-time.Minute),
+		NextUpdate: now.Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{
+			{SerialNumber: revoked.SerialNumber, RevocationTime: now.Add(-time.Minute)},
+		},
+	}, ca.Certificate, ca.Signer())
+	if err != nil {
+		t.Fatalf("error while creating CRL: %s", err.Error())
+	}
+	return crl
+}
+
+func newOCSPResponse(t *testing.T, ca *crypto.CertificateAuthority, serial *big.Int, revoked bool) []byte {
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: serial,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   now.Add(time.Hour),
+	}
+	if revoked {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = now.Add(-time.Minute)
+	}
+	response, err := ocsp.CreateResponse(ca.Certificate, ca.Certificate, template, ca.Signer())
+	if err != nil {
+		t.Errorf("error while creating OCSP response: %s", err.Error())
+	}
+	return response
+}
@@ -7,7 +7,9 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"fmt"
 
 	"go.sophtrust.dev/pkg/zerolog/v2"
 	"go.sophtrust.dev/pkg/zerolog/v2/log"
@@ -15,6 +17,8 @@ import (
 
 // ParsePublicKeyFromCertificate parses the RSA public key portion from an X509 certificate.
 //
+// Use NewVerifierFromCertificate() to verify signatures with certificates containing ECDSA or Ed25519 keys.
+//
 // The following errors are returned by this function:
 // ErrExtractPublicKeyFailure
 func ParsePublicKeyFromCertificate(ctx context.Context, cert *x509.Certificate) (*rsa.PublicKey, error) {
@@ -43,7 +47,7 @@ func ParsePublicKeyFromCertificate(ctx context.Context, cert *x509.Certificate)
 // Sign takes the content and generates a signature using a private key certificate.
 //
 // Use the DecodePEMData() function to convert a PEM-formatted certificate into a PEM block. If the
-// private key is encrypted, use the DecryptPEMBlock() function to decrypt it first.
+// private key is encrypted, use the ParsePrivateKeyBytes() function to decrypt and parse it first.
 //
 // Use the Verify() function to verify the signature produced for the content.
 //
@@ -126,3 +130,137 @@ func Verify(ctx context.Context, contents, signature []byte, publicKey *rsa.Publ
 	}
 	return nil
 }
+
+// EncryptRSA encrypts the plaintext with the given public key using RSA-OAEP with SHA-256.
+//
+// The plaintext can be at most k - 66 bytes long, where k is the size of the key in bytes (190 bytes for a 2048-bit
+// key). Use EncryptRSAHybrid() to encrypt larger payloads.
+//
+// Use the DecryptRSA() function to decrypt the ciphertext.
+//
+// The following errors are returned by this function:
+// ErrEncryptFailure
+func EncryptRSA(ctx context.Context, plaintext []byte, publicKey *rsa.PublicKey) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// validate parameters
+	if publicKey == nil {
+		e := &ErrEncryptFailure{Err: errors.New("no public key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if max := publicKey.Size() - 2*sha256.Size - 2; len(plaintext) > max {
+		e := &ErrEncryptFailure{Err: fmt.Errorf("plaintext is %d bytes but the key can encrypt at most %d bytes",
+			len(plaintext), max)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, plaintext, nil)
+	if err != nil {
+		e := &ErrEncryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return ciphertext, nil
+}
+
+// DecryptRSA decrypts ciphertext produced by EncryptRSA() with the given private key.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure
+func DecryptRSA(ctx context.Context, ciphertext []byte, privateKey *rsa.PrivateKey) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// validate parameters
+	if privateKey == nil {
+		e := &ErrDecryptFailure{Err: errors.New("no private key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	plaintext, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, ciphertext, nil)
+	if err != nil {
+		e := &ErrDecryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return plaintext, nil
+}
+
+// EncryptRSAHybrid encrypts a payload of any size for the holder of the given public key.
+//
+// The payload is encrypted with EncryptWithKEK() using an RSAKeyEncryptionKey with an empty ID, so the data is
+// encrypted using AES-256-GCM with a random key, and that key is encrypted with the public key using RSA-OAEP with
+// SHA-256. The result is the JSON encoding of the DataKeyEnvelope, which can also be decrypted by DecryptWithKEK().
+//
+// Use the DecryptRSAHybrid() function to decrypt the payload.
+//
+// The following errors are returned by this function:
+// ErrEncryptFailure, ErrUnsupportedKey, ErrGenerateRandomKeyFailure, ErrWrapKeyFailure, ErrGenerateCipherFailure,
+// ErrGenerateGCMFailure, ErrGenerateNonceFailure
+func EncryptRSAHybrid(ctx context.Context, plaintext []byte, publicKey *rsa.PublicKey) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// validate parameters
+	if publicKey == nil {
+		e := &ErrEncryptFailure{Err: errors.New("no public key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	kek, err := NewRSAKeyEncryptionKey(ctx, "", publicKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	env, err := EncryptWithKEK(ctx, plaintext, kek)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := json.Marshal(env)
+	if err != nil {
+		e := &ErrEncryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return ciphertext, nil
+}
+
+// DecryptRSAHybrid decrypts a payload produced by EncryptRSAHybrid() with the given private key.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure, ErrUnsupportedKey, ErrUnwrapKeyFailure, ErrGenerateCipherFailure, ErrGenerateGCMFailure
+func DecryptRSAHybrid(ctx context.Context, ciphertext []byte, privateKey *rsa.PrivateKey) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// validate parameters
+	if privateKey == nil {
+		e := &ErrDecryptFailure{Err: errors.New("no private key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	var env DataKeyEnvelope
+	if err := json.Unmarshal(ciphertext, &env); err != nil {
+		e := &ErrDecryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	kek, err := NewRSAKeyEncryptionKey(ctx, "", nil, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptWithKEK(ctx, &env, kek)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"math/big"
 	"testing"
@@ -321,3 +322,86 @@ func TestVerifyFailure(t *testing.T) {
 		t.Logf("success - error was %s", err.Error())
 	}
 }
+
+func TestEncryptDecryptRSA(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	block, _ := pem.Decode([]byte(SigningKey))
+	if block == nil {
+		t.Fatal("error: No PEM data was decoded.")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("error: failed to parse private key: %s", err.Error())
+	}
+	block, _ = pem.Decode([]byte(SigningCertificate))
+	if block == nil {
+		t.Fatal("error: No PEM data was decoded.")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("error: failed to parse certificate: %s", err.Error())
+	}
+	publicKey, err := crypto.ParsePublicKeyFromCertificate(ctx, cert)
+	if err != nil {
+		t.Fatalf("error: failed to extract public key: %s", err.Error())
+	}
+
+	// direct RSA-OAEP encryption
+	ciphertext, err := crypto.EncryptRSA(ctx, []byte(TestContents), publicKey)
+	if err != nil {
+		t.Fatalf("error: failed to encrypt contents: %s", err.Error())
+	}
+	plaintext, err := crypto.DecryptRSA(ctx, ciphertext, key)
+	if err != nil {
+		t.Fatalf("error: failed to decrypt contents: %s", err.Error())
+	}
+	if string(plaintext) != TestContents {
+		t.Errorf("want: %s, got: %s", TestContents, string(plaintext))
+	}
+	if _, err := crypto.EncryptRSA(ctx, make([]byte, 191), publicKey); err == nil {
+		t.Errorf("error: got nil, expected error for oversized plaintext")
+	}
+
+	// hybrid encryption of a payload larger than the key
+	payload := make([]byte, 100000)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("error: failed to generate payload: %s", err.Error())
+	}
+	ciphertext, err = crypto.EncryptRSAHybrid(ctx, payload, publicKey)
+	if err != nil {
+		t.Fatalf("error: failed to encrypt payload: %s", err.Error())
+	}
+	plaintext, err = crypto.DecryptRSAHybrid(ctx, ciphertext, key)
+	if err != nil {
+		t.Fatalf("error: failed to decrypt payload: %s", err.Error())
+	}
+	if string(plaintext) != string(payload) {
+		t.Errorf("error: decrypted payload does not match")
+	}
+
+	// the payload is a data key envelope
+	var env crypto.DataKeyEnvelope
+	if err := json.Unmarshal(ciphertext, &env); err != nil {
+		t.Fatalf("error: failed to parse envelope: %s", err.Error())
+	}
+	if env.Algorithm != crypto.KEKAlgorithmRSAOAEP256 || env.Cipher != crypto.DataKeyCipherA256GCM {
+		t.Errorf("want: %s/%s, got: %s/%s", crypto.KEKAlgorithmRSAOAEP256, crypto.DataKeyCipherA256GCM,
+			env.Algorithm, env.Cipher)
+	}
+	kek, _ := crypto.NewRSAKeyEncryptionKey(ctx, "", nil, key)
+	if plaintext, err := crypto.DecryptWithKEK(ctx, &env, kek); err != nil || string(plaintext) != string(payload) {
+		t.Errorf("error: envelope could not be decrypted with DecryptWithKEK(): %v", err)
+	}
+
+	// tampering with the ciphertext must be detected
+	env.Ciphertext[len(env.Ciphertext)-1] ^= 0xFF
+	ciphertext, _ = json.Marshal(&env)
+	if _, err := crypto.DecryptRSAHybrid(ctx, ciphertext, key); err == nil {
+		t.Errorf("error: got nil, expected error for tampered ciphertext")
+	}
+	if _, err := crypto.DecryptRSAHybrid(ctx, ciphertext[:10], key); err == nil {
+		t.Errorf("error: got nil, expected error for truncated ciphertext")
+	}
+}
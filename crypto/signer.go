@@ -0,0 +1,419 @@
+package crypto
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+// SignatureAlgorithm identifies the signature scheme used by a Signer or Verifier.
+type SignatureAlgorithm int
+
+// Possible values for the signature scheme.
+const (
+	_ SignatureAlgorithm = iota
+	SignatureRSAPSS
+	SignatureRSAPKCS1v15
+	SignatureECDSA
+	SignatureEd25519
+)
+
+// String returns the name of the signature scheme.
+func (a SignatureAlgorithm) String() string {
+	switch a {
+	case SignatureRSAPSS:
+		return "rsa-pss"
+	case SignatureRSAPKCS1v15:
+		return "rsa-pkcs1v15"
+	case SignatureECDSA:
+		return "ecdsa"
+	case SignatureEd25519:
+		return "ed25519"
+	}
+	return fmt.Sprintf("unknown(%d)", int(a))
+}
+
+// SignatureOptions holds the signature scheme and hash used by a Signer or Verifier.
+//
+// If Algorithm is not set, RSA keys use RSA-PSS, ECDSA keys use ECDSA and Ed25519 keys use Ed25519. If Hash is not
+// set, SHA-256 is used for RSA keys and the hash matching the curve size is used for ECDSA keys (SHA-256 for P-256,
+// SHA-384 for P-384 and SHA-512 for P-521). Ed25519 signs the contents directly and ignores Hash.
+type SignatureOptions struct {
+	// Algorithm is the signature scheme to use. It must be compatible with the key.
+	Algorithm SignatureAlgorithm
+
+	// Hash is the hash function to use. It must be crypto.SHA256, crypto.SHA384 or crypto.SHA512.
+	Hash crypto.Hash
+}
+
+// Signer creates signatures using a private key.
+type Signer interface {
+	// Algorithm returns the signature scheme used by the signer.
+	Algorithm() SignatureAlgorithm
+
+	// Hash returns the hash function applied to the contents before signing, or 0 for Ed25519.
+	Hash() crypto.Hash
+
+	// Public returns the public key corresponding to the private key.
+	Public() crypto.PublicKey
+
+	// Sign hashes the contents and returns the signature.
+	Sign(ctx context.Context, contents []byte) ([]byte, error)
+
+	// SignDigest returns the signature for a digest that was already computed using Hash(). It is not supported by
+	// Ed25519.
+	SignDigest(ctx context.Context, digest []byte) ([]byte, error)
+}
+
+// Verifier checks signatures using a public key.
+type Verifier interface {
+	// Algorithm returns the signature scheme used by the verifier.
+	Algorithm() SignatureAlgorithm
+
+	// Hash returns the hash function applied to the contents before verifying, or 0 for Ed25519.
+	Hash() crypto.Hash
+
+	// Public returns the public key used to verify signatures.
+	Public() crypto.PublicKey
+
+	// Verify hashes the contents and checks the signature.
+	Verify(ctx context.Context, contents, signature []byte) error
+
+	// VerifyDigest checks the signature for a digest that was already computed using Hash(). It is not supported by
+	// Ed25519.
+	VerifyDigest(ctx context.Context, digest, signature []byte) error
+}
+
+// keySigner implements the Signer interface for RSA, ECDSA and Ed25519 keys.
+type keySigner struct {
+	algorithm SignatureAlgorithm
+	hash      crypto.Hash
+	key       crypto.Signer
+}
+
+// keyVerifier implements the Verifier interface for RSA, ECDSA and Ed25519 keys.
+type keyVerifier struct {
+	algorithm SignatureAlgorithm
+	hash      crypto.Hash
+	key       crypto.PublicKey
+}
+
+// NewSigner creates a new Signer for the given private key.
+//
+// The key must be an RSA, ECDSA or Ed25519 key. Any crypto.Signer whose public key is one of those types, such as a
+// key stored in a hardware module, can be used. If opts is nil, the default scheme and hash for the key are used.
+//
+// The following errors are returned by this function:
+// ErrUnsupportedKey
+func NewSigner(ctx context.Context, key crypto.Signer, opts *SignatureOptions) (Signer, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if key == nil {
+		e := &ErrUnsupportedKey{Err: errors.New("no private key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	alg, hash, err := resolveSignatureOptions(key.Public(), opts)
+	if err != nil {
+		e := &ErrUnsupportedKey{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return &keySigner{algorithm: alg, hash: hash, key: key}, nil
+}
+
+// NewVerifier creates a new Verifier for the given public key.
+//
+// The key must be an *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey. If opts is nil, the default scheme and
+// hash for the key are used.
+//
+// The following errors are returned by this function:
+// ErrUnsupportedKey
+func NewVerifier(ctx context.Context, key crypto.PublicKey, opts *SignatureOptions) (Verifier, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if key == nil {
+		e := &ErrUnsupportedKey{Err: errors.New("no public key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	alg, hash, err := resolveSignatureOptions(key, opts)
+	if err != nil {
+		e := &ErrUnsupportedKey{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return &keyVerifier{algorithm: alg, hash: hash, key: key}, nil
+}
+
+// NewVerifierFromCertificate creates a new Verifier for the public key in the given certificate.
+//
+// Unlike ParsePublicKeyFromCertificate(), this function accepts certificates with RSA, ECDSA or Ed25519 keys.
+//
+// The following errors are returned by this function:
+// ErrExtractPublicKeyFailure, ErrUnsupportedKey
+func NewVerifierFromCertificate(ctx context.Context, cert *x509.Certificate, opts *SignatureOptions) (Verifier,
+	error) {
+
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	if cert == nil {
+		e := &ErrExtractPublicKeyFailure{Err: errors.New("no certificate was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return NewVerifier(ctx, cert.PublicKey, opts)
+}
+
+// resolveSignatureOptions determines the signature scheme and hash to use for the given public key and checks
+// that they are compatible with the key.
+func resolveSignatureOptions(key crypto.PublicKey, opts *SignatureOptions) (SignatureAlgorithm, crypto.Hash, error) {
+	o := SignatureOptions{}
+	if opts != nil {
+		o = *opts
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if o.Algorithm == 0 {
+			o.Algorithm = SignatureRSAPSS
+		}
+		if o.Algorithm != SignatureRSAPSS && o.Algorithm != SignatureRSAPKCS1v15 {
+			return 0, 0, fmt.Errorf("%s cannot be used with an RSA key", o.Algorithm)
+		}
+		if o.Hash == 0 {
+			o.Hash = crypto.SHA256
+		}
+	case *ecdsa.PublicKey:
+		if o.Algorithm == 0 {
+			o.Algorithm = SignatureECDSA
+		}
+		if o.Algorithm != SignatureECDSA {
+			return 0, 0, fmt.Errorf("%s cannot be used with an ECDSA key", o.Algorithm)
+		}
+		if o.Hash == 0 {
+			switch k.Curve {
+			case elliptic.P256():
+				o.Hash = crypto.SHA256
+			case elliptic.P384():
+				o.Hash = crypto.SHA384
+			case elliptic.P521():
+				o.Hash = crypto.SHA512
+			default:
+				return 0, 0, errors.New("ECDSA key must use the P-256, P-384 or P-521 curve")
+			}
+		}
+	case ed25519.PublicKey:
+		if o.Algorithm == 0 {
+			o.Algorithm = SignatureEd25519
+		}
+		if o.Algorithm != SignatureEd25519 {
+			return 0, 0, fmt.Errorf("%s cannot be used with an Ed25519 key", o.Algorithm)
+		}
+		return o.Algorithm, 0, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported key type: %T", key)
+	}
+
+	switch o.Hash {
+	case crypto.SHA256, crypto.SHA384, crypto.SHA512:
+	default:
+		return 0, 0, fmt.Errorf("unsupported hash: %s", o.Hash)
+	}
+	return o.Algorithm, o.Hash, nil
+}
+
+// Algorithm returns the signature scheme used by the signer.
+func (s *keySigner) Algorithm() SignatureAlgorithm {
+	return s.algorithm
+}
+
+// Hash returns the hash function applied to the contents before signing, or 0 for Ed25519.
+func (s *keySigner) Hash() crypto.Hash {
+	return s.hash
+}
+
+// Public returns the public key corresponding to the private key.
+func (s *keySigner) Public() crypto.PublicKey {
+	return s.key.Public()
+}
+
+// Sign hashes the contents and returns the signature.
+//
+// The following errors are returned by this function:
+// ErrSignDataFailure
+func (s *keySigner) Sign(ctx context.Context, contents []byte) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("algorithm", s.algorithm.String()).Logger()
+
+	if contents == nil {
+		e := &ErrSignDataFailure{Err: errors.New("no content was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	// Ed25519 signs the contents directly
+	if s.algorithm == SignatureEd25519 {
+		signature, err := s.key.Sign(rand.Reader, contents, crypto.Hash(0))
+		if err != nil {
+			e := &ErrSignDataFailure{Err: err}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return nil, e
+		}
+		return signature, nil
+	}
+
+	h := s.hash.New()
+	h.Write(contents) // never returns an error
+	return s.SignDigest(ctx, h.Sum(nil))
+}
+
+// SignDigest returns the signature for a digest that was already computed using Hash().
+//
+// The following errors are returned by this function:
+// ErrSignDataFailure
+func (s *keySigner) SignDigest(ctx context.Context, digest []byte) ([]byte, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("algorithm", s.algorithm.String()).Logger()
+
+	if s.algorithm == SignatureEd25519 {
+		e := &ErrSignDataFailure{Err: errors.New("Ed25519 cannot sign a pre-computed digest")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if len(digest) != s.hash.Size() {
+		e := &ErrSignDataFailure{Err: fmt.Errorf("digest must be %d bytes long", s.hash.Size())}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	var signerOpts crypto.SignerOpts = s.hash
+	if s.algorithm == SignatureRSAPSS {
+		signerOpts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: s.hash}
+	}
+	signature, err := s.key.Sign(rand.Reader, digest, signerOpts)
+	if err != nil {
+		e := &ErrSignDataFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	return signature, nil
+}
+
+// Algorithm returns the signature scheme used by the verifier.
+func (v *keyVerifier) Algorithm() SignatureAlgorithm {
+	return v.algorithm
+}
+
+// Hash returns the hash function applied to the contents before verifying, or 0 for Ed25519.
+func (v *keyVerifier) Hash() crypto.Hash {
+	return v.hash
+}
+
+// Public returns the public key used to verify signatures.
+func (v *keyVerifier) Public() crypto.PublicKey {
+	return v.key
+}
+
+// Verify hashes the contents and checks the signature.
+//
+// The following errors are returned by this function:
+// ErrInvalidSignature
+func (v *keyVerifier) Verify(ctx context.Context, contents, signature []byte) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("algorithm", v.algorithm.String()).Logger()
+
+	if contents == nil {
+		e := &ErrInvalidSignature{Err: errors.New("no content was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+
+	// Ed25519 verifies the contents directly
+	if v.algorithm == SignatureEd25519 {
+		if signature == nil {
+			e := &ErrInvalidSignature{Err: errors.New("no signature was provided")}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return e
+		}
+		if !ed25519.Verify(v.key.(ed25519.PublicKey), contents, signature) {
+			e := &ErrInvalidSignature{Err: errors.New("Ed25519 verification failed")}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return e
+		}
+		return nil
+	}
+
+	h := v.hash.New()
+	h.Write(contents) // never returns an error
+	return v.VerifyDigest(ctx, h.Sum(nil), signature)
+}
+
+// VerifyDigest checks the signature for a digest that was already computed using Hash().
+//
+// RSA-PSS signatures are accepted with any salt length so that signatures made by Sign() can also be verified.
+//
+// The following errors are returned by this function:
+// ErrInvalidSignature
+func (v *keyVerifier) VerifyDigest(ctx context.Context, digest, signature []byte) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("algorithm", v.algorithm.String()).Logger()
+
+	if signature == nil {
+		e := &ErrInvalidSignature{Err: errors.New("no signature was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+
+	var err error
+	switch v.algorithm {
+	case SignatureRSAPSS:
+		err = rsa.VerifyPSS(v.key.(*rsa.PublicKey), v.hash, digest, signature,
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+	case SignatureRSAPKCS1v15:
+		err = rsa.VerifyPKCS1v15(v.key.(*rsa.PublicKey), v.hash, digest, signature)
+	case SignatureECDSA:
+		if !ecdsa.VerifyASN1(v.key.(*ecdsa.PublicKey), digest, signature) {
+			err = errors.New("ECDSA verification failed")
+		}
+	default:
+		err = fmt.Errorf("%s cannot verify a pre-computed digest", v.algorithm)
+	}
+	if err != nil {
+		e := &ErrInvalidSignature{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return nil
+}
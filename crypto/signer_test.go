@@ -0,0 +1,166 @@
+package crypto_test
+
+import (
+	"context"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestSignerVerifier(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	block, _ := pem.Decode([]byte(SigningKey))
+	rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("error: failed to parse private key: %s", err.Error())
+	}
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name string
+		key  gocrypto.Signer
+		opts *crypto.SignatureOptions
+		alg  crypto.SignatureAlgorithm
+		hash gocrypto.Hash
+	}{
+		{"rsa-pss-default", rsaKey, nil, crypto.SignatureRSAPSS, gocrypto.SHA256},
+		{"rsa-pss-sha512", rsaKey, &crypto.SignatureOptions{Hash: gocrypto.SHA512}, crypto.SignatureRSAPSS,
+			gocrypto.SHA512},
+		{"rsa-pkcs1v15-sha384", rsaKey, &crypto.SignatureOptions{Algorithm: crypto.SignatureRSAPKCS1v15,
+			Hash: gocrypto.SHA384}, crypto.SignatureRSAPKCS1v15, gocrypto.SHA384},
+		{"ecdsa-p256", p256Key, nil, crypto.SignatureECDSA, gocrypto.SHA256},
+		{"ecdsa-p384", p384Key, nil, crypto.SignatureECDSA, gocrypto.SHA384},
+		{"ed25519", edKey, nil, crypto.SignatureEd25519, 0},
+	}
+	for _, test := range tests {
+		signer, err := crypto.NewSigner(ctx, test.key, test.opts)
+		if err != nil {
+			t.Fatalf("%s: error while creating signer: %s", test.name, err.Error())
+		}
+		if signer.Algorithm() != test.alg || signer.Hash() != test.hash {
+			t.Errorf("%s: got %s/%s, expected %s/%s", test.name, signer.Algorithm(), signer.Hash(), test.alg,
+				test.hash)
+		}
+		signature, err := signer.Sign(ctx, []byte(TestContents))
+		if err != nil {
+			t.Fatalf("%s: error while signing: %s", test.name, err.Error())
+		}
+
+		verifier, err := crypto.NewVerifier(ctx, signer.Public(), test.opts)
+		if err != nil {
+			t.Fatalf("%s: error while creating verifier: %s", test.name, err.Error())
+		}
+		if err := verifier.Verify(ctx, []byte(TestContents), signature); err != nil {
+			t.Errorf("%s: error while verifying signature: %s", test.name, err.Error())
+		}
+		if err := verifier.Verify(ctx, []byte(TestContents+"!"), signature); err == nil {
+			t.Errorf("%s: error: got nil, expected error for altered contents", test.name)
+		} else if _, ok := err.(*crypto.ErrInvalidSignature); !ok {
+			t.Errorf("%s: error: got %T, expected *crypto.ErrInvalidSignature", test.name, err)
+		}
+	}
+}
+
+func TestSignerCompatibleWithVerify(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	block, _ := pem.Decode([]byte(SigningKey))
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("error: failed to parse private key: %s", err.Error())
+	}
+	block, _ = pem.Decode([]byte(SigningCertificate))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("error: failed to parse certificate: %s", err.Error())
+	}
+
+	// signatures made by Sign() verify with a certificate-based verifier and vice versa
+	signature, err := crypto.Sign(ctx, []byte(TestContents), key)
+	if err != nil {
+		t.Fatalf("error: failed to generate signature: %s", err.Error())
+	}
+	verifier, err := crypto.NewVerifierFromCertificate(ctx, cert, nil)
+	if err != nil {
+		t.Fatalf("error while creating verifier: %s", err.Error())
+	}
+	if err := verifier.Verify(ctx, []byte(TestContents), signature); err != nil {
+		t.Errorf("error while verifying signature: %s", err.Error())
+	}
+
+	signer, err := crypto.NewSigner(ctx, key, nil)
+	if err != nil {
+		t.Fatalf("error while creating signer: %s", err.Error())
+	}
+	signature, err = signer.Sign(ctx, []byte(TestContents))
+	if err != nil {
+		t.Fatalf("error while signing: %s", err.Error())
+	}
+	publicKey, _ := crypto.ParsePublicKeyFromCertificate(ctx, cert)
+	if err := crypto.Verify(ctx, []byte(TestContents), signature, publicKey); err != nil {
+		t.Errorf("error while verifying signature: %s", err.Error())
+	}
+}
+
+func TestNewVerifierFromECDSACertificate(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ECDSA Test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error while creating certificate: %s", err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	signer, _ := crypto.NewSigner(ctx, key, nil)
+	signature, err := signer.Sign(ctx, []byte(TestContents))
+	if err != nil {
+		t.Fatalf("error while signing: %s", err.Error())
+	}
+	verifier, err := crypto.NewVerifierFromCertificate(ctx, cert, nil)
+	if err != nil {
+		t.Fatalf("error while creating verifier: %s", err.Error())
+	}
+	if err := verifier.Verify(ctx, []byte(TestContents), signature); err != nil {
+		t.Errorf("error while verifying signature: %s", err.Error())
+	}
+}
+
+func TestNewSignerFailure(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := crypto.NewSigner(ctx, ecKey, &crypto.SignatureOptions{Algorithm: crypto.SignatureRSAPSS}); err == nil {
+		t.Errorf("error: got nil, expected error for mismatched algorithm")
+	}
+	if _, err := crypto.NewSigner(ctx, ecKey, &crypto.SignatureOptions{Hash: gocrypto.MD5}); err == nil {
+		t.Errorf("error: got nil, expected error for unsupported hash")
+	}
+	if _, err := crypto.NewVerifier(ctx, "not a key", nil); err == nil {
+		t.Errorf("error: got nil, expected error for unsupported key")
+	}
+}
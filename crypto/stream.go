@@ -0,0 +1,420 @@
+package crypto
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"go.sophtrust.dev/pkg/zerolog/v2"
+	"go.sophtrust.dev/pkg/zerolog/v2/log"
+)
+
+const (
+	// DefaultStreamChunkSize is the default number of plaintext bytes encrypted into each chunk of a stream.
+	DefaultStreamChunkSize = 64 * 1024
+
+	// MaxStreamChunkSize is the largest chunk size that may be used when encrypting or decrypting a stream.
+	MaxStreamChunkSize = 16 * 1024 * 1024
+
+	// streamVersion1 identifies the first version of the stream format.
+	streamVersion1 = 0x01
+
+	// streamNoncePrefixSize is the number of random bytes at the start of each chunk's nonce.
+	streamNoncePrefixSize = 7
+
+	// streamHeaderSize is the size of the stream header: version, chunk size and nonce prefix.
+	streamHeaderSize = 1 + 4 + streamNoncePrefixSize
+)
+
+// EncryptWriter encrypts everything written to it in authenticated chunks using AES-256-GCM.
+//
+// The stream begins with a header holding the format version, the chunk size and a random nonce prefix. Each chunk
+// is then sealed with a nonce built from the prefix, a 32-bit chunk counter and a flag marking the final chunk, so
+// that chunks which are reordered, dropped or truncated fail to decrypt. The header is authenticated along with
+// every chunk.
+//
+// Close must be called once all of the data has been written in order to write the final chunk.
+type EncryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	size    int
+	closed  bool
+	err     error
+	logger  zerolog.Logger
+}
+
+// NewEncryptWriter returns a new EncryptWriter which writes the encrypted stream to the given writer.
+//
+// The key is hashed in the same manner as EncryptString(). Unlike EncryptString(), a key must be provided since
+// there is nowhere to safely store a random key. If chunkSize is 0, DefaultStreamChunkSize is used.
+//
+// The header is written to w immediately.
+//
+// The following errors are returned by this function:
+// ErrEncryptFailure, ErrGenerateCipherFailure, ErrGenerateGCMFailure, ErrGenerateNonceFailure
+func NewEncryptWriter(ctx context.Context, w io.Writer, key string, chunkSize int) (*EncryptWriter, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// validate parameters
+	if w == nil {
+		e := &ErrEncryptFailure{Err: errors.New("no writer was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if key == "" {
+		e := &ErrEncryptFailure{Err: errors.New("no key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if chunkSize == 0 {
+		chunkSize = DefaultStreamChunkSize
+	}
+	if chunkSize < 0 || chunkSize > MaxStreamChunkSize {
+		e := &ErrEncryptFailure{Err: fmt.Errorf("chunk size must be between 1 and %d", MaxStreamChunkSize)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	// hash the key and create a new GCM from it
+	aesGCM, err := newGCM([]byte(key))
+	if err != nil {
+		logger.Error().Err(err).Msg(err.Error())
+		return nil, err
+	}
+
+	// build the header
+	header := make([]byte, streamHeaderSize)
+	header[0] = streamVersion1
+	binary.BigEndian.PutUint32(header[1:5], uint32(chunkSize))
+	if _, err := io.ReadFull(rand.Reader, header[5:]); err != nil {
+		e := &ErrGenerateNonceFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if _, err := w.Write(header); err != nil {
+		e := &ErrEncryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	return &EncryptWriter{
+		w:      w,
+		aead:   aesGCM,
+		header: header,
+		prefix: header[5:],
+		buf:    make([]byte, 0, chunkSize+1),
+		size:   chunkSize,
+		logger: logger,
+	}, nil
+}
+
+// Write encrypts the given data and writes any completed chunks to the underlying writer.
+//
+// The following errors are returned by this function:
+// ErrEncryptFailure
+func (ew *EncryptWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	if ew.closed {
+		e := &ErrEncryptFailure{Err: errors.New("write to closed stream")}
+		ew.logger.Error().Err(e.Err).Msg(e.Error())
+		return 0, e
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// a chunk is only flushed once we know more data follows it so that the final chunk is never empty unless
+		// the whole stream is empty
+		if len(ew.buf) > ew.size {
+			if err := ew.sealChunk(ew.buf[:ew.size], false); err != nil {
+				return n, err
+			}
+			ew.buf = append(ew.buf[:0], ew.buf[ew.size:]...)
+		}
+		count := ew.size + 1 - len(ew.buf)
+		if count > len(p) {
+			count = len(p)
+		}
+		ew.buf = append(ew.buf, p[:count]...)
+		p = p[count:]
+		n += count
+	}
+	return n, nil
+}
+
+// Close encrypts any remaining data as the final chunk and writes it to the underlying writer.
+//
+// Close does not close the underlying writer.
+//
+// The following errors are returned by this function:
+// ErrEncryptFailure
+func (ew *EncryptWriter) Close() error {
+	if ew.err != nil {
+		return ew.err
+	}
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+
+	if len(ew.buf) > ew.size {
+		if err := ew.sealChunk(ew.buf[:ew.size], false); err != nil {
+			return err
+		}
+		ew.buf = ew.buf[ew.size:]
+	}
+	return ew.sealChunk(ew.buf, true)
+}
+
+// sealChunk encrypts a single chunk and writes it to the underlying writer.
+func (ew *EncryptWriter) sealChunk(plaintext []byte, final bool) error {
+	if ew.counter == math.MaxUint32 {
+		ew.err = &ErrEncryptFailure{Err: errors.New("maximum number of chunks in stream exceeded")}
+		ew.logger.Error().Err(ew.err).Msg(ew.err.Error())
+		return ew.err
+	}
+
+	nonce := streamNonce(ew.prefix, ew.counter, final)
+	ciphertext := ew.aead.Seal(nil, nonce, plaintext, ew.header)
+	if _, err := ew.w.Write(ciphertext); err != nil {
+		ew.err = &ErrEncryptFailure{Err: err}
+		ew.logger.Error().Err(err).Msg(ew.err.Error())
+		return ew.err
+	}
+	ew.counter++
+	return nil
+}
+
+// DecryptReader decrypts a stream that was produced by an EncryptWriter.
+//
+// Data is only returned to the caller once the chunk containing it has been authenticated. If the stream has been
+// truncated, reordered or otherwise altered, Read returns an ErrDecryptFailure error.
+type DecryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	pending int
+	out     []byte
+	done    bool
+	err     error
+	logger  zerolog.Logger
+}
+
+// NewDecryptReader returns a new DecryptReader which decrypts the stream read from the given reader.
+//
+// The stream header is read from r immediately.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure, ErrDecodeFailure, ErrGenerateCipherFailure, ErrGenerateGCMFailure
+func NewDecryptReader(ctx context.Context, r io.Reader, key string) (*DecryptReader, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	// validate parameters
+	if r == nil {
+		e := &ErrDecryptFailure{Err: errors.New("no reader was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if key == "" {
+		e := &ErrDecryptFailure{Err: errors.New("no key was provided")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	// read and validate the header
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		e := &ErrDecodeFailure{Err: fmt.Errorf("failed to read stream header: %s", err.Error())}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	if header[0] != streamVersion1 {
+		e := &ErrDecodeFailure{Err: fmt.Errorf("unsupported stream version: %d", header[0])}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+	chunkSize := binary.BigEndian.Uint32(header[1:5])
+	if chunkSize == 0 || chunkSize > MaxStreamChunkSize {
+		e := &ErrDecodeFailure{Err: fmt.Errorf("invalid stream chunk size: %d", chunkSize)}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return nil, e
+	}
+
+	// hash the key and create a new GCM from it
+	aesGCM, err := newGCM([]byte(key))
+	if err != nil {
+		logger.Error().Err(err).Msg(err.Error())
+		return nil, err
+	}
+
+	return &DecryptReader{
+		r:      r,
+		aead:   aesGCM,
+		header: header,
+		prefix: header[5:],
+		buf:    make([]byte, int(chunkSize)+aesGCM.Overhead()+1),
+		logger: logger,
+	}, nil
+}
+
+// Read reads decrypted data from the stream.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure
+func (dr *DecryptReader) Read(p []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.openChunk(); err != nil {
+			dr.err = err
+			return 0, err
+		}
+	}
+	n := copy(p, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+// openChunk reads and decrypts the next chunk from the underlying reader.
+//
+// One byte beyond the end of a full chunk is read in order to tell whether or not the chunk is the final one.
+func (dr *DecryptReader) openChunk() error {
+	n, err := io.ReadFull(dr.r, dr.buf[dr.pending:])
+	n += dr.pending
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		e := &ErrDecryptFailure{Err: err}
+		dr.logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+
+	chunkLen := len(dr.buf) - 1
+	final := n <= chunkLen
+	if final {
+		chunkLen = n
+	}
+	if chunkLen < dr.aead.Overhead() {
+		e := &ErrDecryptFailure{Err: errors.New("stream is truncated")}
+		dr.logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	if dr.counter == math.MaxUint32 {
+		e := &ErrDecryptFailure{Err: errors.New("maximum number of chunks in stream exceeded")}
+		dr.logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+
+	nonce := streamNonce(dr.prefix, dr.counter, final)
+	plaintext, err := dr.aead.Open(nil, nonce, dr.buf[:chunkLen], dr.header)
+	if err != nil {
+		e := &ErrDecryptFailure{Err: err}
+		dr.logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	dr.counter++
+	dr.out = plaintext
+
+	if final {
+		dr.done = true
+		dr.pending = 0
+	} else {
+		dr.buf[0] = dr.buf[chunkLen]
+		dr.pending = 1
+	}
+	return nil
+}
+
+// EncryptStream encrypts everything read from src and writes the encrypted stream to dst.
+//
+// It returns the number of plaintext bytes that were encrypted. See NewEncryptWriter() for details on the key and
+// chunk size.
+//
+// The following errors are returned by this function:
+// ErrEncryptFailure, any error returned by NewEncryptWriter
+func EncryptStream(ctx context.Context, dst io.Writer, src io.Reader, key string, chunkSize int) (int64, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	ew, err := NewEncryptWriter(ctx, dst, key, chunkSize)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(ew, src)
+	if err != nil {
+		if _, ok := err.(*ErrEncryptFailure); ok {
+			return n, err
+		}
+		e := &ErrEncryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return n, e
+	}
+	if err := ew.Close(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// DecryptStream decrypts the stream read from src, which was produced by EncryptStream() or an EncryptWriter, and
+// writes the plaintext to dst.
+//
+// It returns the number of plaintext bytes that were written. Since plaintext is written as each chunk is
+// authenticated, dst may have received part of the data when an error is returned.
+//
+// The following errors are returned by this function:
+// ErrDecryptFailure, any error returned by NewDecryptReader
+func DecryptStream(ctx context.Context, dst io.Writer, src io.Reader, key string) (int64, error) {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	dr, err := NewDecryptReader(ctx, src, key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(dst, dr)
+	if err != nil {
+		if _, ok := err.(*ErrDecryptFailure); ok {
+			return n, err
+		}
+		e := &ErrDecryptFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return n, e
+	}
+	return n, nil
+}
+
+// streamNonce builds the nonce for a single chunk from the nonce prefix, chunk counter and final chunk flag.
+func streamNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, streamNoncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefixSize:], counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
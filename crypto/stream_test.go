@@ -0,0 +1,132 @@
+package crypto_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+const (
+	// streamTestHeaderSize is the size of the stream header (version, chunk size and nonce prefix).
+	streamTestHeaderSize = 12
+
+	// streamTestChunkSize is the plaintext chunk size used by the tests.
+	streamTestChunkSize = 16
+
+	// streamTestSealedChunkSize is the size of a full chunk once sealed with its GCM tag.
+	streamTestSealedChunkSize = streamTestChunkSize + 16
+)
+
+func encryptTestStream(t *testing.T, plaintext []byte) []byte {
+	var ciphertext bytes.Buffer
+	if _, err := crypto.EncryptStream(context.TODO(), &ciphertext, bytes.NewReader(plaintext), "some_key",
+		streamTestChunkSize); err != nil {
+		t.Fatalf("error while encrypting stream: %s", err.Error())
+	}
+	return ciphertext.Bytes()
+}
+
+func TestStreamEncryptDecrypt(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	for _, size := range []int{0, 1, streamTestChunkSize - 1, streamTestChunkSize, streamTestChunkSize + 1,
+		streamTestChunkSize * 4, 1000} {
+
+		plaintext := make([]byte, size)
+		if _, err := rand.Read(plaintext); err != nil {
+			t.Fatalf("error: failed to generate random plaintext")
+		}
+		ciphertext := encryptTestStream(t, plaintext)
+
+		var decrypted bytes.Buffer
+		if _, err := crypto.DecryptStream(ctx, &decrypted, bytes.NewReader(ciphertext), "some_key"); err != nil {
+			t.Errorf("size %d: error while decrypting stream: %s", size, err.Error())
+			continue
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("size %d: decrypted data does not match plaintext", size)
+		}
+	}
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ciphertext := encryptTestStream(t, []byte(TestContents))
+	if _, err := crypto.DecryptStream(ctx, ioutil.Discard, bytes.NewReader(ciphertext), "wrong_key"); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func TestStreamReorderedChunks(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ciphertext := encryptTestStream(t, bytes.Repeat([]byte("a"), streamTestChunkSize*3))
+
+	// swap the first two chunks
+	first := streamTestHeaderSize
+	second := first + streamTestSealedChunkSize
+	reordered := append([]byte{}, ciphertext[:first]...)
+	reordered = append(reordered, ciphertext[second:second+streamTestSealedChunkSize]...)
+	reordered = append(reordered, ciphertext[first:second]...)
+	reordered = append(reordered, ciphertext[second+streamTestSealedChunkSize:]...)
+	if len(reordered) != len(ciphertext) {
+		t.Fatalf("error: reordered stream is %d bytes, expected %d", len(reordered), len(ciphertext))
+	}
+
+	if _, err := crypto.DecryptStream(ctx, ioutil.Discard, bytes.NewReader(reordered), "some_key"); err == nil {
+		t.Errorf("error: got nil, expected error")
+	} else if _, ok := err.(*crypto.ErrDecryptFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrDecryptFailure", err)
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ciphertext := encryptTestStream(t, bytes.Repeat([]byte("a"), streamTestChunkSize*3+5))
+
+	t.Log("*** testing stream with final chunk dropped ***")
+	truncated := ciphertext[:streamTestHeaderSize+streamTestSealedChunkSize*3]
+	if _, err := crypto.DecryptStream(ctx, ioutil.Discard, bytes.NewReader(truncated), "some_key"); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+
+	t.Log("*** testing stream truncated in the middle of a chunk ***")
+	truncated = ciphertext[:len(ciphertext)-3]
+	if _, err := crypto.DecryptStream(ctx, ioutil.Discard, bytes.NewReader(truncated), "some_key"); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+
+	t.Log("*** testing stream with only a header ***")
+	truncated = ciphertext[:streamTestHeaderSize]
+	if _, err := crypto.DecryptStream(ctx, ioutil.Discard, bytes.NewReader(truncated), "some_key"); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+
+	t.Log("*** testing stream with extra data appended ***")
+	extended := append(append([]byte{}, ciphertext...), ciphertext[streamTestHeaderSize:]...)
+	if _, err := crypto.DecryptStream(ctx, ioutil.Discard, bytes.NewReader(extended), "some_key"); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func TestStreamTamperedHeader(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	ciphertext := encryptTestStream(t, []byte(TestContents))
+	ciphertext[streamTestHeaderSize-1] ^= 0x01
+	if _, err := crypto.DecryptStream(ctx, ioutil.Discard, bytes.NewReader(ciphertext), "some_key"); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
@@ -1,23 +1,40 @@
 package crypto
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"go.sophtrust.dev/pkg/zerolog/v2"
 	"go.sophtrust.dev/pkg/zerolog/v2/log"
 )
 
 // CertificatePool stores X509 certificates.
+//
+// The certificates added to the pool through its methods are tracked so that they can be listed with
+// Certificates() and Inspect(). The system's trusted root certificates are not listed.
 type CertificatePool struct {
 	*x509.CertPool
+
+	// certs holds the certificates added to the pool.
+	certs []*x509.Certificate
+
+	// mutex protects certs.
+	mutex sync.RWMutex
 }
 
 // NewCertificatePool creates a new CertificatePool object.
@@ -50,6 +67,65 @@ func NewCertificatePool(ctx context.Context, emptyPool bool) (*CertificatePool,
 	}, nil
 }
 
+// AddCert adds a certificate to the pool.
+func (p *CertificatePool) AddCert(cert *x509.Certificate) {
+	if cert == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, c := range p.certs {
+		if c.Equal(cert) {
+			return
+		}
+	}
+	p.certs = append(p.certs, cert)
+	p.CertPool.AddCert(cert)
+}
+
+// AppendCertsFromPEM adds a series of PEM-encoded certificates to the pool and returns whether any certificates
+// were added.
+//
+// As with x509.CertPool, blocks which are not certificates or cannot be parsed are skipped.
+func (p *CertificatePool) AppendCertsFromPEM(pemCerts []byte) bool {
+	ok := false
+	for block, rest := pem.Decode(pemCerts); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != PEMTypeCertificate || len(block.Headers) != 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		p.AddCert(cert)
+		ok = true
+	}
+	return ok
+}
+
+// Certificates returns the certificates added to the pool in the order they were added.
+func (p *CertificatePool) Certificates() []*x509.Certificate {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	certs := make([]*x509.Certificate, len(p.certs))
+	copy(certs, p.certs)
+	return certs
+}
+
+// Inspect returns a summary of each certificate added to the pool, including its subject and fingerprints, so that
+// the contents of the pool can be audited.
+//
+// See InspectCertificate() for details.
+func (p *CertificatePool) Inspect(opts *CertificateInspectionOptions) []*CertificateInfo {
+	infos := []*CertificateInfo{}
+	for _, cert := range p.Certificates() {
+		infos = append(infos, InspectCertificate(cert, opts))
+	}
+	return infos
+}
+
 // AddPEMCertificatesFromFile adds one or more PEM-formatted certificates from a file to the certificate pool.
 //
 // The following errors are returned by this function:
@@ -67,31 +143,185 @@ func (p *CertificatePool) AddPEMCertificatesFromFile(ctx context.Context, file s
 		return e
 	}
 
-	if !p.AppendCertsFromPEM([]byte(contents)) {
-		e := &ErrLoadCertificateFailure{Err: errors.New("one or more PEM certificates werre not parsed")}
+	if !p.AppendCertsFromPEM(contents) {
+		e := &ErrLoadCertificateFailure{Err: errors.New("one or more PEM certificates were not parsed")}
 		logger.Error().Err(e.Err).Msg(e.Error())
 		return e
 	}
 	return nil
 }
 
-// ValidateCertificate verifies the given certificate is completely trusted.
+// AddCertificatesFromBytes adds the certificates in a PEM-formatted bundle or in DER-encoded data to the pool.
 //
-// If the certificate was signed with a key that is not trusted by the default system certificate pool, be sure
-// to specify a root CA certificate pool and, if necessary, an intermediate pool containing the certificates
-// required to verify the chain.
+// A PEM bundle may hold any number of "CERTIFICATE" blocks; other blocks are ignored. DER-encoded data may hold a
+// single certificate or several concatenated certificates.
 //
-// If you wish to match against specific X509 extended key usages such as verifying the signing key has the
-// Code Signing key usage, pass those fields in the keyUsages parameter.
+// The following errors are returned by this function:
+// ErrLoadCertificateFailure
+func (p *CertificatePool) AddCertificatesFromBytes(ctx context.Context, contents []byte) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+
+	certs, err := parseCertificates(contents)
+	if err != nil {
+		e := &ErrLoadCertificateFailure{Err: err}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	for _, cert := range certs {
+		p.AddCert(cert)
+	}
+	return nil
+}
+
+// AddCertificatesFromFile adds the certificates in a PEM-formatted bundle file or DER-encoded file to the pool.
 //
-// If you wish to verify the common name (CN) field of the public key passed in, specify a non-empty string
-// for the cn parameter. This match is case-sensitive.
+// The following errors are returned by this function:
+// ErrReadFileFailure, any error returned by AddCertificatesFromBytes
+func (p *CertificatePool) AddCertificatesFromFile(ctx context.Context, file string) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("file", file).Logger()
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: file}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return p.AddCertificatesFromBytes(logger.WithContext(ctx), contents)
+}
+
+// AddFromDirectory adds the certificates in every file in a directory to the pool, in the same way as OpenSSL uses
+// the SSL_CERT_DIR environment variable.
+//
+// Each file may be a PEM-formatted bundle or a DER-encoded certificate. Subdirectories are not read, symbolic links
+// such as the hashed names created by c_rehash are followed and certificates found in more than one file are only
+// added once. Files which do not hold any certificates are skipped, but an error is returned if no certificates are
+// found at all.
 //
 // The following errors are returned by this function:
-// ErrInvalidCertificate
-func ValidateCertificate(ctx context.Context, cert *x509.Certificate, roots *CertificatePool,
-	intermediates *CertificatePool, keyUsages []x509.ExtKeyUsage, cn string) error {
+// ErrReadFileFailure, ErrLoadCertificateFailure
+func (p *CertificatePool) AddFromDirectory(ctx context.Context, dir string) error {
+	logger := log.Logger
+	if l := zerolog.Ctx(ctx); l != nil {
+		logger = *l
+	}
+	logger = logger.With().Str("directory", dir).Logger()
 
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		e := &ErrReadFileFailure{Err: err, File: dir}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	added := 0
+	for _, entry := range entries {
+		file := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(file)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			e := &ErrReadFileFailure{Err: err, File: file}
+			logger.Error().Err(e.Err).Msg(e.Error())
+			return e
+		}
+		certs, err := parseCertificates(contents)
+		if err != nil {
+			logger.Debug().Str("file", file).Err(err).Msg("skipping file which does not hold any certificates")
+			continue
+		}
+		for _, cert := range certs {
+			p.AddCert(cert)
+		}
+		added += len(certs)
+	}
+	if added == 0 {
+		e := &ErrLoadCertificateFailure{Err: errors.New("no certificates were found in the directory")}
+		logger.Error().Err(e.Err).Msg(e.Error())
+		return e
+	}
+	return nil
+}
+
+// anyPolicyOID is the certificate policy OID which matches any policy.
+var anyPolicyOID = asn1.ObjectIdentifier{2, 5, 29, 32, 0}
+
+// ValidationOptions holds the options used to validate a certificate.
+type ValidationOptions struct {
+	// Roots holds the trusted root certificates. If nil, the system's trusted root certificates are used.
+	Roots *CertificatePool
+
+	// Intermediates holds intermediate certificates which may be used to build the chain to a root certificate.
+	Intermediates *CertificatePool
+
+	// KeyUsages holds the extended key usages which the certificate must be valid for, such as
+	// x509.ExtKeyUsageCodeSigning. If empty, the certificate must be valid for server authentication. Use
+	// x509.ExtKeyUsageAny to accept any usage.
+	KeyUsages []x509.ExtKeyUsage
+
+	// DNSName is a host name which must be matched by one of the certificate's DNS subject alternative names.
+	// Wildcard names in the certificate such as "*.example.com" match a single label. The common name is ignored.
+	DNSName string
+
+	// IPAddress is an IP address which must match one of the certificate's IP address subject alternative names.
+	IPAddress net.IP
+
+	// URI must match one of the certificate's URI subject alternative names. If it ends with "*", any URI starting
+	// with the text before the "*" matches, so "spiffe://cluster.local/ns/prod/*" matches any identity in the
+	// namespace.
+	URI string
+
+	// CommonName is the expected subject common name of the certificate. The match is case-sensitive. Prefer
+	// DNSName for host names.
+	CommonName string
+
+	// SPKIPins holds pins for the public keys which are trusted. If set, at least one certificate in the verified
+	// chain must have a public key matching one of the pins. Use SPKIPin() to calculate a pin.
+	SPKIPins []string
+
+	// CurrentTime is the time at which the certificate is validated. If zero, the current time is used. CRLs and OCSP
+	// responses used for revocation checking must also be valid at this time.
+	CurrentTime time.Time
+
+	// MaxChainDepth is the maximum number of certificates in the verified chain, including the certificate itself
+	// and the root certificate. If zero, the depth is not limited.
+	MaxChainDepth int
+
+	// RequiredPolicies holds the certificate policy OIDs which must be asserted by the certificate and each of its
+	// intermediate certificates. A certificate asserting anyPolicy (2.5.29.32.0) satisfies every policy.
+	RequiredPolicies []asn1.ObjectIdentifier
+
+	// Revocation is used to check whether any certificate in the verified chain has been revoked. At least one
+	// verified chain must pass the check. If nil, revocation is not checked.
+	Revocation *RevocationChecker
+}
+
+// SPKIPin returns the pin for the certificate's public key to be used in ValidationOptions.SPKIPins. The pin is the
+// base64-encoded SHA-256 hash of the DER-encoded SubjectPublicKeyInfo, the same format used by HTTP public key
+// pinning.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ValidateCertificate verifies the given certificate is completely trusted.
+//
+// The certificate chain is verified against the roots and intermediates in opts and then checked against every
+// other option. If opts is nil, the certificate must chain to one of the system's trusted root certificates and be
+// valid for server authentication.
+//
+// Every reason the certificate failed validation is listed in the Reasons field of the returned error.
+//
+// The following errors are returned by this function:
+// ErrInvalidCertificate
+func ValidateCertificate(ctx context.Context, cert *x509.Certificate, opts *ValidationOptions) error {
 	logger := log.Logger
 	if l := zerolog.Ctx(ctx); l != nil {
 		logger = *l
@@ -102,28 +332,104 @@ func ValidateCertificate(ctx context.Context, cert *x509.Certificate, roots *Cer
 		logger.Error().Err(e.Err).Msg(e.Error())
 		return e
 	}
+	o := ValidationOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	logger = logger.With().Str("subject", cert.Subject.String()).Logger()
 
 	// verify the certificate chain and usage
-	verifyOptions := x509.VerifyOptions{}
-	if roots != nil {
-		verifyOptions.Roots = roots.CertPool
+	reasons := []string{}
+	verifyOptions := x509.VerifyOptions{
+		KeyUsages:   o.KeyUsages,
+		CurrentTime: o.CurrentTime,
 	}
-	if intermediates != nil {
-		verifyOptions.Intermediates = intermediates.CertPool
+	if o.Roots != nil {
+		verifyOptions.Roots = o.Roots.CertPool
 	}
-	if keyUsages != nil {
-		verifyOptions.KeyUsages = keyUsages
+	if o.Intermediates != nil {
+		verifyOptions.Intermediates = o.Intermediates.CertPool
 	}
-	if _, err := cert.Verify(verifyOptions); err != nil {
-		e := &ErrInvalidCertificate{Err: err}
-		logger.Error().Err(e.Err).Msg(e.Error())
-		return e
+	chains, err := cert.Verify(verifyOptions)
+	if err != nil {
+		reasons = append(reasons, err.Error())
+	}
+	if o.MaxChainDepth > 0 && len(chains) > 0 {
+		var allowed [][]*x509.Certificate
+		for _, chain := range chains {
+			if len(chain) <= o.MaxChainDepth {
+				allowed = append(allowed, chain)
+			}
+		}
+		if len(allowed) == 0 {
+			reasons = append(reasons, fmt.Sprintf("certificate chain has %d certificates but at most %d are allowed",
+				len(chains[0]), o.MaxChainDepth))
+		}
+		chains = allowed
 	}
 
-	// verify the common name
-	if cn != "" && cert.Subject.CommonName != cn {
-		e := &ErrInvalidCertificate{CommonName: cert.Subject.CommonName, ExpectedCommonName: cn,
-			Err: fmt.Errorf("CommonName '%s' does not match expected CN '%s'", cert.Subject.CommonName, cn)}
+	// verify the names
+	if o.DNSName != "" {
+		if err := verifyDNSName(cert, o.DNSName); err != nil {
+			reasons = append(reasons, err.Error())
+		}
+	}
+	if o.IPAddress != nil {
+		found := false
+		for _, ip := range cert.IPAddresses {
+			if ip.Equal(o.IPAddress) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			reasons = append(reasons, fmt.Sprintf("certificate is not valid for IP address %s", o.IPAddress))
+		}
+	}
+	if o.URI != "" && !matchURI(cert, o.URI) {
+		reasons = append(reasons, fmt.Sprintf("certificate is not valid for URI %s", o.URI))
+	}
+	if o.CommonName != "" && cert.Subject.CommonName != o.CommonName {
+		reasons = append(reasons, fmt.Sprintf("CommonName '%s' does not match expected CN '%s'",
+			cert.Subject.CommonName, o.CommonName))
+	}
+
+	// verify the chain satisfies the pins and policies
+	if len(o.SPKIPins) > 0 && len(chains) > 0 {
+		chains = filterChains(chains, func(chain []*x509.Certificate) bool { return matchPins(chain, o.SPKIPins) })
+		if len(chains) == 0 {
+			reasons = append(reasons, "no certificate in the chain matches a pinned public key")
+		}
+	}
+	if len(o.RequiredPolicies) > 0 && len(chains) > 0 {
+		var missing []string
+		chains = filterChains(chains, func(chain []*x509.Certificate) bool {
+			missing = missingPolicies(chain, o.RequiredPolicies)
+			return len(missing) == 0
+		})
+		if len(chains) == 0 {
+			reasons = append(reasons, missing...)
+		}
+	}
+
+	// check revocation
+	if o.Revocation != nil && len(chains) > 0 {
+		var revoked error
+		chains = filterChains(chains, func(chain []*x509.Certificate) bool {
+			err := o.Revocation.CheckChain(logger.WithContext(ctx), chain, nil, o.CurrentTime)
+			if err != nil {
+				revoked = err
+			}
+			return err == nil
+		})
+		if len(chains) == 0 {
+			reasons = append(reasons, revoked.Error())
+		}
+	}
+
+	if len(reasons) > 0 {
+		e := &ErrInvalidCertificate{CommonName: cert.Subject.CommonName, ExpectedCommonName: o.CommonName,
+			Reasons: reasons, Err: errors.New(strings.Join(reasons, "; "))}
 		logger.Error().Err(e.Err).Msg(e.Error())
 		return e
 	}
@@ -133,8 +439,10 @@ func ValidateCertificate(ctx context.Context, cert *x509.Certificate, roots *Cer
 // NewSelfSignedCertificateKeyPair creates a new self-signed certificate using the given template and returns the
 // public certificate and private key, respectively, on success.
 //
-// The following errors are returned by this function:
+// The private key is a PKCS#1 "RSA PRIVATE KEY" PEM block. Use MarshalPrivateKeyPEM() to encode it differently.
 //
+// The following errors are returned by this function:
+// ErrGeneratePrivateKeyFailure, ErrGenerateCertificateFailure, any error returned by MarshalPrivateKeyPEM
 func NewSelfSignedCertificateKeyPair(ctx context.Context, template *x509.Certificate, keyBits int) (
 	[]byte, []byte, error) {
 
@@ -150,34 +458,101 @@ func NewSelfSignedCertificateKeyPair(ctx context.Context, template *x509.Certifi
 		logger.Error().Err(e.Err).Msg(e.Error())
 		return nil, nil, e
 	}
-	publicKey := &privateKey.PublicKey
-	key := new(bytes.Buffer)
-	if err := pem.Encode(key, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	}); err != nil {
-		e := &ErrEncodeFailure{Err: err}
-		logger.Error().Err(e.Err).Msg(e.Error())
-		return nil, nil, e
+	key, err := MarshalPrivateKeyPEM(ctx, privateKey, &PrivateKeyMarshalOptions{Format: PrivateKeyFormatPKCS1})
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// create a self-signed certificate
 	var parent = template
-	certBytes, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, privateKey)
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, parent, &privateKey.PublicKey, privateKey)
 	if err != nil {
 		e := &ErrGenerateCertificateFailure{Err: err}
 		logger.Error().Err(e.Err).Msg(e.Error())
 		return nil, nil, e
 	}
-	cert := new(bytes.Buffer)
-	if err := pem.Encode(cert, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certBytes,
-	}); err != nil {
-		e := &ErrEncodeFailure{Err: err}
-		logger.Error().Err(e.Err).Msg(e.Error())
-		return nil, nil, e
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypeCertificate, Bytes: certBytes}), key, nil
+}
+
+// verifyDNSName checks that one of the certificate's DNS subject alternative names matches the host name. The common
+// name is ignored.
+func verifyDNSName(cert *x509.Certificate, name string) error {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, san := range cert.DNSNames {
+		san = strings.ToLower(strings.TrimSuffix(san, "."))
+		if san == name {
+			return nil
+		}
+		// a wildcard matches exactly one label
+		if strings.HasPrefix(san, "*.") {
+			if i := strings.Index(name, "."); i > 0 && name[i:] == san[1:] {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("certificate is not valid for host name %s", name)
+}
+
+// matchURI returns whether one of the certificate's URI subject alternative names matches the pattern.
+func matchURI(cert *x509.Certificate, pattern string) bool {
+	for _, uri := range cert.URIs {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(uri.String(), strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if uri.String() == pattern {
+			return true
+		}
 	}
+	return false
+}
 
-	return cert.Bytes(), key.Bytes(), nil
+// matchPins returns whether any certificate in the chain has a public key matching one of the pins.
+func matchPins(chain []*x509.Certificate, pins []string) bool {
+	for _, cert := range chain {
+		pin := SPKIPin(cert)
+		for _, p := range pins {
+			if p == pin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// missingPolicies returns a description of each required policy which is not asserted by every certificate in the
+// chain except the root.
+func missingPolicies(chain []*x509.Certificate, required []asn1.ObjectIdentifier) []string {
+	missing := []string{}
+	n := len(chain) - 1
+	if n == 0 {
+		n = 1 // a self-signed certificate is its own root
+	}
+	for i := 0; i < n; i++ {
+		for _, policy := range required {
+			found := false
+			for _, oid := range chain[i].PolicyIdentifiers {
+				if oid.Equal(policy) || oid.Equal(anyPolicyOID) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing = append(missing, fmt.Sprintf("certificate '%s' does not assert policy %s",
+					chain[i].Subject, policy))
+			}
+		}
+	}
+	return missing
+}
+
+// filterChains returns the chains for which the function returns true.
+func filterChains(chains [][]*x509.Certificate, f func([]*x509.Certificate) bool) [][]*x509.Certificate {
+	var filtered [][]*x509.Certificate
+	for _, chain := range chains {
+		if f(chain) {
+			filtered = append(filtered, chain)
+		}
+	}
+	return filtered
 }
@@ -0,0 +1,260 @@
+package crypto_test
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.sophtrust.dev/pkg/toolbox/crypto"
+	"go.sophtrust.dev/pkg/zerolog/v2"
+)
+
+func TestValidateCertificate(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	root, intermediate, leaf := newValidationFixtures(t)
+	roots, _ := crypto.NewCertificatePool(ctx, true)
+	roots.AddCert(root.Certificate)
+	intermediates, _ := crypto.NewCertificatePool(ctx, true)
+	intermediates.AddCert(intermediate.Certificate)
+	policy := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	base := crypto.ValidationOptions{Roots: roots, Intermediates: intermediates}
+	rootPin := crypto.SPKIPin(root.Certificate)
+
+	tests := []struct {
+		name   string
+		modify func(o *crypto.ValidationOptions)
+		valid  bool
+	}{
+		{"chain", func(o *crypto.ValidationOptions) {}, true},
+		{"dns", func(o *crypto.ValidationOptions) { o.DNSName = "api.example.com" }, true},
+		{"dns-wildcard", func(o *crypto.ValidationOptions) { o.DNSName = "Web.Apps.Example.com" }, true},
+		{"dns-wildcard-depth", func(o *crypto.ValidationOptions) { o.DNSName = "a.web.apps.example.com" }, false},
+		{"dns-common-name", func(o *crypto.ValidationOptions) { o.DNSName = "leaf.example.org" }, false},
+		{"ip", func(o *crypto.ValidationOptions) { o.IPAddress = net.ParseIP("192.168.1.10") }, true},
+		{"ip-mismatch", func(o *crypto.ValidationOptions) { o.IPAddress = net.ParseIP("192.168.1.11") }, false},
+		{"uri", func(o *crypto.ValidationOptions) { o.URI = "spiffe://cluster.local/ns/prod/sa/api" }, true},
+		{"uri-wildcard", func(o *crypto.ValidationOptions) { o.URI = "spiffe://cluster.local/ns/prod/*" }, true},
+		{"uri-mismatch", func(o *crypto.ValidationOptions) { o.URI = "spiffe://cluster.local/ns/dev/*" }, false},
+		{"cn", func(o *crypto.ValidationOptions) { o.CommonName = "leaf.example.org" }, true},
+		{"pin-root", func(o *crypto.ValidationOptions) { o.SPKIPins = []string{rootPin} }, true},
+		{"pin-mismatch", func(o *crypto.ValidationOptions) { o.SPKIPins = []string{"AAAA"} }, false},
+		{"depth", func(o *crypto.ValidationOptions) { o.MaxChainDepth = 3 }, true},
+		{"depth-exceeded", func(o *crypto.ValidationOptions) { o.MaxChainDepth = 2 }, false},
+		{"expired", func(o *crypto.ValidationOptions) { o.CurrentTime = time.Now().Add(48 * time.Hour) }, false},
+		{"policy", func(o *crypto.ValidationOptions) { o.RequiredPolicies = []asn1.ObjectIdentifier{policy} }, false},
+		{"usage", func(o *crypto.ValidationOptions) {
+			o.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+		}, false},
+	}
+	for _, test := range tests {
+		opts := base
+		test.modify(&opts)
+		err := crypto.ValidateCertificate(ctx, leaf, &opts)
+		if test.valid && err != nil {
+			t.Errorf("%s: error while validating certificate: %s", test.name, err.Error())
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: error: got nil, expected error", test.name)
+		}
+	}
+}
+
+func TestValidateCertificateReasons(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	root, _, leaf := newValidationFixtures(t)
+	roots, _ := crypto.NewCertificatePool(ctx, true)
+	roots.AddCert(root.Certificate)
+
+	// the intermediate is missing so the chain cannot be built and every other check fails too
+	err := crypto.ValidateCertificate(ctx, leaf, &crypto.ValidationOptions{
+		Roots:      roots,
+		DNSName:    "other.example.com",
+		IPAddress:  net.ParseIP("10.0.0.1"),
+		CommonName: "other",
+	})
+	e, ok := err.(*crypto.ErrInvalidCertificate)
+	if !ok {
+		t.Fatalf("error: got %T, expected *crypto.ErrInvalidCertificate", err)
+	}
+	if len(e.Reasons) != 4 {
+		t.Errorf("want: 4 reasons, got: %d (%s)", len(e.Reasons), strings.Join(e.Reasons, "; "))
+	}
+}
+
+func TestValidateCertificatePolicies(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	root, _ := crypto.NewRootCertificateAuthority(ctx, nil)
+	roots, _ := crypto.NewCertificatePool(ctx, true)
+	roots.AddCert(root.Certificate)
+	policy := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	leaf, _, err := root.IssueCertificateKeyPair(ctx, 0, &crypto.CertificateOptions{
+		PolicyIdentifiers: []asn1.ObjectIdentifier{policy},
+	})
+	if err != nil {
+		t.Fatalf("error while issuing certificate: %s", err.Error())
+	}
+
+	opts := &crypto.ValidationOptions{Roots: roots, RequiredPolicies: []asn1.ObjectIdentifier{policy}}
+	if err := crypto.ValidateCertificate(ctx, leaf, opts); err != nil {
+		t.Errorf("error while validating certificate: %s", err.Error())
+	}
+	opts.RequiredPolicies = append(opts.RequiredPolicies, asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2})
+	if err := crypto.ValidateCertificate(ctx, leaf, opts); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
+
+func TestValidateCertificateRevocation(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	// two intermediate certificates share a subject and key, so the leaf chains through either of them
+	root, _ := crypto.NewRootCertificateAuthority(ctx, nil)
+	key, _ := crypto.GeneratePrivateKey(ctx, crypto.KeyTypeECDSAP256)
+	opts := &crypto.CertificateAuthorityOptions{Subject: pkix.Name{CommonName: "Intermediate"}, Key: key}
+	revoked, err := root.NewIntermediateCertificateAuthority(ctx, opts)
+	if err != nil {
+		t.Fatalf("error while creating CA: %s", err.Error())
+	}
+	clean, err := root.NewIntermediateCertificateAuthority(ctx, opts)
+	if err != nil {
+		t.Fatalf("error while creating CA: %s", err.Error())
+	}
+	leaf, _, err := revoked.IssueCertificateKeyPair(ctx, 0, nil)
+	if err != nil {
+		t.Fatalf("error while issuing certificate: %s", err.Error())
+	}
+	roots, _ := crypto.NewCertificatePool(ctx, true)
+	roots.AddCert(root.Certificate)
+	intermediates, _ := crypto.NewCertificatePool(ctx, true)
+	intermediates.AddCert(revoked.Certificate)
+	intermediates.AddCert(clean.Certificate)
+	chains, err := leaf.Verify(x509.VerifyOptions{Roots: roots.CertPool, Intermediates: intermediates.CertPool})
+	if err != nil || len(chains) != 2 {
+		t.Fatalf("want: 2 chains, got: %d (%v)", len(chains), err)
+	}
+
+	// the certificate is accepted because the chain through the other intermediate is not revoked
+	checker, _ := crypto.NewRevocationChecker(ctx, nil)
+	if err := checker.AddCRL(ctx, newCRL(t, root, revoked.Certificate)); err != nil {
+		t.Fatalf("error while adding CRL: %s", err.Error())
+	}
+	validation := &crypto.ValidationOptions{Roots: roots, Intermediates: intermediates, Revocation: checker}
+	if err := crypto.ValidateCertificate(ctx, leaf, validation); err != nil {
+		t.Errorf("error while validating certificate: %s", err.Error())
+	}
+
+	// without the other intermediate every chain is revoked
+	only, _ := crypto.NewCertificatePool(ctx, true)
+	only.AddCert(revoked.Certificate)
+	validation.Intermediates = only
+	if _, ok := crypto.ValidateCertificate(ctx, leaf, validation).(*crypto.ErrInvalidCertificate); !ok {
+		t.Errorf("error: expected invalid certificate")
+	}
+}
+
+func newValidationFixtures(t *testing.T) (*crypto.CertificateAuthority, *crypto.CertificateAuthority,
+	*x509.Certificate) {
+
+	ctx := context.TODO()
+	root, err := crypto.NewRootCertificateAuthority(ctx, nil)
+	if err != nil {
+		t.Fatalf("error while creating CA: %s", err.Error())
+	}
+	intermediate, err := root.NewIntermediateCertificateAuthority(ctx, nil)
+	if err != nil {
+		t.Fatalf("error while creating CA: %s", err.Error())
+	}
+	uri, _ := url.Parse("spiffe://cluster.local/ns/prod/sa/api")
+	leaf, _, err := intermediate.IssueCertificateKeyPair(ctx, 0, &crypto.CertificateOptions{
+		Subject:     pkix.Name{CommonName: "leaf.example.org"},
+		DNSNames:    []string{"api.example.com", "*.apps.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("192.168.1.10")},
+		URIs:        []*url.URL{uri},
+		Validity:    24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("error while issuing certificate: %s", err.Error())
+	}
+	return root, intermediate, leaf
+}
+
+func TestCertificatePoolLoading(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx := context.TODO()
+
+	dir, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatalf("error while creating directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	root, intermediate, leaf := newValidationFixtures(t)
+	bundle := filepath.Join(dir, "bundle.pem")
+	if err := crypto.WriteCertificatesFile(ctx, bundle,
+		[]*x509.Certificate{root.Certificate, intermediate.Certificate}); err != nil {
+		t.Fatalf("error while writing certificates: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "leaf.der"), leaf.Raw, 0644); err != nil {
+		t.Fatalf("error while writing certificate: %s", err.Error())
+	}
+	if err := os.Symlink(bundle, filepath.Join(dir, "0123abcd.0")); err != nil {
+		t.Fatalf("error while creating link: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a certificate"), 0644); err != nil {
+		t.Fatalf("error while writing file: %s", err.Error())
+	}
+
+	// duplicate certificates from the link are only added once
+	pool, _ := crypto.NewCertificatePool(ctx, true)
+	if err := pool.AddFromDirectory(ctx, dir); err != nil {
+		t.Fatalf("error while loading directory: %s", err.Error())
+	}
+	certs := pool.Certificates()
+	if len(certs) != 3 || !certs[2].Equal(leaf) {
+		t.Errorf("want: 3 certificates, got: %d", len(certs))
+	}
+	infos := pool.Inspect(nil)
+	if infos[0].Subject != root.Certificate.Subject.String() || infos[0].SHA256Fingerprint == "" {
+		t.Errorf("error: unexpected pool contents: %+v", infos[0])
+	}
+
+	// the bundle is enough to verify the leaf
+	pool, _ = crypto.NewCertificatePool(ctx, true)
+	if err := pool.AddCertificatesFromFile(ctx, bundle); err != nil {
+		t.Fatalf("error while loading bundle: %s", err.Error())
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool.CertPool, Intermediates: pool.CertPool}); err != nil {
+		t.Errorf("error while verifying certificate: %s", err.Error())
+	}
+	if err := pool.AddCertificatesFromFile(ctx, filepath.Join(dir, "leaf.der")); err != nil {
+		t.Fatalf("error while loading DER certificate: %s", err.Error())
+	}
+	if len(pool.Certificates()) != 3 {
+		t.Errorf("want: 3, got: %d", len(pool.Certificates()))
+	}
+
+	if err := pool.AddCertificatesFromFile(ctx, filepath.Join(dir, "README")); err == nil {
+		t.Errorf("error: got nil, expected error")
+	} else if _, ok := err.(*crypto.ErrLoadCertificateFailure); !ok {
+		t.Errorf("error: got %T, expected *crypto.ErrLoadCertificateFailure", err)
+	}
+	empty, _ := ioutil.TempDir(dir, "empty")
+	if err := pool.AddFromDirectory(ctx, empty); err == nil {
+		t.Errorf("error: got nil, expected error")
+	}
+}
@@ -149,7 +149,7 @@ func JWTAuth(options JWTAuthOptions) gin.HandlerFunc {
 			handleError(c, errorCode, err, options.ErrorHandler, http.StatusUnauthorized)
 			return
 		}
-		token, err := options.AuthService.VerifyToken(tokenString, ctx)
+		token, err := options.AuthService.VerifyToken(ctx, tokenString)
 		if err != nil {
 			errorCode := "jwt-verify-token-failed"
 			setErrorHeaders(c, options, errorCode, err)